@@ -0,0 +1,77 @@
+// Package access tracks when feeds are requested, so the refresher can prioritize feeds that are in use,
+// and stop refreshing feeds that are not (see refresher.Refresher).
+package access
+
+import (
+	"context"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/internal"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Tracker records feed requests in memory, and writes them to the database in batches when run,
+// so that serving feeds does not write to the database on every request.
+type Tracker struct {
+	db      *db.DB
+	mux     sync.Mutex
+	pending map[string]*db.FeedAccess
+}
+
+func NewTracker(conn db.IConn) *Tracker {
+	return &Tracker{db: db.New(conn), pending: make(map[string]*db.FeedAccess)}
+}
+
+func StartScheduler(ctx context.Context, t *Tracker) {
+	ctx = logctx.AddTo(ctx, "logger", "access")
+	internal.StartScheduler(ctx, t, 10*time.Second)
+}
+
+// Record records a request for the feed at the url.
+// t may be nil, in which case nothing is recorded.
+func (t *Tracker) Record(uri *url.URL) {
+	if t == nil {
+		return
+	}
+	t.record(uri.String(), 1, time.Now())
+}
+
+func (t *Tracker) record(u string, count int64, at time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	a, ok := t.pending[u]
+	if !ok {
+		t.pending[u] = &db.FeedAccess{Url: u, Count: count, AccessedAt: at}
+		return
+	}
+	a.Count += count
+	if at.After(a.AccessedAt) {
+		a.AccessedAt = at
+	}
+}
+
+// Run writes the recorded requests to the database.
+// If that fails, they are kept to be written on the next run.
+func (t *Tracker) Run(ctx context.Context) error {
+	t.mux.Lock()
+	pending := t.pending
+	t.pending = make(map[string]*db.FeedAccess, len(pending))
+	t.mux.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	accesses := make([]db.FeedAccess, 0, len(pending))
+	for _, a := range pending {
+		accesses = append(accesses, *a)
+	}
+	if err := t.db.RecordAccesses(ctx, accesses); err != nil {
+		for _, a := range accesses {
+			t.record(a.Url, a.Count, a.AccessedAt)
+		}
+		return err
+	}
+	logctx.Logger(ctx).DebugContext(ctx, "access_recorded", "feed_count", len(accesses))
+	return nil
+}
@@ -0,0 +1,82 @@
+package access_test
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/webhookdb/icalproxy/access"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/fp"
+	. "github.com/webhookdb/icalproxy/icalproxytest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAccess(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "access package Suite")
+}
+
+var _ = Describe("access", func() {
+	var ctx context.Context
+	var ag *appglobals.AppGlobals
+
+	BeforeEach(func() {
+		ctx, _ = logctx.WithNullLogger(context.Background())
+		ag = fp.Must(appglobals.New(ctx, fp.Must(config.LoadConfig())))
+		Expect(TruncateLocal(ctx, ag.DB)).To(Succeed())
+	})
+
+	fetchRow := func(u string) FeedRow {
+		return fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+			fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = $1`, u)),
+			pgx.RowToStructByName[FeedRow],
+		))
+	}
+
+	Describe("StartScheduler", func() {
+		It("starts a routine that can be canceled", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			access.StartScheduler(ctx, access.NewTracker(ag.DB))
+			cancel()
+		})
+	})
+
+	Describe("Tracker", func() {
+		It("writes recorded requests to stored feeds when run", func() {
+			uri := fp.Must(url.Parse("https://localhost/feed"))
+			fd := feed.New(uri, map[string]string{}, 200, []byte(Calendar("ORIGINAL")), time.Now())
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, fd, nil)).To(Succeed())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET last_accessed_at = now() - '1 day'::interval WHERE url = $1`, uri.String())).Error().ToNot(HaveOccurred())
+
+			t := access.NewTracker(ag.DB)
+			t.Record(uri)
+			t.Record(uri)
+			// Requests for feeds that are not stored are ignored
+			t.Record(fp.Must(url.Parse("https://localhost/unknown")))
+			Expect(fetchRow(uri.String())).To(HaveField("AccessCount", BeEquivalentTo(0)))
+
+			Expect(t.Run(ctx)).To(Succeed())
+			Expect(fetchRow(uri.String())).To(And(
+				HaveField("AccessCount", BeEquivalentTo(2)),
+				HaveField("LastAccessedAt", BeTemporally("~", time.Now(), time.Minute)),
+			))
+
+			// Accesses are only written once
+			t.Record(uri)
+			Expect(t.Run(ctx)).To(Succeed())
+			Expect(t.Run(ctx)).To(Succeed())
+			Expect(fetchRow(uri.String())).To(HaveField("AccessCount", BeEquivalentTo(3)))
+		})
+		It("does nothing if nil", func() {
+			var t *access.Tracker
+			t.Record(fp.Must(url.Parse("https://localhost/feed")))
+		})
+	})
+})
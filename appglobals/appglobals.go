@@ -6,15 +6,27 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/lithictech/go-aperitif/v2/logctx"
+	"github.com/webhookdb/icalproxy/access"
 	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/credentials"
+	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/feedstorage"
 	"github.com/webhookdb/icalproxy/pgxt"
+	"net/url"
 )
 
 type AppGlobals struct {
 	Config      config.Config
 	DB          *pgxpool.Pool
 	FeedStorage feedstorage.Interface
+	// Credentials is nil if CredentialsKey is not configured.
+	Credentials *credentials.Store
+	// HostLimiter is shared by everything fetching feeds, so limits apply across the refresher and server.
+	HostLimiter *feed.HostLimiter
+	// ByteBudget is shared by everything fetching feeds, so it limits the bodies read across the refresher and server.
+	ByteBudget *feed.ByteBudget
+	// AccessTracker records feed requests, so the refresher knows which feeds are in use.
+	AccessTracker *access.Tracker
 }
 
 func New(ctx context.Context, cfg config.Config) (ac *AppGlobals, err error) {
@@ -24,6 +36,8 @@ func New(ctx context.Context, cfg config.Config) (ac *AppGlobals, err error) {
 	}
 	ac = &AppGlobals{}
 	ac.Config = cfg
+	ac.HostLimiter = feed.NewHostLimiter(cfg)
+	ac.ByteBudget = feed.NewByteBudget(cfg.FetchBytesInFlight)
 	dbUrl := ac.Config.DatabaseUrl
 	if ac.Config.DatabaseConnectionPoolUrl != "" {
 		dbUrl = ac.Config.DatabaseConnectionPoolUrl
@@ -37,8 +51,22 @@ func New(ctx context.Context, cfg config.Config) (ac *AppGlobals, err error) {
 	}); err != nil {
 		return
 	}
+	ac.AccessTracker = access.NewTracker(ac.DB)
 	if ac.FeedStorage, err = feedstorage.New(ctx, cfg); err != nil {
 		return
 	}
+	if cfg.CredentialsKey != "" {
+		if ac.Credentials, err = credentials.NewStore(ac.DB, cfg.CredentialsKey); err != nil {
+			return
+		}
+	}
 	return
 }
+
+// FetchOptions returns the options for fetching the url: its credentials (see credentials.Store.FetchOptions),
+// and the shared ByteBudget.
+func (ac *AppGlobals) FetchOptions(ctx context.Context, uri *url.URL) *feed.FetchOptions {
+	opts := ac.Credentials.FetchOptions(ctx, uri, ac.Config)
+	opts.ByteBudget = ac.ByteBudget
+	return opts
+}
@@ -18,6 +18,7 @@ func Execute() {
 		Commands: []*cli.Command{
 			dbCmd,
 			devCmd,
+			gcCmd,
 			serverCmd,
 		},
 		Flags: []cli.Flag{
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"github.com/lithictech/go-aperitif/v2/logctx"
 	"github.com/urfave/cli/v2"
 	"github.com/webhookdb/icalproxy/db"
 )
@@ -16,6 +17,30 @@ var dbCmd = &cli.Command{
 				return db.New(appGlobals.DB).Migrate(ctx)
 			},
 		},
+		{
+			Name:  "backfill-events",
+			Usage: "Store the events of feeds that were last changed before events were stored",
+			Action: func(c *cli.Context) error {
+				ctx, appGlobals := loadAppCtx(loadCtx(c, loadConfig(c)))
+				n, err := db.New(appGlobals.DB).BackfillEvents(ctx, appGlobals.FeedStorage)
+				logctx.Logger(ctx).InfoContext(ctx, "backfilled_events", "feed_count", n)
+				return err
+			},
+		},
+		{
+			Name:  "canonicalize-urls",
+			Usage: "Rewrite feed urls to their canonical form, merging feeds that are duplicates",
+			Action: func(c *cli.Context) error {
+				ctx, appGlobals := loadAppCtx(loadCtx(c, loadConfig(c)))
+				renamed, deleted, err := db.New(appGlobals.DB).CanonicalizeFeedUrls(ctx, appGlobals.FeedStorage, appGlobals.Config.IcalSortQueryMap)
+				contentsBytes := int64(0)
+				for _, df := range deleted {
+					contentsBytes += df.ContentsSize
+				}
+				logctx.Logger(ctx).InfoContext(ctx, "canonicalized_urls", "renamed_count", renamed, "deleted_count", len(deleted), "contents_bytes", contentsBytes)
+				return err
+			},
+		},
 		{
 			Name: "reset",
 			Action: func(c *cli.Context) error {
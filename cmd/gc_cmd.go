@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/urfave/cli/v2"
+	"github.com/webhookdb/icalproxy/gc"
+)
+
+var gcCmd = &cli.Command{
+	Name:  "gc",
+	Usage: "Delete abandoned feeds and their stored contents",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{Name: "dry-run", Usage: "Report what would be deleted without deleting it"},
+		&cli.DurationFlag{Name: "access-threshold", Usage: "Delete feeds not requested within this (overrides GC_ACCESS_THRESHOLD)"},
+		&cli.DurationFlag{Name: "failure-threshold", Usage: "Delete feeds failing for longer than this (overrides GC_FAILURE_THRESHOLD)"},
+	},
+	Action: func(c *cli.Context) error {
+		cfg := loadConfig(c)
+		if c.IsSet("access-threshold") {
+			cfg.GcAccessThreshold = c.Duration("access-threshold")
+		}
+		if c.IsSet("failure-threshold") {
+			cfg.GcFailureThreshold = c.Duration("failure-threshold")
+		}
+		if !gc.Enabled(cfg) {
+			return errors.New("no threshold configured, set GC_ACCESS_THRESHOLD or GC_FAILURE_THRESHOLD, or pass --access-threshold or --failure-threshold")
+		}
+		ctx, appGlobals := loadAppCtx(loadCtx(c, cfg))
+		_, err := gc.New(appGlobals).Collect(ctx, c.Bool("dry-run"))
+		return err
+	},
+}
@@ -10,8 +10,10 @@ import (
 	"github.com/lithictech/go-aperitif/v2/api"
 	"github.com/lithictech/go-aperitif/v2/logctx"
 	"github.com/urfave/cli/v2"
+	"github.com/webhookdb/icalproxy/access"
 	"github.com/webhookdb/icalproxy/config"
 	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/gc"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/notifier"
 	"github.com/webhookdb/icalproxy/refresher"
@@ -80,6 +82,8 @@ var serverCmd = &cli.Command{
 		cancelCtx, cancel := context.WithCancel(ctx)
 		refresher.StartScheduler(cancelCtx, refresher.New(appGlobals))
 		notifier.StartScheduler(cancelCtx, notifier.New(appGlobals))
+		access.StartScheduler(cancelCtx, appGlobals.AccessTracker)
+		gc.StartScheduler(cancelCtx, gc.New(appGlobals))
 
 		logger.With("port", appGlobals.Config.Port).InfoContext(ctx, "server_listening")
 		if err := e.Start(fmt.Sprintf(":%d", appGlobals.Config.Port)); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -87,6 +91,10 @@ var serverCmd = &cli.Command{
 			panic(err)
 		}
 		cancel()
+		// Write any accesses recorded since the last run.
+		if err := appGlobals.AccessTracker.Run(ctx); err != nil {
+			logger.With("error", err).ErrorContext(ctx, "access_flush")
+		}
 		return nil
 	},
 }
@@ -15,6 +15,25 @@ func TestConfig(t *testing.T) {
 }
 
 var _ = Describe("config", func() {
+	Describe("LoadConfig", func() {
+		It("errors if the refresh lease is not longer than the refresh timeout and margin", func() {
+			GinkgoT().Setenv("REFRESH_TIMEOUT", "60")
+			GinkgoT().Setenv("REFRESH_LEASE_DURATION", "90s")
+			_, err := config.LoadConfig()
+			Expect(err).To(MatchError(ContainSubstring("REFRESH_LEASE_DURATION")))
+
+			GinkgoT().Setenv("REFRESH_LEASE_DURATION", "91s")
+			Expect(config.LoadConfig()).Error().ToNot(HaveOccurred())
+		})
+	})
+	Describe("Validate", func() {
+		It("requires the refresh lease to be longer than the refresh timeout and margin", func() {
+			cfg := config.Config{RefreshTimeout: 30, RefreshLeaseDuration: 5 * time.Minute}
+			Expect(cfg.Validate()).To(Succeed())
+			cfg.RefreshLeaseDuration = 30 * time.Second
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("REFRESH_LEASE_DURATION")))
+		})
+	})
 	Describe("BuildTTLMap", func() {
 		It("builds the ttl map as specified from the environment", func() {
 			e := []string{
@@ -30,4 +49,96 @@ var _ = Describe("config", func() {
 			))
 		})
 	})
+	Describe("BuildMaxTTLMap", func() {
+		It("builds the max ttl map as specified from the environment", func() {
+			m, err := config.BuildMaxTTLMap([]string{
+				"ICAL_TTL_WEBHOOKDBCOM=15m",
+				"ICAL_MAX_TTL_WEBHOOKDBCOM=12h",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[types.NormalizedHostname]types.TTL{"WEBHOOKDBCOM": types.TTL(12 * time.Hour)}))
+		})
+		It("errors for an invalid value", func() {
+			_, err := config.BuildMaxTTLMap([]string{"ICAL_MAX_TTL_WEBHOOKDBCOM=forever"})
+			Expect(err).To(MatchError(ContainSubstring("ICAL_MAX_TTL_WEBHOOKDBCOM")))
+		})
+	})
+	Describe("BuildMaxBytesMap", func() {
+		It("builds the max bytes map as specified from the environment", func() {
+			m, err := config.BuildMaxBytesMap([]string{
+				"EXAMPLEORG=10",
+				"ICAL_MAX_BYTES_WEBHOOKDBCOM=1000",
+				"ICAL_MAX_BYTES_sub.webhookdb.com=0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(And(
+				HaveLen(2),
+				HaveKeyWithValue(types.NormalizedHostname("WEBHOOKDBCOM"), int64(1000)),
+				HaveKeyWithValue(types.NormalizedHostname("SUBWEBHOOKDBCOM"), int64(0)),
+			))
+		})
+		It("errors for an invalid size", func() {
+			_, err := config.BuildMaxBytesMap([]string{"ICAL_MAX_BYTES_WEBHOOKDBCOM=10mb"})
+			Expect(err).To(MatchError(ContainSubstring("ICAL_MAX_BYTES_WEBHOOKDBCOM")))
+		})
+	})
+	Describe("BuildConcurrencyMap", func() {
+		It("builds the concurrency map as specified from the environment", func() {
+			m, err := config.BuildConcurrencyMap([]string{
+				"EXAMPLEORG=1",
+				"ICAL_CONCURRENCY_ICLOUDCOM=5",
+				"ICAL_CONCURRENCY_internal.example.org=0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[types.NormalizedHostname]int{"ICLOUDCOM": 5, "INTERNALEXAMPLEORG": 0}))
+		})
+		It("errors for an invalid value", func() {
+			_, err := config.BuildConcurrencyMap([]string{"ICAL_CONCURRENCY_ICLOUDCOM=-1"})
+			Expect(err).To(MatchError(ContainSubstring("ICAL_CONCURRENCY_ICLOUDCOM")))
+		})
+	})
+	Describe("BuildSpacingMap", func() {
+		It("builds the spacing map as specified from the environment", func() {
+			m, err := config.BuildSpacingMap([]string{
+				"EXAMPLEORG=1s",
+				"ICAL_SPACING_ICLOUDCOM=250ms",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[types.NormalizedHostname]time.Duration{"ICLOUDCOM": 250 * time.Millisecond}))
+		})
+		It("errors for an invalid value", func() {
+			_, err := config.BuildSpacingMap([]string{"ICAL_SPACING_ICLOUDCOM=fast"})
+			Expect(err).To(MatchError(ContainSubstring("ICAL_SPACING_ICLOUDCOM")))
+		})
+	})
+	Describe("BuildSortQueryMap", func() {
+		It("builds the sort query map as specified from the environment", func() {
+			m, err := config.BuildSortQueryMap([]string{
+				"EXAMPLEORG=true",
+				"ICAL_SORT_QUERY_WEBHOOKDBCOM=true",
+				"ICAL_SORT_QUERY_sub.webhookdb.com=false",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[types.NormalizedHostname]bool{"WEBHOOKDBCOM": true, "SUBWEBHOOKDBCOM": false}))
+		})
+		It("errors for an invalid value", func() {
+			_, err := config.BuildSortQueryMap([]string{"ICAL_SORT_QUERY_WEBHOOKDBCOM=sometimes"})
+			Expect(err).To(MatchError(ContainSubstring("ICAL_SORT_QUERY_WEBHOOKDBCOM")))
+		})
+	})
+	Describe("BuildVolatileMap", func() {
+		It("builds the volatile property map as specified from the environment", func() {
+			e := []string{
+				"EXAMPLEORG=X-FOO",
+				"ICAL_VOLATILE_PROPS_WEBHOOKDBCOM=x-generated, SEQUENCE",
+				"ICAL_VOLATILE_PROPS_sub.webhookdb.com=",
+			}
+			m := config.BuildVolatileMap(e)
+			Expect(m).To(And(
+				HaveLen(2),
+				HaveKeyWithValue(types.NormalizedHostname("WEBHOOKDBCOM"), []string{"X-GENERATED", "SEQUENCE"}),
+				HaveKeyWithValue(types.NormalizedHostname("SUBWEBHOOKDBCOM"), BeEmpty()),
+			))
+		})
+	})
 })
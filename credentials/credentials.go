@@ -0,0 +1,253 @@
+// Package credentials stores headers (like Authorization) that are sent to origins
+// when fetching feeds whose urls start with a given prefix.
+// Headers are encrypted at rest with the configured key, and are never returned by the API;
+// only their names are.
+package credentials
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/internal"
+	"golang.org/x/net/http/httpguts"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheTTL is how long credentials are cached in memory before being reloaded from the database.
+// Credentials changed through a Store are visible to it immediately.
+const CacheTTL = time.Minute
+
+// Credentials are the headers to send to origins for feeds whose url starts with UrlPrefix.
+type Credentials struct {
+	UrlPrefix string
+	Headers   map[string]string
+}
+
+// Summary describes stored credentials without revealing their values.
+type Summary struct {
+	UrlPrefix   string    `json:"url_prefix"`
+	HeaderNames []string  `json:"header_names"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Validate returns an error if the headers cannot be sent in a request.
+func (c Credentials) Validate() error {
+	if c.UrlPrefix == "" {
+		return errors.New("url prefix is required")
+	}
+	if len(c.Headers) == 0 {
+		return errors.New("at least one header is required")
+	}
+	for k, v := range c.Headers {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("header name %q is invalid", k)
+		}
+		if !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("value of header %q is invalid", k)
+		}
+	}
+	return nil
+}
+
+// Cipher encrypts and decrypts headers with AES-256-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher using key, which is 32 bytes encoded as standard base64
+// (like the output of 'openssl rand -base64 32').
+func NewCipher(key string) (*Cipher, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, internal.ErrWrap(err, "key must be base64")
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(b))
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns the nonce followed by the ciphertext of plaintext.
+// The same additionalData must be passed to Decrypt, which ties the ciphertext to its row.
+func (c *Cipher) Encrypt(plaintext []byte, additionalData string) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, []byte(additionalData)), nil
+}
+
+func (c *Cipher) Decrypt(ciphertext []byte, additionalData string) ([]byte, error) {
+	if len(ciphertext) < c.aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, sealed := ciphertext[:c.aead.NonceSize()], ciphertext[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, sealed, []byte(additionalData))
+}
+
+// Store reads and writes credentials in the database, and caches them (decrypted) in memory.
+type Store struct {
+	conn     db.IConn
+	cipher   *Cipher
+	mux      sync.Mutex
+	loadedAt time.Time
+	// cached is sorted by descending url prefix length, so the first match is the most specific.
+	cached []Credentials
+}
+
+func NewStore(conn db.IConn, key string) (*Store, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, internal.ErrWrap(err, "invalid credentials key")
+	}
+	return &Store{conn: conn, cipher: c}, nil
+}
+
+// CanonicalPrefix returns the url prefix canonicalized like feed urls (see feed.CanonicalURL),
+// so it matches the urls that are fetched.
+func CanonicalPrefix(prefix string, cfg config.Config) (string, error) {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("must be an absolute url")
+	}
+	return feed.CanonicalURL(u, cfg.IcalSortQueryMap).String(), nil
+}
+
+// Put stores the credentials, replacing any for the same prefix.
+func (s *Store) Put(ctx context.Context, c Credentials) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(c.Headers)
+	if err != nil {
+		return err
+	}
+	encrypted, err := s.cipher.Encrypt(plaintext, c.UrlPrefix)
+	if err != nil {
+		return internal.ErrWrap(err, "encrypting headers")
+	}
+	names := make([]string, 0, len(c.Headers))
+	for k := range c.Headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	if err := db.New(s.conn).UpsertCredentials(ctx, c.UrlPrefix, encrypted, names); err != nil {
+		return err
+	}
+	s.invalidate()
+	return nil
+}
+
+// Delete deletes the credentials for the prefix, returning false if there were none.
+func (s *Store) Delete(ctx context.Context, urlPrefix string) (bool, error) {
+	deleted, err := db.New(s.conn).DeleteCredentials(ctx, urlPrefix)
+	if err != nil {
+		return false, err
+	}
+	s.invalidate()
+	return deleted, nil
+}
+
+// List returns a Summary of all stored credentials.
+func (s *Store) List(ctx context.Context) ([]Summary, error) {
+	rows, err := db.New(s.conn).ListCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Summary, len(rows))
+	for i, r := range rows {
+		result[i] = Summary{UrlPrefix: r.UrlPrefix, HeaderNames: r.HeaderNames, CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt}
+	}
+	return result, nil
+}
+
+// HeadersFor returns the headers of the most specific credentials whose prefix the url starts with,
+// or nil if there are none.
+// If the credentials cannot be reloaded (like if the database is down),
+// the previously loaded credentials are used, and the error is only returned if there are none.
+func (s *Store) HeadersFor(ctx context.Context, uri *url.URL) (map[string]string, error) {
+	all, err := s.load(ctx)
+	u := uri.String()
+	for _, c := range all {
+		if strings.HasPrefix(u, c.UrlPrefix) {
+			return c.Headers, nil
+		}
+	}
+	return nil, err
+}
+
+// FetchOptions returns feed.OptionsFor the url, with the headers from HeadersFor.
+// If the headers cannot be loaded, the error is logged and the feed is fetched without them.
+// s may be nil, if credentials are not configured.
+func (s *Store) FetchOptions(ctx context.Context, uri *url.URL, cfg config.Config) *feed.FetchOptions {
+	opts := feed.OptionsFor(uri, cfg)
+	if s == nil {
+		return opts
+	}
+	headers, err := s.HeadersFor(ctx, uri)
+	if err != nil {
+		logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "loading_credentials_error")
+	}
+	opts.Headers = headers
+	return opts
+}
+
+func (s *Store) invalidate() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.loadedAt = time.Time{}
+}
+
+func (s *Store) load(ctx context.Context) ([]Credentials, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if time.Since(s.loadedAt) < CacheTTL {
+		return s.cached, nil
+	}
+	rows, err := db.New(s.conn).ListCredentials(ctx)
+	if err != nil {
+		return s.cached, internal.ErrWrap(err, "loading credentials")
+	}
+	loaded := make([]Credentials, 0, len(rows))
+	for _, r := range rows {
+		plaintext, err := s.cipher.Decrypt(r.HeadersEncrypted, r.UrlPrefix)
+		if err != nil {
+			// Likely the key changed. Do not include the prefix, which could be sensitive, in the error.
+			return s.cached, errors.New("decrypting credentials failed")
+		}
+		c := Credentials{UrlPrefix: r.UrlPrefix}
+		if err := json.Unmarshal(plaintext, &c.Headers); err != nil {
+			return s.cached, errors.New("decoding credentials failed")
+		}
+		loaded = append(loaded, c)
+	}
+	slices.SortStableFunc(loaded, func(a, b Credentials) int { return len(b.UrlPrefix) - len(a.UrlPrefix) })
+	s.cached = loaded
+	s.loadedAt = time.Now()
+	return s.cached, nil
+}
@@ -0,0 +1,128 @@
+package credentials_test
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/credentials"
+	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/icalproxytest"
+	"github.com/webhookdb/icalproxy/types"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "credentials package Suite")
+}
+
+var key = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+var otherKey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32)))
+
+var _ = Describe("credentials", func() {
+	ctx, _ := logctx.WithNullLogger(context.Background())
+
+	Describe("Cipher", func() {
+		It("round trips with the same key and additional data", func() {
+			c := fp.Must(credentials.NewCipher(key))
+			encrypted := fp.Must(c.Encrypt([]byte("hello"), "http://a.b/"))
+			Expect(encrypted).ToNot(ContainSubstring("hello"))
+			Expect(c.Decrypt(encrypted, "http://a.b/")).To(BeEquivalentTo("hello"))
+			Expect(c.Encrypt([]byte("hello"), "http://a.b/")).ToNot(Equal(encrypted))
+		})
+		It("fails to decrypt with a different key or additional data", func() {
+			encrypted := fp.Must(fp.Must(credentials.NewCipher(key)).Encrypt([]byte("hello"), "http://a.b/"))
+			_, err := fp.Must(credentials.NewCipher(otherKey)).Decrypt(encrypted, "http://a.b/")
+			Expect(err).To(HaveOccurred())
+			_, err = fp.Must(credentials.NewCipher(key)).Decrypt(encrypted, "http://x.y/")
+			Expect(err).To(HaveOccurred())
+			_, err = fp.Must(credentials.NewCipher(key)).Decrypt([]byte("x"), "http://a.b/")
+			Expect(err).To(MatchError(ContainSubstring("too short")))
+		})
+		It("errors for an invalid key", func() {
+			_, err := credentials.NewCipher("not base64!")
+			Expect(err).To(MatchError(ContainSubstring("base64")))
+			_, err = credentials.NewCipher(base64.StdEncoding.EncodeToString([]byte("short")))
+			Expect(err).To(MatchError(ContainSubstring("32 bytes")))
+		})
+	})
+
+	Describe("Credentials", func() {
+		It("validates the prefix and headers", func() {
+			Expect(credentials.Credentials{UrlPrefix: "http://a.b/", Headers: map[string]string{"X-Token": "abc"}}.Validate()).To(Succeed())
+			Expect(credentials.Credentials{Headers: map[string]string{"X-Token": "abc"}}.Validate()).To(MatchError(ContainSubstring("prefix")))
+			Expect(credentials.Credentials{UrlPrefix: "http://a.b/"}.Validate()).To(MatchError(ContainSubstring("at least one")))
+			Expect(credentials.Credentials{UrlPrefix: "http://a.b/", Headers: map[string]string{"X Token": "abc"}}.Validate()).
+				To(MatchError(ContainSubstring("name")))
+			Expect(credentials.Credentials{UrlPrefix: "http://a.b/", Headers: map[string]string{"X-Token": "a\r\nb"}}.Validate()).
+				To(MatchError(ContainSubstring("value")))
+		})
+	})
+
+	Describe("CanonicalPrefix", func() {
+		It("canonicalizes the url like feeds", func() {
+			cfg := config.Config{IcalSortQueryMap: map[types.NormalizedHostname]bool{}}
+			Expect(credentials.CanonicalPrefix("webcal://Cal.Example.COM:80", cfg)).To(Equal("http://cal.example.com/"))
+			Expect(credentials.CanonicalPrefix("https://a.b/feeds/", cfg)).To(Equal("https://a.b/feeds/"))
+			_, err := credentials.CanonicalPrefix("/feeds", cfg)
+			Expect(err).To(MatchError(ContainSubstring("absolute")))
+		})
+	})
+
+	Describe("Store", func() {
+		var ag *appglobals.AppGlobals
+		var store *credentials.Store
+
+		BeforeEach(func() {
+			ag = fp.Must(appglobals.New(ctx, fp.Must(config.LoadConfig())))
+			Expect(icalproxytest.TruncateLocal(ctx, ag.DB)).To(Succeed())
+			store = fp.Must(credentials.NewStore(ag.DB, key))
+		})
+
+		It("returns the headers of the most specific matching prefix", func() {
+			Expect(store.Put(ctx, credentials.Credentials{
+				UrlPrefix: "http://localhost/",
+				Headers:   map[string]string{"Authorization": "Bearer all"},
+			})).To(Succeed())
+			Expect(store.Put(ctx, credentials.Credentials{
+				UrlPrefix: "http://localhost/private/",
+				Headers:   map[string]string{"Authorization": "Bearer private", "X-Extra": "1"},
+			})).To(Succeed())
+
+			Expect(store.HeadersFor(ctx, fp.Must(url.Parse("http://localhost/private/feed.ics")))).
+				To(Equal(map[string]string{"Authorization": "Bearer private", "X-Extra": "1"}))
+			Expect(store.HeadersFor(ctx, fp.Must(url.Parse("http://localhost/public.ics")))).
+				To(Equal(map[string]string{"Authorization": "Bearer all"}))
+			Expect(store.HeadersFor(ctx, fp.Must(url.Parse("http://127.0.0.1/public.ics")))).To(BeNil())
+
+			summaries := fp.Must(store.List(ctx))
+			Expect(summaries).To(ContainElement(HaveField("HeaderNames", Equal([]string{"Authorization", "X-Extra"}))))
+
+			Expect(store.Delete(ctx, "http://localhost/private/")).To(BeTrue())
+			Expect(store.Delete(ctx, "http://localhost/private/")).To(BeFalse())
+			Expect(store.HeadersFor(ctx, fp.Must(url.Parse("http://localhost/private/feed.ics")))).
+				To(Equal(map[string]string{"Authorization": "Bearer all"}))
+		})
+		It("errors if the stored credentials cannot be decrypted", func() {
+			Expect(store.Put(ctx, credentials.Credentials{
+				UrlPrefix: "http://localhost/",
+				Headers:   map[string]string{"Authorization": "Bearer all"},
+			})).To(Succeed())
+			other := fp.Must(credentials.NewStore(ag.DB, otherKey))
+			_, err := other.HeadersFor(ctx, fp.Must(url.Parse("http://localhost/feed.ics")))
+			Expect(err).To(MatchError(ContainSubstring("decrypting")))
+		})
+		It("uses the default options when the store is nil", func() {
+			var nilStore *credentials.Store
+			opts := nilStore.FetchOptions(ctx, fp.Must(url.Parse("http://localhost/feed.ics")), ag.Config)
+			Expect(opts.Headers).To(BeEmpty())
+			Expect(opts.MaxBytes).To(Equal(ag.Config.MaxFeedBytes))
+		})
+	})
+})
@@ -4,19 +4,25 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/feedstorage"
+	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/ical"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/pgxt"
 	"github.com/webhookdb/icalproxy/types"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type IConn interface {
 	pgxt.IBegin
 	pgxt.IExec
+	pgxt.IQuery
 	pgxt.IQueryRow
 }
 
@@ -62,12 +68,77 @@ CREATE INDEX IF NOT EXISTS icalproxy_feeds_v2_url_host_rev_idx ON icalproxy_feed
 CREATE INDEX IF NOT EXISTS icalproxy_feeds_v2_checked_at_idx ON icalproxy_feeds_v2(checked_at);
 -- Use partial index, we only need to check where something is pending, never where it's not.
 CREATE INDEX IF NOT EXISTS icalproxy_feeds_v2_webhook_pending_idx ON icalproxy_feeds_v2((1)) WHERE webhook_pending;
+-- Semantic hash of the contents, see feed.Fingerprint. Empty if the contents are not a valid calendar.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS contents_fingerprint TEXT NOT NULL DEFAULT '';
+-- Events changed since the last webhook was sent, see ical.Diff.
+-- NULL if a webhook is not pending, or the changes are not known.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS webhook_diff JSONB;
+-- Result of validating the contents, see ical.Validate. Empty/NULL for error feeds
+-- and feeds that have not been fetched since validation was added.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS validation_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS validation_report JSONB;
+-- Number of fetches in a row that have failed (fetch_status >= 400), and when the first of them was.
+-- The refresher backs off failing feeds based on failure_count. first_failed_at is NULL when failure_count is 0.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS failure_count INT NOT NULL DEFAULT 0;
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS first_failed_at timestamptz;
+CREATE INDEX IF NOT EXISTS icalproxy_feeds_v2_failing_idx ON icalproxy_feeds_v2((1)) WHERE failure_count > 0;
+-- When the contents (contents_md5) last changed, and the moving average time between changes.
+-- NULL/0 if not known. Used to calculate refresh_at, see feed.RefreshBounds.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS changed_at timestamptz;
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS change_interval_ms BIGINT NOT NULL DEFAULT 0;
+-- When the refresher should next check the feed. Set whenever the feed is committed.
+-- Rows from before this column was added are checked on the next refresh.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS refresh_at timestamptz NOT NULL DEFAULT 'epoch';
+CREATE INDEX IF NOT EXISTS icalproxy_feeds_v2_refresh_at_idx ON icalproxy_feeds_v2(refresh_at);
+-- When the origin asked to be fetched again (429 or 503 with Retry-After), see feed.ParseRetryAfter.
+-- NULL if it did not. refresh_at is never before this.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS retry_after timestamptz;
+-- When the feed was last requested, and how many times, see package access.
+-- Existing rows are treated as if they were requested when the columns were added.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS last_accessed_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS access_count BIGINT NOT NULL DEFAULT 0;
+-- When the refresher's claim on the feed expires, see refresher.Refresher.ClaimRowsToProcess.
+-- NULL if it is not claimed. Cleared by the refresher that claimed it once it commits the feed (see ReleaseLease);
+-- claims that expire first (like if the refresher stopped) are refreshed again.
+ALTER TABLE icalproxy_feeds_v2 ADD COLUMN IF NOT EXISTS leased_until timestamptz;
+-- Like retry_after, but for all feeds with the host, since the rate limit is usually per host.
+-- Rows are removed once they expire, see SetHostRetryAfter.
+CREATE TABLE IF NOT EXISTS icalproxy_host_retry_after_v1 (
+    url_host_rev TEXT PRIMARY KEY,
+    retry_after timestamptz NOT NULL
+);
+-- Parsed VEVENTs of the last successfully fetched contents of each feed, for searching (see SearchEvents).
+-- Recurring events have one row (not one per instance), spanning all their instances;
+-- ends_at is NULL if the event recurs forever. starts_at and ends_at are NULL if they cannot be interpreted.
+CREATE TABLE IF NOT EXISTS icalproxy_events_v1 (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    feed_id BIGINT NOT NULL REFERENCES icalproxy_feeds_v2(id) ON DELETE CASCADE,
+    uid TEXT NOT NULL,
+    recurrence_id timestamptz,
+    starts_at timestamptz,
+    ends_at timestamptz,
+    summary TEXT NOT NULL,
+    location TEXT NOT NULL,
+    status TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS icalproxy_events_v1_feed_id_idx ON icalproxy_events_v1(feed_id);
+CREATE INDEX IF NOT EXISTS icalproxy_events_v1_starts_at_idx ON icalproxy_events_v1(starts_at);
+-- Headers sent to origins for feeds with urls starting with url_prefix, see package credentials.
+-- headers_encrypted is the encrypted JSON of the headers; header_names is kept in the clear for listing.
+CREATE TABLE IF NOT EXISTS icalproxy_credentials_v1 (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    url_prefix TEXT NOT NULL UNIQUE,
+    headers_encrypted BYTEA NOT NULL,
+    header_names JSONB NOT NULL DEFAULT '[]',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
 `
 	return db.exec(ctx, q)
 }
 
 func (db *DB) Reset(ctx context.Context) error {
-	const q = `DROP TABLE IF EXISTS icalproxy_feeds_v2;`
+	const q = `DROP TABLE IF EXISTS icalproxy_host_retry_after_v1; DROP TABLE IF EXISTS icalproxy_credentials_v1; DROP TABLE IF EXISTS icalproxy_events_v1; DROP TABLE IF EXISTS icalproxy_feeds_v2;`
 	return db.exec(ctx, q)
 }
 
@@ -75,33 +146,43 @@ type FeedRow struct {
 	ContentsMD5          types.MD5Hash
 	ContentsLastModified time.Time
 	FetchHeaders         feed.HeaderMap
+	// RetryAfter is when the origin asked to be fetched again, or zero. See feed.Feed.
+	RetryAfter time.Time
 }
 
 func (db *DB) FetchFeedRow(ctx context.Context, uri *url.URL) (*FeedRow, error) {
 	r := FeedRow{}
-	const q = `SELECT contents_md5, contents_last_modified, fetch_headers FROM icalproxy_feeds_v2 WHERE url = $1`
-	err := db.conn.QueryRow(ctx, q, uri.String()).Scan(&r.ContentsMD5, &r.ContentsLastModified, &r.FetchHeaders)
+	var retryAfter *time.Time
+	const q = `SELECT contents_md5, contents_last_modified, fetch_headers, retry_after FROM icalproxy_feeds_v2 WHERE url = $1`
+	err := db.conn.QueryRow(ctx, q, uri.String()).Scan(&r.ContentsMD5, &r.ContentsLastModified, &r.FetchHeaders, &retryAfter)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if retryAfter != nil {
+		r.RetryAfter = *retryAfter
+	}
 	return &r, nil
 }
 
 func (db *DB) FetchContentsAsFeed(ctx context.Context, feedStorage feedstorage.Interface, uri *url.URL) (*feed.Feed, error) {
 	r := feed.Feed{}
 	var fetchHeaders json.RawMessage
+	var validationReport []byte
 	// Having no row in the contents table is fine, since we may have committed an error feed
 	// as an initial version, which will not have contents.
 	var feedId int64
+	var firstFailedAt *time.Time
 	const q = `SELECT
-	id, fetch_headers, fetch_status, checked_at, contents_md5, (CASE WHEN fetch_status >= 400 THEN fetch_error_body ELSE NULL END)
+	id, fetch_headers, fetch_status, checked_at, contents_md5, (CASE WHEN fetch_status >= 400 THEN fetch_error_body ELSE NULL END), validation_report,
+	failure_count, first_failed_at
 FROM icalproxy_feeds_v2
 WHERE url = $1`
 	err := db.conn.QueryRow(ctx, q, uri.String()).Scan(
-		&feedId, &fetchHeaders, &r.HttpStatus, &r.FetchedAt, &r.MD5, &r.Body,
+		&feedId, &fetchHeaders, &r.HttpStatus, &r.FetchedAt, &r.MD5, &r.Body, &validationReport,
+		&r.FailureCount, &firstFailedAt,
 	)
 	if err != nil {
 		return nil, internal.ErrWrap(err, "fetching row")
@@ -116,6 +197,14 @@ WHERE url = $1`
 	if err := json.Unmarshal(fetchHeaders, &r.HttpHeaders); err != nil {
 		return nil, internal.ErrWrap(err, "unmarshaling db headers")
 	}
+	if validationReport != nil {
+		if err := json.Unmarshal(validationReport, &r.Validation); err != nil {
+			return nil, internal.ErrWrap(err, "unmarshaling validation report")
+		}
+	}
+	if firstFailedAt != nil {
+		r.FailingSince = *firstFailedAt
+	}
 	r.Url = uri
 	return &r, nil
 }
@@ -124,12 +213,25 @@ type CommitFeedOptions struct {
 	// WebhookPending should be true to set the webhook_pending column to true on update/upsert.
 	// Since the initial insert is always via HTTP request (not a refresh),
 	// there's no point sending a webhook on insert.
+	// If the feed has the same (non-empty) fingerprint as the stored row,
+	// the change is not meaningful, so webhook_pending is left as-is.
 	WebhookPending bool
 	// WebhookPendingOnInsert is true to set the webhook_pending column true on insert.
 	// Generally only useful during testing.
 	WebhookPendingOnInsert bool
+	// WebhookDiff is the change to include in the webhook. It is stored along with webhook_pending
+	// (so is left as-is when the fingerprint is unchanged). It should already be merged
+	// with any diff that was pending. If nil, the change is unknown.
+	WebhookDiff *ical.Diff
+	// Refresh is used to calculate when the feed is next refreshed. See feed.RefreshBoundsFor.
+	Refresh feed.RefreshBounds
 }
 
+// CommitFeed upserts the feed and stores its body.
+// Error feeds (HttpStatus >= 400) keep the last successful body in storage,
+// and increment failure_count, which is reset by successful feeds.
+// feed.FailureCount and feed.FailingSince are set to the stored values.
+// If the contents changed, the change history is updated, and refresh_at is set from it.
 func (db *DB) CommitFeed(ctx context.Context, feedStorage feedstorage.Interface, feed *feed.Feed, opts *CommitFeedOptions) error {
 	if opts == nil {
 		opts = &CommitFeedOptions{}
@@ -142,17 +244,41 @@ func (db *DB) CommitFeed(ctx context.Context, feedStorage feedstorage.Interface,
 	if err != nil {
 		return internal.ErrWrap(err, "encoding http headers to save")
 	}
+	var encodedDiff any
+	if opts.WebhookDiff != nil {
+		b, err := json.Marshal(opts.WebhookDiff)
+		if err != nil {
+			return internal.ErrWrap(err, "encoding webhook diff to save")
+		}
+		encodedDiff = string(b)
+	}
+	var validationStatus string
+	var encodedValidation any
+	if feed.Validation != nil {
+		b, err := json.Marshal(feed.Validation)
+		if err != nil {
+			return internal.ErrWrap(err, "encoding validation report to save")
+		}
+		validationStatus = string(feed.Validation.Status)
+		encodedValidation = string(b)
+	}
 
 	if feed.HttpStatus >= 400 {
 		const errQuery = `INSERT INTO icalproxy_feeds_v2 
-(url, url_host_rev, checked_at, fetch_status, fetch_headers, fetch_error_body, contents_md5, contents_last_modified, contents_size)
-VALUES ($1, $2, $3, $4, $5, $6, '', $7, 0)
+(url, url_host_rev, checked_at, fetch_status, fetch_headers, fetch_error_body, contents_md5, contents_last_modified, contents_size, failure_count, first_failed_at, retry_after)
+VALUES ($1, $2, $3, $4, $5, $6, '', $7, 0, 1, $3, $8)
 ON CONFLICT (url) DO UPDATE SET
 	url_host_rev=EXCLUDED.url_host_rev,
 	checked_at=EXCLUDED.checked_at,
 	fetch_status=EXCLUDED.fetch_status,
 	fetch_headers=EXCLUDED.fetch_headers,
-	fetch_error_body=EXCLUDED.fetch_error_body`
+	fetch_error_body=EXCLUDED.fetch_error_body,
+	validation_status='',
+	validation_report=NULL,
+	failure_count=icalproxy_feeds_v2.failure_count + 1,
+	first_failed_at=COALESCE(icalproxy_feeds_v2.first_failed_at, EXCLUDED.checked_at),
+	retry_after=EXCLUDED.retry_after
+RETURNING failure_count, first_failed_at, changed_at, change_interval_ms`
 		args := []any{
 			feed.Url.String(),
 			urlHost,
@@ -161,15 +287,18 @@ ON CONFLICT (url) DO UPDATE SET
 			string(encodedHeaders),
 			feed.Body,
 			fetchedTrunc,
+			nullTime(feed.RetryAfter),
 		}
-		if err := db.exec(ctx, errQuery, args...); err != nil {
+		var hist changeHistory
+		if err := db.conn.QueryRow(ctx, errQuery, args...).Scan(&feed.FailureCount, &feed.FailingSince, &hist.changedAt, &hist.changeIntervalMs); err != nil {
 			return internal.ErrWrap(err, "unable to upsert error feed")
 		}
-		return nil
+		hist.failureCount = feed.FailureCount
+		return db.scheduleRefresh(ctx, feed, fetchedTrunc, opts.Refresh, hist)
 	}
 	const feedQuery = `INSERT INTO icalproxy_feeds_v2 
-(url, url_host_rev, checked_at, fetch_status, fetch_headers, contents_md5, contents_last_modified, contents_size, fetch_error_body, webhook_pending)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, '', $9)
+(url, url_host_rev, checked_at, fetch_status, fetch_headers, contents_md5, contents_last_modified, contents_size, fetch_error_body, webhook_pending, contents_fingerprint, webhook_diff, validation_status, validation_report, changed_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, '', $9, $11, $12::jsonb, $13, $14::jsonb, $3)
 ON CONFLICT (url) DO UPDATE SET
 	url_host_rev=EXCLUDED.url_host_rev,
 	checked_at=EXCLUDED.checked_at,
@@ -178,9 +307,35 @@ ON CONFLICT (url) DO UPDATE SET
 	contents_md5=EXCLUDED.contents_md5,
 	contents_last_modified=EXCLUDED.contents_last_modified,
 	contents_size=EXCLUDED.contents_size,
+	contents_fingerprint=EXCLUDED.contents_fingerprint,
+	validation_status=EXCLUDED.validation_status,
+	validation_report=EXCLUDED.validation_report,
 	fetch_error_body='',
-	webhook_pending=$10
-RETURNING id`
+	failure_count=0,
+	first_failed_at=NULL,
+	retry_after=NULL,
+	changed_at=(CASE
+		WHEN EXCLUDED.contents_md5 <> icalproxy_feeds_v2.contents_md5 THEN EXCLUDED.checked_at
+		ELSE icalproxy_feeds_v2.changed_at
+	END),
+	change_interval_ms=(CASE
+		WHEN EXCLUDED.contents_md5 = icalproxy_feeds_v2.contents_md5 OR icalproxy_feeds_v2.changed_at IS NULL
+		THEN icalproxy_feeds_v2.change_interval_ms
+		WHEN icalproxy_feeds_v2.change_interval_ms = 0
+		THEN (EXTRACT(EPOCH FROM EXCLUDED.checked_at - icalproxy_feeds_v2.changed_at) * 1000)::bigint
+		ELSE (icalproxy_feeds_v2.change_interval_ms + EXTRACT(EPOCH FROM EXCLUDED.checked_at - icalproxy_feeds_v2.changed_at) * 1000)::bigint / 2
+	END),
+	webhook_pending=(CASE
+		WHEN EXCLUDED.contents_fingerprint <> '' AND EXCLUDED.contents_fingerprint = icalproxy_feeds_v2.contents_fingerprint
+		THEN icalproxy_feeds_v2.webhook_pending
+		ELSE $10
+	END),
+	webhook_diff=(CASE
+		WHEN EXCLUDED.contents_fingerprint <> '' AND EXCLUDED.contents_fingerprint = icalproxy_feeds_v2.contents_fingerprint
+		THEN icalproxy_feeds_v2.webhook_diff
+		ELSE $12::jsonb
+	END)
+RETURNING id, changed_at, change_interval_ms`
 	feedArgs := []any{
 		feed.Url.String(),
 		urlHost,
@@ -192,24 +347,564 @@ RETURNING id`
 		len(feed.Body),
 		opts.WebhookPendingOnInsert,
 		opts.WebhookPending,
+		feed.Fingerprint,
+		encodedDiff,
+		validationStatus,
+		encodedValidation,
 	}
 	var insertedId int64
-	if err := db.conn.QueryRow(ctx, feedQuery, feedArgs...).Scan(&insertedId); err != nil {
+	var hist changeHistory
+	if err := db.conn.QueryRow(ctx, feedQuery, feedArgs...).Scan(&insertedId, &hist.changedAt, &hist.changeIntervalMs); err != nil {
 		return internal.ErrWrap(err, "unable to upsert feed")
 	}
+	feed.FailureCount = 0
+	feed.FailingSince = time.Time{}
+	if err := db.scheduleRefresh(ctx, feed, fetchedTrunc, opts.Refresh, hist); err != nil {
+		return err
+	}
 
 	if err := feedStorage.Store(ctx, insertedId, feed.Body); err != nil {
 		return internal.ErrWrap(err, "unable to upsert contents")
 	}
+	if err := db.replaceEvents(ctx, insertedId, feed.Body); err != nil {
+		return internal.ErrWrap(err, "unable to replace events")
+	}
 	return nil
 }
 
-func (db *DB) CommitUnchanged(ctx context.Context, feed *feed.Feed) error {
+// BackfillEvents stores the events of successfully fetched feeds that have none stored,
+// like feeds that have not changed since events were first stored.
+// It returns the number of feeds that were processed.
+func (db *DB) BackfillEvents(ctx context.Context, feedStorage feedstorage.Interface) (int, error) {
+	const q = `SELECT id FROM icalproxy_feeds_v2 f
+WHERE id > $1 AND fetch_status < 400 AND NOT EXISTS (SELECT 1 FROM icalproxy_events_v1 e WHERE e.feed_id = f.id)
+ORDER BY id
+LIMIT 100`
+	count := 0
+	lastId := int64(0)
+	for {
+		ids, err := pgxt.GetScalars[int64](ctx, db.conn, q, lastId)
+		if err != nil {
+			return count, internal.ErrWrap(err, "selecting feeds to backfill")
+		}
+		if len(ids) == 0 {
+			return count, nil
+		}
+		for _, id := range ids {
+			body, err := feedStorage.Fetch(ctx, id)
+			if errors.Is(err, feedstorage.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return count, internal.ErrWrap(err, "fetching feed %d from storage", id)
+			}
+			if err := db.replaceEvents(ctx, id, body); err != nil {
+				return count, internal.ErrWrap(err, "replacing events for feed %d", id)
+			}
+			count++
+		}
+		lastId = ids[len(ids)-1]
+	}
+}
+
+// CanonicalizeFeedUrls rewrites the url of every feed to its feed.CanonicalURL,
+// so feeds added before urls were canonicalized are found (and refreshed) under their canonical url.
+// If several feeds have the same canonical url, only one is kept: the most recently checked successful feed,
+// or the most recently checked feed if none are successful. The kept feed gets the accesses of the others,
+// and any webhook they have pending (see mergeDuplicateFeeds). The contents of the others are removed from storage
+// once the changes are committed. Feeds with urls that cannot be parsed are left alone.
+// Return the number of feeds that were renamed, and the feeds that were deleted as duplicates.
+func (db *DB) CanonicalizeFeedUrls(ctx context.Context, feedStorage feedstorage.Interface, sortQueryMap map[types.NormalizedHostname]bool) (int, []DeletedFeed, error) {
+	renamed := 0
+	var deleted []DeletedFeed
+	err := pgxt.WithTransaction(ctx, db.conn, func(tx pgx.Tx) error {
+		const q = `SELECT id, url, fetch_status < 400, checked_at, contents_size, access_count, last_accessed_at, webhook_pending, webhook_diff
+FROM icalproxy_feeds_v2 ORDER BY id FOR UPDATE`
+		rows, err := tx.Query(ctx, q)
+		if err != nil {
+			return internal.ErrWrap(err, "selecting feeds")
+		}
+		feedRows, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (feedUrlRow, error) {
+			var r feedUrlRow
+			return r, row.Scan(&r.id, &r.url, &r.success, &r.checkedAt, &r.contentsSize, &r.accessCount, &r.lastAccessedAt, &r.webhookPending, &r.webhookDiff)
+		})
+		if err != nil {
+			return internal.ErrWrap(err, "scanning feeds")
+		}
+		byCanonical := make(map[string][]feedUrlRow)
+		var canonicals []string
+		for _, r := range feedRows {
+			u, err := url.Parse(r.url)
+			if err != nil {
+				continue
+			}
+			c := feed.CanonicalURL(u, sortQueryMap).String()
+			if _, ok := byCanonical[c]; !ok {
+				canonicals = append(canonicals, c)
+			}
+			byCanonical[c] = append(byCanonical[c], r)
+		}
+		for _, c := range canonicals {
+			group := byCanonical[c]
+			if len(group) == 1 && group[0].url == c {
+				continue
+			}
+			keep := group[0]
+			for _, r := range group[1:] {
+				if (r.success && !keep.success) || (r.success == keep.success && r.checkedAt.After(keep.checkedAt)) {
+					keep = r
+				}
+			}
+			for _, r := range group {
+				if r.id == keep.id {
+					continue
+				}
+				if _, err := tx.Exec(ctx, `DELETE FROM icalproxy_feeds_v2 WHERE id = $1`, r.id); err != nil {
+					return internal.ErrWrap(err, "deleting duplicate feed %d", r.id)
+				}
+				deleted = append(deleted, DeletedFeed{Id: r.id, ContentsSize: r.contentsSize})
+			}
+			if len(group) > 1 {
+				if err := mergeDuplicateFeeds(ctx, tx, keep, group); err != nil {
+					return err
+				}
+			}
+			if keep.url != c {
+				cu := fp.Must(url.Parse(c))
+				const q = `UPDATE icalproxy_feeds_v2 SET url = $1, url_host_rev = $2 WHERE id = $3`
+				if _, err := tx.Exec(ctx, q, c, types.NormalizeURLHostname(cu).Reverse(), keep.id); err != nil {
+					return internal.ErrWrap(err, "renaming feed %d", keep.id)
+				}
+				renamed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return renamed, nil, err
+	}
+	// Remove the contents only once the rows are gone, so a failed transaction does not lose them.
+	var storageErrs []error
+	for _, df := range deleted {
+		if err := feedStorage.Delete(ctx, df.Id); err != nil {
+			storageErrs = append(storageErrs, internal.ErrWrap(err, "deleting duplicate feed %d from storage", df.Id))
+		}
+	}
+	return renamed, deleted, errors.Join(storageErrs...)
+}
+
+type feedUrlRow struct {
+	id             int64
+	url            string
+	success        bool
+	checkedAt      time.Time
+	contentsSize   int64
+	accessCount    int64
+	lastAccessedAt time.Time
+	webhookPending bool
+	webhookDiff    *ical.Diff
+}
+
+// mergeDuplicateFeeds gives the kept feed the accesses of all the feeds in its group,
+// and a pending webhook if any of them had one, so merging does not lose a notification.
+// The pending changes are merged if they are all known, otherwise they are unknown (NULL).
+func mergeDuplicateFeeds(ctx context.Context, tx pgx.Tx, keep feedUrlRow, group []feedUrlRow) error {
+	accessCount := int64(0)
+	lastAccessedAt := keep.lastAccessedAt
+	webhookPending := false
+	var webhookDiff *ical.Diff
+	diffKnown := true
+	for _, r := range group {
+		accessCount += r.accessCount
+		if r.lastAccessedAt.After(lastAccessedAt) {
+			lastAccessedAt = r.lastAccessedAt
+		}
+		if !r.webhookPending {
+			continue
+		}
+		webhookPending = true
+		if r.webhookDiff == nil {
+			diffKnown = false
+		} else if webhookDiff == nil {
+			webhookDiff = r.webhookDiff
+		} else {
+			webhookDiff = webhookDiff.Merge(r.webhookDiff)
+		}
+	}
+	var encodedDiff any
+	if webhookPending && diffKnown && webhookDiff != nil {
+		b, err := json.Marshal(webhookDiff)
+		if err != nil {
+			return internal.ErrWrap(err, "encoding merged webhook diff")
+		}
+		encodedDiff = string(b)
+	}
+	const q = `UPDATE icalproxy_feeds_v2 SET access_count = $1, last_accessed_at = $2, webhook_pending = $3, webhook_diff = $4::jsonb WHERE id = $5`
+	if _, err := tx.Exec(ctx, q, accessCount, lastAccessedAt, webhookPending, encodedDiff, keep.id); err != nil {
+		return internal.ErrWrap(err, "merging duplicates into feed %d", keep.id)
+	}
+	return nil
+}
+
+type CredentialsRow struct {
+	UrlPrefix        string
+	HeadersEncrypted []byte
+	HeaderNames      []string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// UpsertCredentials stores the (already encrypted) headers for the url prefix,
+// replacing any that are already stored.
+func (db *DB) UpsertCredentials(ctx context.Context, urlPrefix string, headersEncrypted []byte, headerNames []string) error {
+	encodedNames, err := json.Marshal(headerNames)
+	if err != nil {
+		return internal.ErrWrap(err, "encoding header names")
+	}
+	const q = `INSERT INTO icalproxy_credentials_v1 (url_prefix, headers_encrypted, header_names)
+VALUES ($1, $2, $3::jsonb)
+ON CONFLICT (url_prefix) DO UPDATE SET
+	headers_encrypted=EXCLUDED.headers_encrypted,
+	header_names=EXCLUDED.header_names,
+	updated_at=now()`
+	if err := db.exec(ctx, q, urlPrefix, headersEncrypted, string(encodedNames)); err != nil {
+		return internal.ErrWrap(err, "unable to upsert credentials")
+	}
+	return nil
+}
+
+// DeleteCredentials deletes the credentials for the url prefix,
+// and returns false if there were none.
+func (db *DB) DeleteCredentials(ctx context.Context, urlPrefix string) (bool, error) {
+	tag, err := db.conn.Exec(ctx, `DELETE FROM icalproxy_credentials_v1 WHERE url_prefix = $1`, urlPrefix)
+	if err != nil {
+		return false, internal.ErrWrap(err, "unable to delete credentials")
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListCredentials returns all stored credentials, ordered by url prefix.
+func (db *DB) ListCredentials(ctx context.Context) ([]CredentialsRow, error) {
+	rows, err := db.conn.Query(ctx, `SELECT url_prefix, headers_encrypted, header_names, created_at, updated_at
+FROM icalproxy_credentials_v1
+ORDER BY url_prefix`)
+	if err != nil {
+		return nil, internal.ErrWrap(err, "listing credentials")
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (CredentialsRow, error) {
+		var r CredentialsRow
+		var names json.RawMessage
+		if err := row.Scan(&r.UrlPrefix, &r.HeadersEncrypted, &names, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return r, err
+		}
+		return r, json.Unmarshal(names, &r.HeaderNames)
+	})
+}
+
+type eventRow struct {
+	UID          string     `json:"uid"`
+	RecurrenceID *time.Time `json:"recurrence_id"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	Summary      string     `json:"summary"`
+	Location     string     `json:"location"`
+	Status       string     `json:"status"`
+}
+
+// replaceEvents replaces the stored events of the feed with the VEVENTs in body.
+// If body cannot be parsed, the feed has no events.
+func (db *DB) replaceEvents(ctx context.Context, feedId int64, body []byte) error {
+	rows := make([]eventRow, 0)
+	if cal, err := ical.Parse(body); err == nil {
+		for _, span := range cal.EventSpans(time.UTC) {
+			rows = append(rows, eventRow{
+				UID:          span.Event.PropValue("UID"),
+				RecurrenceID: nullTime(span.RecurrenceID),
+				StartsAt:     nullTime(span.Start),
+				EndsAt:       nullTime(span.End),
+				Summary:      ical.UnescapeText(span.Event.PropValue("SUMMARY")),
+				Location:     ical.UnescapeText(span.Event.PropValue("LOCATION")),
+				Status:       span.Event.PropValue("STATUS"),
+			})
+		}
+	}
+	// Pass rows as JSON, since arrays of composite types do not work with the simple protocol.
+	encodedRows, err := json.Marshal(rows)
+	if err != nil {
+		return internal.ErrWrap(err, "encoding events to save")
+	}
+	// The DELETE and INSERT see the same snapshot, so the new rows are not deleted.
+	const q = `WITH deleted AS (DELETE FROM icalproxy_events_v1 WHERE feed_id = $1)
+INSERT INTO icalproxy_events_v1 (feed_id, uid, recurrence_id, starts_at, ends_at, summary, location, status)
+SELECT $1, e.uid, e.recurrence_id, e.starts_at, e.ends_at, e.summary, e.location, e.status
+FROM jsonb_to_recordset($2::jsonb) AS e(
+	uid TEXT, recurrence_id timestamptz, starts_at timestamptz, ends_at timestamptz, summary TEXT, location TEXT, status TEXT
+)`
+	return db.exec(ctx, q, feedId, string(encodedRows))
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// EventSearch are the filters for SearchEvents. Empty filters are ignored.
+type EventSearch struct {
+	// Query is matched (case-insensitively) against the UID, summary, and location of events.
+	Query string
+	// Host matches feeds with this hostname, or subdomains of it (so 'icloud.com' matches 'p123.icloud.com').
+	Host string
+	// Start and End match events that have any time in [Start, End).
+	Start time.Time
+	End   time.Time
+	// Limit is the maximum number of events to return.
+	Limit int
+}
+
+type EventSearchResult struct {
+	FeedUrl      string     `json:"feed_url"`
+	UID          string     `json:"uid"`
+	RecurrenceID *time.Time `json:"recurrence_id"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	Summary      string     `json:"summary"`
+	Location     string     `json:"location"`
+	Status       string     `json:"status"`
+}
+
+// SearchEvents returns the stored events matching the search, along with the url of their feed,
+// ordered by feed url and start time.
+func (db *DB) SearchEvents(ctx context.Context, search EventSearch) ([]EventSearchResult, error) {
+	q := `SELECT f.url, e.uid, e.recurrence_id, e.starts_at, e.ends_at, e.summary, e.location, e.status
+FROM icalproxy_events_v1 e
+JOIN icalproxy_feeds_v2 f ON f.id = e.feed_id
+WHERE TRUE`
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if search.Query != "" {
+		p := arg("%" + escapeLike(search.Query) + "%")
+		q += fmt.Sprintf(" AND (e.uid ILIKE %[1]s OR e.summary ILIKE %[1]s OR e.location ILIKE %[1]s)", p)
+	}
+	if search.Host != "" {
+		q += fmt.Sprintf(" AND starts_with(f.url_host_rev, %s)", arg(string(types.NormalizeHostname(search.Host).Reverse())))
+	}
+	if !search.End.IsZero() {
+		q += fmt.Sprintf(" AND e.starts_at < %s", arg(search.End))
+	}
+	if !search.Start.IsZero() {
+		q += fmt.Sprintf(" AND (e.ends_at IS NULL OR e.ends_at > %[1]s OR (e.ends_at = e.starts_at AND e.starts_at >= %[1]s))", arg(search.Start))
+	}
+	q += " ORDER BY f.url, e.starts_at, e.uid"
+	if search.Limit > 0 {
+		q += " LIMIT " + arg(search.Limit)
+	}
+	rows, err := db.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, internal.ErrWrap(err, "searching events")
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (EventSearchResult, error) {
+		var r EventSearchResult
+		err := row.Scan(&r.FeedUrl, &r.UID, &r.RecurrenceID, &r.StartsAt, &r.EndsAt, &r.Summary, &r.Location, &r.Status)
+		for _, t := range []*time.Time{r.RecurrenceID, r.StartsAt, r.EndsAt} {
+			if t != nil {
+				*t = t.UTC()
+			}
+		}
+		return r, err
+	})
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike escapes s so it matches literally in a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// CommitUnchanged bumps checked_at for a feed whose stored row does not need to change,
+// stores its RetryAfter, and sets refresh_at using the refresh bounds.
+// If the feed is an error (like the same error status as last time), failure_count is incremented;
+// otherwise (like a 304), the origin is working, so failure_count is reset.
+func (db *DB) CommitUnchanged(ctx context.Context, feed *feed.Feed, refresh feed.RefreshBounds) error {
 	fetchedTrunc := feed.FetchedAt.Truncate(time.Second)
-	const query = `UPDATE icalproxy_feeds_v2 SET checked_at = $1 WHERE url = $2`
-	if err := db.exec(ctx, query, fetchedTrunc, feed.Url); err != nil {
+	const query = `UPDATE icalproxy_feeds_v2 SET
+	checked_at = $1,
+	failure_count = (CASE WHEN $3 THEN failure_count + 1 ELSE 0 END),
+	first_failed_at = (CASE WHEN $3 THEN COALESCE(first_failed_at, $1) ELSE NULL END),
+	retry_after = $4
+WHERE url = $2
+RETURNING failure_count, changed_at, change_interval_ms`
+	var hist changeHistory
+	err := db.conn.QueryRow(ctx, query, fetchedTrunc, feed.Url, feed.HttpStatus >= 400, nullTime(feed.RetryAfter)).Scan(
+		&hist.failureCount, &hist.changedAt, &hist.changeIntervalMs,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
 		return internal.ErrWrap(err, "unable to update feed")
 	}
+	return db.scheduleRefresh(ctx, feed, fetchedTrunc, refresh, hist)
+}
+
+// changeHistory is the history columns of a committed row, used to calculate refresh_at.
+type changeHistory struct {
+	changedAt        *time.Time
+	changeIntervalMs int64
+	failureCount     int
+}
+
+// scheduleRefresh sets refresh_at to when the feed checked at checkedAt should next be checked
+// (see feed.RefreshBounds.Interval), or its RetryAfter if that is later.
+// If the feed has a RetryAfter, it is also stored for the host (see SetHostRetryAfter).
+func (db *DB) scheduleRefresh(ctx context.Context, fd *feed.Feed, checkedAt time.Time, refresh feed.RefreshBounds, hist changeHistory) error {
+	h := feed.ChangeHistory{
+		ChangeInterval: time.Duration(hist.changeIntervalMs) * time.Millisecond,
+		FailureCount:   hist.failureCount,
+	}
+	if hist.changedAt != nil {
+		h.ChangedAt = *hist.changedAt
+	}
+	refreshAt := checkedAt.Add(refresh.Interval(h, checkedAt))
+	if fd.RetryAfter.After(refreshAt) {
+		refreshAt = fd.RetryAfter
+	}
+	if err := db.exec(ctx, `UPDATE icalproxy_feeds_v2 SET refresh_at = $1 WHERE url = $2`, refreshAt, fd.Url.String()); err != nil {
+		return internal.ErrWrap(err, "unable to set refresh time")
+	}
+	if !fd.RetryAfter.IsZero() {
+		return db.SetHostRetryAfter(ctx, fd.Url, fd.RetryAfter)
+	}
+	return nil
+}
+
+// SetHostRetryAfter stores that no feeds with the url's host should be fetched before t,
+// unless a later time is already stored. Expired rows for other hosts are removed.
+func (db *DB) SetHostRetryAfter(ctx context.Context, uri *url.URL, t time.Time) error {
+	const q = `WITH expired AS (DELETE FROM icalproxy_host_retry_after_v1 WHERE retry_after < now() AND url_host_rev <> $1)
+INSERT INTO icalproxy_host_retry_after_v1 (url_host_rev, retry_after) VALUES ($1, $2)
+ON CONFLICT (url_host_rev) DO UPDATE SET retry_after=GREATEST(icalproxy_host_retry_after_v1.retry_after, EXCLUDED.retry_after)`
+	if err := db.exec(ctx, q, types.NormalizeURLHostname(uri).Reverse(), t); err != nil {
+		return internal.ErrWrap(err, "unable to set host retry after")
+	}
+	return nil
+}
+
+// HostRetryAfter returns the time stored with SetHostRetryAfter for the url's host,
+// or zero if there is none or it has passed.
+func (db *DB) HostRetryAfter(ctx context.Context, uri *url.URL) (time.Time, error) {
+	const q = `SELECT retry_after FROM icalproxy_host_retry_after_v1 WHERE url_host_rev = $1 AND retry_after > now()`
+	var t time.Time
+	err := db.conn.QueryRow(ctx, q, types.NormalizeURLHostname(uri).Reverse()).Scan(&t)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, internal.ErrWrap(err, "selecting host retry after")
+	}
+	return t, nil
+}
+
+// FeedAccess is the requests for a feed since its accesses were last recorded.
+type FeedAccess struct {
+	Url   string `json:"url"`
+	Count int64  `json:"count"`
+	// AccessedAt is the time of the latest request.
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// RecordAccesses adds the counts to the access_count of the feeds, and updates their last_accessed_at.
+// Feeds that are not stored are ignored.
+func (db *DB) RecordAccesses(ctx context.Context, accesses []FeedAccess) error {
+	// Pass rows as JSON, like replaceEvents.
+	encoded, err := json.Marshal(accesses)
+	if err != nil {
+		return internal.ErrWrap(err, "encoding accesses")
+	}
+	const q = `UPDATE icalproxy_feeds_v2 f SET
+	access_count = f.access_count + a.count,
+	last_accessed_at = GREATEST(f.last_accessed_at, a.accessed_at)
+FROM jsonb_to_recordset($1::jsonb) AS a(url TEXT, count BIGINT, accessed_at timestamptz)
+WHERE f.url = a.url`
+	if err := db.exec(ctx, q, string(encoded)); err != nil {
+		return internal.ErrWrap(err, "unable to record accesses")
+	}
+	return nil
+}
+
+// AbandonedFeeds are the criteria for feeds that are no longer worth keeping (see package gc).
+// A feed matching either is abandoned; zero times are ignored.
+type AbandonedFeeds struct {
+	// NotAccessedSince matches feeds whose last_accessed_at is before it.
+	NotAccessedSince time.Time
+	// FailingSince matches feeds that have failed every fetch since before it.
+	FailingSince time.Time
+}
+
+// abandonedFeedsWhere uses $1 and $2 for the NotAccessedSince and FailingSince args.
+const abandonedFeedsWhere = `($1::timestamptz IS NOT NULL AND last_accessed_at < $1)
+	OR ($2::timestamptz IS NOT NULL AND failure_count > 0 AND first_failed_at < $2)`
+
+func (a AbandonedFeeds) args() []any {
+	return []any{nullTime(a.NotAccessedSince), nullTime(a.FailingSince)}
+}
+
+// CountAbandonedFeeds returns the number of abandoned feeds, and the total size of their contents.
+func (db *DB) CountAbandonedFeeds(ctx context.Context, a AbandonedFeeds) (int64, int64, error) {
+	q := `SELECT count(1), COALESCE(sum(contents_size), 0)::BIGINT FROM icalproxy_feeds_v2 WHERE ` + abandonedFeedsWhere
+	var count, size int64
+	if err := db.conn.QueryRow(ctx, q, a.args()...).Scan(&count, &size); err != nil {
+		return 0, 0, internal.ErrWrap(err, "counting abandoned feeds")
+	}
+	return count, size, nil
+}
+
+// DeletedFeed is a feed deleted by DeleteAbandonedFeeds.
+type DeletedFeed struct {
+	Id           int64
+	ContentsSize int64
+}
+
+// DeleteAbandonedFeeds deletes up to limit abandoned feeds (and their events), and returns the deleted feeds
+// so their contents can be removed from storage. Feeds that are locked, or leased by the refresher
+// (see refresher.Refresher.ClaimRowsToProcess), are skipped, since they are being fetched
+// and committing them would store them again as new feeds.
+func (db *DB) DeleteAbandonedFeeds(ctx context.Context, a AbandonedFeeds, limit int) ([]DeletedFeed, error) {
+	q := fmt.Sprintf(`DELETE FROM icalproxy_feeds_v2 WHERE id IN (
+	SELECT id FROM icalproxy_feeds_v2
+	WHERE (%s) AND (leased_until IS NULL OR leased_until < now())
+	LIMIT %d
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, contents_size`, abandonedFeedsWhere, limit)
+	rows, err := db.conn.Query(ctx, q, a.args()...)
+	if err != nil {
+		return nil, internal.ErrWrap(err, "deleting abandoned feeds")
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeletedFeed, error) {
+		var d DeletedFeed
+		return d, row.Scan(&d.Id, &d.ContentsSize)
+	})
+}
+
+// DeferRefresh sets the refresh_at of the feed to t, without checking it.
+func (db *DB) DeferRefresh(ctx context.Context, uri *url.URL, t time.Time) error {
+	if err := db.exec(ctx, `UPDATE icalproxy_feeds_v2 SET refresh_at = $1 WHERE url = $2`, t, uri.String()); err != nil {
+		return internal.ErrWrap(err, "unable to defer refresh")
+	}
+	return nil
+}
+
+// ReleaseLease clears the lease on the feed, if it is still the lease that was taken
+// (see refresher.Refresher.ClaimRowsToProcess). A lease that expired and was claimed again is left alone.
+func (db *DB) ReleaseLease(ctx context.Context, feedId int64, leasedUntil time.Time) error {
+	const q = `UPDATE icalproxy_feeds_v2 SET leased_until = NULL WHERE id = $1 AND leased_until = $2`
+	if err := db.exec(ctx, q, feedId, leasedUntil); err != nil {
+		return internal.ErrWrap(err, "unable to release lease")
+	}
 	return nil
 }
 
@@ -218,7 +913,7 @@ func (db *DB) CommitUnchanged(ctx context.Context, feed *feed.Feed) error {
 // it will only happen if something manually changes feed storage.
 func (db *DB) ExpireFeed(ctx context.Context, u *url.URL) error {
 	t := time.Time{}
-	const query = `UPDATE icalproxy_feeds_v2 SET checked_at = $1, contents_last_modified = $1 WHERE url = $2`
+	const query = `UPDATE icalproxy_feeds_v2 SET checked_at = $1, contents_last_modified = $1, refresh_at = $1 WHERE url = $2`
 	if err := db.exec(ctx, query, t, u); err != nil {
 		return internal.ErrWrap(err, "unable to expire feed")
 	}
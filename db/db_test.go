@@ -13,7 +13,10 @@ import (
 	"github.com/webhookdb/icalproxy/feedstorage"
 	"github.com/webhookdb/icalproxy/feedstorage/fakefeedstorage"
 	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/ical"
 	. "github.com/webhookdb/icalproxy/icalproxytest"
+	"github.com/webhookdb/icalproxy/pgxt"
+	"github.com/webhookdb/icalproxy/types"
 	"net/url"
 	"testing"
 	"time"
@@ -96,6 +99,23 @@ var _ = Describe("db", func() {
 			Expect(r.MD5).To(BeEquivalentTo(""))
 			Expect(r.Body).To(BeEquivalentTo("hello"))
 		})
+		It("returns the validation report", func() {
+			Expect(d.CommitFeed(ctx, fs, feed.New(
+				fp.Must(url.Parse("https://localhost/feed")),
+				make(map[string]string),
+				200,
+				[]byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"),
+				time.Now(),
+			), nil)).To(Succeed())
+			r, err := d.FetchContentsAsFeed(ctx, fs, fp.Must(url.Parse("https://localhost/feed")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Validation).To(And(
+				HaveField("Status", ical.ValidationInvalid),
+				HaveField("Errors", 2),
+				HaveField("Warnings", 3),
+				HaveField("Issues", HaveLen(5)),
+			))
+		})
 		It("errors if the row does not exist", func() {
 			_, err := d.FetchContentsAsFeed(ctx, fs, fp.Must(url.Parse("https://localhost/feed")))
 			Expect(err).To(MatchError(ContainSubstring("no rows in result set")))
@@ -165,6 +185,8 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("FetchStatus", 201),
 				HaveField("FetchHeaders", BeEquivalentTo(`{"X": "11"}`)),
 				HaveField("FetchErrorBody", BeEmpty()),
+				HaveField("FailureCount", 0),
+				HaveField("FirstFailedAt", BeNil()),
 			))
 		})
 		It("inserts and upserts field from an error response", func() {
@@ -192,6 +214,8 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("FetchStatus", 400),
 				HaveField("FetchHeaders", BeEquivalentTo(`{"X": "1"}`)),
 				HaveField("FetchErrorBody", BeEquivalentTo("someerror")),
+				HaveField("FailureCount", 1),
+				HaveField("FirstFailedAt", HaveValue(BeTemporally("==", t))),
 			))
 
 			// Update and check all fields
@@ -220,6 +244,9 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("FetchStatus", 401),
 				HaveField("FetchHeaders", BeEquivalentTo(`{"X": "11"}`)),
 				HaveField("FetchErrorBody", BeEquivalentTo("error2")),
+				HaveField("FailureCount", 2),
+				// Still the time of the first failure
+				HaveField("FirstFailedAt", HaveValue(BeTemporally("==", t))),
 			))
 		})
 		It("will clear error fields on a successful fetch", func() {
@@ -291,6 +318,113 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("FetchStatus", 401),
 				HaveField("FetchHeaders", BeEquivalentTo(`{"X": "11"}`)),
 				HaveField("FetchErrorBody", BeEquivalentTo("error2")),
+				HaveField("ValidationStatus", ""),
+				HaveField("ValidationReport", BeNil()),
+			))
+		})
+		It("stores the validation of a successful fetch", func() {
+			Expect(d.CommitFeed(ctx, fs, feed.New(
+				fp.Must(url.Parse("https://localhost/feed")),
+				make(map[string]string),
+				200,
+				[]byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:x\r\nEND:VCALENDAR\r\n"),
+				time.Now(),
+			), nil)).To(Succeed())
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row.ValidationStatus).To(Equal("valid"))
+			Expect(row.ValidationReport).To(MatchJSON(`{"status":"valid","errors":0,"warnings":0,"issues":[]}`))
+		})
+		It("tracks how often the contents change, and sets when to refresh the feed", func() {
+			t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			opts := &db.CommitFeedOptions{Refresh: feed.RefreshBounds{Min: time.Hour, Max: 24 * time.Hour, MaxBackoff: 8 * time.Hour}}
+			commit := func(status int, body string, at time.Duration) {
+				fd := feed.New(fp.Must(url.Parse("https://localhost/feed")), map[string]string{}, status, []byte(body), t.Add(at))
+				Expect(d.CommitFeed(ctx, fs, fd, opts)).To(Succeed())
+			}
+			row := func() FeedRow {
+				return fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+					fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
+					pgx.RowToStructByName[FeedRow],
+				))
+			}
+
+			commit(200, "v1", 0)
+			Expect(row()).To(And(
+				HaveField("ChangedAt", HaveValue(BeTemporally("==", t))),
+				HaveField("ChangeIntervalMs", BeEquivalentTo(0)),
+				// Nothing is known, so use the minimum
+				HaveField("RefreshAt", BeTemporally("==", t.Add(time.Hour))),
+			))
+
+			commit(200, "v2", 10*time.Hour)
+			Expect(row()).To(And(
+				HaveField("ChangedAt", HaveValue(BeTemporally("==", t.Add(10*time.Hour)))),
+				HaveField("ChangeIntervalMs", BeEquivalentTo((10*time.Hour).Milliseconds())),
+				// Check twice per expected change
+				HaveField("RefreshAt", BeTemporally("==", t.Add(15*time.Hour))),
+			))
+
+			// Committing the same contents does not count as a change
+			commit(200, "v2", 12*time.Hour)
+			Expect(row()).To(And(
+				HaveField("ChangedAt", HaveValue(BeTemporally("==", t.Add(10*time.Hour)))),
+				HaveField("ChangeIntervalMs", BeEquivalentTo((10*time.Hour).Milliseconds())),
+				HaveField("RefreshAt", BeTemporally("==", t.Add(17*time.Hour))),
+			))
+
+			commit(200, "v3", 14*time.Hour)
+			Expect(row()).To(And(
+				HaveField("ChangedAt", HaveValue(BeTemporally("==", t.Add(14*time.Hour)))),
+				// Average of 10 and 4 hours
+				HaveField("ChangeIntervalMs", BeEquivalentTo((7*time.Hour).Milliseconds())),
+				HaveField("RefreshAt", BeTemporally("==", t.Add(14*time.Hour+210*time.Minute))),
+			))
+
+			// Errors back off from the minimum, and do not change the history
+			commit(500, "error", 15*time.Hour)
+			Expect(row()).To(And(
+				HaveField("ChangedAt", HaveValue(BeTemporally("==", t.Add(14*time.Hour)))),
+				HaveField("ChangeIntervalMs", BeEquivalentTo((7*time.Hour).Milliseconds())),
+				HaveField("RefreshAt", BeTemporally("==", t.Add(17*time.Hour))),
+			))
+			errFeed := feed.New(fp.Must(url.Parse("https://localhost/feed")), map[string]string{}, 500, []byte("error"), t.Add(17*time.Hour))
+			Expect(d.CommitUnchanged(ctx, errFeed, opts.Refresh)).To(Succeed())
+			Expect(row()).To(HaveField("RefreshAt", BeTemporally("==", t.Add(21*time.Hour))))
+		})
+		It("stores when the origin asked to retry, for the feed and its host", func() {
+			t := time.Now().Truncate(time.Second)
+			retryAfter := t.Add(6 * time.Hour)
+			opts := &db.CommitFeedOptions{Refresh: feed.RefreshBounds{Min: time.Hour}}
+			fd := feed.New(fp.Must(url.Parse("https://sub.localhost/feed")), map[string]string{}, 429, []byte("slow down"), t)
+			fd.RetryAfter = retryAfter
+			Expect(d.CommitFeed(ctx, fs, fd, opts)).To(Succeed())
+			row := func() FeedRow {
+				return fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+					fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://sub.localhost/feed'`)),
+					pgx.RowToStructByName[FeedRow],
+				))
+			}
+			Expect(row()).To(And(
+				HaveField("RetryAfter", HaveValue(BeTemporally("==", retryAfter))),
+				// Later than the 2 hour backoff
+				HaveField("RefreshAt", BeTemporally("==", retryAfter)),
+			))
+			Expect(fp.Must(d.FetchFeedRow(ctx, fd.Url))).To(HaveField("RetryAfter", BeTemporally("==", retryAfter)))
+			Expect(d.HostRetryAfter(ctx, fp.Must(url.Parse("https://sub.localhost/other")))).To(BeTemporally("==", retryAfter))
+			Expect(d.HostRetryAfter(ctx, fp.Must(url.Parse("https://localhost/other")))).To(BeZero())
+
+			// An earlier time does not replace the host's time
+			Expect(d.SetHostRetryAfter(ctx, fd.Url, t.Add(time.Hour))).To(Succeed())
+			Expect(d.HostRetryAfter(ctx, fd.Url)).To(BeTemporally("==", retryAfter))
+
+			fd = feed.New(fd.Url, map[string]string{}, 200, []byte("ok"), t.Add(7*time.Hour))
+			Expect(d.CommitFeed(ctx, fs, fd, opts)).To(Succeed())
+			Expect(row()).To(And(
+				HaveField("RetryAfter", BeNil()),
+				HaveField("RefreshAt", BeTemporally("==", t.Add(8*time.Hour))),
 			))
 		})
 		It("sets WebhookPending only on upsert if a webhook is configured", func() {
@@ -340,6 +474,200 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("WebhookPending", true),
 			))
 		})
+		It("does not change WebhookPending if the fingerprint is unchanged", func() {
+			fd := &feed.Feed{
+				Url:         fp.Must(url.Parse("https://localhost/feed")),
+				HttpHeaders: map[string]string{},
+				HttpStatus:  200,
+				Body:        []byte("BEGIN:VCALENDAR\r\nDTSTAMP:1\r\nEND:VCALENDAR\r\n"),
+				MD5:         "version1hash",
+				Fingerprint: "samefingerprint",
+				FetchedAt:   time.Now(),
+			}
+			Expect(d.CommitFeed(ctx, fs, fd, nil)).To(Succeed())
+			fd.MD5 = "version2hash"
+			Expect(d.CommitFeed(ctx, fs, fd, &db.CommitFeedOptions{WebhookPending: true})).To(Succeed())
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(And(
+				HaveField("ContentsMD5", BeEquivalentTo("version2hash")),
+				HaveField("ContentsFingerprint", BeEquivalentTo("samefingerprint")),
+				HaveField("WebhookPending", false),
+			))
+
+			fd.Fingerprint = "newfingerprint"
+			diff := &ical.Diff{Added: []ical.EventKey{}, Removed: []ical.EventKey{}, Modified: []ical.EventKey{{UID: "1"}}}
+			Expect(d.CommitFeed(ctx, fs, fd, &db.CommitFeedOptions{WebhookPending: true, WebhookDiff: diff})).To(Succeed())
+			row = fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(HaveField("WebhookPending", true))
+			Expect(row.WebhookDiff).To(MatchJSON(`{"added": [], "removed": [], "modified": [{"uid": "1"}]}`))
+
+			// A cosmetic change must not clear a webhook that has not been sent yet.
+			Expect(d.CommitFeed(ctx, fs, fd, nil)).To(Succeed())
+			row = fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(HaveField("WebhookPending", true))
+			Expect(row.WebhookDiff).To(MatchJSON(`{"added": [], "removed": [], "modified": [{"uid": "1"}]}`))
+		})
+	})
+	Describe("events", func() {
+		calBody := "BEGIN:VCALENDAR\r\n" +
+			"BEGIN:VEVENT\r\nUID:weekly\r\nSUMMARY:Standup\r\nDTSTART:20240101T090000Z\r\nDURATION:PT30M\r\n" +
+			"RRULE:FREQ=WEEKLY;COUNT=3\r\nEND:VEVENT\r\n" +
+			"BEGIN:VEVENT\r\nUID:booking-123\r\nSUMMARY:Haircut\\, Bob\r\nLOCATION:Salon\r\nSTATUS:CONFIRMED\r\n" +
+			"DTSTART:20240201T100000Z\r\nDTEND:20240201T110000Z\r\nEND:VEVENT\r\n" +
+			"END:VCALENDAR\r\n"
+		commit := func(u string, body string, status int) {
+			Expect(d.CommitFeed(ctx, fs, &feed.Feed{
+				Url:         fp.Must(url.Parse(u)),
+				HttpHeaders: make(map[string]string),
+				HttpStatus:  status,
+				Body:        []byte(body),
+				MD5:         MustMD5(body),
+				FetchedAt:   time.Now(),
+			}, nil)).To(Succeed())
+		}
+		uids := func(search db.EventSearch) []string {
+			var r []string
+			for _, ev := range fp.Must(d.SearchEvents(ctx, search)) {
+				r = append(r, ev.FeedUrl+" "+ev.UID)
+			}
+			return r
+		}
+
+		It("stores the events of committed feeds, and replaces them when the feed changes", func() {
+			commit("https://localhost/feed", calBody, 200)
+			events := fp.Must(d.SearchEvents(ctx, db.EventSearch{}))
+			Expect(events).To(HaveLen(2))
+			Expect(events[0]).To(And(
+				HaveField("FeedUrl", "https://localhost/feed"),
+				HaveField("UID", "weekly"),
+				HaveField("RecurrenceID", BeNil()),
+				HaveField("StartsAt", HaveValue(BeTemporally("==", time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)))),
+				HaveField("EndsAt", HaveValue(BeTemporally("==", time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)))),
+			))
+			Expect(events[1]).To(And(
+				HaveField("UID", "booking-123"),
+				HaveField("Summary", "Haircut, Bob"),
+				HaveField("Location", "Salon"),
+				HaveField("Status", "CONFIRMED"),
+			))
+
+			commit("https://localhost/feed", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:other\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", 200)
+			Expect(uids(db.EventSearch{})).To(ConsistOf("https://localhost/feed other"))
+		})
+		It("keeps the events of the last successful fetch if the fetch errors", func() {
+			commit("https://localhost/feed", calBody, 200)
+			commit("https://localhost/feed", "oops", 500)
+			Expect(uids(db.EventSearch{})).To(HaveLen(2))
+		})
+		It("can search by text, host, and time", func() {
+			commit("https://localhost/feed", calBody, 200)
+			commit("https://sub.localhost/feed", calBody, 200)
+			commit("https://127.0.0.1/feed", calBody, 200)
+			Expect(uids(db.EventSearch{Query: "haircut"})).To(Equal([]string{
+				"https://127.0.0.1/feed booking-123",
+				"https://localhost/feed booking-123",
+				"https://sub.localhost/feed booking-123",
+			}))
+			Expect(uids(db.EventSearch{Query: "booking-1", Host: "localhost"})).To(Equal([]string{
+				"https://localhost/feed booking-123",
+				"https://sub.localhost/feed booking-123",
+			}))
+			Expect(uids(db.EventSearch{Query: "%"})).To(BeEmpty())
+			Expect(uids(db.EventSearch{
+				Host:  "127.0.0.1",
+				Start: time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC),
+			})).To(Equal([]string{"https://127.0.0.1/feed weekly"}))
+			Expect(uids(db.EventSearch{Limit: 1})).To(HaveLen(1))
+		})
+		It("can backfill events for feeds without any", func() {
+			commit("https://localhost/feed", calBody, 200)
+			_, err := ag.DB.Exec(ctx, `DELETE FROM icalproxy_events_v1`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.BackfillEvents(ctx, fs)).To(BeNumerically(">=", 1))
+			Expect(uids(db.EventSearch{Host: "localhost"})).To(HaveLen(2))
+		})
+	})
+	Describe("CanonicalizeFeedUrls", func() {
+		commit := func(u string, status int, fetchedAt time.Time) {
+			Expect(d.CommitFeed(ctx, fs, &feed.Feed{
+				Url:         fp.Must(url.Parse(u)),
+				HttpHeaders: make(map[string]string),
+				HttpStatus:  status,
+				Body:        []byte(u),
+				MD5:         MustMD5(u),
+				FetchedAt:   fetchedAt,
+			}, nil)).To(Succeed())
+		}
+		urls := func() []string {
+			return fp.Must(pgxt.GetScalars[string](ctx, ag.DB, `SELECT url FROM icalproxy_feeds_v2 WHERE url LIKE '%//localhost%' ORDER BY url`))
+		}
+
+		It("renames feeds and keeps the best of any duplicates", func() {
+			now := time.Now()
+			commit("webcal://localhost/a", 200, now.Add(-time.Hour))
+			commit("https://LOCALHOST:443/b", 500, now)
+			commit("https://localhost/b", 200, now.Add(-time.Hour))
+			commit("https://localhost/c", 200, now)
+			commit("webcals://localhost/c", 200, now.Add(-time.Hour))
+			commit("https://localhost/d?b=1&a=1", 200, now)
+
+			dupIds := fp.Must(pgxt.GetScalars[int64](ctx, ag.DB, `SELECT id FROM icalproxy_feeds_v2 WHERE url IN ('https://LOCALHOST:443/b', 'webcals://localhost/c') ORDER BY id`))
+			Expect(dupIds).To(HaveLen(2))
+			Expect(fs.Files).To(HaveKey(dupIds[0]))
+
+			renamed, deleted, err := d.CanonicalizeFeedUrls(ctx, fs, map[types.NormalizedHostname]bool{"LOCALHOST": true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(renamed).To(Equal(2))
+			Expect(deleted).To(ConsistOf(HaveField("Id", dupIds[0]), HaveField("Id", dupIds[1])))
+			for _, id := range dupIds {
+				Expect(fs.Files).ToNot(HaveKey(id))
+			}
+			Expect(urls()).To(Equal([]string{
+				"http://localhost/a",
+				"https://localhost/b",
+				"https://localhost/c",
+				"https://localhost/d?a=1&b=1",
+			}))
+			Expect(fp.Must(d.FetchContentsAsFeed(ctx, fs, fp.Must(url.Parse("https://localhost/b"))))).To(
+				HaveField("Body", BeEquivalentTo("https://localhost/b")))
+			Expect(fp.Must(d.FetchContentsAsFeed(ctx, fs, fp.Must(url.Parse("https://localhost/c"))))).To(
+				HaveField("Body", BeEquivalentTo("https://localhost/c")))
+		})
+		It("merges the accesses and pending webhooks of duplicates into the kept feed", func() {
+			now := time.Now()
+			commit("https://localhost/a", 200, now)
+			commit("https://LOCALHOST:443/a", 200, now.Add(-time.Hour))
+			commit("webcals://localhost/a", 200, now.Add(-time.Hour))
+			accessed := now.Add(-time.Minute).Truncate(time.Second)
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET access_count = 2, last_accessed_at = $1 WHERE url = 'https://LOCALHOST:443/a'`, accessed)).Error().ToNot(HaveOccurred())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET access_count = 3, last_accessed_at = $1 - '1 day'::interval WHERE url = 'https://localhost/a'`, accessed)).Error().ToNot(HaveOccurred())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET webhook_pending = true, webhook_diff = '{"added":[{"uid":"1"}],"removed":[],"modified":[]}' WHERE url = 'webcals://localhost/a'`)).Error().ToNot(HaveOccurred())
+
+			_, deleted, err := d.CanonicalizeFeedUrls(ctx, fs, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleted).To(HaveLen(2))
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url LIKE '%//localhost/a'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(And(
+				HaveField("Url", "https://localhost/a"),
+				HaveField("AccessCount", BeEquivalentTo(5)),
+				HaveField("LastAccessedAt", BeTemporally("==", accessed)),
+				HaveField("WebhookPending", true),
+				HaveField("WebhookDiff", MatchJSON(`{"added":[{"uid":"1"}],"removed":[],"modified":[]}`)),
+			))
+		})
 	})
 	Describe("CommitUnchanged", func() {
 		It("bumps the checked_at time", func() {
@@ -355,7 +683,7 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 			Expect(d.CommitFeed(ctx, fs, fd, nil)).To(Succeed())
 
 			fd.FetchedAt = t
-			Expect(d.CommitUnchanged(ctx, fd)).To(Succeed())
+			Expect(d.CommitUnchanged(ctx, fd, feed.RefreshBounds{})).To(Succeed())
 			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
 				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://localhost/feed'`)),
 				pgx.RowToStructByName[FeedRow],
@@ -365,6 +693,35 @@ VALUES ('https://localhost/feed', 'TSOHLACOL', now(), 'abc123', now(), 5, 200, '
 				HaveField("ContentsMD5", BeEquivalentTo("version1hash")),
 			))
 		})
+		It("increments the failure count if the feed is an error, and resets it otherwise", func() {
+			t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			fd := &feed.Feed{
+				Url:         fp.Must(url.Parse("https://localhost/feed")),
+				HttpHeaders: map[string]string{},
+				HttpStatus:  500,
+				Body:        []byte("error"),
+				FetchedAt:   t,
+			}
+			Expect(d.CommitFeed(ctx, fs, fd, nil)).To(Succeed())
+			Expect(fd).To(And(HaveField("FailureCount", 1), HaveField("FailingSince", BeTemporally("==", t))))
+
+			fd.FetchedAt = t.Add(time.Hour)
+			Expect(d.CommitUnchanged(ctx, fd, feed.RefreshBounds{})).To(Succeed())
+			loaded := fp.Must(d.FetchContentsAsFeed(ctx, fs, fd.Url))
+			Expect(loaded).To(And(
+				HaveField("FailureCount", 2),
+				HaveField("FailingSince", BeTemporally("==", t)),
+			))
+
+			// Like a 304
+			notModified := &feed.Feed{Url: fd.Url, FetchedAt: t.Add(2 * time.Hour)}
+			Expect(d.CommitUnchanged(ctx, notModified, feed.RefreshBounds{})).To(Succeed())
+			loaded = fp.Must(d.FetchContentsAsFeed(ctx, fs, fd.Url))
+			Expect(loaded).To(And(
+				HaveField("FailureCount", 0),
+				HaveField("FailingSince", BeZero()),
+			))
+		})
 	})
 	Describe("ExpireFeed", func() {
 		It("resets the fetch-at time so TTL will be expired", func() {
@@ -0,0 +1,57 @@
+package feed
+
+import (
+	"bytes"
+	"github.com/webhookdb/icalproxy/ical"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"mime"
+	"unicode/utf8"
+)
+
+// NormalizeBody converts a successful origin body to what we claim to serve in CalendarContentType:
+// it is transcoded to UTF-8 and, if it is a calendar, its lines are repaired with ical.Normalize.
+// The encoding comes from a byte order mark, then the charset of contentType, and otherwise is detected.
+func NormalizeBody(body []byte, contentType string) []byte {
+	body = toUTF8(body, contentType)
+	if !IsCalendar(body) {
+		return body
+	}
+	return ical.Normalize(body)
+}
+
+func toUTF8(body []byte, contentType string) []byte {
+	switch {
+	case bytes.HasPrefix(body, utf8BOM):
+		return body[len(utf8BOM):]
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}), bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return decodeOr(unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), body)
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		if enc, err := htmlindex.Get(params["charset"]); err == nil && enc != unicode.UTF8 {
+			return decodeOr(enc, body)
+		}
+	}
+	// Calendars start with ASCII, which in UTF-16 without a byte order mark has a NUL in every other byte.
+	if len(body) >= 2 && body[0] == 0 && body[1] != 0 {
+		return decodeOr(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), body)
+	} else if len(body) >= 2 && body[0] != 0 && body[1] == 0 {
+		return decodeOr(unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), body)
+	}
+	if utf8.Valid(body) {
+		return body
+	}
+	// Bytes that are not valid UTF-8 are almost always from Windows (or Latin-1, which it is a superset of).
+	return decodeOr(charmap.Windows1252, body)
+}
+
+// decodeOr returns body decoded with enc, or body unchanged if it cannot be decoded.
+func decodeOr(enc encoding.Encoding, body []byte) []byte {
+	b, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body
+	}
+	return b
+}
@@ -1,16 +1,21 @@
 package feed
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/pquerna/cachecontrol/cacheobject"
 	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/ical"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/types"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,40 +30,172 @@ const DefaultTTL = types.TTL(2 * time.Hour)
 
 var ErrNotModified = errors.New("feed has not been modified (cached, 304, etc)")
 
+// StatusNotCalendar is the HttpStatus of a feed whose origin returned a success,
+// but whose body is not an iCalendar (like an HTML login page or a JSON error).
+// These are treated like any other origin error, so they do not replace a stored calendar.
+const StatusNotCalendar = 598
+
+// StatusTooLarge is the HttpStatus of a feed whose origin returned a body larger than
+// FetchOptions.MaxBytes. The body is not read, so it is treated like any other origin error.
+const StatusTooLarge = 597
+
+// StatusOriginError is the HttpStatus of a feed whose origin could not be reached or read,
+// like timeouts, invalid hosts, and certificate errors.
+// (0 is dangerous because most people check status >= 400 for errors).
+const StatusOriginError = 599
+
 // TTLFor returns the TTL for the given url.URL. It uses the hostname
 // to search through config.Config IcalTTLMap.
 func TTLFor(uri *url.URL, ttlMap map[types.NormalizedHostname]types.TTL) types.TTL {
-	// Given a url hostname of foo.example.org, we want to match against ICAL_TTL_EXAMPLEORG and ICAL_TTL_FOOEXAMPLEORG
-	// Given a url hostname of example.org, we want to match against ICAL_TTL_EXAMPLEORG
-	// So check to see that the url hostname ends with the 'env var hostname'
 	cleanHostname := types.NormalizeURLHostname(uri)
 	result := DefaultTTL
 	for envHostname, d := range ttlMap {
-		// FOOEXAMPLEORG, EXAMPLEORG, etc check to match they end with EXAMPLEORG
-		if strings.HasSuffix(string(cleanHostname), string(envHostname)) {
-			if d < result {
-				result = d
-			}
+		if hostMatches(cleanHostname, envHostname) && d < result {
+			result = d
 		}
 	}
 	return result
 }
 
+// MaxBytesFor returns the maximum body size for the given url.
+// It is the value for the most specific matching host in maxBytesMap,
+// or defaultMaxBytes if no host matches. 0 is no limit.
+func MaxBytesFor(uri *url.URL, defaultMaxBytes int64, maxBytesMap map[types.NormalizedHostname]int64) int64 {
+	if _, n, ok := mostSpecificMatch(types.NormalizeURLHostname(uri), maxBytesMap); ok {
+		return n
+	}
+	return defaultMaxBytes
+}
+
+// hostMatches returns true if the hostname is configured by the env var hostname.
+// Given a url hostname of foo.example.org, we want to match against ICAL_TTL_EXAMPLEORG and ICAL_TTL_FOOEXAMPLEORG
+// Given a url hostname of example.org, we want to match against ICAL_TTL_EXAMPLEORG
+// So check to see that the url hostname ends with the 'env var hostname'.
+func hostMatches(hostname, envHostname types.NormalizedHostname) bool {
+	return strings.HasSuffix(string(hostname), string(envHostname))
+}
+
+// mostSpecificMatch returns the longest host in m that matches the hostname, and its value.
+func mostSpecificMatch[T any](hostname types.NormalizedHostname, m map[types.NormalizedHostname]T) (types.NormalizedHostname, T, bool) {
+	var result T
+	var match types.NormalizedHostname
+	found := false
+	for envHostname, v := range m {
+		if hostMatches(hostname, envHostname) && (!found || len(envHostname) > len(match)) {
+			match, result, found = envHostname, v, true
+		}
+	}
+	return match, result, found
+}
+
+// DefaultVolatileProperties are iCalendar properties that many providers regenerate on every request,
+// so are ignored when deciding if a feed has changed in a meaningful way.
+// Additional properties can be ignored per-host, see VolatilePropertiesFor.
+var DefaultVolatileProperties = []string{"DTSTAMP", "LAST-MODIFIED"}
+
+// VolatilePropertiesFor returns the properties to ignore when fingerprinting a feed at the given url.
+// This is DefaultVolatileProperties, plus the properties for every matching host in the map
+// (matched the same way as TTLFor).
+func VolatilePropertiesFor(uri *url.URL, volatileMap map[types.NormalizedHostname][]string) []string {
+	cleanHostname := types.NormalizeURLHostname(uri)
+	result := append([]string{}, DefaultVolatileProperties...)
+	for envHostname, props := range volatileMap {
+		if hostMatches(cleanHostname, envHostname) {
+			result = append(result, props...)
+		}
+	}
+	return result
+}
+
+// Fingerprint returns a hash of the semantic content of an iCalendar body,
+// which is stable across reordering of components and properties,
+// and changes to the given volatile properties.
+// If the body is not a valid calendar, return an empty string,
+// which callers should treat as 'compare bodies byte-for-byte instead'.
+func Fingerprint(body []byte, volatileProperties []string) types.MD5Hash {
+	cal, err := ical.Parse(body)
+	if err != nil {
+		return ""
+	}
+	return internal.MD5HashHex(cal.Canonical(volatileProperties...))
+}
+
 type Feed struct {
 	Url         *url.URL
 	HttpHeaders map[string]string
 	HttpStatus  int
 	Body        []byte
 	MD5         types.MD5Hash
-	FetchedAt   time.Time
+	// Fingerprint is the semantic hash of Body. See Fingerprint.
+	Fingerprint types.MD5Hash
+	// Validation is the result of validating Body as iCalendar. See ical.Validate.
+	// It is nil for error feeds, and feeds stored before validation was added.
+	Validation *ical.Validation
+	FetchedAt  time.Time
+	// FailureCount is the number of fetches in a row that have failed, as stored.
+	// It is only set for feeds that have been committed or loaded from the database.
+	FailureCount int
+	// FailingSince is when the first of those failures was, or zero if FailureCount is 0.
+	FailingSince time.Time
+	// RetryAfter is when the origin asked to be fetched again, if it responded with a 429 or 503
+	// and a Retry-After header. Zero otherwise. See ParseRetryAfter.
+	RetryAfter time.Time
 }
 
+// SetBody sets the body, its hashes, and its validation (if HttpStatus is not an error).
+// The fingerprint uses DefaultVolatileProperties;
+// call SetFingerprint to use host-specific volatile properties.
 func (f *Feed) SetBody(body []byte) {
 	f.Body = body
 	f.MD5 = internal.MD5HashHex(body)
+	f.Fingerprint = Fingerprint(body, DefaultVolatileProperties)
+	f.Validation = nil
+	if f.HttpStatus < 400 {
+		f.Validation = ical.Validate(body)
+	}
+}
+
+// SetFingerprint recalculates Fingerprint using the volatile properties configured for the feed's host.
+func (f *Feed) SetFingerprint(volatileMap map[types.NormalizedHostname][]string) {
+	f.Fingerprint = Fingerprint(f.Body, VolatilePropertiesFor(f.Url, volatileMap))
+}
+
+type FetchOptions struct {
+	// MaxBytes is the largest body to read. If the origin sends more,
+	// the feed has StatusTooLarge. 0 is no limit.
+	MaxBytes int64
+	// Headers are added to the origin request, like credentials (see package credentials).
+	// They must never be logged or stored.
+	Headers map[string]string
+	// ByteBudget limits the size of bodies read across all fetches at the same time.
+	// Each fetch reserves its Content-Length, or MaxBytes if that is unknown. nil is no limit.
+	ByteBudget *ByteBudget
+	// Allowlist is the hosts and networks that may be requested even though they are otherwise blocked,
+	// like loopback or private addresses (see BlockedAddrReason).
+	Allowlist types.OriginAllowlist
+}
+
+// OptionsFor returns the FetchOptions configured for the given url.
+func OptionsFor(uri *url.URL, cfg config.Config) *FetchOptions {
+	return &FetchOptions{
+		MaxBytes:  MaxBytesFor(uri, cfg.MaxFeedBytes, cfg.IcalMaxBytesMap),
+		Allowlist: cfg.OriginAllowlist,
+	}
 }
 
-func Fetch(ctx context.Context, u *url.URL, previousHeaders HeaderMap) (*Feed, error) {
+// Fetch fetches the feed from origin. If previousHeaders are given, make a conditional request,
+// and return ErrNotModified if the feed has not changed.
+// Origin errors are not returned as errors, but as a feed with an error HttpStatus.
+// If the origin address is not allowed, return ErrOriginForbidden, along with a feed with StatusOriginForbidden.
+// If opts is nil, use the defaults.
+//
+// The whole body is read into memory, since it is normalized, fingerprinted, validated, and indexed
+// before it is stored. Its size is bounded by FetchOptions.MaxBytes, and FetchOptions.ByteBudget
+// bounds the total across fetches; streaming the body to feedstorage has not been done yet.
+func Fetch(ctx context.Context, u *url.URL, previousHeaders HeaderMap, opts *FetchOptions) (*Feed, error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
 	now := time.Now().Truncate(time.Second)
 	fd := &Feed{
 		Url:         u,
@@ -68,7 +205,11 @@ func Fetch(ctx context.Context, u *url.URL, previousHeaders HeaderMap) (*Feed, e
 	if previousHeaders != nil && feedStillCached(previousHeaders, now) {
 		return fd, ErrNotModified
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	reqCtx := withAllowlist(ctx, opts.Allowlist)
+	if len(opts.Headers) > 0 {
+		reqCtx = context.WithValue(reqCtx, optionHeadersKey{}, opts.Headers)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +217,9 @@ func Fetch(ctx context.Context, u *url.URL, previousHeaders HeaderMap) (*Feed, e
 	// Some hosts (hostfully.com) require text/calendar listed specifically in the Accept header.
 	// Everyone else is fine with */*.
 	req.Header.Set("Accept", "text/calendar,*/*")
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
+	}
 	// Pass conditional get headers if we have them
 	if previousHeaders != nil {
 		if etag, ok := previousHeaders["Etag"]; ok {
@@ -86,33 +230,89 @@ func Fetch(ctx context.Context, u *url.URL, previousHeaders HeaderMap) (*Feed, e
 		}
 	}
 	resp, err := httpClient.Do(req)
-	if isOriginBasedError(err) {
+	if errors.Is(err, ErrOriginForbidden) {
+		fd.HttpStatus = StatusOriginForbidden
+		fd.SetBody([]byte(err.Error()))
+		return fd, err
+	} else if isOriginBasedError(err) {
 		// These are timeouts, invalid hosts, etc. We should treat these like normal HTTP errors,
-		// but with a special 599 status code (0 is dangerous because most people check status >= 400 for errors).
-		fd.HttpStatus = 599
+		// but with a special status code.
+		fd.HttpStatus = StatusOriginError
 		fd.SetBody([]byte(err.Error()))
 		return fd, nil
 	} else if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotModified {
 		return fd, ErrNotModified
 	}
 	fd.HttpStatus = resp.StatusCode
 	fd.HttpHeaders = HeadersToMap(resp.Header)
-	b, err := internal.ReadAllWithContext(ctx, resp.Body)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		fd.RetryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"), now)
+	}
+	tooLarge := func() (*Feed, error) {
+		fd.HttpStatus = StatusTooLarge
+		// The origin's headers describe a body we are not serving.
+		fd.HttpHeaders = make(map[string]string)
+		fd.SetBody([]byte(fmt.Sprintf("response body is larger than the limit of %d bytes", opts.MaxBytes)))
+		return fd, nil
+	}
+	// Check Content-Length so we can avoid reading at all, but it may be missing or wrong
+	// (and is the compressed size), so also limit what is read.
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return tooLarge()
+	}
+	reserve := opts.MaxBytes
+	if resp.ContentLength >= 0 && (reserve == 0 || resp.ContentLength < reserve) {
+		reserve = resp.ContentLength
+	}
+	releaseBytes, err := opts.ByteBudget.Reserve(ctx, reserve)
+	if err != nil {
+		fd.HttpStatus = StatusOriginError
+		fd.SetBody([]byte("error waiting to read body: " + err.Error()))
+		return fd, nil
+	}
+	defer releaseBytes()
+	body := io.Reader(resp.Body)
+	if opts.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, opts.MaxBytes+1)
+	}
+	b, err := internal.ReadAllWithContext(ctx, body)
+	if err == nil && opts.MaxBytes > 0 && int64(len(b)) > opts.MaxBytes {
+		return tooLarge()
+	}
 	if err != nil {
 		// If reading the body fails, we need to record an error, even if the HTTP response was a success.
 		if fd.HttpStatus < 400 {
-			fd.HttpStatus = 599
+			fd.HttpStatus = StatusOriginError
 		}
 		fd.SetBody([]byte("error reading body: " + err.Error()))
 		return fd, nil
 	}
+	if fd.HttpStatus < 400 {
+		b = NormalizeBody(b, fd.HttpHeaders["Content-Type"])
+	}
+	if fd.HttpStatus < 400 && !IsCalendar(b) {
+		// Keep the body (and Content-Type), so the caller can see what origin sent instead.
+		fd.HttpStatus = StatusNotCalendar
+	}
 	fd.SetBody(b)
 	return fd, nil
 }
 
+// IsCalendar returns true if the body starts with BEGIN:VCALENDAR,
+// ignoring any byte order mark and leading whitespace.
+func IsCalendar(body []byte) bool {
+	body = bytes.TrimPrefix(body, utf8BOM)
+	body = bytes.TrimLeft(body, " \t\r\n")
+	const begin = "BEGIN:VCALENDAR"
+	return len(body) >= len(begin) && strings.EqualFold(string(body[:len(begin)]), begin)
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
 func feedStillCached(h HeaderMap, now time.Time) bool {
 	date, err := http.ParseTime(h["Date"])
 	if err != nil {
@@ -130,6 +330,36 @@ func feedStillCached(h HeaderMap, now time.Time) bool {
 	return now.Before(cacheUntil)
 }
 
+// ParseRetryAfter returns the time a Retry-After header value (in seconds, or an HTTP date) asks to retry after,
+// capped at maximumRetryAfter from now. Returns zero if the value is empty, invalid, or not after now.
+func ParseRetryAfter(value string, now time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	var t time.Time
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs <= 0 {
+			return time.Time{}
+		}
+		t = now.Add(min(time.Duration(secs), maximumRetryAfter/time.Second) * time.Second)
+	} else if d, err := http.ParseTime(value); err == nil {
+		t = d
+	} else {
+		return time.Time{}
+	}
+	if !t.After(now) {
+		return time.Time{}
+	}
+	if latest := now.Add(maximumRetryAfter); t.After(latest) {
+		t = latest
+	}
+	return t
+}
+
+// Upper bound on Retry-After, so a misbehaving origin cannot stop its feeds from being refreshed.
+var maximumRetryAfter = 24 * time.Hour
+
 // When checking Cache-Control max-age, use this as upper bound on max-age.
 // There are feeds, like sports teach schedules, that may give
 // immutable values (20 years, etc) that clearly are incorrect.
@@ -160,6 +390,10 @@ func New(url *url.URL, headers map[string]string, httpStatus int, body []byte, f
 	}
 	hash := md5.Sum(body)
 	f.MD5 = types.MD5Hash(hex.EncodeToString(hash[:]))
+	f.Fingerprint = Fingerprint(body, DefaultVolatileProperties)
+	if httpStatus < 400 {
+		f.Validation = ical.Validate(body)
+	}
 	return f
 }
 
@@ -182,8 +416,30 @@ var httpClient IHttpClient = &http.Client{}
 func init() {
 	httpClient = &http.Client{
 		// This should be overridden by passing a context timeout, like refresher does
-		Timeout: time.Minute,
+		Timeout:       time.Minute,
+		Transport:     newTransport(),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+type optionHeadersKey struct{}
+
+// checkRedirect removes the FetchOptions Headers (like credentials) from redirects to a different host
+// than the original request, since the client copies all headers to redirects,
+// and only removes the standard sensitive ones (like Authorization).
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	// Same limit as the default policy.
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host == via[0].URL.Host {
+		return nil
+	}
+	headers, _ := req.Context().Value(optionHeadersKey{}).(map[string]string)
+	for k := range headers {
+		req.Header.Del(k)
 	}
+	return nil
 }
 
 // WithHttpClient temporarily sets the http client used for fetching.
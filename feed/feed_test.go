@@ -9,10 +9,13 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"github.com/webhookdb/icalproxy/config"
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/fp"
 	"github.com/webhookdb/icalproxy/types"
+	"math"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"testing"
 	"time"
@@ -49,7 +52,318 @@ var _ = Describe("feed", func() {
 		})
 	})
 
+	Describe("MaxBytesFor", func() {
+		maxBytesMap := map[types.NormalizedHostname]int64{
+			"WEBHOOKDBCOM":    100,
+			"SUBWEBHOOKDBCOM": 0,
+		}
+		It("returns the value of the most specific matching host, or the default", func() {
+			Expect(feed.MaxBytesFor(fp.Must(url.Parse("https://lithic.tech/feed.ics")), 50, maxBytesMap)).To(BeEquivalentTo(50))
+			Expect(feed.MaxBytesFor(fp.Must(url.Parse("https://x.webhookdb.com/feed.ics")), 50, maxBytesMap)).To(BeEquivalentTo(100))
+			Expect(feed.MaxBytesFor(fp.Must(url.Parse("https://sub.webhookdb.com/feed.ics")), 50, maxBytesMap)).To(BeEquivalentTo(0))
+		})
+	})
+
+	Describe("ParseRetryAfter", func() {
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		It("parses seconds and HTTP dates", func() {
+			Expect(feed.ParseRetryAfter("120", now)).To(Equal(now.Add(2 * time.Minute)))
+			Expect(feed.ParseRetryAfter(" 120 ", now)).To(Equal(now.Add(2 * time.Minute)))
+			Expect(feed.ParseRetryAfter("Mon, 01 Jan 2024 01:00:00 GMT", now)).To(BeTemporally("==", now.Add(time.Hour)))
+		})
+		It("caps the time at 24 hours", func() {
+			Expect(feed.ParseRetryAfter("9999999999999", now)).To(Equal(now.Add(24 * time.Hour)))
+			Expect(feed.ParseRetryAfter("Mon, 01 Jan 2035 00:00:00 GMT", now)).To(BeTemporally("==", now.Add(24*time.Hour)))
+		})
+		It("returns zero for empty, invalid, and past values", func() {
+			Expect(feed.ParseRetryAfter("", now)).To(BeZero())
+			Expect(feed.ParseRetryAfter("soon", now)).To(BeZero())
+			Expect(feed.ParseRetryAfter("0", now)).To(BeZero())
+			Expect(feed.ParseRetryAfter("-5", now)).To(BeZero())
+			Expect(feed.ParseRetryAfter("Sun, 31 Dec 2023 00:00:00 GMT", now)).To(BeZero())
+		})
+	})
+
+	Describe("RefreshBoundsFor", func() {
+		It("uses the host TTL as the minimum, and the most specific max TTL", func() {
+			cfg := config.Config{
+				IcalTTLMap:        map[types.NormalizedHostname]types.TTL{"WEBHOOKDBCOM": types.TTL(time.Minute)},
+				IcalMaxTTLMap:     map[types.NormalizedHostname]types.TTL{"WEBHOOKDBCOM": types.TTL(time.Hour), "SUBWEBHOOKDBCOM": types.TTL(2 * time.Hour)},
+				MaxTTL:            24 * time.Hour,
+				RefreshMaxBackoff: 12 * time.Hour,
+			}
+			Expect(feed.RefreshBoundsFor(fp.Must(url.Parse("https://lithic.tech/feed.ics")), cfg)).To(Equal(
+				feed.RefreshBounds{Min: time.Duration(feed.DefaultTTL), Max: 24 * time.Hour, MaxBackoff: 12 * time.Hour}))
+			Expect(feed.RefreshBoundsFor(fp.Must(url.Parse("https://x.webhookdb.com/feed.ics")), cfg)).To(Equal(
+				feed.RefreshBounds{Min: time.Minute, Max: time.Hour, MaxBackoff: 12 * time.Hour}))
+			Expect(feed.RefreshBoundsFor(fp.Must(url.Parse("https://sub.webhookdb.com/feed.ics")), cfg)).To(Equal(
+				feed.RefreshBounds{Min: time.Minute, Max: 2 * time.Hour, MaxBackoff: 12 * time.Hour}))
+		})
+	})
+
+	Describe("RefreshBounds", func() {
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		b := feed.RefreshBounds{Min: 30 * time.Minute, Max: 24 * time.Hour, MaxBackoff: 3 * time.Hour}
+		It("uses the minimum if the change history is not known", func() {
+			Expect(b.Interval(feed.ChangeHistory{}, now)).To(Equal(30 * time.Minute))
+		})
+		It("checks twice as often as the feed is expected to change, within the bounds", func() {
+			Expect(b.Interval(feed.ChangeHistory{ChangedAt: now, ChangeInterval: 4 * time.Hour}, now)).To(Equal(2 * time.Hour))
+			Expect(b.Interval(feed.ChangeHistory{ChangedAt: now, ChangeInterval: 10 * time.Minute}, now)).To(Equal(30 * time.Minute))
+			Expect(b.Interval(feed.ChangeHistory{ChangedAt: now, ChangeInterval: 30 * 24 * time.Hour}, now)).To(Equal(24 * time.Hour))
+		})
+		It("slows down when the feed has not changed for longer than expected", func() {
+			h := feed.ChangeHistory{ChangedAt: now.Add(-10 * time.Hour), ChangeInterval: 4 * time.Hour}
+			Expect(b.Interval(h, now)).To(Equal(5 * time.Hour))
+			h = feed.ChangeHistory{ChangedAt: now.Add(-2 * time.Hour)}
+			Expect(b.Interval(h, now)).To(Equal(time.Hour))
+		})
+		It("backs off exponentially from the minimum while failing, up to the max backoff", func() {
+			h := feed.ChangeHistory{ChangedAt: now, ChangeInterval: 4 * time.Hour}
+			h.FailureCount = 1
+			Expect(b.Interval(h, now)).To(Equal(time.Hour))
+			h.FailureCount = 2
+			Expect(b.Interval(h, now)).To(Equal(2 * time.Hour))
+			h.FailureCount = 3
+			Expect(b.Interval(h, now)).To(Equal(3 * time.Hour))
+			h.FailureCount = 1000
+			Expect(b.Interval(h, now)).To(Equal(3 * time.Hour))
+			huge := feed.RefreshBounds{Min: 1000 * time.Hour, MaxBackoff: math.MaxInt64}
+			Expect(huge.Interval(h, now)).To(Equal(time.Duration(math.MaxInt64)))
+		})
+		It("uses the default TTL, and does not adapt or back off, for the zero value", func() {
+			Expect(feed.RefreshBounds{}.Interval(feed.ChangeHistory{ChangedAt: now, ChangeInterval: 30 * 24 * time.Hour}, now)).To(Equal(time.Duration(feed.DefaultTTL)))
+			Expect(feed.RefreshBounds{}.Interval(feed.ChangeHistory{FailureCount: 5}, now)).To(Equal(time.Duration(feed.DefaultTTL)))
+		})
+	})
+
+	Describe("CanonicalURL", func() {
+		canonical := func(s string, sortQueryMap map[types.NormalizedHostname]bool) string {
+			return feed.CanonicalURL(fp.Must(url.Parse(s)), sortQueryMap).String()
+		}
+		It("maps webcal schemes, lowercases the host, and removes default ports and fragments", func() {
+			Expect(canonical("webcal://Example.COM/a/B.ics?X=Y#frag", nil)).To(Equal("http://example.com/a/B.ics?X=Y"))
+			Expect(canonical("webcals://example.com:443/feed", nil)).To(Equal("https://example.com/feed"))
+			Expect(canonical("HTTP://example.com:80", nil)).To(Equal("http://example.com/"))
+			Expect(canonical("https://example.com:80/feed", nil)).To(Equal("https://example.com:80/feed"))
+			Expect(canonical("https://[::1]:443/feed", nil)).To(Equal("https://[::1]/feed"))
+			Expect(canonical("https://[::1]:8443/feed", nil)).To(Equal("https://[::1]:8443/feed"))
+		})
+		It("sorts query params for configured hosts", func() {
+			m := map[types.NormalizedHostname]bool{"EXAMPLECOM": true, "NOSORTEXAMPLECOM": false}
+			Expect(canonical("https://sub.example.com/feed?b=2&a=1&b=1", m)).To(Equal("https://sub.example.com/feed?a=1&b=2&b=1"))
+			Expect(canonical("https://nosort.example.com/feed?b=2&a=1", m)).To(Equal("https://nosort.example.com/feed?b=2&a=1"))
+			Expect(canonical("https://other.com/feed?b=2&a=1", m)).To(Equal("https://other.com/feed?b=2&a=1"))
+		})
+		It("does not modify the url", func() {
+			u := fp.Must(url.Parse("webcal://EXAMPLE.com"))
+			feed.CanonicalURL(u, nil)
+			Expect(u.String()).To(Equal("webcal://EXAMPLE.com"))
+		})
+	})
+
+	Describe("VolatilePropertiesFor", func() {
+		volatileMap := map[types.NormalizedHostname][]string{
+			"WEBHOOKDBCOM":    {"X-A"},
+			"SUBWEBHOOKDBCOM": {"X-B"},
+		}
+		It("returns the default properties plus those of all matching hosts", func() {
+			Expect(feed.VolatilePropertiesFor(fp.Must(url.Parse("https://lithic.tech/feed.ics")), volatileMap)).To(Equal(feed.DefaultVolatileProperties))
+			Expect(feed.VolatilePropertiesFor(fp.Must(url.Parse("https://sub.webhookdb.com/feed.ics")), volatileMap)).To(ConsistOf(
+				"DTSTAMP", "LAST-MODIFIED", "X-A", "X-B",
+			))
+		})
+	})
+
+	Describe("Fingerprint", func() {
+		cal := func(stamp, summary string) []byte {
+			return []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTAMP:" + stamp + "\r\nSUMMARY:" + summary + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+		}
+		It("ignores volatile properties", func() {
+			a := feed.Fingerprint(cal("20240101T000000Z", "x"), feed.DefaultVolatileProperties)
+			Expect(a).ToNot(BeEmpty())
+			Expect(feed.Fingerprint(cal("20250101T000000Z", "x"), feed.DefaultVolatileProperties)).To(Equal(a))
+			Expect(feed.Fingerprint(cal("20240101T000000Z", "y"), feed.DefaultVolatileProperties)).ToNot(Equal(a))
+			Expect(feed.Fingerprint(cal("20250101T000000Z", "x"), nil)).ToNot(Equal(a))
+		})
+		It("is empty for bodies that are not calendars", func() {
+			Expect(feed.Fingerprint([]byte("hello"), feed.DefaultVolatileProperties)).To(BeEmpty())
+		})
+		It("is set by SetBody and can use host-specific properties", func() {
+			fd := &feed.Feed{Url: fp.Must(url.Parse("https://webhookdb.com/feed.ics"))}
+			fd.SetBody(cal("20240101T000000Z", "x"))
+			Expect(fd.Fingerprint).To(Equal(feed.Fingerprint(cal("20240101T000000Z", "x"), feed.DefaultVolatileProperties)))
+			fd.SetFingerprint(map[types.NormalizedHostname][]string{"WEBHOOKDBCOM": {"SUMMARY"}})
+			Expect(fd.Fingerprint).To(Equal(feed.Fingerprint(cal("20240101T000000Z", "other"), []string{"DTSTAMP", "SUMMARY"})))
+		})
+	})
+
+	Describe("NormalizeBody", func() {
+		want := "BEGIN:VCALENDAR\r\nSUMMARY:Caf\u00e9 \u2013 Cr\u00e8me\r\nEND:VCALENDAR\r\n"
+		It("transcodes using the charset of the content type", func() {
+			body := "BEGIN:VCALENDAR\r\nSUMMARY:Caf\xe9 \x96 Cr\xe8me\r\nEND:VCALENDAR\r\n"
+			Expect(string(feed.NormalizeBody([]byte(body), "text/calendar; charset=windows-1252"))).To(Equal(want))
+			Expect(string(feed.NormalizeBody([]byte(body), `text/calendar;charset="ISO-8859-1"`))).To(Equal(want))
+		})
+		It("detects Windows-1252 if the body is not valid UTF-8", func() {
+			body := "BEGIN:VCALENDAR\r\nSUMMARY:Caf\xe9 \x96 Cr\xe8me\r\nEND:VCALENDAR\r\n"
+			Expect(string(feed.NormalizeBody([]byte(body), "text/calendar; charset=utf-8"))).To(Equal(want))
+			Expect(string(feed.NormalizeBody([]byte(body), ""))).To(Equal(want))
+		})
+		It("transcodes UTF-16, with or without a byte order mark", func() {
+			le := []byte{0xFF, 0xFE}
+			be := []byte{}
+			for _, r := range want {
+				le = append(le, byte(r), byte(r>>8))
+				be = append(be, byte(r>>8), byte(r))
+			}
+			Expect(string(feed.NormalizeBody(le, "text/calendar"))).To(Equal(want))
+			Expect(string(feed.NormalizeBody(be, "text/calendar"))).To(Equal(want))
+		})
+		It("repairs line endings and folding", func() {
+			Expect(string(feed.NormalizeBody([]byte("\xEF\xBB\xBFBEGIN:VCALENDAR\nSUMMARY:Caf\u00e9 \u2013 Cr\u00e8me\nEND:VCALENDAR"), ""))).To(Equal(want))
+		})
+		It("does not change valid bodies, or bodies that are not calendars", func() {
+			Expect(string(feed.NormalizeBody([]byte(want), "text/calendar; charset=utf-8"))).To(Equal(want))
+			Expect(string(feed.NormalizeBody([]byte("<html>\n</html>"), "text/html"))).To(Equal("<html>\n</html>"))
+		})
+	})
+
+	Describe("ByteBudget", func() {
+		It("waits until enough bytes are released", func() {
+			b := feed.NewByteBudget(100)
+			release60 := fp.Must(b.Reserve(ctx, 60))
+			release40 := fp.Must(b.Reserve(ctx, 40))
+
+			waited := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				release := fp.Must(b.Reserve(ctx, 50))
+				close(waited)
+				release()
+			}()
+			Consistently(waited, "50ms").ShouldNot(BeClosed())
+			release40()
+			Consistently(waited, "50ms").ShouldNot(BeClosed())
+			release60()
+			// Releasing more than once does nothing
+			release60()
+			Eventually(waited).Should(BeClosed())
+		})
+		It("lets reservations larger than the total run alone", func() {
+			b := feed.NewByteBudget(100)
+			release := fp.Must(b.Reserve(ctx, 1000))
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := b.Reserve(timeoutCtx, 1)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			release()
+			Expect(b.Reserve(ctx, 100)).ToNot(BeNil())
+		})
+		It("does not limit if nil", func() {
+			b := feed.NewByteBudget(0)
+			Expect(b).To(BeNil())
+			Expect(b.Reserve(ctx, 1000)).ToNot(BeNil())
+		})
+	})
+	Describe("HostLimiter", func() {
+		newLimiter := func(concurrency int, concurrencyMap map[types.NormalizedHostname]int, spacingMap map[types.NormalizedHostname]time.Duration) *feed.HostLimiter {
+			return feed.NewHostLimiter(config.Config{HostConcurrency: concurrency, IcalConcurrencyMap: concurrencyMap, IcalSpacingMap: spacingMap})
+		}
+		u := func(s string) *url.URL { return fp.Must(url.Parse(s)) }
+
+		It("limits concurrent requests to the same host", func() {
+			l := newLimiter(1, nil, nil)
+			release := fp.Must(l.Acquire(ctx, u("https://a.com/1.ics")))
+			// Other hosts are not affected.
+			fp.Must(l.Acquire(ctx, u("https://b.com/1.ics")))()
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			_, err := l.Acquire(timeoutCtx, u("https://a.com/2.ics"))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+
+			release()
+			release()
+			fp.Must(l.Acquire(ctx, u("https://a.com/2.ics")))()
+		})
+		It("limits all subdomains of the most specific configured host together", func() {
+			l := newLimiter(0, map[types.NormalizedHostname]int{"ICLOUDCOM": 1, "P02ICLOUDCOM": 5}, nil)
+			release := fp.Must(l.Acquire(ctx, u("https://p01.icloud.com/1.ics")))
+			defer release()
+			timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			_, err := l.Acquire(timeoutCtx, u("https://p03.icloud.com/1.ics"))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			fp.Must(l.Acquire(ctx, u("https://p02.icloud.com/1.ics")))()
+			// 0 is no limit.
+			for i := 0; i < 3; i++ {
+				defer fp.Must(l.Acquire(ctx, u("https://a.com/1.ics")))()
+			}
+		})
+		It("spaces out the start of requests", func() {
+			l := newLimiter(0, nil, map[types.NormalizedHostname]time.Duration{"ACOM": 50 * time.Millisecond})
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				fp.Must(l.Acquire(ctx, u("https://x.a.com/1.ics")))()
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := l.Acquire(timeoutCtx, u("https://a.com/1.ics"))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+		It("hands back the spacing of requests that are canceled while waiting", func() {
+			l := newLimiter(0, nil, map[types.NormalizedHostname]time.Duration{"ACOM": 200 * time.Millisecond})
+			start := time.Now()
+			fp.Must(l.Acquire(ctx, u("https://a.com/1.ics")))()
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := l.Acquire(timeoutCtx, u("https://a.com/2.ics"))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+
+			fp.Must(l.Acquire(ctx, u("https://a.com/3.ics")))()
+			Expect(time.Since(start)).To(And(
+				BeNumerically(">=", 200*time.Millisecond),
+				BeNumerically("<", 350*time.Millisecond),
+			))
+		})
+		It("has no limits if nil", func() {
+			var l *feed.HostLimiter
+			fp.Must(l.Acquire(ctx, u("https://a.com/1.ics")))()
+		})
+	})
+
+	Describe("BlockedAddrReason", func() {
+		It("blocks private, loopback, link-local, and reserved addresses", func() {
+			for addr, reason := range map[string]string{
+				"127.0.0.1":            "loopback",
+				"::1":                  "loopback",
+				"::ffff:127.0.0.1":     "loopback",
+				"10.1.2.3":             "private",
+				"172.16.0.1":           "private",
+				"192.168.1.1":          "private",
+				"fd00::1":              "private",
+				"169.254.169.254":      "link-local",
+				"fe80::1":              "link-local",
+				"0.0.0.0":              "unspecified",
+				"100.100.100.200":      "reserved",
+				"255.255.255.255":      "reserved",
+				"239.1.2.3":            "multicast",
+				"8.8.8.8":              "",
+				"2606:4700::6810:84e5": "",
+			} {
+				Expect(feed.BlockedAddrReason(netip.MustParseAddr(addr))).To(Equal(reason), addr)
+			}
+		})
+	})
+
 	Describe("Fetch", func() {
+		calBody := "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"
+		// ghttp servers listen on loopback, which is blocked by default.
+		localOpts := &feed.FetchOptions{Allowlist: fp.Must(types.ParseOriginAllowlist([]string{"127.0.0.1"}))}
 		var server *ghttp.Server
 		BeforeEach(func() {
 			server = ghttp.NewServer()
@@ -62,16 +376,183 @@ var _ = Describe("feed", func() {
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/feed.ics", ""),
 					ghttp.VerifyHeaderKV("Accept", "text/calendar,*/*"),
-					ghttp.RespondWith(200, "hi"),
+					ghttp.RespondWith(200, calBody),
 				))
-			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(feed).To(And(
 				HaveField("HttpStatus", 200),
-				HaveField("Body", BeEquivalentTo("hi")),
-				HaveField("MD5", BeEquivalentTo("49f68a5c8493ec2c0bf489821c21fc3b")),
+				HaveField("Body", BeEquivalentTo(calBody)),
+				HaveField("MD5", BeEquivalentTo("11e703821cd191c587e9c854a193f98e")),
 			))
 		})
+		It("sends the headers from the options", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer abc"),
+					ghttp.VerifyHeaderKV("X-Calendar-Token", "xyz"),
+					ghttp.RespondWith(200, calBody),
+				))
+			opts := &feed.FetchOptions{Headers: map[string]string{"Authorization": "Bearer abc", "X-Calendar-Token": "xyz"}, Allowlist: localOpts.Allowlist}
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(feed).To(HaveField("HttpStatus", 200))
+		})
+		It("records an origin error if the body cannot be reserved in the byte budget", func() {
+			server.AppendHandlers(ghttp.RespondWith(200, calBody))
+			budget := feed.NewByteBudget(10)
+			release := fp.Must(budget.Reserve(ctx, 10))
+			defer release()
+			timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			opts := &feed.FetchOptions{ByteBudget: budget, Allowlist: localOpts.Allowlist}
+			fd, err := feed.Fetch(timeoutCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fd).To(HaveField("HttpStatus", feed.StatusOriginError))
+			Expect(string(fd.Body)).To(HavePrefix("error waiting to read body"))
+		})
+		It("does not send the headers from the options to redirects to other hosts", func() {
+			other := ghttp.NewServer()
+			defer other.Close()
+			other.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/other.ics", ""),
+					func(w http.ResponseWriter, r *http.Request) {
+						Expect(r.Header).ToNot(HaveKey("Authorization"))
+						Expect(r.Header).ToNot(HaveKey("X-Calendar-Token"))
+					},
+					ghttp.RespondWith(200, calBody),
+				))
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeaderKV("X-Calendar-Token", "xyz"),
+					ghttp.RespondWith(302, "", http.Header{"Location": {"/same.ics"}}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/same.ics", ""),
+					// Redirects to the same host keep them
+					ghttp.VerifyHeaderKV("X-Calendar-Token", "xyz"),
+					ghttp.RespondWith(302, "", http.Header{"Location": {other.URL() + "/other.ics"}}),
+				),
+			)
+			opts := &feed.FetchOptions{Headers: map[string]string{"Authorization": "Bearer abc", "X-Calendar-Token": "xyz"}, Allowlist: localOpts.Allowlist}
+			fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fd).To(HaveField("HttpStatus", 200))
+			Expect(other.ReceivedRequests()).To(HaveLen(1))
+		})
+		Describe("with a blocked origin address", func() {
+			It("returns ErrOriginForbidden without making a request", func() {
+				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, nil)
+				Expect(err).To(MatchError(feed.ErrOriginForbidden))
+				Expect(err).To(MatchError(ContainSubstring("127.0.0.1 is loopback")))
+				Expect(fd).To(HaveField("HttpStatus", feed.StatusOriginForbidden))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+			It("checks the address of the resolved host", func() {
+				u := fp.Must(url.Parse(server.URL()))
+				u.Host = "localhost:" + u.Port()
+				_, err := feed.Fetch(ctx, u, nil, nil)
+				Expect(err).To(MatchError(ContainSubstring("localhost resolves to")))
+			})
+			It("can allow hosts by name", func() {
+				server.AppendHandlers(ghttp.RespondWith(200, calBody))
+				u := fp.Must(url.Parse(server.URL()))
+				u.Host = "localhost:" + u.Port()
+				opts := &feed.FetchOptions{Allowlist: fp.Must(types.ParseOriginAllowlist([]string{"localhost"}))}
+				fd, err := feed.Fetch(ctx, u, nil, opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fd).To(HaveField("HttpStatus", 200))
+			})
+			It("checks redirects", func() {
+				blocked := ghttp.NewServer()
+				defer blocked.Close()
+				// Allow the first server by name, and have it redirect to the other by its address.
+				server.AppendHandlers(ghttp.RespondWith(302, nil, http.Header{"Location": {blocked.URL()}}))
+				u := fp.Must(url.Parse(server.URL()))
+				u.Host = "localhost:" + u.Port()
+				opts := &feed.FetchOptions{Allowlist: fp.Must(types.ParseOriginAllowlist([]string{"localhost"}))}
+				fd, err := feed.Fetch(ctx, u, nil, opts)
+				Expect(err).To(MatchError(feed.ErrOriginForbidden))
+				Expect(fd).To(HaveField("HttpStatus", feed.StatusOriginForbidden))
+				Expect(blocked.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+		It("normalizes the body", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, "BEGIN:VCALENDAR\nSUMMARY:Caf\xe9\nEND:VCALENDAR\n", http.Header{"Content-Type": {"text/calendar; charset=iso-8859-1"}}),
+				),
+			)
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(feed).To(And(
+				HaveField("HttpStatus", 200),
+				HaveField("Body", BeEquivalentTo("BEGIN:VCALENDAR\r\nSUMMARY:Caf\u00e9\r\nEND:VCALENDAR\r\n")),
+			))
+		})
+		It("returns the feed as an error if a success is not a calendar", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, "<html>Log in</html>", http.Header{"Content-Type": {"text/html"}}),
+				),
+			)
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(feed).To(And(
+				HaveField("HttpStatus", 598),
+				HaveField("Body", BeEquivalentTo("<html>Log in</html>")),
+				HaveField("HttpHeaders", HaveKeyWithValue("Content-Type", "text/html")),
+				HaveField("Validation", BeNil()),
+			))
+		})
+		It("allows a byte order mark and whitespace before the calendar", func() {
+			body := "\xEF\xBB\xBF\r\n  begin:vcalendar\r\nEND:VCALENDAR\r\n"
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, body),
+				),
+			)
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(feed).To(HaveField("HttpStatus", 200))
+		})
+		Describe("with a maximum body size", func() {
+			opts := &feed.FetchOptions{MaxBytes: int64(len(calBody)), Allowlist: localOpts.Allowlist}
+
+			It("reads bodies up to the limit", func() {
+				server.AppendHandlers(ghttp.RespondWith(200, calBody))
+				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fd).To(HaveField("HttpStatus", 200))
+			})
+			It("returns a too large error if Content-Length is over the limit", func() {
+				server.AppendHandlers(ghttp.RespondWith(200, calBody+" ", http.Header{"Content-Type": {"text/calendar"}}))
+				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fd).To(And(
+					HaveField("HttpStatus", feed.StatusTooLarge),
+					HaveField("Body", BeEquivalentTo("response body is larger than the limit of 32 bytes")),
+					HaveField("HttpHeaders", BeEmpty()),
+				))
+			})
+			It("returns a too large error if more than the limit is read", func() {
+				// Without a Content-Length, like a chunked or compressed response.
+				server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(200)
+					_, _ = w.Write([]byte(calBody))
+					w.(http.Flusher).Flush()
+					_, _ = w.Write([]byte(calBody))
+				})
+				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fd).To(HaveField("HttpStatus", feed.StatusTooLarge))
+			})
+		})
 		It("returns the feed in the case of an http error", func() {
 			server.AppendHandlers(
 				ghttp.CombineHandlers(
@@ -79,13 +560,30 @@ var _ = Describe("feed", func() {
 					ghttp.RespondWith(403, "hi"),
 				),
 			)
-			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+			feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(feed).To(And(
 				HaveField("HttpStatus", 403),
 				HaveField("Body", BeEquivalentTo("hi")),
+				HaveField("RetryAfter", BeZero()),
 			))
 		})
+		It("returns when to retry a rate limited or unavailable origin", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(429, "slow down", http.Header{"Retry-After": {"120"}}),
+				ghttp.RespondWith(503, "down", http.Header{"Retry-After": {"Wed, 21 Oct 2099 07:28:00 GMT"}}),
+				ghttp.RespondWith(500, "oops", http.Header{"Retry-After": {"120"}}),
+			)
+			uri := fp.Must(url.Parse(server.URL() + "/feed.ics"))
+			fd := fp.Must(feed.Fetch(ctx, uri, nil, localOpts))
+			Expect(fd.HttpStatus).To(Equal(429))
+			Expect(fd.RetryAfter).To(BeTemporally("~", time.Now().Add(2*time.Minute), 2*time.Second))
+			fd = fp.Must(feed.Fetch(ctx, uri, nil, localOpts))
+			// Capped
+			Expect(fd.RetryAfter).To(BeTemporally("~", time.Now().Add(24*time.Hour), 2*time.Second))
+			fd = fp.Must(feed.Fetch(ctx, uri, nil, localOpts))
+			Expect(fd.RetryAfter).To(BeZero())
+		})
 		It("returns the feed in the case of a url error (http timeout, etc)", func() {
 			server.AppendHandlers(
 				ghttp.CombineHandlers(
@@ -98,7 +596,7 @@ var _ = Describe("feed", func() {
 			)
 			timeoutCtx, cancel := context.WithTimeout(ctx, 0)
 			defer cancel()
-			feed, err := feed.Fetch(timeoutCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+			feed, err := feed.Fetch(timeoutCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(feed).To(And(
 				HaveField("HttpStatus", 599),
@@ -108,7 +606,7 @@ var _ = Describe("feed", func() {
 		It("returns the feed in the case of a certificate error", func() {
 			certErr := x509.SystemRootsError{Err: errors.New("bad cert")}
 			Expect(feed.WithHttpClient(&erroringHttpClient{Err: certErr}, func() error {
-				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(feed).To(And(
 					HaveField("HttpStatus", 599),
@@ -119,7 +617,7 @@ var _ = Describe("feed", func() {
 
 			wrappedErr := fmt.Errorf("wrapped: %w", certErr)
 			Expect(feed.WithHttpClient(&erroringHttpClient{Err: wrappedErr}, func() error {
-				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(feed).To(And(
 					HaveField("HttpStatus", 599),
@@ -145,7 +643,7 @@ var _ = Describe("feed", func() {
 						cancel()
 					},
 				))
-			feed, err := feed.Fetch(cancelCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+			feed, err := feed.Fetch(cancelCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(feed).To(And(
 				HaveField("HttpStatus", 599),
@@ -166,7 +664,7 @@ var _ = Describe("feed", func() {
 						cancel()
 					},
 				))
-			feed, err := feed.Fetch(cancelCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil)
+			feed, err := feed.Fetch(cancelCtx, fp.Must(url.Parse(server.URL()+"/feed.ics")), nil, localOpts)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(feed).To(And(
 				HaveField("HttpStatus", 400),
@@ -182,9 +680,9 @@ var _ = Describe("feed", func() {
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
 						ghttp.VerifyHeaderKV("If-None-Match", `"abcd"`),
-						ghttp.RespondWith(200, "hi"),
+						ghttp.RespondWith(200, calBody),
 					))
-				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Etag": `"abcd"`})
+				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Etag": `"abcd"`}, localOpts)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(feed).To(HaveField("HttpStatus", 200))
 			})
@@ -193,9 +691,9 @@ var _ = Describe("feed", func() {
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
 						ghttp.VerifyHeaderKV("If-Modified-Since", `Tue, 22 Feb 2022 22:00:00 GMT`),
-						ghttp.RespondWith(200, "hi"),
+						ghttp.RespondWith(200, calBody),
 					))
-				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Last-Modified": `Tue, 22 Feb 2022 22:00:00 GMT`})
+				feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Last-Modified": `Tue, 22 Feb 2022 22:00:00 GMT`}, localOpts)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(feed).To(HaveField("HttpStatus", 200))
 			})
@@ -205,7 +703,7 @@ var _ = Describe("feed", func() {
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
 						ghttp.RespondWith(304, ""),
 					))
-				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Etag": `xyz`})
+				fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{"Etag": `xyz`}, localOpts)
 				Expect(err).To(BeIdenticalTo(feed.ErrNotModified))
 				Expect(fd).To(HaveField("FetchedAt", BeTemporally("~", time.Now(), time.Minute)))
 			})
@@ -214,12 +712,12 @@ var _ = Describe("feed", func() {
 					server.AppendHandlers(
 						ghttp.CombineHandlers(
 							ghttp.VerifyRequest("GET", "/feed.ics", ""),
-							ghttp.RespondWith(200, "hi"),
+							ghttp.RespondWith(200, calBody),
 						))
 					feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{
 						"Date":          nowFmt,
 						"Cache-Control": `max-age=0`,
-					})
+					}, localOpts)
 					Expect(err).ToNot(HaveOccurred())
 					Expect(feed).To(HaveField("HttpStatus", 200))
 				})
@@ -227,12 +725,12 @@ var _ = Describe("feed", func() {
 					server.AppendHandlers(
 						ghttp.CombineHandlers(
 							ghttp.VerifyRequest("GET", "/feed.ics", ""),
-							ghttp.RespondWith(200, "hi"),
+							ghttp.RespondWith(200, calBody),
 						))
 					feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{
 						"Date":          "not valid",
 						"Cache-Control": "max-age=1000",
-					})
+					}, localOpts)
 					Expect(err).ToNot(HaveOccurred())
 					Expect(feed).To(HaveField("HttpStatus", 200))
 				})
@@ -240,12 +738,12 @@ var _ = Describe("feed", func() {
 					server.AppendHandlers(
 						ghttp.CombineHandlers(
 							ghttp.VerifyRequest("GET", "/feed.ics", ""),
-							ghttp.RespondWith(200, "hi"),
+							ghttp.RespondWith(200, calBody),
 						))
 					feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{
 						"Date":          nowFmt,
 						"Cache-Control": "not sure what is up here",
-					})
+					}, localOpts)
 					Expect(err).ToNot(HaveOccurred())
 					Expect(feed).To(HaveField("HttpStatus", 200))
 				})
@@ -253,7 +751,7 @@ var _ = Describe("feed", func() {
 					fd, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{
 						"Date":          nowFmt,
 						"Cache-Control": `max-age=100`,
-					})
+					}, localOpts)
 					Expect(err).To(BeIdenticalTo(feed.ErrNotModified))
 					Expect(fd).To(HaveField("FetchedAt", BeTemporally("~", time.Now(), time.Minute)))
 				})
@@ -261,12 +759,12 @@ var _ = Describe("feed", func() {
 					server.AppendHandlers(
 						ghttp.CombineHandlers(
 							ghttp.VerifyRequest("GET", "/feed.ics", ""),
-							ghttp.RespondWith(200, "hi"),
+							ghttp.RespondWith(200, calBody),
 						))
 					feed, err := feed.Fetch(ctx, fp.Must(url.Parse(server.URL()+"/feed.ics")), map[string]string{
 						"Date":          time.Now().Add(-25 * time.Hour).UTC().Format(http.TimeFormat),
 						"Cache-Control": `max-age=9999999999999`,
-					})
+					}, localOpts)
 					Expect(err).ToNot(HaveOccurred())
 					Expect(feed).To(HaveField("HttpStatus", 200))
 				})
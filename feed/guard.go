@@ -0,0 +1,116 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/webhookdb/icalproxy/types"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrOriginForbidden is returned from Fetch (along with a feed with StatusOriginForbidden)
+// when the origin, or a redirect from it, resolves to an address that origin requests may not connect to.
+// See BlockedAddrReason.
+var ErrOriginForbidden = errors.New("origin address is not allowed")
+
+// StatusOriginForbidden is the HttpStatus of a feed whose origin was not requested
+// because of ErrOriginForbidden.
+const StatusOriginForbidden = 596
+
+// blockedPrefixes are special-purpose networks not covered by the netip.Addr predicates
+// used in BlockedAddrReason.
+var blockedPrefixes = []netip.Prefix{
+	// "This network", which some systems route to the local host.
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// Carrier-grade NAT, which includes some cloud metadata services (like 100.100.100.200).
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// Reserved, including the broadcast address.
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// BlockedAddrReason returns why origin requests may not connect to the address,
+// or an empty string if they may.
+// This protects against callers using the proxy to reach internal services,
+// like cloud metadata (169.254.169.254) or hosts on a private network.
+func BlockedAddrReason(addr netip.Addr) string {
+	addr = addr.Unmap()
+	switch {
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsPrivate():
+		return "private"
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast(), addr.IsInterfaceLocalMulticast():
+		return "link-local"
+	case addr.IsMulticast():
+		return "multicast"
+	case addr.IsUnspecified():
+		return "unspecified"
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return "reserved"
+		}
+	}
+	return ""
+}
+
+type allowlistKey struct{}
+
+// withAllowlist returns a context that guardedDialer uses to allow connections to otherwise blocked addresses.
+func withAllowlist(ctx context.Context, a types.OriginAllowlist) context.Context {
+	return context.WithValue(ctx, allowlistKey{}, a)
+}
+
+// guardedDialer returns a DialContext that refuses to connect to blocked addresses (see BlockedAddrReason),
+// unless the host or address is in the OriginAllowlist of the request context.
+// The address is checked after DNS resolution, and for every connection,
+// so it applies to redirects, and hosts that resolve to different addresses over time.
+func guardedDialer(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		allowlist, _ := ctx.Value(allowlistKey{}).(types.OriginAllowlist)
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if allowlist.AllowsHost(host) {
+			return d.DialContext(ctx, network, address)
+		}
+		guarded := *d
+		guarded.Control = func(_, resolved string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(resolved)
+			if err != nil {
+				return err
+			}
+			if allowlist.AllowsAddr(ap.Addr()) {
+				return nil
+			}
+			if reason := BlockedAddrReason(ap.Addr()); reason != "" {
+				addr := ap.Addr().Unmap().String()
+				if addr == host {
+					return fmt.Errorf("%w: %s is %s", ErrOriginForbidden, addr, reason)
+				}
+				return fmt.Errorf("%w: %s resolves to %s, which is %s", ErrOriginForbidden, host, addr, reason)
+			}
+			return nil
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+}
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// Connections through a proxy would be checked against the proxy's address, not the origin's,
+	// so proxies are not supported.
+	t.Proxy = nil
+	t.DialContext = guardedDialer(&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	})
+	return t
+}
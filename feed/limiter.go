@@ -0,0 +1,194 @@
+package feed
+
+import (
+	"context"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/types"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HostLimiter limits how many requests are made to a host at the same time,
+// and how soon after each other they can start, so fetching many feeds from one provider
+// does not get us rate limited.
+//
+// Hosts are limited by the most specific host in the concurrency or spacing config that matches
+// (matched like TTLFor), so ICAL_CONCURRENCY_ICLOUDCOM limits all of p01.icloud.com, p02.icloud.com, etc. together.
+// Urls that do not match any configured host are limited by their own hostname.
+type HostLimiter struct {
+	defaultConcurrency int
+	concurrencyMap     map[types.NormalizedHostname]int
+	spacingMap         map[types.NormalizedHostname]time.Duration
+	mux                sync.Mutex
+	hosts              map[types.NormalizedHostname]*hostSlots
+}
+
+type hostSlots struct {
+	// sem has a value for each request in progress. It is nil if there is no limit.
+	sem chan struct{}
+	// next is the earliest time the next request can start.
+	next time.Time
+	// users is the number of callers holding or waiting for a slot,
+	// so the host can be forgotten when it is not in use.
+	users int
+}
+
+func NewHostLimiter(cfg config.Config) *HostLimiter {
+	return &HostLimiter{
+		defaultConcurrency: cfg.HostConcurrency,
+		concurrencyMap:     cfg.IcalConcurrencyMap,
+		spacingMap:         cfg.IcalSpacingMap,
+		hosts:              make(map[types.NormalizedHostname]*hostSlots),
+	}
+}
+
+// Acquire waits until a request can be made to the url's host, and returns a function to call
+// when the request is finished. Returns the context's error if it is done before then.
+// l may be nil, in which case there are no limits.
+func (l *HostLimiter) Acquire(ctx context.Context, uri *url.URL) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	key, concurrency, spacing := l.settingsFor(uri)
+
+	l.mux.Lock()
+	h, ok := l.hosts[key]
+	if !ok {
+		h = &hostSlots{}
+		if concurrency > 0 {
+			h.sem = make(chan struct{}, concurrency)
+		}
+		l.hosts[key] = h
+	}
+	h.users++
+	l.mux.Unlock()
+
+	done := func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		h.users--
+		if h.users == 0 && !time.Now().Before(h.next) {
+			delete(l.hosts, key)
+		}
+	}
+	if h.sem != nil {
+		// Take a free slot even if the context is done, since select picks randomly if both are ready.
+		select {
+		case h.sem <- struct{}{}:
+		default:
+			select {
+			case h.sem <- struct{}{}:
+			case <-ctx.Done():
+				done()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	release := func() {
+		if h.sem != nil {
+			<-h.sem
+		}
+		done()
+	}
+	if spacing > 0 {
+		l.mux.Lock()
+		start := time.Now()
+		if h.next.After(start) {
+			start = h.next
+		}
+		h.next = start.Add(spacing)
+		l.mux.Unlock()
+		if wait := time.Until(start); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				// Hand back the slot, so it does not delay later requests,
+				// unless another request has already been spaced out after it.
+				l.mux.Lock()
+				if h.next.Equal(start.Add(spacing)) {
+					h.next = start
+				}
+				l.mux.Unlock()
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// settingsFor returns the key the url is limited by, and its limits.
+func (l *HostLimiter) settingsFor(uri *url.URL) (types.NormalizedHostname, int, time.Duration) {
+	hostname := types.NormalizeURLHostname(uri)
+	key := hostname
+	concurrency := l.defaultConcurrency
+	var spacing time.Duration
+	keyLen := -1
+	if h, n, ok := mostSpecificMatch(hostname, l.concurrencyMap); ok {
+		concurrency = n
+		key, keyLen = h, len(h)
+	}
+	if h, d, ok := mostSpecificMatch(hostname, l.spacingMap); ok {
+		spacing = d
+		if len(h) > keyLen {
+			key = h
+		}
+	}
+	return key, concurrency, spacing
+}
+
+// ByteBudget limits the total size of origin bodies being read at the same time, across all fetches,
+// so many large fetches in parallel (like a page of the refresher) cannot use up the process's memory.
+type ByteBudget struct {
+	total int64
+	mux   sync.Mutex
+	used  int64
+	// released is closed (and replaced) whenever bytes are released, to wake up waiting callers.
+	released chan struct{}
+}
+
+// NewByteBudget returns a budget of total bytes. If total is 0, it returns nil, which is no limit.
+func NewByteBudget(total int64) *ByteBudget {
+	if total <= 0 {
+		return nil
+	}
+	return &ByteBudget{total: total, released: make(chan struct{})}
+}
+
+// Reserve waits until n bytes are available, and returns a function to call when they are no longer used.
+// Reservations larger than the total wait until nothing else is reserved.
+// Returns the context's error if it is done before then. b may be nil, in which case there is no limit.
+func (b *ByteBudget) Reserve(ctx context.Context, n int64) (func(), error) {
+	if b == nil || n <= 0 {
+		return func() {}, nil
+	}
+	n = min(n, b.total)
+	for {
+		b.mux.Lock()
+		if b.used+n <= b.total {
+			b.used += n
+			b.mux.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { b.release(n) }) }, nil
+		}
+		released := b.released
+		b.mux.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *ByteBudget) release(n int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
@@ -0,0 +1,74 @@
+package feed
+
+import (
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/types"
+	"net/url"
+	"time"
+)
+
+// RefreshBounds are the limits on how often a feed is refreshed. See Interval.
+// The zero value refreshes every DefaultTTL.
+type RefreshBounds struct {
+	// Min is the shortest time between refreshes, which is the TTL for the feed's host (see TTLFor).
+	Min time.Duration
+	// Max is the longest time between refreshes of a feed that rarely changes.
+	Max time.Duration
+	// MaxBackoff is the longest time between refreshes of a feed that keeps failing.
+	MaxBackoff time.Duration
+}
+
+// RefreshBoundsFor returns the RefreshBounds for the url.
+// Max is the most specific matching host in IcalMaxTTLMap (see mostSpecificMatch), or MaxTTL.
+func RefreshBoundsFor(uri *url.URL, cfg config.Config) RefreshBounds {
+	b := RefreshBounds{
+		Min:        time.Duration(TTLFor(uri, cfg.IcalTTLMap)),
+		Max:        cfg.MaxTTL,
+		MaxBackoff: cfg.RefreshMaxBackoff,
+	}
+	if _, ttl, ok := mostSpecificMatch(types.NormalizeURLHostname(uri), cfg.IcalMaxTTLMap); ok {
+		b.Max = time.Duration(ttl)
+	}
+	return b
+}
+
+// ChangeHistory is what is known about how often a feed has changed and failed.
+type ChangeHistory struct {
+	// ChangedAt is when the feed contents were last seen to change, or zero if not known.
+	ChangedAt time.Time
+	// ChangeInterval is the (moving average) time between changes, or 0 if not known.
+	ChangeInterval time.Duration
+	// FailureCount is the number of fetches in a row that have failed.
+	FailureCount int
+}
+
+// maxBackoffExponent caps the exponent in Interval, so the backoff cannot overflow
+// (MaxBackoff is almost always reached well before this).
+const maxBackoffExponent = 16
+
+// Interval returns how long after now (when the feed was checked) it should be checked again.
+//
+// Feeds that have failed n times in a row are checked every Min * 2^n, up to MaxBackoff.
+// Otherwise, the feed is checked about twice as often as it is expected to change,
+// between Min and Max. The expected change interval is ChangeInterval,
+// or the time since the last change if that is longer, so feeds that stop changing slow down.
+func (b RefreshBounds) Interval(h ChangeHistory, now time.Time) time.Duration {
+	if b.Min <= 0 {
+		b.Min = time.Duration(DefaultTTL)
+	}
+	b.Max = max(b.Max, b.Min)
+	b.MaxBackoff = max(b.MaxBackoff, b.Min)
+	if h.FailureCount > 0 {
+		n := min(h.FailureCount, maxBackoffExponent)
+		// Compare before shifting, so this cannot overflow.
+		if b.Min > b.MaxBackoff>>n {
+			return b.MaxBackoff
+		}
+		return b.Min << n
+	}
+	if h.ChangedAt.IsZero() {
+		return b.Min
+	}
+	expected := max(h.ChangeInterval, now.Sub(h.ChangedAt))
+	return min(max(expected/2, b.Min), b.Max)
+}
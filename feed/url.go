@@ -0,0 +1,62 @@
+package feed
+
+import (
+	"github.com/webhookdb/icalproxy/types"
+	"net/url"
+	"strings"
+)
+
+// schemeMap maps calendar subscription schemes to the scheme used to fetch the feed.
+var schemeMap = map[string]string{
+	"webcal":  "http",
+	"webcals": "https",
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// CanonicalURL returns the form of the url used to store and fetch the feed,
+// so that different spellings of the same feed share a single row:
+//
+//   - webcal and webcals schemes become http and https.
+//   - The scheme and host are lowercased, and default ports are removed.
+//   - An empty path becomes "/", and the fragment (which is never sent to the origin) is removed.
+//   - If the most specific host in sortQueryMap that matches (like MaxBytesFor) is true,
+//     query params are sorted by name.
+//     This is opt-in, since some origins sign or otherwise depend on the order of their params.
+//
+// u is not modified.
+func CanonicalURL(u *url.URL, sortQueryMap map[types.NormalizedHostname]bool) *url.URL {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	if s, ok := schemeMap[c.Scheme]; ok {
+		c.Scheme = s
+	}
+	host := strings.ToLower(c.Hostname())
+	if strings.Contains(host, ":") {
+		// Hostname strips the brackets from IPv6 addresses.
+		host = "[" + host + "]"
+	}
+	if port := c.Port(); port != "" && port != defaultPorts[c.Scheme] {
+		host += ":" + port
+	}
+	c.Host = host
+	if c.Path == "" && c.Opaque == "" {
+		c.Path = "/"
+		c.RawPath = ""
+	}
+	c.Fragment = ""
+	c.RawFragment = ""
+	if c.RawQuery != "" && sortQuery(&c, sortQueryMap) {
+		c.RawQuery = c.Query().Encode()
+	}
+	return &c
+}
+
+// sortQuery returns the value of the most specific host in sortQueryMap that matches the url.
+func sortQuery(u *url.URL, sortQueryMap map[types.NormalizedHostname]bool) bool {
+	_, sort, _ := mostSpecificMatch(types.NormalizeURLHostname(u), sortQueryMap)
+	return sort
+}
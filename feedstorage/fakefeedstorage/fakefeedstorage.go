@@ -28,6 +28,13 @@ func (f *FakeFeedStorage) Fetch(_ context.Context, feedId int64) ([]byte, error)
 	return b, nil
 }
 
+func (f *FakeFeedStorage) Delete(_ context.Context, feedId int64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.Files, feedId)
+	return nil
+}
+
 func New() *FakeFeedStorage {
 	return &FakeFeedStorage{Files: make(map[int64][]byte), mux: new(sync.Mutex)}
 }
@@ -24,6 +24,9 @@ type Interface interface {
 	// Fetch fetches the feed from storage and returns the bytes.
 	// If the feed is not stored, return ErrNotFound as the error.
 	Fetch(ctx context.Context, feedId int64) ([]byte, error)
+	// Delete deletes the feed from storage.
+	// It is not an error if the feed is not stored.
+	Delete(ctx context.Context, feedId int64) error
 }
 
 func New(ctx context.Context, cfg config.Config) (*Storage, error) {
@@ -87,6 +90,16 @@ func (s *Storage) Fetch(ctx context.Context, feedId int64) ([]byte, error) {
 	return io.ReadAll(cacheObj.Body)
 }
 
+func (s *Storage) Delete(ctx context.Context, feedId int64) error {
+	if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: s.bucket,
+		Key:    s.key(feedId),
+	}); err != nil {
+		return internal.ErrWrap(err, "s3 DeleteObject")
+	}
+	return nil
+}
+
 func (s *Storage) key(f int64) *string {
 	return aws.String(fmt.Sprintf("%s/%d.ics", s.prefix, f))
 }
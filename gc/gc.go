@@ -0,0 +1,106 @@
+// Package gc deletes abandoned feeds, and their stored contents, so the database and storage
+// do not grow forever. Feeds are abandoned when they have not been requested within GcAccessThreshold,
+// or have been failing for longer than GcFailureThreshold (see db.AbandonedFeeds).
+package gc
+
+import (
+	"context"
+	"errors"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/internal"
+	"time"
+)
+
+// pageSize is the number of feeds deleted at a time.
+const pageSize = 500
+
+func New(ag *appglobals.AppGlobals) *Collector {
+	return &Collector{ag: ag}
+}
+
+func StartScheduler(ctx context.Context, c *Collector) {
+	ctx = logctx.AddTo(ctx, "logger", "gc")
+	if !Enabled(c.ag.Config) {
+		logctx.Logger(ctx).InfoContext(ctx, "gc_scheduler_not_configured")
+		return
+	}
+	internal.StartScheduler(ctx, c, time.Hour)
+}
+
+// Enabled returns true if either GC threshold is configured.
+func Enabled(cfg config.Config) bool {
+	return cfg.GcAccessThreshold > 0 || cfg.GcFailureThreshold > 0
+}
+
+type Collector struct {
+	ag *appglobals.AppGlobals
+}
+
+// Result is what was (or would be, for a dry run) reclaimed by Collect.
+type Result struct {
+	FeedCount int64
+	// ContentsBytes is the total size of the stored contents of the feeds.
+	ContentsBytes int64
+}
+
+func (c *Collector) Run(ctx context.Context) error {
+	_, err := c.Collect(ctx, false)
+	return err
+}
+
+// Collect deletes abandoned feeds, and then their stored contents.
+// If dryRun is true, the feeds that would be deleted are counted instead.
+//
+// Feeds whose contents fail to be deleted from storage are still deleted from the database,
+// and the errors are returned after all abandoned feeds have been deleted.
+func (c *Collector) Collect(ctx context.Context, dryRun bool) (Result, error) {
+	var result Result
+	if !Enabled(c.ag.Config) {
+		return result, nil
+	}
+	now := time.Now()
+	criteria := db.AbandonedFeeds{}
+	if t := c.ag.Config.GcAccessThreshold; t > 0 {
+		criteria.NotAccessedSince = now.Add(-t)
+	}
+	if t := c.ag.Config.GcFailureThreshold; t > 0 {
+		criteria.FailingSince = now.Add(-t)
+	}
+	d := db.New(c.ag.DB)
+	if dryRun {
+		count, size, err := d.CountAbandonedFeeds(ctx, criteria)
+		if err != nil {
+			return result, err
+		}
+		result.FeedCount, result.ContentsBytes = count, size
+		logctx.Logger(ctx).InfoContext(ctx, "gc_dry_run", "feed_count", result.FeedCount, "contents_bytes", result.ContentsBytes)
+		return result, nil
+	}
+	var storageErrs []error
+	for {
+		deleted, err := d.DeleteAbandonedFeeds(ctx, criteria, pageSize)
+		if err != nil {
+			return result, err
+		}
+		if len(deleted) == 0 {
+			break
+		}
+		for _, df := range deleted {
+			result.FeedCount++
+			result.ContentsBytes += df.ContentsSize
+			if err := c.ag.FeedStorage.Delete(ctx, df.Id); err != nil {
+				logctx.Logger(ctx).With("error", err).WarnContext(ctx, "gc_storage_delete_failed", "feed_id", df.Id)
+				storageErrs = append(storageErrs, internal.ErrWrap(err, "deleting feed %d from storage", df.Id))
+			}
+		}
+	}
+	logctx.Logger(ctx).InfoContext(ctx, "gc_finished",
+		"feed_count", result.FeedCount,
+		"contents_bytes", result.ContentsBytes,
+		"storage_error_count", len(storageErrs),
+	)
+	return result, errors.Join(storageErrs...)
+}
@@ -0,0 +1,120 @@
+package gc_test
+
+import (
+	"context"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/db"
+	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/feedstorage/fakefeedstorage"
+	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/gc"
+	. "github.com/webhookdb/icalproxy/icalproxytest"
+	"github.com/webhookdb/icalproxy/pgxt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "gc package Suite")
+}
+
+var _ = Describe("gc", func() {
+	var ctx context.Context
+	var ag *appglobals.AppGlobals
+	var fs *fakefeedstorage.FakeFeedStorage
+	var d *db.DB
+
+	BeforeEach(func() {
+		ctx, _ = logctx.WithNullLogger(context.Background())
+		ag = fp.Must(appglobals.New(ctx, fp.Must(config.LoadConfig())))
+		Expect(TruncateLocal(ctx, ag.DB)).To(Succeed())
+		fs = fakefeedstorage.New()
+		ag.FeedStorage = fs
+		d = db.New(ag.DB)
+	})
+
+	// commit stores a feed at https://localhost/<tail>, with the given status, last requested age ago.
+	commit := func(tail string, status int, accessedAge time.Duration) int64 {
+		u := "https://localhost/" + tail
+		fd := feed.New(fp.Must(url.Parse(u)), map[string]string{}, status, []byte(Calendar(tail)), time.Now())
+		Expect(d.CommitFeed(ctx, ag.FeedStorage, fd, nil)).To(Succeed())
+		Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET last_accessed_at = $1 WHERE url = $2`, time.Now().Add(-accessedAge), u)).Error().ToNot(HaveOccurred())
+		return fp.Must(pgxt.GetScalar[int64](ctx, ag.DB, `SELECT id FROM icalproxy_feeds_v2 WHERE url = $1`, u))
+	}
+	feedUrls := func() []string {
+		return fp.Must(pgxt.GetScalars[string](ctx, ag.DB, `SELECT url FROM icalproxy_feeds_v2 WHERE url LIKE 'https://localhost/%'`))
+	}
+
+	Describe("StartScheduler", func() {
+		It("starts a routine that can be canceled", func() {
+			ag.Config.GcAccessThreshold = time.Hour
+			ctx, cancel := context.WithCancel(ctx)
+			gc.StartScheduler(ctx, gc.New(ag))
+			cancel()
+		})
+	})
+
+	Describe("Collect", func() {
+		It("deletes feeds not requested within the access threshold, and their stored contents", func() {
+			ag.Config.GcAccessThreshold = 24 * time.Hour
+			abandonedId := commit("abandoned", 200, 48*time.Hour)
+			activeId := commit("active", 200, time.Hour)
+
+			result, err := gc.New(ag).Collect(ctx, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(gc.Result{FeedCount: 1, ContentsBytes: int64(len(Calendar("abandoned")))}))
+			Expect(feedUrls()).To(ConsistOf("https://localhost/active"))
+			Expect(fs.Files).ToNot(HaveKey(abandonedId))
+			Expect(fs.Files).To(HaveKey(activeId))
+		})
+		It("deletes feeds that have been failing for longer than the failure threshold", func() {
+			ag.Config.GcFailureThreshold = 24 * time.Hour
+			commit("dead", 500, time.Hour)
+			commit("newly-failing", 500, time.Hour)
+			commit("ok", 200, time.Hour)
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET first_failed_at = now() - '48 hours'::interval WHERE url = 'https://localhost/dead'`)).Error().ToNot(HaveOccurred())
+
+			result, err := gc.New(ag).Collect(ctx, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.FeedCount).To(BeEquivalentTo(1))
+			Expect(feedUrls()).To(ConsistOf("https://localhost/newly-failing", "https://localhost/ok"))
+		})
+		It("does not delete feeds leased by the refresher", func() {
+			ag.Config.GcAccessThreshold = 24 * time.Hour
+			leasedId := commit("leased", 200, 48*time.Hour)
+			commit("expired-lease", 200, 48*time.Hour)
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET leased_until = now() + '1 hour'::interval WHERE url = 'https://localhost/leased'`)).Error().ToNot(HaveOccurred())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET leased_until = now() - '1 hour'::interval WHERE url = 'https://localhost/expired-lease'`)).Error().ToNot(HaveOccurred())
+
+			result, err := gc.New(ag).Collect(ctx, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.FeedCount).To(BeEquivalentTo(1))
+			Expect(feedUrls()).To(ConsistOf("https://localhost/leased"))
+			Expect(fs.Files).To(HaveKey(leasedId))
+		})
+		It("counts but does not delete feeds for a dry run", func() {
+			ag.Config.GcAccessThreshold = 24 * time.Hour
+			id := commit("abandoned", 200, 48*time.Hour)
+
+			result, err := gc.New(ag).Collect(ctx, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.FeedCount).To(BeEquivalentTo(1))
+			Expect(result.ContentsBytes).To(BeNumerically(">", 0))
+			Expect(feedUrls()).To(ConsistOf("https://localhost/abandoned"))
+			Expect(fs.Files).To(HaveKey(id))
+		})
+		It("deletes nothing if no threshold is configured", func() {
+			commit("abandoned", 200, 1000*time.Hour)
+			result, err := gc.New(ag).Collect(ctx, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(gc.Result{}))
+			Expect(feedUrls()).To(HaveLen(1))
+		})
+	})
+})
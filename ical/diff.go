@@ -0,0 +1,130 @@
+package ical
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+)
+
+// EventKey identifies a single VEVENT in a calendar.
+// Recurrence overrides share the UID of their master event,
+// and are distinguished by the (raw) RECURRENCE-ID value.
+type EventKey struct {
+	UID          string `json:"uid"`
+	RecurrenceID string `json:"recurrence_id,omitempty"`
+}
+
+func (k EventKey) compare(o EventKey) int {
+	return cmp.Or(cmp.Compare(k.UID, o.UID), cmp.Compare(k.RecurrenceID, o.RecurrenceID))
+}
+
+// Diff is the set of events that changed between two versions of a calendar.
+type Diff struct {
+	Added    []EventKey `json:"added"`
+	Removed  []EventKey `json:"removed"`
+	Modified []EventKey `json:"modified"`
+}
+
+// Empty returns true if there are no changes.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// DiffCalendars returns the events added, removed, and modified from old to new.
+// Events are compared using Canonical, so properties named in ignore are not considered changes.
+// Events without a UID cannot be tracked and are skipped.
+func DiffCalendars(old, new *Calendar, ignore ...string) *Diff {
+	oldEvents := canonicalEvents(old, ignore)
+	newEvents := canonicalEvents(new, ignore)
+	d := &Diff{}
+	for k, nc := range newEvents {
+		if oc, ok := oldEvents[k]; !ok {
+			d.Added = append(d.Added, k)
+		} else if !bytes.Equal(oc, nc) {
+			d.Modified = append(d.Modified, k)
+		}
+	}
+	for k := range oldEvents {
+		if _, ok := newEvents[k]; !ok {
+			d.Removed = append(d.Removed, k)
+		}
+	}
+	d.sort()
+	return d
+}
+
+func canonicalEvents(c *Calendar, ignore []string) map[EventKey][]byte {
+	r := make(map[EventKey][]byte)
+	for _, ev := range c.Events() {
+		k := EventKey{UID: ev.PropValue("UID"), RecurrenceID: ev.PropValue("RECURRENCE-ID")}
+		if k.UID == "" {
+			continue
+		}
+		r[k] = ev.Canonical(ignore...)
+	}
+	return r
+}
+
+const (
+	diffAdded = iota + 1
+	diffRemoved
+	diffModified
+)
+
+// Merge returns the diff equivalent to applying d and then next.
+// For example, an event added in d and removed in next does not appear at all,
+// and an event removed in d and added back in next is modified.
+func (d *Diff) Merge(next *Diff) *Diff {
+	state := make(map[EventKey]int)
+	for _, k := range d.Added {
+		state[k] = diffAdded
+	}
+	for _, k := range d.Removed {
+		state[k] = diffRemoved
+	}
+	for _, k := range d.Modified {
+		state[k] = diffModified
+	}
+	for _, k := range next.Added {
+		if state[k] == diffRemoved {
+			state[k] = diffModified
+		} else {
+			state[k] = diffAdded
+		}
+	}
+	for _, k := range next.Removed {
+		if state[k] == diffAdded {
+			delete(state, k)
+		} else {
+			state[k] = diffRemoved
+		}
+	}
+	for _, k := range next.Modified {
+		if state[k] != diffAdded {
+			state[k] = diffModified
+		}
+	}
+	r := &Diff{}
+	for k, st := range state {
+		switch st {
+		case diffAdded:
+			r.Added = append(r.Added, k)
+		case diffRemoved:
+			r.Removed = append(r.Removed, k)
+		case diffModified:
+			r.Modified = append(r.Modified, k)
+		}
+	}
+	r.sort()
+	return r
+}
+
+func (d *Diff) sort() {
+	// Use empty (not nil) slices so the JSON always has arrays.
+	for _, sl := range []*[]EventKey{&d.Added, &d.Removed, &d.Modified} {
+		if *sl == nil {
+			*sl = []EventKey{}
+		}
+		slices.SortFunc(*sl, EventKey.compare)
+	}
+}
@@ -0,0 +1,104 @@
+package ical
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLineOctets is the maximum length of a content line before it must be folded (RFC 5545 section 3.1).
+const MaxLineOctets = 75
+
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(s string) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = io.WriteString(e.w, s)
+}
+
+func (e *encoder) component(c *Component) {
+	e.boundary(c.begin, "BEGIN", c.Name)
+	for _, p := range c.Properties {
+		e.property(p)
+	}
+	for _, ch := range c.Components {
+		e.component(ch)
+	}
+	e.boundary(c.end, "END", c.Name)
+}
+
+func (e *encoder) boundary(orig *Property, name, compName string) {
+	// Compare case-insensitively so a component parsed from 'BEGIN:vevent' is written back the same way.
+	if orig != nil && strings.EqualFold(orig.Value, compName) {
+		e.property(orig)
+		return
+	}
+	e.property(&Property{Name: name, Value: compName})
+}
+
+func (e *encoder) property(p *Property) {
+	if p.raw != nil && p.equal(&p.raw.orig) {
+		e.write(p.raw.folded)
+		return
+	}
+	e.write(Fold(p.ContentLine()))
+	e.write("\r\n")
+}
+
+// ContentLine returns the unfolded content line for the property, without a line ending.
+func (p *Property) ContentLine() string {
+	b := strings.Builder{}
+	b.WriteString(p.Name)
+	for _, pa := range p.Params {
+		b.WriteByte(';')
+		b.WriteString(pa.Name)
+		if pa.Values == nil {
+			continue
+		}
+		b.WriteByte('=')
+		for i, v := range pa.Values {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if strings.ContainsAny(v, ":;,") {
+				b.WriteByte('"')
+				b.WriteString(v)
+				b.WriteByte('"')
+			} else {
+				b.WriteString(v)
+			}
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(p.Value)
+	return b.String()
+}
+
+// Fold splits a content line into lines of at most MaxLineOctets octets,
+// joined with CRLF and a leading space. Multi-byte UTF-8 sequences are never split.
+// The result has no trailing line ending.
+func Fold(line string) string {
+	if len(line) <= MaxLineOctets {
+		return line
+	}
+	b := strings.Builder{}
+	limit := MaxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines include the leading space in their length.
+		limit = MaxLineOctets - 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
@@ -0,0 +1,472 @@
+package ical
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Occurrence is a single instance of an event.
+type Occurrence struct {
+	// Event is the VEVENT the occurrence comes from.
+	// For an instance of a recurring event which has been overridden, this is the override
+	// (the VEVENT with the RECURRENCE-ID).
+	Event *Component
+	Start time.Time
+	End   time.Time
+	// AllDay is true if the event uses DATE values.
+	// Start and End are then midnight in the floating location passed to Expand.
+	AllDay bool
+	// RecurrenceID is the original start of the instance of a recurring event,
+	// or zero if the event does not recur.
+	RecurrenceID time.Time
+}
+
+// Expand returns the occurrences of the calendar's events that overlap the window [start, end),
+// sorted by start time.
+// Recurring events are expanded using RRULE, RDATE, and EXDATE,
+// and instances overridden by a VEVENT with a RECURRENCE-ID are replaced by the override.
+// TZIDs are resolved using the calendar's VTIMEZONE components, or the IANA time zone database.
+// Floating times, and the dates of all-day events, are interpreted in floating.
+// Events that cannot be interpreted (like ones with no valid DTSTART) are skipped.
+func (c *Calendar) Expand(start, end time.Time, floating *time.Location) []Occurrence {
+	zr := newZoneResolver(c, floating)
+	var masters []*Component
+	overrides := make(map[string]map[int64]*Component)
+	for _, ev := range c.Events() {
+		rid := ev.Prop("RECURRENCE-ID")
+		uid := ev.PropValue("UID")
+		if rid == nil || uid == "" {
+			masters = append(masters, ev)
+			continue
+		}
+		t, _, err := zr.propTime(rid)
+		if err != nil {
+			continue
+		}
+		if overrides[uid] == nil {
+			overrides[uid] = make(map[int64]*Component)
+		}
+		overrides[uid][t.Unix()] = ev
+	}
+	var result []Occurrence
+	add := func(o Occurrence) {
+		if o.overlaps(start, end) {
+			result = append(result, o)
+		}
+	}
+	for _, ev := range masters {
+		occs, err := expandEvent(ev, zr, end)
+		if err != nil {
+			continue
+		}
+		overridden := overrides[ev.PropValue("UID")]
+		for _, o := range occs {
+			if o.RecurrenceID.IsZero() || overridden[o.RecurrenceID.Unix()] == nil {
+				add(o)
+			}
+		}
+	}
+	// Overrides are always included, even if the instance they override is not generated by the master
+	// (or there is no master), since they can move an instance anywhere.
+	for _, byRid := range overrides {
+		for ridUnix, ev := range byRid {
+			o, err := singleOccurrence(ev, zr)
+			if err != nil {
+				continue
+			}
+			o.RecurrenceID = time.Unix(ridUnix, 0).In(o.Start.Location())
+			add(o)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b Occurrence) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.Event.PropValue("UID"), b.Event.PropValue("UID")))
+	})
+	return result
+}
+
+// overlaps returns true if the occurrence overlaps [start, end).
+// Occurrences with no duration overlap if they start in the window.
+func (o Occurrence) overlaps(start, end time.Time) bool {
+	if !o.Start.Before(end) {
+		return false
+	}
+	return o.End.After(start) || (o.End.Equal(o.Start) && !o.Start.Before(start))
+}
+
+// eventDuration is the nominal and exact parts of an event's duration.
+// Days are nominal (the same wall-clock time on another day), regardless of DST.
+type eventDuration struct {
+	days  int
+	exact time.Duration
+}
+
+func (d eventDuration) addTo(t time.Time) time.Time {
+	return t.AddDate(0, 0, d.days).Add(d.exact)
+}
+
+// singleOccurrence returns the occurrence described by the DTSTART and DTEND/DURATION of ev,
+// ignoring any recurrence.
+func singleOccurrence(ev *Component, zr *zoneResolver) (Occurrence, error) {
+	dtstart := ev.Prop("DTSTART")
+	if dtstart == nil {
+		return Occurrence{}, fmt.Errorf("missing DTSTART")
+	}
+	start, allDay, err := zr.propTime(dtstart)
+	if err != nil {
+		return Occurrence{}, err
+	}
+	dur, err := durationOf(ev, start, allDay, zr)
+	if err != nil {
+		return Occurrence{}, err
+	}
+	return Occurrence{Event: ev, Start: start, End: dur.addTo(start), AllDay: allDay}, nil
+}
+
+func durationOf(ev *Component, start time.Time, allDay bool, zr *zoneResolver) (eventDuration, error) {
+	if dtend := ev.Prop("DTEND"); dtend != nil {
+		end, endDate, err := zr.propTime(dtend)
+		if err != nil {
+			return eventDuration{}, err
+		}
+		if allDay && endDate {
+			return eventDuration{days: daysBetween(naive(start), naive(end))}, nil
+		}
+		return eventDuration{exact: end.Sub(start)}, nil
+	}
+	if d := ev.Prop("DURATION"); d != nil {
+		return parseDuration(d.Value)
+	}
+	if allDay {
+		return eventDuration{days: 1}, nil
+	}
+	return eventDuration{}, nil
+}
+
+// expandEvent returns the occurrences of ev that start before end, sorted by start.
+func expandEvent(ev *Component, zr *zoneResolver, end time.Time) ([]Occurrence, error) {
+	byStart := make(map[int64]Occurrence)
+	err := eachOccurrence(ev, zr, end, maxRecurPeriods, func(o Occurrence) bool {
+		byStart[o.Start.Unix()] = o
+		return true
+	})
+	// Rules that hit the limit still have the instances found before it.
+	if err != nil && !errors.Is(err, errRecurLimit) {
+		return nil, err
+	}
+	result := make([]Occurrence, 0, len(byStart))
+	for _, o := range byStart {
+		result = append(result, o)
+	}
+	slices.SortFunc(result, func(a, b Occurrence) int { return a.Start.Compare(b.Start) })
+	return result, nil
+}
+
+// errRecurLimit is returned from eachOccurrence when an RRULE had more periods than it was allowed to examine,
+// so some of its instances before end may not have been passed to fn.
+var errRecurLimit = errors.New("recurrence rule examined too many periods")
+
+// eachOccurrence calls fn with the occurrences of ev that start before end, until fn returns false.
+// Occurrences are not in order, and the same start may be passed more than once
+// (like if an RDATE duplicates an RRULE instance).
+// At most maxPeriods periods of each RRULE are examined (see Recur.each); if any rule needs more,
+// the other occurrences are still passed to fn, and errRecurLimit is returned.
+func eachOccurrence(ev *Component, zr *zoneResolver, end time.Time, maxPeriods int, fn func(Occurrence) bool) error {
+	first, err := singleOccurrence(ev, zr)
+	if err != nil {
+		return err
+	}
+	rrules := ev.Props("RRULE")
+	rdates := ev.Props("RDATE")
+	if len(rrules) == 0 && len(rdates) == 0 {
+		if first.Start.Before(end) {
+			fn(first)
+		}
+		return nil
+	}
+	dur := eventDuration{exact: first.End.Sub(first.Start)}
+	if first.AllDay {
+		dur = eventDuration{days: daysBetween(naive(first.Start), naive(first.End))}
+	}
+	exdates := make(map[int64]bool)
+	// Some producers use DATE values in EXDATE for events with DATE-TIME starts,
+	// which exclude any instance on that day.
+	exdays := make(map[string]bool)
+	for _, exdate := range ev.Props("EXDATE") {
+		loc := zr.location(exdate.Param("TZID"))
+		for _, v := range splitEscaped(exdate.Value, ',') {
+			t, isDate, err := parseDateTime(v, loc)
+			if err != nil {
+				continue
+			}
+			if isDate && !first.AllDay {
+				exdays[v] = true
+			} else {
+				exdates[t.Unix()] = true
+			}
+		}
+	}
+	excluded := func(t time.Time) bool {
+		return exdates[t.Unix()] || exdays[t.Format("20060102")]
+	}
+	occurrence := func(t time.Time) Occurrence {
+		return Occurrence{Event: ev, Start: t, End: dur.addTo(t), AllDay: first.AllDay, RecurrenceID: t}
+	}
+	var parsedRules []*Recur
+	for _, rrule := range rrules {
+		r, err := ParseRecur(rrule.Value, first.Start.Location())
+		if err != nil {
+			return err
+		}
+		parsedRules = append(parsedRules, r)
+	}
+	stopped := false
+	var limitErr error
+	for _, r := range parsedRules {
+		complete := r.each(first.Start, end, maxPeriods, func(t time.Time) bool {
+			if !excluded(t) && !fn(occurrence(t)) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if stopped {
+			return nil
+		}
+		if !complete {
+			limitErr = errRecurLimit
+		}
+	}
+	if len(parsedRules) == 0 && first.Start.Before(end) && !excluded(first.Start) && !fn(occurrence(first.Start)) {
+		return nil
+	}
+	for _, rdate := range rdates {
+		loc := zr.location(rdate.Param("TZID"))
+		for _, v := range splitEscaped(rdate.Value, ',') {
+			var o Occurrence
+			if s, e, ok := strings.Cut(v, "/"); ok {
+				// PERIOD values have their own end or duration.
+				ps, _, err := parseDateTime(s, loc)
+				if err != nil {
+					continue
+				}
+				o = occurrence(ps)
+				if pd, err := parseDuration(e); err == nil {
+					o.End = pd.addTo(ps)
+				} else if pe, _, err := parseDateTime(e, loc); err == nil {
+					o.End = pe
+				}
+			} else if t, _, err := parseDateTime(v, loc); err == nil {
+				o = occurrence(t)
+			} else {
+				continue
+			}
+			if o.Start.Before(end) && !excluded(o.Start) && !fn(o) {
+				return nil
+			}
+		}
+	}
+	return limitErr
+}
+
+// parseDuration parses a DURATION value like P1W, P1DT2H, or -PT15M.
+func parseDuration(v string) (eventDuration, error) {
+	d := eventDuration{}
+	s := v
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg = true
+		s = s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return d, fmt.Errorf("invalid duration %q", v)
+	}
+	s = s[1:]
+	inTime := false
+	num := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return d, fmt.Errorf("invalid duration %q", v)
+		}
+		num = ""
+		switch {
+		case c == 'W' && !inTime:
+			d.days += 7 * n
+		case c == 'D' && !inTime:
+			d.days += n
+		case c == 'H' && inTime:
+			d.exact += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d.exact += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d.exact += time.Duration(n) * time.Second
+		default:
+			return d, fmt.Errorf("invalid duration %q", v)
+		}
+	}
+	if num != "" {
+		return d, fmt.Errorf("invalid duration %q", v)
+	}
+	if neg {
+		d.days, d.exact = -d.days, -d.exact
+	}
+	return d, nil
+}
+
+// Trim returns a copy of the calendar without the VEVENTs that have no occurrences overlapping [since, until).
+// A zero since or until leaves that side of the window open.
+// Recurring events are kept if any of their instances overlap the window, along with all of their overrides.
+// Events that cannot be interpreted, or whose rules need too many periods to decide (see maxScanPeriods),
+// are kept, since it is not known when they occur.
+// Other components, like VTIMEZONE and VTODO, are always kept.
+// Floating times, and the dates of all-day events, are interpreted in floating.
+// The returned calendar shares components with c.
+func (c *Calendar) Trim(since, until time.Time, floating *time.Location) *Calendar {
+	if until.IsZero() {
+		until = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+	zr := newZoneResolver(c, floating)
+	inWindow := func(ev *Component) bool {
+		found := false
+		err := eachOccurrence(ev, zr, until, maxScanPeriods, func(o Occurrence) bool {
+			found = o.overlaps(since, until)
+			// Occurrences start before until, so the first one on or after since is always in the window.
+			return !found && o.Start.Before(since)
+		})
+		// Events whose rules need too many periods are kept, like events that cannot be interpreted.
+		return err != nil || found
+	}
+	keep := make(map[*Component]bool)
+	keptMasters := make(map[string]bool)
+	var overrides []*Component
+	for _, ev := range c.Events() {
+		if ev.Prop("RECURRENCE-ID") != nil && ev.PropValue("UID") != "" {
+			overrides = append(overrides, ev)
+		} else if inWindow(ev) {
+			keep[ev] = true
+			keptMasters[ev.PropValue("UID")] = true
+		}
+	}
+	for _, ev := range overrides {
+		keep[ev] = keptMasters[ev.PropValue("UID")] || inWindow(ev)
+	}
+	trimmed := *c.Component
+	trimmed.Components = make([]*Component, 0, len(c.Components))
+	for _, ch := range c.Components {
+		if ch.Name != VEvent || keep[ch] {
+			trimmed.Components = append(trimmed.Components, ch)
+		}
+	}
+	return &Calendar{Component: &trimmed}
+}
+
+// maxSpanOccurrences limits how many instances EventSpans looks at to find the end of a recurring event.
+// Events with more instances are treated as recurring forever.
+const maxSpanOccurrences = 10000
+
+// maxScanPeriods limits how many periods (see Recur.each) of each RRULE EventSpans and Trim examine,
+// since rules that rarely or never match (like FREQ=DAILY;BYMONTH=2;BYMONTHDAY=30;COUNT=3)
+// could otherwise examine maxRecurPeriods while the feed is being committed or served.
+// Events whose rules need more periods are treated as recurring forever by EventSpans, and kept by Trim.
+const maxScanPeriods = 20_000
+
+// maxSpanYears is how long after DTSTART EventSpans looks for instances.
+// Events with instances after that are treated as recurring forever.
+const maxSpanYears = 100
+
+// EventSpan is the time range covered by an event, including every instance if it recurs.
+type EventSpan struct {
+	Event *Component
+	// RecurrenceID is the RECURRENCE-ID of an override, or zero.
+	RecurrenceID time.Time
+	// Start is the start of the first instance, or zero if the event cannot be interpreted.
+	Start time.Time
+	// End is the end of the last instance, or zero if the event recurs forever
+	// (or cannot be interpreted).
+	End time.Time
+}
+
+// EventSpans returns the span of every VEVENT in the calendar, in order.
+// Unlike Expand, recurring events are not expanded into instances,
+// and overrides (events with a RECURRENCE-ID) have their own span.
+// Floating times, and the dates of all-day events, are interpreted in floating.
+func (c *Calendar) EventSpans(floating *time.Location) []EventSpan {
+	zr := newZoneResolver(c, floating)
+	var result []EventSpan
+	for _, ev := range c.Events() {
+		span := EventSpan{Event: ev}
+		if rid := ev.Prop("RECURRENCE-ID"); rid != nil {
+			if t, _, err := zr.propTime(rid); err == nil {
+				span.RecurrenceID = t
+			}
+		}
+		span.Start, span.End = eventBounds(ev, zr)
+		result = append(result, span)
+	}
+	return result
+}
+
+// eventBounds returns the start of the first, and end of the last, instances of ev.
+// See EventSpan for when they are zero.
+func eventBounds(ev *Component, zr *zoneResolver) (time.Time, time.Time) {
+	first, err := singleOccurrence(ev, zr)
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+	if ev.Prop("RECURRENCE-ID") != nil {
+		return first.Start, first.End
+	}
+	for _, rrule := range ev.Props("RRULE") {
+		r, err := ParseRecur(rrule.Value, first.Start.Location())
+		if err != nil {
+			return first.Start, first.End
+		}
+		if r.Count == 0 && r.Until.IsZero() {
+			return first.Start, time.Time{}
+		}
+	}
+	var start, end time.Time
+	seen := 0
+	forever := false
+	horizon := first.Start.AddDate(maxSpanYears, 0, 0)
+	err = eachOccurrence(ev, zr, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC), maxScanPeriods, func(o Occurrence) bool {
+		if seen++; seen > maxSpanOccurrences || o.Start.After(horizon) {
+			forever = true
+			return false
+		}
+		if seen == 1 {
+			start, end = o.Start, o.End
+		}
+		start = minTime(start, o.Start)
+		end = maxTime(end, o.End)
+		return true
+	})
+	if errors.Is(err, errRecurLimit) {
+		if seen == 0 {
+			start = first.Start
+		}
+		return start, time.Time{}
+	}
+	if err != nil || seen == 0 {
+		// The rules are invalid, or every instance is excluded, so there is nothing better than DTSTART.
+		return first.Start, first.End
+	}
+	if forever {
+		return start, time.Time{}
+	}
+	return start, end
+}
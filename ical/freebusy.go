@@ -0,0 +1,98 @@
+package ical
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Values of the FBTYPE parameter of FREEBUSY properties.
+const (
+	FbTypeBusy          = "BUSY"
+	FbTypeBusyTentative = "BUSY-TENTATIVE"
+)
+
+// FreeBusyPeriod is a time range that is busy, see Calendar.FreeBusy.
+type FreeBusyPeriod struct {
+	Start time.Time
+	End   time.Time
+	// FbType is FbTypeBusy, or FbTypeBusyTentative for events with STATUS:TENTATIVE.
+	FbType string
+}
+
+// BusyPeriods returns the times in the window [start, end) that the calendar's events are busy,
+// sorted by start time, in UTC, and clipped to the window.
+// Recurring events are expanded (see Expand), and floating times and all-day events are in floating.
+// Events with TRANSP:TRANSPARENT or STATUS:CANCELLED, and events with no duration, do not make time busy.
+// Overlapping and adjacent periods of the same FbType are combined.
+func (c *Calendar) BusyPeriods(start, end time.Time, floating *time.Location) []FreeBusyPeriod {
+	var periods []FreeBusyPeriod
+	for _, o := range c.Expand(start, end, floating) {
+		if o.Event.PropValue("TRANSP") == "TRANSPARENT" || o.Event.PropValue("STATUS") == "CANCELLED" {
+			continue
+		}
+		p := FreeBusyPeriod{
+			Start:  maxTime(o.Start, start).UTC(),
+			End:    minTime(o.End, end).UTC(),
+			FbType: FbTypeBusy,
+		}
+		if o.Event.PropValue("STATUS") == "TENTATIVE" {
+			p.FbType = FbTypeBusyTentative
+		}
+		if p.Start.Before(p.End) {
+			periods = append(periods, p)
+		}
+	}
+	slices.SortStableFunc(periods, func(a, b FreeBusyPeriod) int {
+		return cmp.Or(cmp.Compare(a.FbType, b.FbType), a.Start.Compare(b.Start))
+	})
+	var merged []FreeBusyPeriod
+	for _, p := range periods {
+		if n := len(merged); n > 0 && merged[n-1].FbType == p.FbType && !p.Start.After(merged[n-1].End) {
+			merged[n-1].End = maxTime(merged[n-1].End, p.End)
+			continue
+		}
+		merged = append(merged, p)
+	}
+	slices.SortStableFunc(merged, func(a, b FreeBusyPeriod) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.FbType, b.FbType))
+	})
+	return merged
+}
+
+// FreeBusy returns a VFREEBUSY component (RFC 5545 section 3.6.4) for the window [start, end),
+// with a FREEBUSY property for each of BusyPeriods.
+// uid and stamp are used for the required UID and DTSTAMP properties.
+func (c *Calendar) FreeBusy(uid string, stamp, start, end time.Time, floating *time.Location) *Component {
+	fb := NewComponent(VFreeBusy)
+	fb.AddProp("UID", uid)
+	fb.AddProp("DTSTAMP", formatUTC(stamp))
+	fb.AddProp("DTSTART", formatUTC(start))
+	fb.AddProp("DTEND", formatUTC(end))
+	for _, p := range c.BusyPeriods(start, end, floating) {
+		var params []Param
+		if p.FbType != FbTypeBusy {
+			params = append(params, Param{Name: "FBTYPE", Values: []string{p.FbType}})
+		}
+		fb.AddProp("FREEBUSY", formatUTC(p.Start)+"/"+formatUTC(p.End), params...)
+	}
+	return fb
+}
+
+func formatUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
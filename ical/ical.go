@@ -0,0 +1,337 @@
+// Package ical parses iCalendar (RFC 5545) data into a typed model of components and properties,
+// and serializes that model back to bytes.
+//
+// Content lines that are not modified after parsing are written back exactly as they were read
+// (including their original folding and line endings), so parsing and encoding an untouched feed
+// round-trips byte-for-byte. The only exception is blank lines, which carry no meaning and are dropped.
+package ical
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Component names we care about. Any other component name is still parsed and preserved.
+const (
+	VCalendar = "VCALENDAR"
+	VEvent    = "VEVENT"
+	VTodo     = "VTODO"
+	VJournal  = "VJOURNAL"
+	VFreeBusy = "VFREEBUSY"
+	VTimezone = "VTIMEZONE"
+	VAlarm    = "VALARM"
+	Standard  = "STANDARD"
+	Daylight  = "DAYLIGHT"
+)
+
+// Param is a property parameter, like TZID=America/New_York or MEMBER="a","b".
+// Names are always uppercase; values are stored without any quoting.
+type Param struct {
+	Name   string
+	Values []string
+}
+
+// Value returns the first value of the parameter, or an empty string.
+func (p Param) Value() string {
+	if len(p.Values) == 0 {
+		return ""
+	}
+	return p.Values[0]
+}
+
+// Property is a single (unfolded) content line, like DTSTART;TZID=Europe/Paris:20240101T100000.
+// Name is always uppercase. Value is the raw value, so TEXT values are still escaped;
+// use Text to get the unescaped value.
+type Property struct {
+	Name   string
+	Params []Param
+	Value  string
+	// raw is set when the property was parsed, so it can be written back unchanged.
+	raw *rawLine
+}
+
+type rawLine struct {
+	// folded is the original bytes of the content line, including folding and line endings.
+	folded string
+	// orig is a copy of the property as it was parsed. If the property no longer matches it,
+	// folded is stale and the property must be re-encoded.
+	orig Property
+}
+
+// Param returns the first value of the named parameter, or an empty string.
+func (p *Property) Param(name string) string {
+	name = strings.ToUpper(name)
+	for _, pa := range p.Params {
+		if pa.Name == name {
+			return pa.Value()
+		}
+	}
+	return ""
+}
+
+// HasParam returns true if the named parameter is present.
+func (p *Property) HasParam(name string) bool {
+	name = strings.ToUpper(name)
+	return slices.ContainsFunc(p.Params, func(pa Param) bool { return pa.Name == name })
+}
+
+// SetParam replaces any existing parameter with the given name.
+func (p *Property) SetParam(name string, values ...string) {
+	name = strings.ToUpper(name)
+	for i, pa := range p.Params {
+		if pa.Name == name {
+			p.Params[i] = Param{Name: name, Values: values}
+			return
+		}
+	}
+	p.Params = append(p.Params, Param{Name: name, Values: values})
+}
+
+// RemoveParam removes all parameters with the given name.
+func (p *Property) RemoveParam(name string) {
+	name = strings.ToUpper(name)
+	p.Params = slices.DeleteFunc(p.Params, func(pa Param) bool { return pa.Name == name })
+}
+
+// Text returns the value with TEXT escaping removed.
+func (p *Property) Text() string {
+	return UnescapeText(p.Value)
+}
+
+func (p *Property) equal(o *Property) bool {
+	return p.Name == o.Name && p.Value == o.Value && slices.EqualFunc(p.Params, o.Params, func(a, b Param) bool {
+		return a.Name == b.Name && slices.Equal(a.Values, b.Values)
+	})
+}
+
+func (p *Property) clone() *Property {
+	c := &Property{Name: p.Name, Value: p.Value, raw: p.raw}
+	if p.Params != nil {
+		c.Params = make([]Param, len(p.Params))
+		for i, pa := range p.Params {
+			c.Params[i] = Param{Name: pa.Name, Values: slices.Clone(pa.Values)}
+		}
+	}
+	return c
+}
+
+// Component is a BEGIN/END block, like VEVENT, with its properties and nested components.
+// Name is always uppercase.
+type Component struct {
+	Name       string
+	Properties []*Property
+	Components []*Component
+	// begin and end are the original BEGIN/END lines, so they can be written back unchanged.
+	begin *Property
+	end   *Property
+}
+
+// NewComponent returns an empty component with the given name.
+func NewComponent(name string) *Component {
+	return &Component{Name: strings.ToUpper(name)}
+}
+
+// Prop returns the first property with the given name, or nil.
+func (c *Component) Prop(name string) *Property {
+	name = strings.ToUpper(name)
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Props returns all properties with the given name.
+func (c *Component) Props(name string) []*Property {
+	name = strings.ToUpper(name)
+	var r []*Property
+	for _, p := range c.Properties {
+		if p.Name == name {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// PropValue returns the raw value of the first property with the given name,
+// or an empty string if there is no such property.
+func (c *Component) PropValue(name string) string {
+	if p := c.Prop(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+// AddProp appends a new property to the component.
+func (c *Component) AddProp(name, value string, params ...Param) *Property {
+	p := &Property{Name: strings.ToUpper(name), Value: value, Params: params}
+	c.Properties = append(c.Properties, p)
+	return p
+}
+
+// SetProp replaces all properties with the given name with a single new property,
+// in the position of the first existing one (or at the end if there are none).
+func (c *Component) SetProp(name, value string, params ...Param) *Property {
+	p := &Property{Name: strings.ToUpper(name), Value: value, Params: params}
+	idx := slices.IndexFunc(c.Properties, func(o *Property) bool { return o.Name == p.Name })
+	if idx < 0 {
+		c.Properties = append(c.Properties, p)
+		return p
+	}
+	c.RemoveProps(p.Name)
+	c.Properties = slices.Insert(c.Properties, idx, p)
+	return p
+}
+
+// RemoveProps removes all properties with any of the given names.
+func (c *Component) RemoveProps(names ...string) {
+	upper := make([]string, len(names))
+	for i, n := range names {
+		upper[i] = strings.ToUpper(n)
+	}
+	c.Properties = slices.DeleteFunc(c.Properties, func(p *Property) bool { return slices.Contains(upper, p.Name) })
+}
+
+// Children returns the direct child components with the given name.
+func (c *Component) Children(name string) []*Component {
+	name = strings.ToUpper(name)
+	var r []*Component
+	for _, ch := range c.Components {
+		if ch.Name == name {
+			r = append(r, ch)
+		}
+	}
+	return r
+}
+
+// Clone returns a deep copy of the component. Unmodified lines in the copy
+// are still written back as they were originally parsed.
+func (c *Component) Clone() *Component {
+	r := &Component{Name: c.Name, begin: c.begin, end: c.end}
+	r.Properties = make([]*Property, len(c.Properties))
+	for i, p := range c.Properties {
+		r.Properties[i] = p.clone()
+	}
+	r.Components = make([]*Component, len(c.Components))
+	for i, ch := range c.Components {
+		r.Components[i] = ch.Clone()
+	}
+	return r
+}
+
+// Encode writes the component in iCalendar format.
+func (c *Component) Encode(w io.Writer) error {
+	e := &encoder{w: w}
+	e.component(c)
+	return e.err
+}
+
+// Bytes returns the encoded component.
+func (c *Component) Bytes() []byte {
+	b := bytes.NewBuffer(nil)
+	// Writing to a bytes.Buffer cannot fail.
+	_ = c.Encode(b)
+	return b.Bytes()
+}
+
+// Calendar is a parsed VCALENDAR.
+type Calendar struct {
+	*Component
+}
+
+// NewCalendar returns an empty VCALENDAR with the required VERSION and PRODID properties.
+func NewCalendar(prodId string) *Calendar {
+	c := &Calendar{Component: NewComponent(VCalendar)}
+	c.AddProp("VERSION", "2.0")
+	c.AddProp("PRODID", prodId)
+	return c
+}
+
+// Events returns the VEVENT components of the calendar.
+func (c *Calendar) Events() []*Component {
+	return c.Children(VEvent)
+}
+
+// Todos returns the VTODO components of the calendar.
+func (c *Calendar) Todos() []*Component {
+	return c.Children(VTodo)
+}
+
+// Timezones returns the VTIMEZONE components of the calendar.
+func (c *Calendar) Timezones() []*Component {
+	return c.Children(VTimezone)
+}
+
+// Timezone returns the VTIMEZONE with the given TZID, or nil.
+func (c *Calendar) Timezone(tzid string) *Component {
+	for _, tz := range c.Timezones() {
+		if tz.PropValue("TZID") == tzid {
+			return tz
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the calendar.
+func (c *Calendar) Clone() *Calendar {
+	return &Calendar{Component: c.Component.Clone()}
+}
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, `;`, `\,`, `,`, `\n`, "\n", `\N`, "\n")
+var textEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// UnescapeText removes TEXT value escaping (RFC 5545 section 3.3.11).
+func UnescapeText(s string) string {
+	return textUnescaper.Replace(s)
+}
+
+// EscapeText applies TEXT value escaping (RFC 5545 section 3.3.11).
+func EscapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// Canonical returns a normalized encoding of the component, used to compare whether two components
+// are semantically equal even if they were serialized differently.
+// Properties named in ignore are dropped at every level, parameters are sorted by name,
+// and properties and child components are sorted, so reordering them does not change the result.
+// The output is not valid iCalendar and should only be used for comparison and hashing.
+func (c *Component) Canonical(ignore ...string) []byte {
+	ignoreSet := make(map[string]bool, len(ignore))
+	for _, n := range ignore {
+		ignoreSet[strings.ToUpper(n)] = true
+	}
+	return []byte(c.canonical(ignoreSet))
+}
+
+func (c *Component) canonical(ignore map[string]bool) string {
+	lines := make([]string, 0, len(c.Properties))
+	for _, p := range c.Properties {
+		if ignore[p.Name] {
+			continue
+		}
+		np := p.clone()
+		np.raw = nil
+		slices.SortStableFunc(np.Params, func(a, b Param) int { return strings.Compare(a.Name, b.Name) })
+		lines = append(lines, np.ContentLine())
+	}
+	slices.Sort(lines)
+	children := make([]string, len(c.Components))
+	for i, ch := range c.Components {
+		children[i] = ch.canonical(ignore)
+	}
+	slices.Sort(children)
+	b := strings.Builder{}
+	b.WriteString("BEGIN:" + c.Name + "\n")
+	for _, ln := range lines {
+		b.WriteString(ln)
+		b.WriteByte('\n')
+	}
+	for _, ch := range children {
+		b.WriteString(ch)
+	}
+	b.WriteString("END:" + c.Name + "\n")
+	return b.String()
+}
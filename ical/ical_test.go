@@ -0,0 +1,1114 @@
+package ical_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/ical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIcal(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ical package Suite")
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+var _ = Describe("ical", func() {
+	sample := crlf(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Test//Test//EN
+BEGIN:VTIMEZONE
+TZID:America/New_York
+BEGIN:STANDARD
+DTSTART:19701101T020000
+TZOFFSETFROM:-0400
+TZOFFSETTO:-0500
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:abc123
+DTSTAMP:20240101T000000Z
+DTSTART;TZID=America/New_York:20240105T100000
+SUMMARY:Meeting\, with commas
+DESCRIPTION:This is a long description that goes on and on and on and on and
+  needs to be folded.
+ATTENDEE;CN="Doe, Jane";ROLE=REQ-PARTICIPANT:mailto:jane@example.org
+BEGIN:VALARM
+ACTION:DISPLAY
+END:VALARM
+END:VEVENT
+BEGIN:VTODO
+UID:todo1
+END:VTODO
+END:VCALENDAR
+`)
+
+	Describe("Parse", func() {
+		It("parses components, properties, and parameters", func() {
+			cal, err := ical.Parse([]byte(sample))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cal.Name).To(Equal("VCALENDAR"))
+			Expect(cal.PropValue("VERSION")).To(Equal("2.0"))
+			Expect(cal.Timezones()).To(HaveLen(1))
+			Expect(cal.Timezone("America/New_York").Children(ical.Standard)).To(HaveLen(1))
+			Expect(cal.Todos()).To(HaveLen(1))
+			Expect(cal.Events()).To(HaveLen(1))
+
+			ev := cal.Events()[0]
+			Expect(ev.PropValue("UID")).To(Equal("abc123"))
+			Expect(ev.Prop("dtstart").Param("tzid")).To(Equal("America/New_York"))
+			Expect(ev.Prop("SUMMARY").Text()).To(Equal("Meeting, with commas"))
+			Expect(ev.PropValue("DESCRIPTION")).To(Equal("This is a long description that goes on and on and on and on and needs to be folded."))
+			att := ev.Prop("ATTENDEE")
+			Expect(att.Params).To(Equal([]ical.Param{
+				{Name: "CN", Values: []string{"Doe, Jane"}},
+				{Name: "ROLE", Values: []string{"REQ-PARTICIPANT"}},
+			}))
+			Expect(att.Value).To(Equal("mailto:jane@example.org"))
+			Expect(ev.Children(ical.VAlarm)).To(HaveLen(1))
+		})
+		It("handles multi-valued and valueless parameters", func() {
+			c, err := ical.ParseComponent([]byte("BEGIN:VEVENT\nATTENDEE;MEMBER=\"mailto:a@x.org\",\"mailto:b@x.org\";RSVP:mailto:c@x.org\nEND:VEVENT\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Prop("ATTENDEE").Params).To(Equal([]ical.Param{
+				{Name: "MEMBER", Values: []string{"mailto:a@x.org", "mailto:b@x.org"}},
+				{Name: "RSVP"},
+			}))
+			Expect(c.Prop("ATTENDEE").Value).To(Equal("mailto:c@x.org"))
+		})
+		It("accepts LF line endings, tab folding, a BOM, and blank lines", func() {
+			cal, err := ical.Parse([]byte("\xEF\xBB\xBFBEGIN:VCALENDAR\n\nBEGIN:VEVENT\nSUMMARY:a\n\tb\nEND:VEVENT\nEND:VCALENDAR\n\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cal.Events()[0].PropValue("SUMMARY")).To(Equal("ab"))
+		})
+		It("errors for mismatched or missing END lines", func() {
+			_, err := ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VTODO\nEND:VCALENDAR\n")))
+			Expect(err).To(MatchError(ContainSubstring("line 3: expected END:VEVENT, got END:VTODO")))
+			_, err = ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\n")))
+			Expect(err).To(MatchError(ContainSubstring("missing END:VEVENT")))
+		})
+		It("errors for invalid content lines", func() {
+			_, err := ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nNOCOLON\nEND:VCALENDAR\n")))
+			Expect(err).To(MatchError(ContainSubstring("line 2: missing ':'")))
+			_, err = ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nX;A=\"unterminated:val\nEND:VCALENDAR\n")))
+			Expect(err).To(MatchError(ContainSubstring("unterminated quoted value")))
+		})
+		It("errors for anything but a single VCALENDAR", func() {
+			_, err := ical.Parse([]byte("<html>hello</html>"))
+			Expect(err).To(HaveOccurred())
+			_, err = ical.Parse([]byte(crlf("BEGIN:VEVENT\nEND:VEVENT\n")))
+			Expect(err).To(MatchError(ContainSubstring("expected VCALENDAR, got VEVENT")))
+			_, err = ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nEND:VCALENDAR\nBEGIN:VCALENDAR\nEND:VCALENDAR\n")))
+			Expect(err).To(MatchError(ContainSubstring("unexpected content after END:VCALENDAR")))
+			_, err = ical.Parse([]byte(""))
+			Expect(err).To(MatchError(ContainSubstring("no component found")))
+		})
+	})
+
+	Describe("Encode", func() {
+		It("round-trips unmodified input byte-for-byte", func() {
+			cal, err := ical.Parse([]byte(sample))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(cal.Bytes())).To(Equal(sample))
+
+			lf := "BEGIN:vcalendar\nversion:2.0\nX-QUOTED;A=\"plain\":v\nEND:vcalendar"
+			cal, err = ical.Parse([]byte(lf))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(cal.Bytes())).To(Equal(lf))
+		})
+		It("re-encodes and folds modified properties", func() {
+			cal, err := ical.Parse([]byte(sample))
+			Expect(err).ToNot(HaveOccurred())
+			ev := cal.Events()[0]
+			ev.Prop("SUMMARY").Value = strings.Repeat("x", 80)
+			ev.Prop("ATTENDEE").SetParam("ROLE", "CHAIR")
+			ev.RemoveProps("DESCRIPTION", "dtstamp")
+			ev.AddProp("LOCATION", "Here", ical.Param{Name: "ALTREP", Values: []string{"http://x.org"}})
+			out := string(cal.Bytes())
+			Expect(out).To(ContainSubstring("SUMMARY:" + strings.Repeat("x", 67) + "\r\n " + strings.Repeat("x", 13) + "\r\n"))
+			Expect(out).To(ContainSubstring("ATTENDEE;CN=\"Doe, Jane\";ROLE=CHAIR:mailto:jane@example.org\r\n"))
+			Expect(out).To(ContainSubstring("LOCATION;ALTREP=\"http://x.org\":Here\r\n"))
+			Expect(out).ToNot(ContainSubstring("DESCRIPTION"))
+			Expect(out).ToNot(ContainSubstring("DTSTAMP"))
+			Expect(out).To(ContainSubstring("UID:abc123\r\n"))
+		})
+		It("does not share modifications with clones", func() {
+			cal, err := ical.Parse([]byte(sample))
+			Expect(err).ToNot(HaveOccurred())
+			clone := cal.Clone()
+			clone.Events()[0].SetProp("SUMMARY", "Busy")
+			clone.Events()[0].Prop("DTSTART").SetParam("TZID", "UTC")
+			Expect(string(cal.Bytes())).To(Equal(sample))
+			Expect(string(clone.Bytes())).To(ContainSubstring("SUMMARY:Busy\r\n"))
+			Expect(string(clone.Bytes())).To(ContainSubstring("DTSTART;TZID=UTC:20240105T100000\r\n"))
+		})
+		It("encodes new components", func() {
+			cal := ical.NewCalendar("-//icalproxy//EN")
+			ev := ical.NewComponent("vevent")
+			ev.AddProp("uid", "x")
+			cal.Components = append(cal.Components, ev)
+			Expect(string(cal.Bytes())).To(Equal(crlf("BEGIN:VCALENDAR\nVERSION:2.0\nPRODID:-//icalproxy//EN\nBEGIN:VEVENT\nUID:x\nEND:VEVENT\nEND:VCALENDAR\n")))
+		})
+	})
+
+	Describe("Canonical", func() {
+		It("ignores ordering and the given properties", func() {
+			a := crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1\nDTSTAMP:20240101T000000Z\nSUMMARY:x\nEND:VEVENT\nBEGIN:VEVENT\nUID:2\nX-A;B=1;A=2:v\nEND:VEVENT\nEND:VCALENDAR\n")
+			b := "BEGIN:VCALENDAR\nBEGIN:VEVENT\nX-A;A=2;B=1:v\nUID:2\nEND:VEVENT\nBEGIN:VEVENT\nsummary:x\nDTSTAMP:20990101T000000Z\nUID:1\nEND:VEVENT\nEND:VCALENDAR\n"
+			ca := fp.Must(ical.Parse([]byte(a)))
+			cb := fp.Must(ical.Parse([]byte(b)))
+			Expect(ca.Canonical("dtstamp")).To(Equal(cb.Canonical("DTSTAMP")))
+			Expect(ca.Canonical()).ToNot(Equal(cb.Canonical()))
+			cb.Events()[1].SetProp("SUMMARY", "y")
+			Expect(ca.Canonical("DTSTAMP")).ToNot(Equal(cb.Canonical("DTSTAMP")))
+		})
+	})
+
+	Describe("JCal", func() {
+		It("converts the calendar to jCal", func() {
+			cal := fp.Must(ical.Parse([]byte(crlf(`BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+UID:1
+DTSTART;TZID=America/New_York:20240105T100000
+DTEND;VALUE=DATE:20240106
+SUMMARY:Hi\, there
+CATEGORIES:a,b\,c
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=3;UNTIL=20240301T000000Z
+EXDATE:20240110T150000Z,20240112T150000Z
+GEO:37.5;-122.25
+ATTENDEE;MEMBER="mailto:a@x.org","mailto:b@x.org":mailto:c@x.org
+X-CUSTOM:whatever
+END:VEVENT
+BEGIN:VTIMEZONE
+TZID:X
+BEGIN:STANDARD
+TZOFFSETTO:-0500
+END:STANDARD
+END:VTIMEZONE
+END:VCALENDAR
+`))))
+			b, err := cal.MarshalJCal()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b).To(MatchJSON(`["vcalendar",
+  [["version", {}, "text", "2.0"]],
+  [
+    ["vevent", [
+      ["uid", {}, "text", "1"],
+      ["dtstart", {"tzid": "America/New_York"}, "date-time", "2024-01-05T10:00:00"],
+      ["dtend", {}, "date", "2024-01-06"],
+      ["summary", {}, "text", "Hi, there"],
+      ["categories", {}, "text", "a", "b,c"],
+      ["rrule", {}, "recur", {"freq": "WEEKLY", "byday": ["MO", "WE"], "count": 3, "until": "2024-03-01T00:00:00Z"}],
+      ["exdate", {}, "date-time", "2024-01-10T15:00:00Z", "2024-01-12T15:00:00Z"],
+      ["geo", {}, "float", [37.5, -122.25]],
+      ["attendee", {"member": ["mailto:a@x.org", "mailto:b@x.org"]}, "cal-address", "mailto:c@x.org"],
+      ["x-custom", {}, "unknown", "whatever"]
+    ], []],
+    ["vtimezone", [["tzid", {}, "text", "X"]], [
+      ["standard", [["tzoffsetto", {}, "utc-offset", "-05:00"]], []]
+    ]]
+  ]
+]`))
+		})
+	})
+
+	Describe("DiffCalendars", func() {
+		cal := func(events ...string) *ical.Calendar {
+			return fp.Must(ical.Parse([]byte("BEGIN:VCALENDAR\n" + strings.Join(events, "") + "END:VCALENDAR\n")))
+		}
+		ev := func(uid, rid, summary string) string {
+			s := "BEGIN:VEVENT\nUID:" + uid + "\nDTSTAMP:" + summary + "Z\nSUMMARY:" + summary + "\n"
+			if rid != "" {
+				s += "RECURRENCE-ID:" + rid + "\n"
+			}
+			return s + "END:VEVENT\n"
+		}
+
+		It("returns added, removed, and modified events, including overrides", func() {
+			old := cal(ev("1", "", "a"), ev("2", "", "a"), ev("3", "", "a"), ev("3", "20240101", "a"))
+			new := cal(ev("4", "", "a"), ev("2", "", "b"), ev("3", "", "a"), ev("3", "20240108", "a"), ev("1", "", "a"))
+			d := ical.DiffCalendars(old, new)
+			Expect(d.Added).To(Equal([]ical.EventKey{{UID: "3", RecurrenceID: "20240108"}, {UID: "4"}}))
+			Expect(d.Removed).To(Equal([]ical.EventKey{{UID: "3", RecurrenceID: "20240101"}}))
+			Expect(d.Modified).To(Equal([]ical.EventKey{{UID: "2"}}))
+		})
+		It("ignores the given properties", func() {
+			old := cal(ev("1", "", "a"))
+			new := cal(ev("1", "", "b"))
+			Expect(ical.DiffCalendars(old, new, "SUMMARY", "DTSTAMP").Empty()).To(BeTrue())
+		})
+		It("can merge consecutive diffs", func() {
+			d1 := &ical.Diff{
+				Added:    []ical.EventKey{{UID: "added-removed"}, {UID: "added-modified"}},
+				Removed:  []ical.EventKey{{UID: "removed-added"}},
+				Modified: []ical.EventKey{{UID: "modified-removed"}, {UID: "modified"}},
+			}
+			d2 := &ical.Diff{
+				Added:    []ical.EventKey{{UID: "removed-added"}, {UID: "new"}},
+				Removed:  []ical.EventKey{{UID: "added-removed"}, {UID: "modified-removed"}},
+				Modified: []ical.EventKey{{UID: "added-modified"}},
+			}
+			Expect(d1.Merge(d2)).To(Equal(&ical.Diff{
+				Added:    []ical.EventKey{{UID: "added-modified"}, {UID: "new"}},
+				Removed:  []ical.EventKey{{UID: "modified-removed"}},
+				Modified: []ical.EventKey{{UID: "modified"}, {UID: "removed-added"}},
+			}))
+		})
+	})
+
+	Describe("Recur", func() {
+		ny := fp.Must(time.LoadLocation("America/New_York"))
+		occurrences := func(rule string, dtstart time.Time) []string {
+			r, err := ical.ParseRecur(rule, dtstart.Location())
+			Expect(err).ToNot(HaveOccurred())
+			var result []string
+			for _, t := range r.Occurrences(dtstart, time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				result = append(result, t.Format("2006-01-02T15:04Z07:00"))
+			}
+			return result
+		}
+		dates := func(rule string, dtstart time.Time) []string {
+			var result []string
+			for _, s := range occurrences(rule, dtstart) {
+				result = append(result, s[:10])
+			}
+			return result
+		}
+
+		It("expands daily and hourly rules", func() {
+			Expect(occurrences("FREQ=DAILY;COUNT=3", time.Date(1997, 9, 2, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"1997-09-02T09:00-04:00", "1997-09-03T09:00-04:00", "1997-09-04T09:00-04:00",
+			}))
+			Expect(occurrences("FREQ=HOURLY;INTERVAL=3;UNTIL=19970902T170000Z", time.Date(1997, 9, 2, 9, 0, 0, 0, time.UTC))).To(Equal([]string{
+				"1997-09-02T09:00Z", "1997-09-02T12:00Z", "1997-09-02T15:00Z",
+			}))
+		})
+		It("keeps the wall-clock time across DST changes", func() {
+			Expect(occurrences("FREQ=WEEKLY;COUNT=2", time.Date(2024, 10, 28, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-10-28T09:00-04:00", "2024-11-04T09:00-05:00",
+			}))
+		})
+		It("expands weekly rules using the week start", func() {
+			start := time.Date(1997, 9, 2, 9, 0, 0, 0, ny)
+			Expect(dates("FREQ=WEEKLY;INTERVAL=2;UNTIL=19971224T000000Z;WKST=SU;BYDAY=MO,WE,FR", start.AddDate(0, 0, -1))).To(Equal([]string{
+				"1997-09-01", "1997-09-03", "1997-09-05", "1997-09-15", "1997-09-17", "1997-09-19", "1997-09-29",
+				"1997-10-01", "1997-10-03", "1997-10-13", "1997-10-15", "1997-10-17", "1997-10-27", "1997-10-29", "1997-10-31",
+				"1997-11-10", "1997-11-12", "1997-11-14", "1997-11-24", "1997-11-26", "1997-11-28",
+				"1997-12-08", "1997-12-10", "1997-12-12", "1997-12-22",
+			}))
+			start = time.Date(1997, 8, 5, 9, 0, 0, 0, ny)
+			Expect(dates("FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=MO", start)).To(Equal([]string{
+				"1997-08-05", "1997-08-10", "1997-08-19", "1997-08-24",
+			}))
+			Expect(dates("FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=SU", start)).To(Equal([]string{
+				"1997-08-05", "1997-08-17", "1997-08-19", "1997-08-31",
+			}))
+		})
+		It("expands monthly rules", func() {
+			Expect(dates("FREQ=MONTHLY;COUNT=4;BYDAY=1FR", time.Date(1997, 9, 5, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"1997-09-05", "1997-10-03", "1997-11-07", "1997-12-05",
+			}))
+			Expect(dates("FREQ=MONTHLY;COUNT=3;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", time.Date(1997, 9, 30, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"1997-09-30", "1997-10-31", "1997-11-28",
+			}))
+			// DTSTART is always the first occurrence, even if it does not match.
+			Expect(dates("FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13;COUNT=4", time.Date(1997, 9, 2, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"1997-09-02", "1998-02-13", "1998-03-13", "1998-11-13",
+			}))
+			// Months without the day are skipped.
+			Expect(dates("FREQ=MONTHLY;COUNT=4", time.Date(2024, 1, 31, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-01-31", "2024-03-31", "2024-05-31", "2024-07-31",
+			}))
+			Expect(dates("FREQ=MONTHLY;COUNT=3;BYMONTHDAY=-1", time.Date(2024, 1, 31, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-01-31", "2024-02-29", "2024-03-31",
+			}))
+		})
+		It("expands yearly rules", func() {
+			Expect(dates("FREQ=YEARLY;COUNT=3", time.Date(2024, 2, 29, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-02-29", "2028-02-29", "2032-02-29",
+			}))
+			Expect(dates("FREQ=YEARLY;BYWEEKNO=20;BYDAY=MO;COUNT=3", time.Date(1997, 5, 12, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"1997-05-12", "1998-05-11", "1999-05-17",
+			}))
+			Expect(dates("FREQ=YEARLY;BYMONTH=11;BYDAY=1SU;COUNT=3", time.Date(2007, 11, 4, 2, 0, 0, 0, time.UTC))).To(Equal([]string{
+				"2007-11-04", "2008-11-02", "2009-11-01",
+			}))
+			Expect(dates("FREQ=YEARLY;BYDAY=-1MO;COUNT=2", time.Date(2024, 12, 30, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-12-30", "2025-12-29",
+			}))
+			Expect(dates("FREQ=YEARLY;BYYEARDAY=1,-1;COUNT=3", time.Date(2024, 1, 1, 9, 0, 0, 0, ny))).To(Equal([]string{
+				"2024-01-01", "2024-12-31", "2025-01-01",
+			}))
+		})
+		It("stops at the end of the window", func() {
+			r := fp.Must(ical.ParseRecur("FREQ=DAILY", time.UTC))
+			Expect(r.Occurrences(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))).To(HaveLen(2))
+			r = fp.Must(ical.ParseRecur("FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", time.UTC))
+			Expect(r.Occurrences(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))).To(HaveLen(1))
+		})
+		It("errors for invalid rules", func() {
+			_, err := ical.ParseRecur("COUNT=1", time.UTC)
+			Expect(err).To(MatchError("FREQ is required"))
+			_, err = ical.ParseRecur("FREQ=FORTNIGHTLY", time.UTC)
+			Expect(err).To(MatchError(ContainSubstring("invalid FREQ")))
+			_, err = ical.ParseRecur("FREQ=DAILY;BYMONTH=13", time.UTC)
+			Expect(err).To(MatchError(ContainSubstring("invalid BYMONTH: 13 out of range")))
+			_, err = ical.ParseRecur("FREQ=DAILY;BYDAY=XX", time.UTC)
+			Expect(err).To(MatchError(ContainSubstring("invalid BYDAY")))
+		})
+	})
+
+	Describe("Expand", func() {
+		window := func(cal string, start, end string) []string {
+			c := fp.Must(ical.Parse([]byte(cal)))
+			var result []string
+			for _, o := range c.Expand(fp.Must(time.Parse(time.RFC3339, start)), fp.Must(time.Parse(time.RFC3339, end)), time.UTC) {
+				s := o.Event.PropValue("UID") + " " + o.Start.Format(time.RFC3339) + " " + o.End.Format(time.RFC3339)
+				if !o.RecurrenceID.IsZero() {
+					s += " " + o.RecurrenceID.UTC().Format(time.RFC3339)
+				}
+				result = append(result, s)
+			}
+			return result
+		}
+
+		It("expands recurring events with exceptions, extra dates, and overrides", func() {
+			cal := `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:weekly
+DTSTART;TZID=America/New_York:20240101T090000
+DTEND;TZID=America/New_York:20240101T100000
+RRULE:FREQ=WEEKLY;COUNT=10
+EXDATE;TZID=America/New_York:20240108T090000
+RDATE;TZID=America/New_York:20240110T120000
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+RECURRENCE-ID;TZID=America/New_York:20240115T090000
+DTSTART;TZID=America/New_York:20240116T140000
+DURATION:PT30M
+END:VEVENT
+BEGIN:VEVENT
+UID:single
+DTSTART:20240103T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:outside
+DTSTART:20250103T000000Z
+END:VEVENT
+END:VCALENDAR
+`
+			Expect(window(cal, "2024-01-01T00:00:00Z", "2024-01-20T00:00:00Z")).To(Equal([]string{
+				"weekly 2024-01-01T09:00:00-05:00 2024-01-01T10:00:00-05:00 2024-01-01T14:00:00Z",
+				"single 2024-01-03T00:00:00Z 2024-01-03T00:00:00Z",
+				"weekly 2024-01-10T12:00:00-05:00 2024-01-10T13:00:00-05:00 2024-01-10T17:00:00Z",
+				"weekly 2024-01-16T14:00:00-05:00 2024-01-16T14:30:00-05:00 2024-01-15T14:00:00Z",
+			}))
+			// Overlapping events are included.
+			Expect(window(cal, "2024-01-01T14:30:00Z", "2024-01-02T00:00:00Z")).To(HaveLen(1))
+		})
+		It("expands all-day events in the floating time zone", func() {
+			cal := `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:allday
+DTSTART;VALUE=DATE:20240101
+RRULE:FREQ=DAILY;UNTIL=20240103
+EXDATE;VALUE=DATE:20240102
+END:VEVENT
+END:VCALENDAR
+`
+			Expect(window(cal, "2023-01-01T00:00:00Z", "2025-01-01T00:00:00Z")).To(Equal([]string{
+				"allday 2024-01-01T00:00:00Z 2024-01-02T00:00:00Z 2024-01-01T00:00:00Z",
+				"allday 2024-01-03T00:00:00Z 2024-01-04T00:00:00Z 2024-01-03T00:00:00Z",
+			}))
+		})
+		It("uses VTIMEZONE definitions", func() {
+			cal := `BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Eastern Standard Time
+BEGIN:STANDARD
+DTSTART:16010101T020000
+TZOFFSETFROM:-0400
+TZOFFSETTO:-0500
+RRULE:FREQ=YEARLY;BYDAY=1SU;BYMONTH=11
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:16010101T020000
+TZOFFSETFROM:-0500
+TZOFFSETTO:-0400
+RRULE:FREQ=YEARLY;BYDAY=2SU;BYMONTH=3
+END:DAYLIGHT
+END:VTIMEZONE
+BEGIN:VTIMEZONE
+TZID:America/New_York
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0100
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:windows
+DTSTART;TZID=Eastern Standard Time:20240301T090000
+RRULE:FREQ=WEEKLY;COUNT=3
+END:VEVENT
+BEGIN:VEVENT
+UID:overridden
+DTSTART;TZID=America/New_York:20240301T090000
+END:VEVENT
+END:VCALENDAR
+`
+			Expect(window(cal, "2024-01-01T00:00:00Z", "2025-01-01T00:00:00Z")).To(Equal([]string{
+				"overridden 2024-03-01T09:00:00+01:00 2024-03-01T09:00:00+01:00",
+				"windows 2024-03-01T09:00:00-05:00 2024-03-01T09:00:00-05:00 2024-03-01T14:00:00Z",
+				"windows 2024-03-08T09:00:00-05:00 2024-03-08T09:00:00-05:00 2024-03-08T14:00:00Z",
+				"windows 2024-03-15T09:00:00-04:00 2024-03-15T09:00:00-04:00 2024-03-15T13:00:00Z",
+			}))
+		})
+		It("skips events that cannot be interpreted", func() {
+			cal := "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1\nEND:VEVENT\nBEGIN:VEVENT\nUID:2\nDTSTART:nope\nEND:VEVENT\nEND:VCALENDAR\n"
+			Expect(window(cal, "2024-01-01T00:00:00Z", "2025-01-01T00:00:00Z")).To(BeEmpty())
+		})
+	})
+
+	Describe("EventSpans", func() {
+		It("returns the span of all the instances of each event", func() {
+			cal := fp.Must(ical.Parse([]byte(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:counted
+DTSTART:20240101T090000Z
+DTEND:20240101T100000Z
+RRULE:FREQ=DAILY;COUNT=3
+EXDATE:20240101T090000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:counted
+RECURRENCE-ID:20240102T090000Z
+DTSTART:20240102T120000Z
+DTEND:20240102T130000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:forever
+DTSTART;VALUE=DATE:20240101
+RRULE:FREQ=YEARLY
+END:VEVENT
+BEGIN:VEVENT
+UID:invalid
+END:VEVENT
+END:VCALENDAR
+`)))
+			var result []string
+			for _, span := range cal.EventSpans(time.UTC) {
+				s := span.Event.PropValue("UID")
+				for _, t := range []time.Time{span.RecurrenceID, span.Start, span.End} {
+					if t.IsZero() {
+						s += " -"
+					} else {
+						s += " " + t.UTC().Format(time.RFC3339)
+					}
+				}
+				result = append(result, s)
+			}
+			Expect(result).To(Equal([]string{
+				"counted - 2024-01-02T09:00:00Z 2024-01-03T10:00:00Z",
+				"counted 2024-01-02T09:00:00Z 2024-01-02T12:00:00Z 2024-01-02T13:00:00Z",
+				"forever - 2024-01-01T00:00:00Z -",
+				"invalid - - -",
+			}))
+		})
+		It("treats rules that need too many periods or years to end as recurring forever", func() {
+			cal := fp.Must(ical.Parse([]byte(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:never-matches
+DTSTART:20240101T090000Z
+RRULE:FREQ=DAILY;BYMONTH=2;BYMONTHDAY=30;COUNT=3
+END:VEVENT
+BEGIN:VEVENT
+UID:rare
+DTSTART:20240101T090000Z
+RRULE:FREQ=DAILY;BYMONTH=2;BYMONTHDAY=29;COUNT=2
+END:VEVENT
+BEGIN:VEVENT
+UID:centuries
+DTSTART:20240101T090000Z
+RRULE:FREQ=YEARLY;COUNT=150
+END:VEVENT
+END:VCALENDAR
+`)))
+			start := time.Now()
+			spans := cal.EventSpans(time.UTC)
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(spans[0].Start).To(Equal(time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)))
+			Expect(spans[0].End).To(BeZero())
+			Expect(spans[1].End).To(Equal(time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC)))
+			Expect(spans[2].End).To(BeZero())
+		})
+	})
+
+	Describe("Trim", func() {
+		cal := crlf(`BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Custom
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0000
+TZOFFSETTO:+0000
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:old
+DTSTART:20100101T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:current
+DTSTART;TZID=Custom:20240105T000000
+DTEND;TZID=Custom:20240106T000000
+END:VEVENT
+BEGIN:VEVENT
+UID:future
+DTSTART;VALUE=DATE:20300101
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+DTSTART:20100101T000000Z
+RRULE:FREQ=WEEKLY
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+RECURRENCE-ID:20100108T000000Z
+DTSTART:20100109T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:ended
+DTSTART:20100101T000000Z
+RRULE:FREQ=DAILY;COUNT=10
+END:VEVENT
+BEGIN:VEVENT
+UID:ended
+RECURRENCE-ID:20100102T000000Z
+DTSTART:20240102T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:invalid
+DTSTART:yesterday
+END:VEVENT
+BEGIN:VTODO
+UID:todo
+END:VTODO
+END:VCALENDAR
+`)
+		uids := func(c *ical.Calendar) []string {
+			var r []string
+			for _, ch := range c.Components {
+				r = append(r, ch.Name+":"+ch.PropValue("UID"))
+			}
+			return r
+		}
+		t := func(s string) time.Time { return fp.Must(time.Parse(time.RFC3339, s)) }
+
+		It("removes events with no occurrences in the window", func() {
+			c := fp.Must(ical.Parse([]byte(cal)))
+			Expect(uids(c.Trim(t("2024-01-01T00:00:00Z"), t("2025-01-01T00:00:00Z"), time.UTC))).To(Equal([]string{
+				"VTIMEZONE:", "VEVENT:current", "VEVENT:weekly", "VEVENT:weekly", "VEVENT:ended", "VEVENT:invalid", "VTODO:todo",
+			}))
+			// Unmodified lines are written as they were.
+			Expect(string(c.Trim(t("2029-12-31T00:00:00Z"), time.Time{}, time.UTC).Bytes())).To(Equal(crlf(`BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Custom
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0000
+TZOFFSETTO:+0000
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:future
+DTSTART;VALUE=DATE:20300101
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+DTSTART:20100101T000000Z
+RRULE:FREQ=WEEKLY
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+RECURRENCE-ID:20100108T000000Z
+DTSTART:20100109T000000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:invalid
+DTSTART:yesterday
+END:VEVENT
+BEGIN:VTODO
+UID:todo
+END:VTODO
+END:VCALENDAR
+`)))
+			Expect(uids(c.Trim(time.Time{}, t("2010-01-02T00:00:00Z"), time.UTC))).To(Equal([]string{
+				"VTIMEZONE:", "VEVENT:old", "VEVENT:weekly", "VEVENT:weekly", "VEVENT:ended", "VEVENT:ended", "VEVENT:invalid", "VTODO:todo",
+			}))
+			// The original is not modified.
+			Expect(c.Events()).To(HaveLen(8))
+		})
+		It("keeps events whose rules need too many periods to decide, without examining them all", func() {
+			c := fp.Must(ical.Parse([]byte(crlf(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:never-matches
+DTSTART:20100101T000000Z
+RRULE:FREQ=DAILY;BYMONTH=2;BYMONTHDAY=30
+END:VEVENT
+BEGIN:VEVENT
+UID:ended
+DTSTART:20100101T000000Z
+RRULE:FREQ=DAILY;COUNT=10
+END:VEVENT
+END:VCALENDAR
+`))))
+			start := time.Now()
+			Expect(uids(c.Trim(t("2024-01-01T00:00:00Z"), time.Time{}, time.UTC))).To(Equal([]string{"VEVENT:never-matches"}))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("returns valid for a well-formed calendar, and warnings for minor problems", func() {
+			v := ical.Validate([]byte(sample))
+			Expect(v.Status).To(Equal(ical.ValidationWarnings))
+			// The sample VTODO has no DTSTAMP.
+			Expect(v.Issues).To(Equal([]ical.ValidationIssue{
+				{Severity: ical.SeverityWarning, Component: "VTODO", UID: "todo1", Property: "DTSTAMP", Message: "missing required property"},
+			}))
+			v = ical.Validate([]byte(crlf("BEGIN:VCALENDAR\nVERSION:2.0\nPRODID:x\nEND:VCALENDAR\n")))
+			Expect(v).To(Equal(&ical.Validation{Status: ical.ValidationValid, Issues: []ical.ValidationIssue{}}))
+		})
+		It("reports parse errors with their line", func() {
+			v := ical.Validate([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VTODO\nEND:VCALENDAR\n")))
+			Expect(v.Status).To(Equal(ical.ValidationInvalid))
+			Expect(v.Issues).To(Equal([]ical.ValidationIssue{
+				{Severity: ical.SeverityError, Line: 3, Message: "expected END:VEVENT, got END:VTODO"},
+			}))
+		})
+		It("reports missing properties, bad values, and unknown time zones", func() {
+			v := ical.Validate([]byte(crlf(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:x
+BEGIN:VTIMEZONE
+TZID:Custom
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:1
+DTSTAMP:20240101T000000Z
+DTSTART;TZID=Eastern:20240105T100000
+DTEND;TZID=Europe/Paris:20240105T090000
+RRULE:FREQ=SOMETIMES
+EXDATE:20240106T100000,tomorrow
+END:VEVENT
+BEGIN:VEVENT
+DTSTART:20240101
+DURATION:1D
+END:VEVENT
+END:VCALENDAR
+`)))
+			Expect(v.Status).To(Equal(ical.ValidationInvalid))
+			Expect(v.Errors).To(Equal(6))
+			Expect(v.Warnings).To(Equal(2))
+			Expect(v.Issues).To(Equal([]ical.ValidationIssue{
+				{Severity: ical.SeverityError, Component: "VTIMEZONE", Message: "invalid time zone Custom: VTIMEZONE Custom has no observances"},
+				{Severity: ical.SeverityError, Component: "VEVENT", UID: "1", Property: "DTEND", Message: "DTEND is before DTSTART"},
+				{Severity: ical.SeverityError, Component: "VEVENT", UID: "1", Property: "RRULE", Message: `invalid rule: invalid FREQ "SOMETIMES"`},
+				{Severity: ical.SeverityWarning, Component: "VEVENT", UID: "1", Property: "DTSTART", Message: `unknown TZID "Eastern"`},
+				{Severity: ical.SeverityError, Component: "VEVENT", UID: "1", Property: "EXDATE", Message: `invalid date or date-time "tomorrow"`},
+				{Severity: ical.SeverityError, Component: "VEVENT", Property: "UID", Message: "missing required property"},
+				{Severity: ical.SeverityWarning, Component: "VEVENT", Property: "DTSTAMP", Message: "missing required property"},
+				{Severity: ical.SeverityError, Component: "VEVENT", Property: "DURATION", Message: `invalid duration "1D"`},
+			}))
+		})
+		It("limits the number of issues listed", func() {
+			cal := "BEGIN:VCALENDAR\nVERSION:2.0\nPRODID:x\n" + strings.Repeat("BEGIN:VEVENT\nUID:1\nDTSTAMP:20240101T000000Z\nEND:VEVENT\n", 150) + "END:VCALENDAR\n"
+			v := ical.Validate([]byte(cal))
+			Expect(v.Errors).To(Equal(150))
+			Expect(v.Issues).To(HaveLen(ical.MaxValidationIssues))
+		})
+	})
+
+	Describe("AddMissingTimezones", func() {
+		now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+		It("adds VTIMEZONEs for TZIDs without one, after existing VTIMEZONEs", func() {
+			c := fp.Must(ical.Parse([]byte(crlf(`BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Custom
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0000
+TZOFFSETTO:+0000
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:1
+DTSTART;TZID=America/New_York:20230601T100000
+DTEND;TZID=Custom:20230601T100000
+EXDATE;TZID=Unknown/Zone:20230601T100000
+END:VEVENT
+END:VCALENDAR
+`))))
+			Expect(c.AddMissingTimezones(now)).To(Equal([]string{"America/New_York"}))
+			Expect(string(c.Bytes())).To(Equal(crlf(`BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Custom
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0000
+TZOFFSETTO:+0000
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VTIMEZONE
+TZID:America/New_York
+X-LIC-LOCATION:America/New_York
+BEGIN:DAYLIGHT
+DTSTART:20230312T020000
+TZOFFSETFROM:-0500
+TZOFFSETTO:-0400
+TZNAME:EDT
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU
+END:DAYLIGHT
+BEGIN:STANDARD
+DTSTART:20231105T020000
+TZOFFSETFROM:-0400
+TZOFFSETTO:-0500
+TZNAME:EST
+RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:1
+DTSTART;TZID=America/New_York:20230601T100000
+DTEND;TZID=Custom:20230601T100000
+EXDATE;TZID=Unknown/Zone:20230601T100000
+END:VEVENT
+END:VCALENDAR
+`)))
+			Expect(c.AddMissingTimezones(now)).To(BeEmpty())
+		})
+		It("describes zones with fixed offsets", func() {
+			c := fp.Must(ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;TZID=Asia/Tokyo:20240101T100000\nEND:VEVENT\nEND:VCALENDAR\n"))))
+			c.AddMissingTimezones(now)
+			Expect(string(c.Timezone("Asia/Tokyo").Bytes())).To(Equal(crlf(`BEGIN:VTIMEZONE
+TZID:Asia/Tokyo
+X-LIC-LOCATION:Asia/Tokyo
+BEGIN:STANDARD
+DTSTART:20240101T000000
+TZOFFSETFROM:+0900
+TZOFFSETTO:+0900
+TZNAME:JST
+END:STANDARD
+END:VTIMEZONE
+`)))
+		})
+		It("generates VTIMEZONEs that match the IANA database, including for Windows zone names", func() {
+			for tzid, iana := range map[string]string{
+				"America/New_York":          "America/New_York",
+				"Eastern Standard Time":     "America/New_York",
+				"AUS Eastern Standard Time": "Australia/Sydney",
+				"Europe/London":             "Europe/London",
+				"Asia/Tehran":               "Asia/Tehran",
+				"America/Sao_Paulo":         "America/Sao_Paulo",
+			} {
+				loc := fp.Must(time.LoadLocation(iana))
+				c := fp.Must(ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1\nDTSTART;TZID=" + tzid +
+					":20000101T023000\nRRULE:FREQ=DAILY\nEND:VEVENT\nEND:VCALENDAR\n"))))
+				Expect(c.AddMissingTimezones(now)).To(Equal([]string{tzid}))
+				Expect(c.Timezone(tzid)).ToNot(BeNil())
+				occurrences := c.Expand(time.Date(2000, 1, 1, 0, 0, 0, 0, loc), time.Date(2030, 1, 1, 0, 0, 0, 0, loc), time.UTC)
+				Expect(len(occurrences)).To(BeNumerically(">", 10000))
+				for _, o := range occurrences {
+					// On days when 02:30 does not exist, both use the offset from before the transition.
+					wall := o.Start.In(loc)
+					want := time.Date(wall.Year(), wall.Month(), wall.Day(), 2, 30, 0, 0, loc)
+					Expect(o.Start.Unix()).To(Equal(want.Unix()), "%s on %s", tzid, wall.Format(time.DateOnly))
+				}
+			}
+		})
+		It("resolves Windows zone names when expanding events", func() {
+			c := fp.Must(ical.Parse([]byte(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;TZID=Pacific Standard Time:20240101T100000\nEND:VEVENT\nEND:VCALENDAR\n"))))
+			Expect(c.Expand(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.UTC)[0].Start.Location().String()).
+				To(Equal("America/Los_Angeles"))
+		})
+	})
+
+	Describe("Merge", func() {
+		tz := "BEGIN:VTIMEZONE\nTZID:X\nBEGIN:STANDARD\nDTSTART:19700101T000000\nTZOFFSETFROM:+0000\nTZOFFSETTO:+0000\nEND:STANDARD\nEND:VTIMEZONE\n"
+		a := crlf("BEGIN:VCALENDAR\nVERSION:2.0\nPRODID:a\nX-WR-CALNAME:A\n" + tz +
+			"BEGIN:VEVENT\nUID:1\nSUMMARY:One\nEND:VEVENT\nBEGIN:VTODO\nUID:2\nEND:VTODO\nEND:VCALENDAR\n")
+		b := crlf("BEGIN:VCALENDAR\nPRODID:b\nBEGIN:VEVENT\nUID:3\nSUMMARY:Three\nEND:VEVENT\n" +
+			strings.Replace(tz, "+0000\nEND", "+0100\nEND", 1) + "END:VCALENDAR\n")
+
+		It("combines components, with each VTIMEZONE once and first", func() {
+			ca, cb := fp.Must(ical.Parse([]byte(a))), fp.Must(ical.Parse([]byte(b)))
+			m := ical.Merge("-//test//EN", ical.MergeSource{Calendar: ca}, ical.MergeSource{Calendar: cb})
+			Expect(string(m.Bytes())).To(Equal(crlf("BEGIN:VCALENDAR\nVERSION:2.0\nPRODID:-//test//EN\n" + tz +
+				"BEGIN:VEVENT\nUID:1\nSUMMARY:One\nEND:VEVENT\nBEGIN:VTODO\nUID:2\nEND:VTODO\n" +
+				"BEGIN:VEVENT\nUID:3\nSUMMARY:Three\nEND:VEVENT\nEND:VCALENDAR\n")))
+		})
+		It("prefixes summaries with labels without modifying the sources", func() {
+			ca, cb := fp.Must(ical.Parse([]byte(a))), fp.Must(ical.Parse([]byte(b)))
+			m := ical.Merge("-//test//EN", ical.MergeSource{Calendar: ca, Label: "Work, Inc"}, ical.MergeSource{Calendar: cb})
+			Expect(m.Events()[0].PropValue("SUMMARY")).To(Equal(`Work\, Inc: One`))
+			Expect(m.Todos()[0].PropValue("SUMMARY")).To(Equal(`Work\, Inc`))
+			Expect(m.Events()[1].PropValue("SUMMARY")).To(Equal("Three"))
+			Expect(string(ca.Bytes())).To(Equal(a))
+		})
+	})
+
+	Describe("BusyOnly", func() {
+		It("removes details from events, to-dos, and journal entries", func() {
+			cal := fp.Must(ical.Parse([]byte(sample)))
+			busy := cal.BusyOnly()
+			Expect(string(busy.Bytes())).To(Equal(crlf(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Test//Test//EN
+BEGIN:VTIMEZONE
+TZID:America/New_York
+BEGIN:STANDARD
+DTSTART:19701101T020000
+TZOFFSETFROM:-0400
+TZOFFSETTO:-0500
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:abc123
+DTSTAMP:20240101T000000Z
+DTSTART;TZID=America/New_York:20240105T100000
+SUMMARY:Busy
+END:VEVENT
+BEGIN:VTODO
+UID:todo1
+SUMMARY:Busy
+END:VTODO
+END:VCALENDAR
+`)))
+			Expect(string(cal.Bytes())).To(Equal(sample))
+		})
+		It("keeps only timing properties from Apple and Google exports", func() {
+			apple := crlf(`BEGIN:VCALENDAR
+METHOD:PUBLISH
+VERSION:2.0
+X-WR-CALNAME:Therapy
+PRODID:-//Apple Inc.//macOS 14.4//EN
+X-APPLE-CALENDAR-COLOR:#1BADF8
+X-WR-TIMEZONE:America/Los_Angeles
+CALSCALE:GREGORIAN
+BEGIN:VEVENT
+TRANSP:OPAQUE
+DTEND;TZID=America/Los_Angeles:20240312T110000
+X-APPLE-TRAVEL-ADVISORY-BEHAVIOR:AUTOMATIC
+UID:5F1B0D1E-7E8B-4C9A-9E0A-8F4D3C2B1A00
+DTSTAMP:20240301T180000Z
+LOCATION:Dr. Smith\n123 Main St\nSan Francisco CA 94105\nUnited States
+X-APPLE-STRUCTURED-LOCATION;VALUE=URI;X-ADDRESS="123 Main St\nSan Francisco
+  CA 94105\nUnited States";X-APPLE-RADIUS=70;X-TITLE="Dr. Smith":geo:37.79,-122.39
+SEQUENCE:1
+SUMMARY:Appointment with Dr. Smith
+LAST-MODIFIED:20240301T180000Z
+DTSTART;TZID=America/Los_Angeles:20240312T100000
+CREATED:20240301T175900Z
+RRULE:FREQ=WEEKLY;COUNT=4
+BEGIN:VALARM
+X-WR-ALARMUID:0D7F2A4B-1C3E-4F5A-8B9C-0D1E2F3A4B5C
+TRIGGER:-PT15M
+DESCRIPTION:Reminder
+ACTION:DISPLAY
+END:VALARM
+END:VEVENT
+END:VCALENDAR
+`)
+			Expect(string(fp.Must(ical.Parse([]byte(apple))).BusyOnly().Bytes())).To(Equal(crlf(`BEGIN:VCALENDAR
+METHOD:PUBLISH
+VERSION:2.0
+PRODID:-//Apple Inc.//macOS 14.4//EN
+CALSCALE:GREGORIAN
+BEGIN:VEVENT
+TRANSP:OPAQUE
+DTEND;TZID=America/Los_Angeles:20240312T110000
+UID:5F1B0D1E-7E8B-4C9A-9E0A-8F4D3C2B1A00
+DTSTAMP:20240301T180000Z
+SEQUENCE:1
+SUMMARY:Busy
+DTSTART;TZID=America/Los_Angeles:20240312T100000
+RRULE:FREQ=WEEKLY;COUNT=4
+END:VEVENT
+END:VCALENDAR
+`)))
+
+			google := crlf(`BEGIN:VCALENDAR
+PRODID:-//Google Inc//Google Calendar 70.9054//EN
+VERSION:2.0
+CALSCALE:GREGORIAN
+METHOD:PUBLISH
+X-WR-CALNAME:jane@example.com
+X-WR-TIMEZONE:America/New_York
+X-WR-CALDESC:Jane's interviews
+BEGIN:VEVENT
+DTSTART:20240312T150000Z
+DTEND:20240312T160000Z
+DTSTAMP:20240301T120000Z
+ORGANIZER;CN=jane@example.com:mailto:jane@example.com
+UID:7kukuqrfedlm2f9t0nlsu9qn8k@google.com
+ATTENDEE;CUTYPE=INDIVIDUAL;ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED;CN=Candid
+ ate;X-NUM-GUESTS=0:mailto:candidate@example.org
+X-GOOGLE-CONFERENCE:https://meet.google.com/abc-defg-hij
+X-MICROSOFT-CDO-BUSYSTATUS:BUSY
+X-MS-OLK-CONFTYPE:0
+CREATED:20240301T115900Z
+DESCRIPTION:Final round for the staff engineer role
+LAST-MODIFIED:20240301T120000Z
+LOCATION:
+SEQUENCE:0
+STATUS:CONFIRMED
+SUMMARY:Interview: Candidate
+TRANSP:OPAQUE
+END:VEVENT
+BEGIN:VFREEBUSY
+UID:fb1
+DTSTAMP:20240301T120000Z
+ORGANIZER:mailto:jane@example.com
+ATTENDEE:mailto:candidate@example.org
+COMMENT:Interview loop
+FREEBUSY:20240312T150000Z/20240312T160000Z
+END:VFREEBUSY
+END:VCALENDAR
+`)
+			Expect(string(fp.Must(ical.Parse([]byte(google))).BusyOnly().Bytes())).To(Equal(crlf(`BEGIN:VCALENDAR
+PRODID:-//Google Inc//Google Calendar 70.9054//EN
+VERSION:2.0
+CALSCALE:GREGORIAN
+METHOD:PUBLISH
+BEGIN:VEVENT
+DTSTART:20240312T150000Z
+DTEND:20240312T160000Z
+DTSTAMP:20240301T120000Z
+UID:7kukuqrfedlm2f9t0nlsu9qn8k@google.com
+SEQUENCE:0
+STATUS:CONFIRMED
+SUMMARY:Busy
+TRANSP:OPAQUE
+END:VEVENT
+BEGIN:VFREEBUSY
+UID:fb1
+DTSTAMP:20240301T120000Z
+FREEBUSY:20240312T150000Z/20240312T160000Z
+END:VFREEBUSY
+END:VCALENDAR
+`)))
+		})
+	})
+
+	Describe("FreeBusy", func() {
+		It("returns the merged busy periods of opaque events in the window", func() {
+			cal := fp.Must(ical.Parse([]byte(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:daily
+DTSTART;TZID=America/New_York:20240101T090000
+DTEND;TZID=America/New_York:20240101T100000
+RRULE:FREQ=DAILY;COUNT=3
+END:VEVENT
+BEGIN:VEVENT
+UID:overlap
+DTSTART:20240101T143000Z
+DTEND:20240101T160000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:tentative
+STATUS:TENTATIVE
+DTSTART:20240102T180000Z
+DURATION:PT1H
+END:VEVENT
+BEGIN:VEVENT
+UID:free
+TRANSP:TRANSPARENT
+DTSTART:20240102T000000Z
+DTEND:20240102T230000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:cancelled
+STATUS:CANCELLED
+DTSTART:20240102T000000Z
+DTEND:20240102T230000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:allday
+DTSTART;VALUE=DATE:20240103
+END:VEVENT
+END:VCALENDAR
+`)))
+			fb := cal.FreeBusy(
+				"fb1",
+				time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC),
+				time.UTC,
+			)
+			Expect(string(fb.Bytes())).To(Equal(crlf(`BEGIN:VFREEBUSY
+UID:fb1
+DTSTAMP:20240101T000000Z
+DTSTART:20240101T000000Z
+DTEND:20240103T120000Z
+FREEBUSY:20240101T140000Z/20240101T160000Z
+FREEBUSY:20240102T140000Z/20240102T150000Z
+FREEBUSY;FBTYPE=BUSY-TENTATIVE:20240102T180000Z/20240102T190000Z
+FREEBUSY:20240103T000000Z/20240103T120000Z
+END:VFREEBUSY
+`)))
+		})
+	})
+
+	Describe("Normalize", func() {
+		It("does not change valid bodies", func() {
+			b := crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDESCRIPTION:" + strings.Repeat("x", 60) + "\n  folded\nEND:VEVENT\nEND:VCALENDAR\n")
+			Expect(string(ical.Normalize([]byte(b)))).To(Equal(b))
+		})
+		It("fixes line endings, folding, and unescaped newlines", func() {
+			long := "SUMMARY:" + strings.Repeat("é", 40)
+			b := "\xEF\xBB\xBFBEGIN:VCALENDAR\n\nBEGIN:VEVENT\r\nDESCRIPTION:line 1\nline 2\r\n" + long + "\nEND:VEVENT\nEND:VCALENDAR"
+			Expect(string(ical.Normalize([]byte(b)))).To(Equal(crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDESCRIPTION:line 1\\nline 2\n") +
+				ical.Fold(long) + crlf("\nEND:VEVENT\nEND:VCALENDAR\n")))
+			cal := fp.Must(ical.Parse(ical.Normalize([]byte(b))))
+			Expect(cal.Events()[0].Prop("DESCRIPTION").Text()).To(Equal("line 1\nline 2"))
+			Expect(cal.Events()[0].PropValue("SUMMARY")).To(Equal(long[len("SUMMARY:"):]))
+		})
+		It("only treats lines starting with property names as new properties", func() {
+			b := crlf("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDESCRIPTION:Meet at the desk.\nNote: bring ID\nNOTE:and a pen\nx-custom;x=1:kept\nEND:VEVENT\nEND:VCALENDAR\n")
+			cal := fp.Must(ical.Parse(ical.Normalize([]byte(b))))
+			ev := cal.Events()[0]
+			Expect(ev.Prop("DESCRIPTION").Text()).To(Equal("Meet at the desk.\nNote: bring ID\nNOTE:and a pen"))
+			Expect(ev.PropValue("X-CUSTOM")).To(Equal("kept"))
+		})
+	})
+
+	Describe("Fold", func() {
+		It("does not split multi-byte characters", func() {
+			line := "SUMMARY:" + strings.Repeat("é", 40)
+			folded := ical.Fold(line)
+			for _, ln := range strings.Split(folded, "\r\n") {
+				Expect(len(ln)).To(BeNumerically("<=", ical.MaxLineOctets))
+				Expect(strings.ToValidUTF8(ln, "?")).To(Equal(ln))
+			}
+			Expect(strings.ReplaceAll(folded, "\r\n ", "")).To(Equal(line))
+		})
+	})
+
+	Describe("text escaping", func() {
+		It("escapes and unescapes TEXT values", func() {
+			s := "a,b;c\\d\ne"
+			Expect(ical.EscapeText(s)).To(Equal(`a\,b\;c\\d\ne`))
+			Expect(ical.UnescapeText(ical.EscapeText(s))).To(Equal(s))
+		})
+	})
+})
@@ -0,0 +1,281 @@
+package ical
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// JCalContentType is the media type for jCal (RFC 7265).
+const JCalContentType = "application/calendar+json"
+
+// Value types, as used in the VALUE parameter (in uppercase) and in jCal (in lowercase).
+const (
+	TypeBinary     = "binary"
+	TypeBoolean    = "boolean"
+	TypeCalAddress = "cal-address"
+	TypeDate       = "date"
+	TypeDateTime   = "date-time"
+	TypeDuration   = "duration"
+	TypeFloat      = "float"
+	TypeInteger    = "integer"
+	TypePeriod     = "period"
+	TypeRecur      = "recur"
+	TypeText       = "text"
+	TypeTime       = "time"
+	TypeUnknown    = "unknown"
+	TypeURI        = "uri"
+	TypeUTCOffset  = "utc-offset"
+)
+
+// defaultTypes are the value types of properties when no VALUE parameter is given (RFC 5545 section 3.8).
+var defaultTypes = map[string]string{
+	"ACTION":           TypeText,
+	"ATTACH":           TypeURI,
+	"ATTENDEE":         TypeCalAddress,
+	"CALSCALE":         TypeText,
+	"CATEGORIES":       TypeText,
+	"CLASS":            TypeText,
+	"COMMENT":          TypeText,
+	"COMPLETED":        TypeDateTime,
+	"CONTACT":          TypeText,
+	"CREATED":          TypeDateTime,
+	"DESCRIPTION":      TypeText,
+	"DTEND":            TypeDateTime,
+	"DTSTAMP":          TypeDateTime,
+	"DTSTART":          TypeDateTime,
+	"DUE":              TypeDateTime,
+	"DURATION":         TypeDuration,
+	"EXDATE":           TypeDateTime,
+	"FREEBUSY":         TypePeriod,
+	"GEO":              TypeFloat,
+	"LAST-MODIFIED":    TypeDateTime,
+	"LOCATION":         TypeText,
+	"METHOD":           TypeText,
+	"ORGANIZER":        TypeCalAddress,
+	"PERCENT-COMPLETE": TypeInteger,
+	"PRIORITY":         TypeInteger,
+	"PRODID":           TypeText,
+	"RDATE":            TypeDateTime,
+	"RECURRENCE-ID":    TypeDateTime,
+	"RELATED-TO":       TypeText,
+	"REPEAT":           TypeInteger,
+	"REQUEST-STATUS":   TypeText,
+	"RESOURCES":        TypeText,
+	"RRULE":            TypeRecur,
+	"SEQUENCE":         TypeInteger,
+	"STATUS":           TypeText,
+	"SUMMARY":          TypeText,
+	"TRANSP":           TypeText,
+	"TRIGGER":          TypeDuration,
+	"TZID":             TypeText,
+	"TZNAME":           TypeText,
+	"TZOFFSETFROM":     TypeUTCOffset,
+	"TZOFFSETTO":       TypeUTCOffset,
+	"TZURL":            TypeURI,
+	"UID":              TypeText,
+	"URL":              TypeURI,
+	"VERSION":          TypeText,
+}
+
+// multiValued are properties whose value is a comma-separated list.
+var multiValued = map[string]bool{
+	"CATEGORIES": true,
+	"EXDATE":     true,
+	"FREEBUSY":   true,
+	"RDATE":      true,
+	"RESOURCES":  true,
+}
+
+// structured are properties whose value is a semicolon-separated structure.
+var structured = map[string]bool{
+	"GEO":            true,
+	"REQUEST-STATUS": true,
+}
+
+// ValueType returns the value type of the property, from its VALUE parameter
+// or the RFC 5545 default. Values that are declared DATE-TIME but are formatted like a DATE
+// (which some providers do) are reported as DATE.
+func (p *Property) ValueType() string {
+	t := strings.ToLower(p.Param("VALUE"))
+	if t == "" {
+		t = defaultTypes[p.Name]
+	}
+	if t == "" {
+		return TypeUnknown
+	}
+	if t == TypeDateTime && len(p.Value) == 8 && !strings.Contains(p.Value, "T") {
+		return TypeDate
+	}
+	return t
+}
+
+// MarshalJCal encodes the component as jCal (RFC 7265).
+func (c *Component) MarshalJCal() ([]byte, error) {
+	return json.Marshal(c.JCal())
+}
+
+// JCal returns the jCal representation of the component,
+// suitable for passing to json.Marshal.
+func (c *Component) JCal() []any {
+	props := make([]any, 0, len(c.Properties))
+	for _, p := range c.Properties {
+		props = append(props, p.JCal())
+	}
+	comps := make([]any, 0, len(c.Components))
+	for _, ch := range c.Components {
+		comps = append(comps, ch.JCal())
+	}
+	return []any{strings.ToLower(c.Name), props, comps}
+}
+
+// JCal returns the jCal representation of the property,
+// like ["dtstart", {"tzid": "Europe/Paris"}, "date-time", "2024-01-01T10:00:00"].
+func (p *Property) JCal() []any {
+	params := make(map[string]any, len(p.Params))
+	for _, pa := range p.Params {
+		if pa.Name == "VALUE" {
+			continue
+		}
+		if len(pa.Values) == 1 {
+			params[strings.ToLower(pa.Name)] = pa.Values[0]
+		} else {
+			params[strings.ToLower(pa.Name)] = pa.Values
+		}
+	}
+	typ := p.ValueType()
+	r := []any{strings.ToLower(p.Name), params, typ}
+	if structured[p.Name] {
+		parts := splitEscaped(p.Value, ';')
+		values := make([]any, len(parts))
+		for i, part := range parts {
+			if p.Name == "GEO" {
+				values[i] = jcalValue(TypeFloat, part)
+			} else {
+				values[i] = UnescapeText(part)
+			}
+		}
+		return append(r, values)
+	}
+	if multiValued[p.Name] {
+		for _, v := range splitEscaped(p.Value, ',') {
+			r = append(r, jcalValue(typ, v))
+		}
+		return r
+	}
+	return append(r, jcalValue(typ, p.Value))
+}
+
+func jcalValue(typ, v string) any {
+	switch typ {
+	case TypeText:
+		return UnescapeText(v)
+	case TypeDate:
+		return jcalDate(v)
+	case TypeDateTime:
+		return jcalDateTime(v)
+	case TypeTime:
+		return jcalTime(v)
+	case TypeUTCOffset:
+		if len(v) >= 5 {
+			return v[:3] + ":" + v[3:]
+		}
+		return v
+	case TypePeriod:
+		start, end, ok := strings.Cut(v, "/")
+		if !ok {
+			return v
+		}
+		if !strings.HasPrefix(end, "P") && !strings.HasPrefix(end, "+P") && !strings.HasPrefix(end, "-P") {
+			end = jcalDateTime(end)
+		}
+		return jcalDateTime(start) + "/" + end
+	case TypeInteger:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+		return v
+	case TypeFloat:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		return v
+	case TypeBoolean:
+		return strings.EqualFold(v, "TRUE")
+	case TypeRecur:
+		return jcalRecur(v)
+	}
+	return v
+}
+
+func jcalDate(v string) string {
+	if len(v) != 8 {
+		return v
+	}
+	return v[:4] + "-" + v[4:6] + "-" + v[6:]
+}
+
+func jcalTime(v string) string {
+	if len(v) < 6 {
+		return v
+	}
+	return v[:2] + ":" + v[2:4] + ":" + v[4:]
+}
+
+func jcalDateTime(v string) string {
+	d, t, ok := strings.Cut(v, "T")
+	if !ok {
+		return jcalDate(v)
+	}
+	return jcalDate(d) + "T" + jcalTime(t)
+}
+
+var recurIntegerParts = map[string]bool{
+	"COUNT": true, "INTERVAL": true, "BYSECOND": true, "BYMINUTE": true, "BYHOUR": true,
+	"BYMONTHDAY": true, "BYYEARDAY": true, "BYWEEKNO": true, "BYMONTH": true, "BYSETPOS": true,
+}
+
+func jcalRecur(v string) map[string]any {
+	r := map[string]any{}
+	for _, part := range strings.Split(v, ";") {
+		k, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToUpper(k)
+		var values []any
+		for _, item := range strings.Split(val, ",") {
+			switch {
+			case k == "UNTIL":
+				values = append(values, jcalDateTime(item))
+			case recurIntegerParts[k]:
+				values = append(values, jcalValue(TypeInteger, item))
+			default:
+				values = append(values, item)
+			}
+		}
+		if len(values) == 1 {
+			r[strings.ToLower(k)] = values[0]
+		} else {
+			r[strings.ToLower(k)] = values
+		}
+	}
+	return r
+}
+
+// splitEscaped splits s on sep, ignoring separators escaped with a backslash.
+func splitEscaped(s string, sep byte) []string {
+	var r []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			r = append(r, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(r, s[start:])
+}
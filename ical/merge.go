@@ -0,0 +1,44 @@
+package ical
+
+// MergeSource is a calendar to include in Merge.
+type MergeSource struct {
+	Calendar *Calendar
+	// Label, if not empty, is prefixed to the SUMMARY of every event, to-do, and journal entry,
+	// like "Label: Summary", so it is clear which calendar they came from.
+	Label string
+}
+
+// Merge returns a new calendar with the components of all the sources, in order.
+// VTIMEZONEs are included once per TZID (the first definition wins).
+// Calendar-level properties of the sources, like X-WR-CALNAME, are not included.
+// Components are copied, so the sources are not modified.
+func Merge(prodId string, sources ...MergeSource) *Calendar {
+	merged := NewCalendar(prodId)
+	var timezones, others []*Component
+	seenTzids := make(map[string]bool)
+	for _, src := range sources {
+		for _, ch := range src.Calendar.Components {
+			if ch.Name == VTimezone {
+				tzid := ch.PropValue("TZID")
+				if seenTzids[tzid] {
+					continue
+				}
+				seenTzids[tzid] = true
+				timezones = append(timezones, ch.Clone())
+				continue
+			}
+			ch = ch.Clone()
+			if src.Label != "" && (ch.Name == VEvent || ch.Name == VTodo || ch.Name == VJournal) {
+				prefix := EscapeText(src.Label)
+				if summary := ch.Prop("SUMMARY"); summary != nil {
+					summary.Value = prefix + ": " + summary.Value
+				} else {
+					ch.AddProp("SUMMARY", prefix)
+				}
+			}
+			others = append(others, ch)
+		}
+	}
+	merged.Components = append(timezones, others...)
+	return merged
+}
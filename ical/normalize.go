@@ -0,0 +1,93 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Normalize repairs the line structure of an iCalendar body, so it matches RFC 5545 section 3.1:
+//
+//   - A leading UTF-8 byte order mark, and blank lines, are removed.
+//   - Every line ends with CRLF.
+//   - Lines longer than MaxLineOctets are refolded.
+//   - Lines that do not start with a property name (like unescaped newlines in a DESCRIPTION)
+//     are joined to the previous line with an escaped newline.
+//
+// Lines that are already valid are kept exactly as they were, so normalizing a valid body is a no-op.
+// The input should already be UTF-8.
+func Normalize(b []byte) []byte {
+	lines := unfold(bytes.TrimPrefix(b, utf8BOM))
+	out := bytes.NewBuffer(make([]byte, 0, len(b)+len(b)/32))
+	for i := 0; i < len(lines); i++ {
+		ln := lines[i]
+		for i+1 < len(lines) && !isContentLine(lines[i+1].text) {
+			i++
+			ln.text += `\n` + lines[i].text
+			// Force refolding, since the original lines are not valid.
+			ln.folded = ""
+		}
+		if validFolding(ln.folded) {
+			out.WriteString(ln.folded)
+		} else {
+			out.WriteString(Fold(ln.text))
+			out.WriteString("\r\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// isContentLine returns true if s starts with a property name followed by ':' or ';'.
+// Only known properties and X- properties count, written all in upper or all in lower case,
+// so text like "Note: bring ID" on the line after an unescaped newline is not mistaken for a property.
+func isContentLine(s string) bool {
+	i := strings.IndexAny(s, ";:")
+	if i <= 0 {
+		return false
+	}
+	name := s[:i]
+	upper := strings.ToUpper(name)
+	if name != upper && name != strings.ToLower(name) {
+		return false
+	}
+	for _, r := range upper {
+		if !(r == '-' || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	if _, ok := defaultTypes[upper]; ok {
+		return true
+	}
+	return otherProperties[upper] || (strings.HasPrefix(upper, "X-") && len(upper) > 2)
+}
+
+// otherProperties are property names that can start a content line, besides those in defaultTypes.
+var otherProperties = map[string]bool{
+	"BEGIN":  true,
+	"END":    true,
+	"EXRULE": true,
+	// RFC 7986
+	"NAME":             true,
+	"REFRESH-INTERVAL": true,
+	"SOURCE":           true,
+	"COLOR":            true,
+	"IMAGE":            true,
+	"CONFERENCE":       true,
+}
+
+// validFolding returns true if every physical line in folded ends with CRLF,
+// and is at most MaxLineOctets long.
+func validFolding(folded string) bool {
+	if folded == "" {
+		return false
+	}
+	for _, physical := range strings.SplitAfter(folded, "\n") {
+		if physical == "" {
+			continue
+		}
+		content, ok := strings.CutSuffix(physical, "\r\n")
+		if !ok || len(content) > MaxLineOctets || strings.Contains(content, "\r") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ParseError is returned when the input cannot be parsed.
+// Line is the 1-based physical line where the problem was found.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("ical parse error on line %d: %s", e.Line, e.Msg)
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Parse parses a VCALENDAR.
+// A leading UTF-8 byte order mark and leading/trailing blank lines are ignored.
+// It is an error for the input to contain anything but a single VCALENDAR.
+func Parse(b []byte) (*Calendar, error) {
+	root, err := ParseComponent(bytes.TrimPrefix(b, utf8BOM))
+	if err != nil {
+		return nil, err
+	}
+	if root.Name != VCalendar {
+		return nil, &ParseError{Line: 1, Msg: fmt.Sprintf("expected %s, got %s", VCalendar, root.Name)}
+	}
+	return &Calendar{Component: root}, nil
+}
+
+// ParseComponent parses a single component of any type, like a VEVENT.
+func ParseComponent(b []byte) (*Component, error) {
+	p := &parser{}
+	for _, ln := range unfold(b) {
+		if err := p.line(ln); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.stack) > 0 {
+		return nil, &ParseError{Line: p.lineNum, Msg: fmt.Sprintf("missing END:%s", p.stack[len(p.stack)-1].Name)}
+	}
+	if p.root == nil {
+		return nil, &ParseError{Line: p.lineNum, Msg: "no component found"}
+	}
+	return p.root, nil
+}
+
+type parser struct {
+	stack   []*Component
+	root    *Component
+	lineNum int
+}
+
+func (p *parser) line(ln logicalLine) error {
+	p.lineNum = ln.num
+	prop, err := parseContentLine(ln.text)
+	if err != nil {
+		return &ParseError{Line: ln.num, Msg: err.Error()}
+	}
+	prop.raw = &rawLine{folded: ln.folded, orig: *prop.clone()}
+	switch prop.Name {
+	case "BEGIN":
+		if p.root != nil && len(p.stack) == 0 {
+			return &ParseError{Line: ln.num, Msg: "unexpected content after END:" + p.root.Name}
+		}
+		c := &Component{Name: strings.ToUpper(prop.Value), begin: prop}
+		if len(p.stack) > 0 {
+			parent := p.stack[len(p.stack)-1]
+			parent.Components = append(parent.Components, c)
+		} else {
+			p.root = c
+		}
+		p.stack = append(p.stack, c)
+	case "END":
+		if len(p.stack) == 0 {
+			return &ParseError{Line: ln.num, Msg: "unexpected END:" + prop.Value}
+		}
+		c := p.stack[len(p.stack)-1]
+		if !strings.EqualFold(prop.Value, c.Name) {
+			return &ParseError{Line: ln.num, Msg: fmt.Sprintf("expected END:%s, got END:%s", c.Name, prop.Value)}
+		}
+		c.end = prop
+		p.stack = p.stack[:len(p.stack)-1]
+	default:
+		if len(p.stack) == 0 {
+			return &ParseError{Line: ln.num, Msg: "property outside of a component: " + prop.Name}
+		}
+		c := p.stack[len(p.stack)-1]
+		c.Properties = append(c.Properties, prop)
+	}
+	return nil
+}
+
+type logicalLine struct {
+	// text is the unfolded content line, without line endings.
+	text string
+	// folded is the original bytes of the line, including any folding and line endings.
+	folded string
+	// num is the physical line number the logical line started on.
+	num int
+}
+
+// unfold splits b into logical content lines (RFC 5545 section 3.1).
+// Both CRLF and bare LF line endings are accepted. Blank lines are skipped.
+func unfold(b []byte) []logicalLine {
+	var lines []logicalLine
+	var text strings.Builder
+	var folded strings.Builder
+	start := 0
+	flush := func() {
+		if folded.Len() > 0 {
+			lines = append(lines, logicalLine{text: text.String(), folded: folded.String(), num: start})
+		}
+		text.Reset()
+		folded.Reset()
+	}
+	num := 0
+	for len(b) > 0 {
+		num++
+		idx := bytes.IndexByte(b, '\n')
+		var physical []byte
+		if idx < 0 {
+			physical = b
+			b = nil
+		} else {
+			physical = b[:idx+1]
+			b = b[idx+1:]
+		}
+		content := bytes.TrimSuffix(bytes.TrimSuffix(physical, []byte{'\n'}), []byte{'\r'})
+		if len(content) > 0 && (content[0] == ' ' || content[0] == '\t') && folded.Len() > 0 {
+			text.Write(content[1:])
+			folded.Write(physical)
+			continue
+		}
+		flush()
+		if len(bytes.TrimSpace(content)) == 0 {
+			continue
+		}
+		start = num
+		text.Write(content)
+		folded.Write(physical)
+	}
+	flush()
+	return lines
+}
+
+// parseContentLine parses an unfolded line like NAME;PARAM=a,"b:c":value.
+func parseContentLine(s string) (*Property, error) {
+	i := strings.IndexAny(s, ";:")
+	if i < 0 {
+		return nil, fmt.Errorf("missing ':' in %q", truncate(s))
+	} else if i == 0 {
+		return nil, fmt.Errorf("missing property name in %q", truncate(s))
+	}
+	prop := &Property{Name: strings.ToUpper(s[:i])}
+	for s[i] == ';' {
+		i++
+		j := strings.IndexAny(s[i:], "=;:")
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated parameter in %s", prop.Name)
+		}
+		param := Param{Name: strings.ToUpper(s[i : i+j])}
+		i += j
+		if s[i] != '=' {
+			// Parameter without a value, which is invalid but harmless to keep.
+			prop.Params = append(prop.Params, param)
+			continue
+		}
+		i++
+		for {
+			if i < len(s) && s[i] == '"' {
+				end := strings.IndexByte(s[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated quoted value in %s;%s", prop.Name, param.Name)
+				}
+				param.Values = append(param.Values, s[i+1:i+1+end])
+				i += end + 2
+			} else {
+				end := strings.IndexAny(s[i:], ",;:")
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated parameter in %s;%s", prop.Name, param.Name)
+				}
+				param.Values = append(param.Values, s[i:i+end])
+				i += end
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("missing ':' in %s", prop.Name)
+			}
+			if s[i] != ',' {
+				break
+			}
+			i++
+		}
+		prop.Params = append(prop.Params, param)
+		if s[i] != ';' && s[i] != ':' {
+			return nil, fmt.Errorf("unexpected %q after parameter %s;%s", s[i], prop.Name, param.Name)
+		}
+	}
+	prop.Value = s[i+1:]
+	return prop, nil
+}
+
+func truncate(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
@@ -0,0 +1,497 @@
+package ical
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies, as used in the FREQ rule part.
+const (
+	FreqSecondly = "SECONDLY"
+	FreqMinutely = "MINUTELY"
+	FreqHourly   = "HOURLY"
+	FreqDaily    = "DAILY"
+	FreqWeekly   = "WEEKLY"
+	FreqMonthly  = "MONTHLY"
+	FreqYearly   = "YEARLY"
+)
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// WeekdayNum is an entry in BYDAY, like MO (N is 0), 1MO (first Monday), or -1FR (last Friday).
+type WeekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// Recur is a RECUR value (RFC 5545 section 3.3.10), as used by RRULE.
+type Recur struct {
+	Freq     string
+	Interval int
+	Count    int
+	// Until is the UNTIL rule part, or zero if there is none.
+	// If UntilDate is true, it was a DATE, and Until is midnight of that date.
+	Until      time.Time
+	UntilDate  bool
+	BySecond   []int
+	ByMinute   []int
+	ByHour     []int
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByYearDay  []int
+	ByWeekNo   []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+// ParseRecur parses a RECUR value like "FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20240101T000000Z".
+// A floating UNTIL is interpreted in loc.
+func ParseRecur(s string, loc *time.Location) (*Recur, error) {
+	r := &Recur{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(v)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(v)
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(v)
+			if err == nil && r.Count < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "UNTIL":
+			r.Until, r.UntilDate, err = parseDateTime(v, loc)
+		case "BYSECOND":
+			r.BySecond, err = parseRecurInts(v, 0, 60, false)
+		case "BYMINUTE":
+			r.ByMinute, err = parseRecurInts(v, 0, 59, false)
+		case "BYHOUR":
+			r.ByHour, err = parseRecurInts(v, 0, 23, false)
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseRecurInts(v, 1, 31, true)
+		case "BYYEARDAY":
+			r.ByYearDay, err = parseRecurInts(v, 1, 366, true)
+		case "BYWEEKNO":
+			r.ByWeekNo, err = parseRecurInts(v, 1, 53, true)
+		case "BYMONTH":
+			r.ByMonth, err = parseRecurInts(v, 1, 12, false)
+		case "BYSETPOS":
+			r.BySetPos, err = parseRecurInts(v, 1, 366, true)
+		case "BYDAY":
+			for _, item := range strings.Split(v, ",") {
+				item = strings.ToUpper(strings.TrimSpace(item))
+				if len(item) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", item)
+				}
+				wd, ok := weekdays[item[len(item)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", item)
+				}
+				wn := WeekdayNum{Weekday: wd}
+				if n := item[:len(item)-2]; n != "" {
+					if wn.N, err = strconv.Atoi(n); err != nil || wn.N == 0 || wn.N < -53 || wn.N > 53 {
+						return nil, fmt.Errorf("invalid BYDAY %q", item)
+					}
+				}
+				r.ByDay = append(r.ByDay, wn)
+			}
+		case "WKST":
+			wd, ok := weekdays[strings.ToUpper(v)]
+			if !ok {
+				return nil, fmt.Errorf("invalid WKST %q", v)
+			}
+			r.WeekStart = wd
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", strings.ToUpper(k), err)
+		}
+	}
+	switch r.Freq {
+	case FreqSecondly, FreqMinutely, FreqHourly, FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+	case "":
+		return nil, fmt.Errorf("FREQ is required")
+	default:
+		return nil, fmt.Errorf("invalid FREQ %q", r.Freq)
+	}
+	return r, nil
+}
+
+func parseRecurInts(v string, min, max int, allowNegative bool) ([]int, error) {
+	var r []int
+	for _, item := range strings.Split(v, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		abs := i
+		if allowNegative && i < 0 {
+			abs = -i
+		}
+		if abs < min || abs > max {
+			return nil, fmt.Errorf("%d out of range", i)
+		}
+		r = append(r, i)
+	}
+	return r, nil
+}
+
+// maxRecurPeriods limits how many periods (years for YEARLY, days for DAILY, etc.)
+// are examined by Occurrences, so pathological rules cannot run forever.
+const maxRecurPeriods = 500_000
+
+// Occurrences returns the start times of the recurrence set generated by the rule,
+// which are before end. Times are in the location of dtstart,
+// and wall-clock fields (like the hour of each occurrence) are kept across DST changes.
+// DTSTART is always the first occurrence (RFC 5545 section 3.8.5.3), even if it does not match the rule.
+func (r *Recur) Occurrences(dtstart, end time.Time) []time.Time {
+	var result []time.Time
+	r.each(dtstart, end, maxRecurPeriods, func(t time.Time) bool {
+		result = append(result, t)
+		return true
+	})
+	return result
+}
+
+// each calls fn with each occurrence (see Occurrences) in order, until fn returns false.
+// At most maxPeriods periods are examined, whether or not they have any occurrences.
+// Returns false if that limit stopped it before the rule's end, or end, was reached.
+func (r *Recur) each(dtstart, end time.Time, maxPeriods int, fn func(time.Time) bool) bool {
+	if !dtstart.Before(end) {
+		return true
+	}
+	loc := dtstart.Location()
+	start := naive(dtstart)
+	limit := naive(end.In(loc))
+	rr := r.withDefaults(start)
+	count := 1
+	if !fn(dtstart) || rr.Count == 1 {
+		return true
+	}
+	period := rr.firstPeriod(start)
+	for i := 0; !period.After(limit); i++ {
+		if i >= maxPeriods {
+			return false
+		}
+		for _, cand := range rr.candidates(period) {
+			if !cand.After(start) {
+				continue
+			}
+			t := time.Date(cand.Year(), cand.Month(), cand.Day(), cand.Hour(), cand.Minute(), cand.Second(), 0, loc)
+			if !t.Before(end) || rr.pastUntil(t) {
+				return true
+			}
+			count++
+			if !fn(t) || (rr.Count > 0 && count >= rr.Count) {
+				return true
+			}
+		}
+		period = rr.nextPeriod(period)
+	}
+	return true
+}
+
+// naive returns the wall-clock fields of t as a UTC time,
+// so they can be manipulated without worrying about DST.
+func naive(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func (r *Recur) pastUntil(t time.Time) bool {
+	if r.Until.IsZero() {
+		return false
+	}
+	if r.UntilDate {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(naive(r.Until))
+	}
+	return t.After(r.Until)
+}
+
+// withDefaults returns a copy of the rule with the parts implied by dtstart filled in.
+// For example, FREQ=MONTHLY with no other parts recurs on the day of the month of dtstart.
+func (r *Recur) withDefaults(start time.Time) *Recur {
+	rr := *r
+	if len(rr.ByWeekNo) == 0 && len(rr.ByYearDay) == 0 && len(rr.ByMonthDay) == 0 && len(rr.ByDay) == 0 {
+		switch rr.Freq {
+		case FreqYearly:
+			if len(rr.ByMonth) == 0 {
+				rr.ByMonth = []int{int(start.Month())}
+			}
+			rr.ByMonthDay = []int{start.Day()}
+		case FreqMonthly:
+			rr.ByMonthDay = []int{start.Day()}
+		case FreqWeekly:
+			rr.ByDay = []WeekdayNum{{Weekday: start.Weekday()}}
+		}
+	}
+	if len(rr.ByHour) == 0 && rr.freqRank() > hourlyRank {
+		rr.ByHour = []int{start.Hour()}
+	}
+	if len(rr.ByMinute) == 0 && rr.freqRank() > minutelyRank {
+		rr.ByMinute = []int{start.Minute()}
+	}
+	if len(rr.BySecond) == 0 && rr.freqRank() > secondlyRank {
+		rr.BySecond = []int{start.Second()}
+	}
+	return &rr
+}
+
+const (
+	secondlyRank = iota
+	minutelyRank
+	hourlyRank
+	dailyRank
+	weeklyRank
+	monthlyRank
+	yearlyRank
+)
+
+func (r *Recur) freqRank() int {
+	switch r.Freq {
+	case FreqSecondly:
+		return secondlyRank
+	case FreqMinutely:
+		return minutelyRank
+	case FreqHourly:
+		return hourlyRank
+	case FreqDaily:
+		return dailyRank
+	case FreqWeekly:
+		return weeklyRank
+	case FreqMonthly:
+		return monthlyRank
+	}
+	return yearlyRank
+}
+
+func (r *Recur) firstPeriod(start time.Time) time.Time {
+	y, m, d := start.Date()
+	switch r.Freq {
+	case FreqYearly:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	case FreqMonthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case FreqWeekly:
+		offset := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, time.UTC)
+	case FreqDaily:
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case FreqHourly:
+		return start.Truncate(time.Hour)
+	case FreqMinutely:
+		return start.Truncate(time.Minute)
+	}
+	return start
+}
+
+func (r *Recur) nextPeriod(p time.Time) time.Time {
+	switch r.Freq {
+	case FreqYearly:
+		return p.AddDate(r.Interval, 0, 0)
+	case FreqMonthly:
+		return p.AddDate(0, r.Interval, 0)
+	case FreqWeekly:
+		return p.AddDate(0, 0, 7*r.Interval)
+	case FreqDaily:
+		return p.AddDate(0, 0, r.Interval)
+	case FreqHourly:
+		return p.Add(time.Duration(r.Interval) * time.Hour)
+	case FreqMinutely:
+		return p.Add(time.Duration(r.Interval) * time.Minute)
+	}
+	return p.Add(time.Duration(r.Interval) * time.Second)
+}
+
+// candidates returns the sorted (naive) times in the period that match the rule,
+// after applying BYSETPOS.
+func (r *Recur) candidates(period time.Time) []time.Time {
+	var days []time.Time
+	y, m, _ := period.Date()
+	switch r.Freq {
+	case FreqYearly:
+		if len(r.ByMonth) > 0 {
+			// Days outside of BYMONTH are never matched, so avoid checking the whole year.
+			for _, bm := range r.ByMonth {
+				days = append(days, monthDays(y, time.Month(bm))...)
+			}
+			break
+		}
+		for d := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC); d.Year() == y; d = d.AddDate(0, 0, 1) {
+			days = append(days, d)
+		}
+	case FreqMonthly:
+		days = monthDays(y, m)
+	case FreqWeekly:
+		for i := 0; i < 7; i++ {
+			days = append(days, period.AddDate(0, 0, i))
+		}
+	default:
+		days = append(days, time.Date(y, m, period.Day(), 0, 0, 0, 0, time.UTC))
+	}
+	var result []time.Time
+	for _, d := range days {
+		if !r.matchesDay(d) {
+			continue
+		}
+		for _, h := range r.timeParts(r.ByHour, period.Hour(), hourlyRank) {
+			for _, mi := range r.timeParts(r.ByMinute, period.Minute(), minutelyRank) {
+				for _, s := range r.timeParts(r.BySecond, period.Second(), secondlyRank) {
+					result = append(result, d.Add(time.Duration(h)*time.Hour+time.Duration(mi)*time.Minute+time.Duration(s)*time.Second))
+				}
+			}
+		}
+	}
+	slices.SortFunc(result, time.Time.Compare)
+	result = slices.CompactFunc(result, time.Time.Equal)
+	if len(r.BySetPos) == 0 {
+		return result
+	}
+	var selected []time.Time
+	for i, t := range result {
+		for _, pos := range r.BySetPos {
+			if pos == i+1 || pos == i-len(result) {
+				selected = append(selected, t)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func monthDays(y int, m time.Month) []time.Time {
+	var days []time.Time
+	for d := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC); d.Month() == m; d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// timeParts returns the values of a time part (hour, minute, second) in a period.
+// If the frequency is coarser than the part, these are the BYxxx values (see withDefaults);
+// otherwise the period determines the part, and BYxxx only limits it.
+func (r *Recur) timeParts(by []int, periodValue int, rank int) []int {
+	if r.freqRank() > rank {
+		return by
+	}
+	if len(by) == 0 || slices.Contains(by, periodValue) {
+		return []int{periodValue}
+	}
+	return nil
+}
+
+func (r *Recur) matchesDay(d time.Time) bool {
+	if len(r.ByMonth) > 0 && !slices.Contains(r.ByMonth, int(d.Month())) {
+		return false
+	}
+	if len(r.ByWeekNo) > 0 {
+		n, total := weekNumber(d, r.WeekStart)
+		if !matchesOrdinal(r.ByWeekNo, n, total) {
+			return false
+		}
+	}
+	if len(r.ByYearDay) > 0 {
+		total := time.Date(d.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay()
+		if !matchesOrdinal(r.ByYearDay, d.YearDay(), total) {
+			return false
+		}
+	}
+	if len(r.ByMonthDay) > 0 {
+		total := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		if !matchesOrdinal(r.ByMonthDay, d.Day(), total) {
+			return false
+		}
+	}
+	if len(r.ByDay) > 0 && !r.matchesWeekday(d) {
+		return false
+	}
+	return true
+}
+
+func (r *Recur) matchesWeekday(d time.Time) bool {
+	for _, wn := range r.ByDay {
+		if wn.Weekday != d.Weekday() {
+			continue
+		}
+		// Ordinals are only meaningful within a month or year.
+		if wn.N == 0 || (r.Freq != FreqMonthly && r.Freq != FreqYearly) {
+			return true
+		}
+		// Within a YEARLY rule, BYMONTH makes the ordinal relative to the month.
+		var first, last time.Time
+		if r.Freq == FreqMonthly || len(r.ByMonth) > 0 {
+			first = time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+			last = first.AddDate(0, 1, -1)
+		} else {
+			first = time.Date(d.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+			last = time.Date(d.Year(), 12, 31, 0, 0, 0, 0, time.UTC)
+		}
+		if wn.N == daysBetween(first, d)/7+1 || wn.N == -(daysBetween(d, last)/7+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesOrdinal returns true if n (1-based, out of total) is in ordinals,
+// where negative ordinals count from the end (-1 is the last).
+func matchesOrdinal(ordinals []int, n, total int) bool {
+	for _, o := range ordinals {
+		if o == n || o == n-total-1 {
+			return true
+		}
+	}
+	return false
+}
+
+func daysBetween(a, b time.Time) int {
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// weekNumber returns the week number of d, and the number of weeks in its week-numbering year.
+// Week 1 is the first week (starting on wkst) with at least four days in the calendar year,
+// so the first and last days of a year can be part of the adjacent year's weeks.
+func weekNumber(d time.Time, wkst time.Weekday) (int, int) {
+	y := d.Year()
+	start := weekOneStart(y, wkst)
+	if d.Before(start) {
+		y--
+		start = weekOneStart(y, wkst)
+	} else if next := weekOneStart(y+1, wkst); !d.Before(next) {
+		y++
+		start = next
+	}
+	total := daysBetween(start, weekOneStart(y+1, wkst)) / 7
+	return daysBetween(start, d)/7 + 1, total
+}
+
+func weekOneStart(year int, wkst time.Weekday) time.Time {
+	jan1 := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(jan1.Weekday()) - int(wkst) + 7) % 7
+	if offset <= 3 {
+		return jan1.AddDate(0, 0, -offset)
+	}
+	return jan1.AddDate(0, 0, 7-offset)
+}
@@ -0,0 +1,51 @@
+package ical
+
+import "slices"
+
+// BusySummary is the SUMMARY of events in a calendar returned from BusyOnly.
+const BusySummary = "Busy"
+
+// BusyProperties are the only properties BusyOnly keeps on events, to-dos, and journal entries,
+// since they say when the component is, but not what it is about or who is attending it.
+// Anything else, including vendor X- properties (like X-APPLE-STRUCTURED-LOCATION), is removed.
+var BusyProperties = []string{
+	"UID", "DTSTAMP", "SEQUENCE", "DTSTART", "DTEND", "DUE", "DURATION",
+	"RRULE", "RDATE", "EXDATE", "RECURRENCE-ID", "TRANSP", "STATUS",
+}
+
+// BusyFreeBusyProperties are the only properties BusyOnly keeps on VFREEBUSY components.
+var BusyFreeBusyProperties = []string{"UID", "DTSTAMP", "DTSTART", "DTEND", "FREEBUSY"}
+
+// BusyCalendarProperties are the only calendar-level properties BusyOnly keeps,
+// so names and descriptions like X-WR-CALNAME and X-WR-CALDESC are removed.
+var BusyCalendarProperties = []string{"VERSION", "PRODID", "CALSCALE", "METHOD"}
+
+// BusyOnly returns a copy of the calendar that only says when events, to-dos, and journal entries are,
+// not what they are: only BusyProperties are kept, and their SUMMARY is BusySummary.
+// VFREEBUSY components keep only BusyFreeBusyProperties, and the calendar keeps only BusyCalendarProperties.
+// VTIMEZONEs are not changed, and any other components (like alarms) are removed.
+func (c *Calendar) BusyOnly() *Calendar {
+	cp := c.Clone()
+	keepProps(cp.Component, BusyCalendarProperties)
+	cp.Components = slices.DeleteFunc(cp.Components, func(ch *Component) bool {
+		switch ch.Name {
+		case VTimezone:
+		case VFreeBusy:
+			keepProps(ch, BusyFreeBusyProperties)
+			ch.Components = nil
+		case VEvent, VTodo, VJournal:
+			keepProps(ch, append([]string{"SUMMARY"}, BusyProperties...))
+			ch.SetProp("SUMMARY", BusySummary)
+			ch.Components = nil
+		default:
+			return true
+		}
+		return false
+	})
+	return cp
+}
+
+// keepProps removes all properties of the component except those with the given (uppercase) names.
+func keepProps(c *Component, names []string) {
+	c.Properties = slices.DeleteFunc(c.Properties, func(p *Property) bool { return !slices.Contains(names, p.Name) })
+}
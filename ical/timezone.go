@@ -0,0 +1,228 @@
+package ical
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDateTime parses a DATE or DATE-TIME value. Values ending in Z are UTC,
+// and other values are interpreted in loc. The returned bool is true if the value is a DATE,
+// in which case the time is midnight in loc.
+func parseDateTime(v string, loc *time.Location) (time.Time, bool, error) {
+	if len(v) == 8 {
+		t, err := time.ParseInLocation("20060102", v, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(v, "Z") || strings.HasSuffix(v, "z") {
+		t, err := time.Parse("20060102T150405", v[:len(v)-1])
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, err
+}
+
+// parseUTCOffset parses a UTC-OFFSET value like -0500 or +013045 into seconds east of UTC.
+func parseUTCOffset(v string) (int, error) {
+	if len(v) != 5 && len(v) != 7 || (v[0] != '+' && v[0] != '-') {
+		return 0, fmt.Errorf("invalid utc offset %q", v)
+	}
+	secs := 0
+	for i, mult := range []int{3600, 60, 1} {
+		if 1+i*2 >= len(v) {
+			break
+		}
+		n, err := strconv.Atoi(v[1+i*2 : 3+i*2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid utc offset %q", v)
+		}
+		secs += n * mult
+	}
+	if v[0] == '-' {
+		secs = -secs
+	}
+	return secs, nil
+}
+
+// zoneResolver finds the location for TZID parameters,
+// using the VTIMEZONE components of a calendar, or the IANA time zone database if there is no VTIMEZONE.
+// Floating values, and TZIDs that cannot be resolved, use the floating location.
+type zoneResolver struct {
+	cal      *Calendar
+	floating *time.Location
+	cache    map[string]*time.Location
+}
+
+func newZoneResolver(cal *Calendar, floating *time.Location) *zoneResolver {
+	return &zoneResolver{cal: cal, floating: floating, cache: make(map[string]*time.Location)}
+}
+
+func (z *zoneResolver) location(tzid string) *time.Location {
+	if tzid == "" {
+		return z.floating
+	}
+	if loc, ok := z.cache[tzid]; ok {
+		return loc
+	}
+	loc := z.floating
+	if tz := z.cal.Timezone(tzid); tz != nil {
+		if l, err := vtimezoneLocation(tzid, tz); err == nil {
+			loc = l
+		}
+	}
+	if loc == z.floating {
+		if l, ok := ianaLocation(tzid); ok {
+			loc = l
+		}
+	}
+	z.cache[tzid] = loc
+	return loc
+}
+
+// ianaLocation loads the location for a TZID from the IANA time zone database.
+// Windows time zone names (like "Eastern Standard Time") are mapped to their IANA equivalent.
+func ianaLocation(tzid string) (*time.Location, bool) {
+	// TZIDs starting with a slash are 'globally unique', which in practice means an IANA name.
+	// Avoid "Local", which would use the server's time zone.
+	name := strings.TrimPrefix(tzid, "/")
+	if iana, ok := windowsZones[name]; ok {
+		name = iana
+	}
+	if name == "Local" || name == "" {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(name)
+	return loc, err == nil
+}
+
+// propTime parses the DATE or DATE-TIME value of a property like DTSTART, using its TZID.
+func (z *zoneResolver) propTime(p *Property) (time.Time, bool, error) {
+	return parseDateTime(p.Value, z.location(p.Param("TZID")))
+}
+
+// maxTimezoneYear is how far into the future VTIMEZONE rules are expanded.
+// After this, the last observance is used.
+const maxTimezoneYear = 2100
+
+// vtimezoneLocation builds a location from the STANDARD and DAYLIGHT observances in a VTIMEZONE.
+func vtimezoneLocation(tzid string, tz *Component) (*time.Location, error) {
+	type transition struct {
+		at   int64
+		from int
+		zone tzifZone
+	}
+	var transitions []transition
+	end := time.Date(maxTimezoneYear, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, obs := range tz.Components {
+		if obs.Name != Standard && obs.Name != Daylight {
+			continue
+		}
+		from, err := parseUTCOffset(obs.PropValue("TZOFFSETFROM"))
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseUTCOffset(obs.PropValue("TZOFFSETTO"))
+		if err != nil {
+			return nil, err
+		}
+		// Onsets are in local time (before the transition), so work with them as UTC and adjust afterwards.
+		dtstart, _, err := parseDateTime(obs.PropValue("DTSTART"), time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		onsets := []time.Time{dtstart}
+		for _, rrule := range obs.Props("RRULE") {
+			if r, err := ParseRecur(rrule.Value, time.UTC); err == nil {
+				onsets = append(onsets, r.Occurrences(dtstart, end)...)
+			}
+		}
+		for _, rdate := range obs.Props("RDATE") {
+			for _, v := range strings.Split(rdate.Value, ",") {
+				if t, _, err := parseDateTime(v, time.UTC); err == nil {
+					onsets = append(onsets, t)
+				}
+			}
+		}
+		zone := tzifZone{offset: to, dst: obs.Name == Daylight, name: obs.PropValue("TZNAME")}
+		for _, onset := range onsets {
+			transitions = append(transitions, transition{at: onset.Unix() - int64(from), from: from, zone: zone})
+		}
+	}
+	if len(transitions) == 0 {
+		return nil, fmt.Errorf("VTIMEZONE %s has no observances", tzid)
+	}
+	slices.SortStableFunc(transitions, func(a, b transition) int { return cmp.Compare(a.at, b.at) })
+	// The first zone is used before the first transition, which is the offset it transitions from.
+	zones := []tzifZone{{offset: transitions[0].from}}
+	var times []int64
+	var indices []byte
+	for _, t := range transitions {
+		idx := slices.Index(zones, t.zone)
+		if idx < 0 {
+			if len(zones) == 255 {
+				return nil, fmt.Errorf("VTIMEZONE %s has too many observances", tzid)
+			}
+			zones = append(zones, t.zone)
+			idx = len(zones) - 1
+		}
+		if n := len(times); n > 0 && times[n-1] == t.at {
+			indices[n-1] = byte(idx)
+			continue
+		}
+		times = append(times, t.at)
+		indices = append(indices, byte(idx))
+	}
+	return time.LoadLocationFromTZData(tzid, encodeTZif(zones, times, indices))
+}
+
+type tzifZone struct {
+	offset int
+	dst    bool
+	name   string
+}
+
+// encodeTZif returns the zones and transitions encoded in the TZif format (RFC 8536),
+// so they can be loaded as a time.Location. Only the version 2 (64-bit) data is written.
+func encodeTZif(zones []tzifZone, times []int64, indices []byte) []byte {
+	var abbrevs []byte
+	abbrevIdx := make([]byte, len(zones))
+	for i, z := range zones {
+		abbrevIdx[i] = byte(len(abbrevs))
+		abbrevs = append(abbrevs, z.name...)
+		abbrevs = append(abbrevs, 0)
+	}
+	b := &bytes.Buffer{}
+	header := func(timecnt, typecnt, charcnt int) {
+		b.WriteString("TZif2")
+		b.Write(make([]byte, 15))
+		// isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt
+		for _, n := range []int{0, 0, 0, timecnt, typecnt, charcnt} {
+			_ = binary.Write(b, binary.BigEndian, uint32(n))
+		}
+	}
+	// Empty version 1 data, which readers of version 2 skip.
+	header(0, 0, 0)
+	header(len(times), len(zones), len(abbrevs))
+	for _, t := range times {
+		_ = binary.Write(b, binary.BigEndian, t)
+	}
+	b.Write(indices)
+	for i, z := range zones {
+		_ = binary.Write(b, binary.BigEndian, int32(z.offset))
+		if z.dst {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+		b.WriteByte(abbrevIdx[i])
+	}
+	b.Write(abbrevs)
+	// Empty footer (no POSIX TZ string), so the last transition applies forever.
+	b.WriteString("\n\n")
+	return b.Bytes()
+}
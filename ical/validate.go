@@ -0,0 +1,215 @@
+package ical
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ValidationStatus summarizes a Validation.
+type ValidationStatus string
+
+const (
+	// ValidationValid means no issues were found.
+	ValidationValid ValidationStatus = "valid"
+	// ValidationWarnings means the calendar breaks RFC 5545 in ways most clients tolerate,
+	// like a missing DTSTAMP or an unknown TZID.
+	ValidationWarnings ValidationStatus = "warnings"
+	// ValidationInvalid means the calendar cannot be parsed,
+	// or has components that cannot be interpreted, like an event without a valid DTSTART.
+	ValidationInvalid ValidationStatus = "invalid"
+)
+
+// Severity is how serious a ValidationIssue is.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// MaxValidationIssues is the most issues listed in a Validation.
+// Issues past this are still counted in Errors and Warnings.
+const MaxValidationIssues = 100
+
+// ValidationIssue is a single problem found in a calendar.
+type ValidationIssue struct {
+	Severity Severity `json:"severity"`
+	// Line is the 1-based line of the problem. It is only known for parse errors.
+	Line int `json:"line,omitempty"`
+	// Component is the name of the component with the problem, like VEVENT.
+	Component string `json:"component,omitempty"`
+	// UID is the UID of the component with the problem, if it has one.
+	UID      string `json:"uid,omitempty"`
+	Property string `json:"property,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Validation is the result of checking a calendar against the basics of RFC 5545.
+type Validation struct {
+	Status   ValidationStatus  `json:"status"`
+	Errors   int               `json:"errors"`
+	Warnings int               `json:"warnings"`
+	Issues   []ValidationIssue `json:"issues"`
+}
+
+// Validate checks that b is a well-formed VCALENDAR (balanced BEGIN/END lines),
+// that components have their required properties, that date and time values and RRULEs can be parsed,
+// and that every TZID is defined by a VTIMEZONE or is in the IANA time zone database.
+// It is not a complete RFC 5545 validator; it looks for the problems that break clients in practice.
+func Validate(b []byte) *Validation {
+	v := &Validation{Issues: []ValidationIssue{}}
+	cal, err := Parse(b)
+	if err != nil {
+		issue := ValidationIssue{Severity: SeverityError, Message: err.Error()}
+		var perr *ParseError
+		if errors.As(err, &perr) {
+			issue.Line = perr.Line
+			issue.Message = perr.Msg
+		}
+		v.add(issue)
+	} else {
+		cv := &calendarValidator{v: v, cal: cal, zr: newZoneResolver(cal, time.UTC)}
+		cv.calendar()
+	}
+	switch {
+	case v.Errors > 0:
+		v.Status = ValidationInvalid
+	case v.Warnings > 0:
+		v.Status = ValidationWarnings
+	default:
+		v.Status = ValidationValid
+	}
+	return v
+}
+
+func (v *Validation) add(issue ValidationIssue) {
+	if issue.Severity == SeverityError {
+		v.Errors++
+	} else {
+		v.Warnings++
+	}
+	if len(v.Issues) < MaxValidationIssues {
+		v.Issues = append(v.Issues, issue)
+	}
+}
+
+type calendarValidator struct {
+	v   *Validation
+	cal *Calendar
+	// zr resolves TZIDs. Only whether values are valid matters, so floating times use UTC.
+	zr *zoneResolver
+}
+
+func (cv *calendarValidator) issue(sev Severity, c *Component, prop string, msg string, args ...any) {
+	cv.v.add(ValidationIssue{
+		Severity:  sev,
+		Component: c.Name,
+		UID:       c.PropValue("UID"),
+		Property:  prop,
+		Message:   fmt.Sprintf(msg, args...),
+	})
+}
+
+// dateTimeProps are the properties whose values are DATE or DATE-TIME lists.
+// RDATE values can also be PERIODs, which start with a DATE-TIME.
+var dateTimeProps = []string{"DTSTART", "DTEND", "DUE", "RECURRENCE-ID", "DTSTAMP", "CREATED", "LAST-MODIFIED", "COMPLETED", "EXDATE", "RDATE"}
+
+func (cv *calendarValidator) calendar() {
+	for _, name := range []string{"VERSION", "PRODID"} {
+		if cv.cal.Prop(name) == nil {
+			cv.issue(SeverityWarning, cv.cal.Component, name, "missing required property")
+		}
+	}
+	for _, c := range cv.cal.Components {
+		switch c.Name {
+		case VEvent:
+			cv.required(c, SeverityError, "UID", "DTSTART")
+			cv.required(c, SeverityWarning, "DTSTAMP")
+			cv.schedule(c, "DTEND")
+		case VTodo:
+			cv.required(c, SeverityError, "UID")
+			cv.required(c, SeverityWarning, "DTSTAMP")
+			cv.schedule(c, "DUE")
+		case VJournal, VFreeBusy:
+			cv.required(c, SeverityError, "UID")
+			cv.required(c, SeverityWarning, "DTSTAMP")
+		case VTimezone:
+			cv.timezone(c)
+		}
+		cv.values(c)
+	}
+}
+
+func (cv *calendarValidator) required(c *Component, sev Severity, names ...string) {
+	for _, name := range names {
+		if c.Prop(name) == nil {
+			cv.issue(sev, c, name, "missing required property")
+		}
+	}
+}
+
+// schedule checks the DTSTART, end (DTEND or DUE), DURATION, and RRULE of an event or to-do.
+func (cv *calendarValidator) schedule(c *Component, endProp string) {
+	end, dur := c.Prop(endProp), c.Prop("DURATION")
+	if end != nil && dur != nil {
+		cv.issue(SeverityError, c, endProp, "cannot have both %s and DURATION", endProp)
+	}
+	if dur != nil {
+		if _, err := parseDuration(dur.Value); err != nil {
+			cv.issue(SeverityError, c, "DURATION", "invalid duration %q", dur.Value)
+		}
+	}
+	if start := c.Prop("DTSTART"); start != nil && end != nil {
+		st, _, serr := cv.zr.propTime(start)
+		et, _, eerr := cv.zr.propTime(end)
+		if serr == nil && eerr == nil && et.Before(st) {
+			cv.issue(SeverityError, c, endProp, "%s is before DTSTART", endProp)
+		}
+	}
+	for _, rrule := range c.Props("RRULE") {
+		if _, err := ParseRecur(rrule.Value, time.UTC); err != nil {
+			cv.issue(SeverityError, c, "RRULE", "invalid rule: %s", err.Error())
+		}
+	}
+}
+
+func (cv *calendarValidator) timezone(c *Component) {
+	tzid := c.PropValue("TZID")
+	if tzid == "" {
+		cv.issue(SeverityError, c, "TZID", "missing required property")
+		return
+	}
+	if _, err := vtimezoneLocation(tzid, c); err != nil {
+		cv.issue(SeverityError, c, "", "invalid time zone %s: %s", tzid, err.Error())
+	}
+}
+
+// values checks the date and time values and TZIDs of the properties of c and its children.
+func (cv *calendarValidator) values(c *Component) {
+	for _, p := range c.Properties {
+		if tzid := p.Param("TZID"); tzid != "" && cv.cal.Timezone(tzid) == nil {
+			if _, ok := ianaLocation(tzid); !ok {
+				cv.issue(SeverityWarning, c, p.Name, "unknown TZID %q", tzid)
+			}
+		}
+		if c.Name == Standard || c.Name == Daylight {
+			// Observances are checked by timezone.
+			continue
+		}
+		if !slices.Contains(dateTimeProps, p.Name) {
+			continue
+		}
+		for _, s := range splitEscaped(p.Value, ',') {
+			start, _, _ := strings.Cut(s, "/")
+			if _, _, err := parseDateTime(start, time.UTC); err != nil {
+				cv.issue(SeverityError, c, p.Name, "invalid date or date-time %q", s)
+			}
+		}
+	}
+	for _, ch := range c.Components {
+		cv.values(ch)
+	}
+}
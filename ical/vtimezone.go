@@ -0,0 +1,236 @@
+package ical
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	// Embed the IANA time zone database, so VTIMEZONEs can be generated
+	// even if the host has no (or an outdated) zoneinfo installed.
+	_ "time/tzdata"
+)
+
+// AddMissingTimezones adds a VTIMEZONE for every TZID that is used in the calendar
+// but has no VTIMEZONE, generated from the IANA time zone database.
+// Windows time zone names (like "Eastern Standard Time") are generated from their IANA equivalent,
+// but keep the TZID used in the calendar. TZIDs that cannot be resolved are left alone.
+// Transitions are described from the earliest year the TZID is used through the year after now;
+// yearly rules still in effect at that point are written as RRULEs, so they continue indefinitely.
+// Returns the TZIDs that were added, in the order they were added.
+func (c *Calendar) AddMissingTimezones(now time.Time) []string {
+	earliest := make(map[string]int)
+	var missing []string
+	var walk func(comp *Component)
+	walk = func(comp *Component) {
+		if comp.Name == VTimezone {
+			return
+		}
+		for _, p := range comp.Properties {
+			tzid := p.Param("TZID")
+			if tzid == "" || c.Timezone(tzid) != nil {
+				continue
+			}
+			if _, ok := earliest[tzid]; !ok {
+				earliest[tzid] = now.Year()
+				missing = append(missing, tzid)
+			}
+			for _, v := range splitEscaped(p.Value, ',') {
+				start, _, _ := strings.Cut(v, "/")
+				if t, _, err := parseDateTime(start, time.UTC); err == nil && t.Year() < earliest[tzid] {
+					earliest[tzid] = t.Year()
+				}
+			}
+		}
+		for _, ch := range comp.Components {
+			walk(ch)
+		}
+	}
+	walk(c.Component)
+	var added []string
+	for _, tzid := range missing {
+		loc, ok := ianaLocation(tzid)
+		if !ok {
+			continue
+		}
+		fromYear := max(earliest[tzid], minGeneratedTimezoneYear)
+		tz := generateVTimezone(tzid, loc, fromYear, now.Year()+1)
+		// VTIMEZONEs conventionally come before other components, so put it after the last one.
+		idx := 0
+		for i, ch := range c.Components {
+			if ch.Name == VTimezone {
+				idx = i + 1
+			}
+		}
+		c.Components = slices.Insert(c.Components, idx, tz)
+		added = append(added, tzid)
+	}
+	return added
+}
+
+// minGeneratedTimezoneYear is the earliest year generated VTIMEZONEs describe,
+// so a single ancient date (like a birthday) does not pull in a century of history.
+const minGeneratedTimezoneYear = 1970
+
+type zoneTransition struct {
+	// onset is the local time of the transition, before it happens (as UTC wall-clock fields).
+	onset time.Time
+	from  int
+	to    int
+	dst   bool
+	name  string
+}
+
+// generateVTimezone returns a VTIMEZONE describing the transitions of loc
+// from the start of fromYear through the end of toYear.
+func generateVTimezone(tzid string, loc *time.Location, fromYear, toYear int) *Component {
+	tz := NewComponent(VTimezone)
+	tz.AddProp("TZID", tzid)
+	tz.AddProp("X-LIC-LOCATION", loc.String())
+
+	start := time.Date(fromYear, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(toYear+1, 1, 1, 0, 0, 0, 0, loc)
+	var transitions []zoneTransition
+	for t := start; ; {
+		_, next := t.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		_, from := next.Add(-time.Second).Zone()
+		name, to := next.Zone()
+		transitions = append(transitions, zoneTransition{
+			onset: next.UTC().Add(time.Duration(from) * time.Second),
+			from:  from,
+			to:    to,
+			dst:   next.IsDST(),
+			name:  name,
+		})
+		t = next
+	}
+	if len(transitions) == 0 {
+		// The zone has a fixed offset for the whole range.
+		name, offset := start.Zone()
+		tz.Components = append(tz.Components, observance(zoneTransition{
+			onset: time.Date(fromYear, 1, 1, 0, 0, 0, 0, time.UTC),
+			from:  offset,
+			to:    offset,
+			dst:   start.IsDST(),
+			name:  name,
+		}))
+		return tz
+	}
+
+	// Group transitions with the same offsets and name into a single observance,
+	// described with an RRULE for the recent years that follow a rule, and RDATEs for the rest.
+	type groupKey struct {
+		from, to int
+		dst      bool
+		name     string
+	}
+	groups := make(map[groupKey][]zoneTransition)
+	var keys []groupKey
+	for _, tr := range transitions {
+		k := groupKey{tr.from, tr.to, tr.dst, tr.name}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], tr)
+	}
+	var observances []*Component
+	for _, k := range keys {
+		g := groups[k]
+		ruleStart, rrule := yearlyRule(g, toYear)
+		if ruleStart < len(g) {
+			obs := observance(g[ruleStart])
+			obs.AddProp("RRULE", rrule)
+			observances = append(observances, obs)
+		}
+		if ruleStart > 0 {
+			obs := observance(g[0])
+			if ruleStart > 1 {
+				rdates := make([]string, 0, ruleStart-1)
+				for _, tr := range g[1:ruleStart] {
+					rdates = append(rdates, tr.onset.Format(icalDateTimeFormat))
+				}
+				obs.AddProp("RDATE", strings.Join(rdates, ","))
+			}
+			observances = append(observances, obs)
+		}
+	}
+	slices.SortStableFunc(observances, func(a, b *Component) int {
+		return strings.Compare(a.PropValue("DTSTART"), b.PropValue("DTSTART"))
+	})
+	tz.Components = append(tz.Components, observances...)
+	return tz
+}
+
+const icalDateTimeFormat = "20060102T150405"
+
+var weekdayCodes = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// yearlyRule finds the trailing run of transitions that happen once a year (through toYear)
+// on the same weekday of the month (like the second Sunday of March, or the last Sunday of October),
+// at the same time. It returns the index where the run starts and the RRULE describing it.
+// If there is no such run, the returned index is len(g).
+func yearlyRule(g []zoneTransition, toYear int) (int, string) {
+	n := len(g)
+	last := g[n-1].onset
+	if last.Year() != toYear {
+		// The rule is no longer in effect.
+		return n, ""
+	}
+	nth := func(t time.Time) int { return (t.Day()-1)/7 + 1 }
+	isLast := func(t time.Time) bool { return t.AddDate(0, 0, 7).Month() != t.Month() }
+	clock := func(t time.Time) time.Duration { return t.Sub(t.Truncate(24 * time.Hour)) }
+	sameNth, allLast := true, isLast(last)
+	i := n - 1
+	for ; i > 0; i-- {
+		prev := g[i-1].onset
+		if prev.Year() != g[i].onset.Year()-1 || prev.Month() != last.Month() || prev.Weekday() != last.Weekday() || clock(prev) != clock(last) {
+			break
+		}
+		nextSameNth, nextAllLast := sameNth && nth(prev) == nth(last), allLast && isLast(prev)
+		if !nextSameNth && !nextAllLast {
+			break
+		}
+		sameNth, allLast = nextSameNth, nextAllLast
+	}
+	if i == n-1 {
+		return n, ""
+	}
+	// Prefer 'last' if both describe the run, since most rules that fall in the final week are 'last' rules.
+	byday := "-1" + weekdayCodes[last.Weekday()]
+	if !allLast {
+		byday = fmt.Sprintf("%d%s", nth(last), weekdayCodes[last.Weekday()])
+	}
+	return i, fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%s", last.Month(), byday)
+}
+
+// observance returns a STANDARD or DAYLIGHT component starting at the transition.
+func observance(tr zoneTransition) *Component {
+	name := Standard
+	if tr.dst {
+		name = Daylight
+	}
+	obs := NewComponent(name)
+	obs.AddProp("DTSTART", tr.onset.Format(icalDateTimeFormat))
+	obs.AddProp("TZOFFSETFROM", formatUTCOffset(tr.from))
+	obs.AddProp("TZOFFSETTO", formatUTCOffset(tr.to))
+	if tr.name != "" {
+		obs.AddProp("TZNAME", tr.name)
+	}
+	return obs
+}
+
+// formatUTCOffset formats seconds east of UTC as a UTC-OFFSET value like -0500 or +013045.
+func formatUTCOffset(secs int) string {
+	sign := "+"
+	if secs < 0 {
+		sign = "-"
+		secs = -secs
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, secs/3600, secs/60%60)
+	if secs%60 != 0 {
+		s += fmt.Sprintf("%02d", secs%60)
+	}
+	return s
+}
@@ -17,18 +17,43 @@ type FeedRow struct {
 	ContentsMD5          types.MD5Hash
 	ContentsLastModified time.Time
 	ContentsSize         int
+	ContentsFingerprint  types.MD5Hash
 	FetchStatus          int
 	FetchHeaders         json.RawMessage
 	FetchErrorBody       []byte
 	WebhookPending       bool
+	WebhookDiff          json.RawMessage
+	ValidationStatus     string
+	ValidationReport     json.RawMessage
+	FailureCount         int
+	FirstFailedAt        *time.Time
+	ChangedAt            *time.Time
+	ChangeIntervalMs     int64
+	RefreshAt            time.Time
+	RetryAfter           *time.Time
+	LastAccessedAt       time.Time
+	AccessCount          int64
+	LeasedUntil          *time.Time
 }
 
-// TruncateLocal deletes localhost and 127.0.0.1 urls,
+// TruncateLocal deletes localhost and 127.0.0.1 urls (and their hosts and credentials),
 // which are usually only generated during testing.
 func TruncateLocal(ctx context.Context, db *pgxpool.Pool) error {
 	_, err := db.Exec(ctx, `
 DELETE FROM icalproxy_feeds_v2
 WHERE starts_with(url_host_rev, reverse('127001')) OR starts_with(url_host_rev, reverse('LOCALHOST'))`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+DELETE FROM icalproxy_host_retry_after_v1
+WHERE starts_with(url_host_rev, reverse('127001')) OR starts_with(url_host_rev, reverse('LOCALHOST'))`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+DELETE FROM icalproxy_credentials_v1
+WHERE starts_with(url_prefix, 'http://127.0.0.1') OR starts_with(url_prefix, 'http://localhost')`)
 	if err != nil {
 		return err
 	}
@@ -38,3 +63,9 @@ WHERE starts_with(url_host_rev, reverse('127001')) OR starts_with(url_host_rev,
 func MustMD5(s string) types.MD5Hash {
 	return internal.MD5HashHex([]byte(s))
 }
+
+// Calendar returns a minimal iCalendar body containing the marker,
+// for tests that only care about which body was fetched or served.
+func Calendar(marker string) string {
+	return "BEGIN:VCALENDAR\r\nX-MARKER:" + marker + "\r\nEND:VCALENDAR\r\n"
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/lithictech/go-aperitif/v2/logctx"
 	"github.com/webhookdb/icalproxy/appglobals"
 	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/ical"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/pgxt"
 	"net/http"
@@ -50,9 +51,11 @@ func (r *Notifier) processChunk(ctx context.Context) (int, error) {
 	err := pgxt.WithTransaction(ctx, r.ag.DB, func(tx pgx.Tx) error {
 		start := time.Now()
 		logctx.Logger(ctx).DebugContext(ctx, "notifier_querying_chunk")
-		q := fmt.Sprintf(`SELECT id, url
+		// Skip feeds the refresher is fetching, since it merges its changes with the pending ones
+		// it selected (see refresher.Refresher.ClaimRowsToProcess), which would resend them.
+		q := fmt.Sprintf(`SELECT id, url, webhook_diff
 FROM icalproxy_feeds_v2
-WHERE webhook_pending
+WHERE webhook_pending AND (leased_until IS NULL OR leased_until < now())
 LIMIT %d
 FOR UPDATE SKIP LOCKED
 `, r.ag.Config.WebhookPageSize)
@@ -62,11 +65,18 @@ FOR UPDATE SKIP LOCKED
 		}
 		var ids []pgtype.Int8
 		var urls []string
+		// Only include feeds where the changes are known.
+		changes := make(map[string]*ical.Diff)
 		var id pgtype.Int8
 		var url string
-		if _, err := pgx.ForEachRow(rows, []any{&id, &url}, func() error {
+		var diff *ical.Diff
+		if _, err := pgx.ForEachRow(rows, []any{&id, &url, &diff}, func() error {
 			ids = append(ids, id)
 			urls = append(urls, url)
+			if diff != nil {
+				changes[url] = diff
+			}
+			diff = nil
 			return nil
 		}); err != nil {
 			return err
@@ -76,7 +86,7 @@ FOR UPDATE SKIP LOCKED
 			return nil
 		}
 		logctx.Logger(ctx).DebugContext(ctx, "notifier_processing_chunk", "row_count", len(urls))
-		body, err := json.Marshal(map[string]any{"urls": urls})
+		body, err := json.Marshal(map[string]any{"urls": urls, "changes": changes})
 		if err != nil {
 			return internal.ErrWrap(err, "marshaling webhook")
 		}
@@ -92,7 +102,7 @@ FOR UPDATE SKIP LOCKED
 		} else if resp.StatusCode >= 400 {
 			return fmt.Errorf("error sending webhook: %d", resp.StatusCode)
 		}
-		if _, err := tx.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET webhook_pending=false WHERE id = ANY($1)`, ids); err != nil {
+		if _, err := tx.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET webhook_pending=false, webhook_diff=NULL WHERE id = ANY($1)`, ids); err != nil {
 			return internal.ErrWrap(err, "updating row")
 		}
 		count += len(urls)
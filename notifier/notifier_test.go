@@ -14,6 +14,7 @@ import (
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/feedstorage/fakefeedstorage"
 	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/ical"
 	. "github.com/webhookdb/icalproxy/icalproxytest"
 	"github.com/webhookdb/icalproxy/notifier"
 	"net/http"
@@ -113,6 +114,84 @@ var _ = Describe("notifier", func() {
 			))
 			Expect(row).To(HaveField("WebhookPending", false))
 		})
+		It("skips rows leased by the refresher", func() {
+			ag.Config.WebhookUrl = webhookSrv.URL() + "/wh"
+			for _, tail := range []string{"leased", "expired-lease"} {
+				Expect(db.New(ag.DB).CommitFeed(ctx,
+					fs,
+					feed.New(
+						fp.Must(url.Parse("https://notifiertest.localhost/"+tail)),
+						make(map[string]string),
+						200,
+						[]byte("FEED"),
+						time.Now(),
+					), &db.CommitFeedOptions{WebhookPendingOnInsert: true})).To(Succeed())
+			}
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET leased_until = now() + '1 hour'::interval WHERE url = 'https://notifiertest.localhost/leased'`)).Error().ToNot(HaveOccurred())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET leased_until = now() - '1 hour'::interval WHERE url = 'https://notifiertest.localhost/expired-lease'`)).Error().ToNot(HaveOccurred())
+			webhookSrv.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/wh", ""),
+					func(w http.ResponseWriter, req *http.Request) {
+						var b map[string]any
+						Expect(json.NewDecoder(req.Body).Decode(&b)).To(Succeed())
+						Expect(b).To(HaveKeyWithValue("urls", ConsistOf("https://notifiertest.localhost/expired-lease")))
+					},
+					ghttp.RespondWith(200, ""),
+				),
+			)
+
+			Expect(notifier.New(ag).Run(ctx)).To(Succeed())
+			Expect(webhookSrv.ReceivedRequests()).To(HaveLen(1))
+		})
+		It("includes the changed events for feeds where they are known", func() {
+			ag.Config.WebhookUrl = webhookSrv.URL() + "/wh"
+			diff := &ical.Diff{Added: []ical.EventKey{{UID: "1"}}, Removed: []ical.EventKey{}, Modified: []ical.EventKey{}}
+			Expect(db.New(ag.DB).CommitFeed(ctx,
+				fs,
+				feed.New(
+					fp.Must(url.Parse("https://notifiertest.localhost/known")),
+					make(map[string]string),
+					200,
+					[]byte("FEED"),
+					time.Now(),
+				), &db.CommitFeedOptions{WebhookPendingOnInsert: true, WebhookDiff: diff})).To(Succeed())
+			Expect(db.New(ag.DB).CommitFeed(ctx,
+				fs,
+				feed.New(
+					fp.Must(url.Parse("https://notifiertest.localhost/unknown")),
+					make(map[string]string),
+					200,
+					[]byte("FEED"),
+					time.Now(),
+				), &db.CommitFeedOptions{WebhookPendingOnInsert: true})).To(Succeed())
+			webhookSrv.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/wh", ""),
+					func(w http.ResponseWriter, req *http.Request) {
+						var b struct {
+							Urls    []string        `json:"urls"`
+							Changes json.RawMessage `json:"changes"`
+						}
+						Expect(json.NewDecoder(req.Body).Decode(&b)).To(Succeed())
+						Expect(b.Urls).To(ConsistOf("https://notifiertest.localhost/known", "https://notifiertest.localhost/unknown"))
+						Expect(b.Changes).To(MatchJSON(`{
+"https://notifiertest.localhost/known": {"added": [{"uid": "1"}], "removed": [], "modified": []}
+}`))
+					},
+					ghttp.RespondWith(200, ""),
+				),
+			)
+
+			Expect(notifier.New(ag).Run(ctx)).To(Succeed())
+
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = 'https://notifiertest.localhost/known'`)),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(HaveField("WebhookPending", false))
+			Expect(row).To(HaveField("WebhookDiff", BeNil()))
+		})
 		It("errors if the webhook call fails", func() {
 			ag.Config.WebhookUrl = webhookSrv.URL() + "/wh"
 			Expect(db.New(ag.DB).CommitFeed(ctx,
@@ -10,6 +10,7 @@ import (
 	"github.com/webhookdb/icalproxy/appglobals"
 	"github.com/webhookdb/icalproxy/db"
 	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/ical"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/pgxt"
 	"github.com/webhookdb/icalproxy/types"
@@ -20,7 +21,7 @@ import (
 )
 
 func New(ag *appglobals.AppGlobals) *Refresher {
-	r := &Refresher{ag: ag}
+	r := &Refresher{ag: ag, hostRetryAfter: make(map[types.NormalizedHostname]time.Time)}
 	return r
 }
 
@@ -31,6 +32,11 @@ func StartScheduler(ctx context.Context, r *Refresher) {
 
 type Refresher struct {
 	ag *appglobals.AppGlobals
+	// hostRetryAfter is when hosts that responded with a Retry-After can be fetched again.
+	// The database has the same information (see db.DB.SetHostRetryAfter),
+	// but this also covers feeds that were already selected when the host responded.
+	hostRetryAfter    map[types.NormalizedHostname]time.Time
+	hostRetryAfterMux sync.Mutex
 }
 
 func (r *Refresher) Run(ctx context.Context) error {
@@ -44,47 +50,66 @@ func (r *Refresher) Run(ctx context.Context) error {
 	}
 }
 
+// buildSelectQuery selects the ids of a page of rows to refresh,
+// skipping rows that are locked because they are being claimed at the same time.
 func (r *Refresher) buildSelectQuery(now time.Time) string {
 	whereSql := r.buildSelectQueryWhere(now)
-	q := fmt.Sprintf(`SELECT url, contents_md5, fetch_status, fetch_headers
+	q := fmt.Sprintf(`SELECT id
 FROM icalproxy_feeds_v2
 WHERE %s
+ORDER BY last_accessed_at DESC
 LIMIT %d
 FOR UPDATE SKIP LOCKED
 `, whereSql, r.ag.Config.RefreshPageSize)
 	return q
 }
 
+// buildClaimQuery leases the rows from buildSelectQuery until RefreshLeaseDuration from now, and returns them.
+func (r *Refresher) buildClaimQuery(now time.Time) string {
+	leasedUntil := now.Add(r.ag.Config.RefreshLeaseDuration).UTC().Format(time.RFC3339)
+	q := fmt.Sprintf(`UPDATE icalproxy_feeds_v2 SET leased_until = '%s'::timestamptz
+WHERE id IN (%s)
+RETURNING id, url, contents_md5, contents_fingerprint, fetch_status, fetch_headers, webhook_pending, webhook_diff, leased_until
+`, leasedUntil, r.buildSelectQuery(now))
+	return q
+}
+
+// buildSelectQueryWhere selects rows whose refresh_at has passed, that are not leased by another run
+// (see ClaimRowsToProcess), and whose host has not asked to be fetched later (see db.DB.SetHostRetryAfter).
+// refresh_at is calculated whenever a feed is committed, from the TTL for its host,
+// how often it changes, whether it is failing (see feed.RefreshBounds), and any Retry-After from the origin.
+// If RefreshAccessWindow is set, feeds that have not been requested within it are not selected.
+//
+// When there are more rows than fit in a page, the most recently requested feeds
+// are refreshed first (see buildSelectQuery).
 func (r *Refresher) buildSelectQueryWhere(now time.Time) string {
-	now = now.UTC()
-	nowFmt := now.Format(time.RFC3339)
-	defaultTTLMillis := time.Duration(feed.DefaultTTL).Milliseconds()
-	conditions := make([]string, 0, len(r.ag.Config.IcalTTLMap))
-	for host, ttl := range r.ag.Config.IcalTTLMap {
-		if host == "" {
-			continue
-		}
-		stmt := fmt.Sprintf(
-			"(starts_with(url_host_rev, '%s') and checked_at < '%s'::timestamptz - '%dms'::interval)",
-			host.Reverse(), nowFmt, time.Duration(ttl).Milliseconds(),
-		)
-		conditions = append(conditions, stmt)
+	nowFmt := now.UTC().Format(time.RFC3339)
+	q := fmt.Sprintf(`refresh_at < '%[1]s'::timestamptz
+AND (leased_until IS NULL OR leased_until < '%[1]s'::timestamptz)
+AND NOT EXISTS (
+	SELECT 1 FROM icalproxy_host_retry_after_v1 h
+	WHERE h.url_host_rev = icalproxy_feeds_v2.url_host_rev AND h.retry_after > '%[1]s'::timestamptz
+)`, nowFmt)
+	if window := r.ag.Config.RefreshAccessWindow; window > 0 {
+		q += fmt.Sprintf(` AND last_accessed_at > '%s'::timestamptz`, now.Add(-window).UTC().Format(time.RFC3339))
 	}
-	conditions = append(
-		conditions,
-		fmt.Sprintf("checked_at < '%s'::timestamptz - '%dms'::interval", nowFmt, defaultTTLMillis),
-	)
-	return strings.Join(conditions, "\nOR ")
+	return q
 }
 
-func (r *Refresher) SelectRowsToProcess(ctx context.Context, tx pgx.Tx) ([]RowToProcess, error) {
-	rows, err := tx.Query(ctx, r.buildSelectQuery(time.Now()))
+// ClaimRowsToProcess leases a page of rows that need to be refreshed, and returns them.
+// Claiming is a single statement, so no transaction or row locks are held while the feeds are fetched.
+// Leased rows are not selected again until the refresher commits them (which releases the lease),
+// or the lease expires, like if the refresher stopped while fetching them.
+func (r *Refresher) ClaimRowsToProcess(ctx context.Context) ([]RowToProcess, error) {
+	rows, err := r.ag.DB.Query(ctx, r.buildClaimQuery(time.Now()))
 	if err != nil {
 		return nil, err
 	}
 	return pgx.CollectRows[RowToProcess](rows, func(r pgx.CollectableRow) (RowToProcess, error) {
 		rtp := RowToProcess{}
-		return rtp, r.Scan(&rtp.Url, &rtp.MD5, &rtp.FetchStatus, &rtp.FetchHeaders)
+		return rtp, r.Scan(
+			&rtp.Id, &rtp.Url, &rtp.MD5, &rtp.Fingerprint, &rtp.FetchStatus, &rtp.FetchHeaders, &rtp.WebhookPending, &rtp.WebhookDiff, &rtp.LeasedUntil,
+		)
 	})
 }
 
@@ -111,59 +136,88 @@ func (r *Refresher) CountRowsAwaitingRefresh(ctx context.Context) (int64, error)
 }
 
 func (r *Refresher) processChunk(ctx context.Context) (int, error) {
-	var count int
-	err := pgxt.WithTransaction(ctx, r.ag.DB, func(tx pgx.Tx) error {
-		start := time.Now()
-		logctx.Logger(ctx).DebugContext(ctx, "refresher_querying_chunk")
-		rowsToProcess, err := r.SelectRowsToProcess(ctx, tx)
-		if err != nil {
-			return err
-		}
-		if len(rowsToProcess) == 0 {
-			logctx.Logger(ctx).InfoContext(ctx, "refresher_empty_chunk")
-			return nil
-		}
-		logctx.Logger(ctx).DebugContext(ctx, "refresher_processing_chunk", "row_count", len(rowsToProcess))
-		// We are processing in multiple threads but can only call the transaction commit
-		// with one thread at a time. Guard it with a mutex, it's a lot simpler
-		// than rewriting this for producer/consumer for minimal benefit of lock-free.
-		txMux := &sync.Mutex{}
-		perr := parallel.ForEach(len(rowsToProcess), len(rowsToProcess), func(idx int) error {
-			return r.processUrl(ctx, tx, txMux, rowsToProcess[idx])
-		})
-		count += len(rowsToProcess)
-		logctx.Logger(ctx).InfoContext(ctx, "refresher_processed_chunk",
-			"row_count", len(rowsToProcess),
-			"elapsed_ms", time.Since(start).Milliseconds(),
-		)
-		return perr
+	start := time.Now()
+	logctx.Logger(ctx).DebugContext(ctx, "refresher_querying_chunk")
+	rowsToProcess, err := r.ClaimRowsToProcess(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(rowsToProcess) == 0 {
+		logctx.Logger(ctx).InfoContext(ctx, "refresher_empty_chunk")
+		return 0, nil
+	}
+	logctx.Logger(ctx).DebugContext(ctx, "refresher_processing_chunk", "row_count", len(rowsToProcess))
+	// Each row is committed on its own as soon as it is fetched,
+	// so a slow origin does not hold up committing the others.
+	perr := parallel.ForEach(len(rowsToProcess), len(rowsToProcess), func(idx int) error {
+		return r.processUrl(ctx, rowsToProcess[idx])
 	})
-	return count, err
+	logctx.Logger(ctx).InfoContext(ctx, "refresher_processed_chunk",
+		"row_count", len(rowsToProcess),
+		"elapsed_ms", time.Since(start).Milliseconds(),
+	)
+	return len(rowsToProcess), perr
 }
 
 type RowToProcess struct {
-	Url          string
-	MD5          types.MD5Hash
-	FetchStatus  int
-	FetchHeaders feed.HeaderMap
+	Id             int64
+	Url            string
+	MD5            types.MD5Hash
+	Fingerprint    types.MD5Hash
+	FetchStatus    int
+	FetchHeaders   feed.HeaderMap
+	WebhookPending bool
+	WebhookDiff    *ical.Diff
+	// LeasedUntil is the lease taken by ClaimRowsToProcess, which is released when the row is committed.
+	LeasedUntil time.Time
 }
 
-func (r *Refresher) processUrl(ctx context.Context, tx pgx.Tx, txMux *sync.Mutex, rtp RowToProcess) error {
+// processUrl fetches and commits the row. If it returns an error, the row is left leased,
+// so it is refreshed again once the lease expires.
+func (r *Refresher) processUrl(ctx context.Context, rtp RowToProcess) error {
 	ctx = logctx.AddTo(ctx, "url", rtp.Url)
 	uri, err := url.Parse(rtp.Url)
 	if err != nil {
 		return internal.ErrWrap(err, "url parsed failed, should not have been stored")
 	}
+	// Wait for the host before starting the timeout, so waiting does not count against the origin.
+	// Stop waiting in time to fetch the feed before the lease expires, so another run does not claim
+	// and fetch it at the same time. The row stays leased, so it is tried again once the lease expires.
+	fetchTimeout := time.Duration(r.ag.Config.RefreshTimeout) * time.Second
+	waitCtx, cancelWait := context.WithDeadline(ctx, rtp.LeasedUntil.Add(-fetchTimeout))
+	release, err := r.ag.HostLimiter.Acquire(waitCtx, uri)
+	cancelWait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		logctx.Logger(ctx).WarnContext(ctx, "feed_host_limit_wait_timeout", "leased_until", rtp.LeasedUntil)
+		return nil
+	}
+	if retryAfter := r.retryAfterFor(uri); !retryAfter.IsZero() {
+		// Another feed for the host was rate limited since this one was selected.
+		release()
+		logctx.Logger(ctx).InfoContext(ctx, "feed_host_retry_after", "retry_after", retryAfter)
+		return r.commit(ctx, rtp, func(d *db.DB) error { return d.DeferRefresh(ctx, uri, retryAfter) })
+	}
 	start := time.Now()
-	reqctx, cancel := context.WithTimeout(ctx, time.Duration(r.ag.Config.RefreshTimeout)*time.Second)
+	reqctx, cancel := context.WithTimeout(ctx, fetchTimeout)
 	defer cancel()
-	fd, err := feed.Fetch(reqctx, uri, rtp.FetchHeaders)
+	fd, err := feed.Fetch(reqctx, uri, rtp.FetchHeaders, r.ag.FetchOptions(reqctx, uri))
+	if fd != nil && !fd.RetryAfter.IsZero() {
+		// Record this before releasing, so feeds waiting for the host see it.
+		r.setRetryAfter(uri, fd.RetryAfter)
+		logctx.Logger(ctx).WarnContext(ctx, "feed_origin_retry_after", "feed_http_status", fd.HttpStatus, "retry_after", fd.RetryAfter)
+	}
+	release()
 	notModified := errors.Is(err, feed.ErrNotModified)
-	if err != nil && !notModified {
+	if errors.Is(err, feed.ErrOriginForbidden) {
+		// The url was stored before it was blocked (or its host now resolves to a blocked address).
+		// Commit it like any other origin error, so it is not retried until its TTL expires again.
+		logctx.Logger(ctx).With("error", err).WarnContext(ctx, "feed_origin_forbidden")
+	} else if err != nil && !notModified {
 		return err
 	}
-	txMux.Lock()
-	defer txMux.Unlock()
 	feedUnchanged := false
 	if notModified {
 		// 304 from server, or request avoided due to Cache-Control
@@ -175,19 +229,100 @@ func (r *Refresher) processUrl(ctx context.Context, tx pgx.Tx, txMux *sync.Mutex
 		// If this is an error fetch, and the last fetch was also an error fetch with the same status code,
 		// don't bother updating the row.
 		feedUnchanged = true
+	} else if r.ag.Config.RefreshRejectInvalid && fd.Validation != nil && fd.Validation.Status == ical.ValidationInvalid {
+		// Keep the last stored body rather than replacing it with one that clients may not be able to parse.
+		// We still bump checked_at, so the feed is not retried until its TTL expires again.
+		logctx.Logger(ctx).WarnContext(ctx, "feed_invalid_rejected", "validation_errors", fd.Validation.Errors)
+		feedUnchanged = true
 	}
+	refresh := feed.RefreshBoundsFor(uri, r.ag.Config)
 	if feedUnchanged {
-		if err := db.New(tx).CommitUnchanged(ctx, fd); err != nil {
+		if err := r.commit(ctx, rtp, func(d *db.DB) error { return d.CommitUnchanged(ctx, fd, refresh) }); err != nil {
 			logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "refresh_commit_feed_error")
 		}
 		logctx.Logger(ctx).DebugContext(ctx, "feed_unchanged")
 	} else {
-		if err := db.New(tx).CommitFeed(ctx, r.ag.FeedStorage, fd, &db.CommitFeedOptions{WebhookPending: r.ag.Config.WebhookUrl != ""}); err != nil {
+		// The body changed, so we always store it, but only notify about the change if it is meaningful.
+		// CommitFeed compares the fingerprints to decide whether to set webhook_pending.
+		fd.SetFingerprint(r.ag.Config.IcalVolatileMap)
+		semanticChange := fd.HttpStatus >= 400 || fd.Fingerprint == "" || fd.Fingerprint != rtp.Fingerprint
+		opts := &db.CommitFeedOptions{WebhookPending: r.ag.Config.WebhookUrl != "", Refresh: refresh}
+		if opts.WebhookPending && semanticChange && fd.HttpStatus < 400 {
+			// Do this before committing, since it needs to load the previous body from storage.
+			opts.WebhookDiff = r.webhookDiff(ctx, rtp, fd)
+		}
+		if err := r.commit(ctx, rtp, func(d *db.DB) error { return d.CommitFeed(ctx, r.ag.FeedStorage, fd, opts) }); err != nil {
 			logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "refresh_commit_feed_error")
 		}
 		logctx.Logger(ctx).
-			With("feed_http_status", fd.HttpStatus, "elapsed_ms", time.Now().Sub(start).Milliseconds()).
+			With("feed_http_status", fd.HttpStatus, "elapsed_ms", time.Now().Sub(start).Milliseconds(), "semantic_change", semanticChange).
 			Info("feed_change_committed")
 	}
 	return nil
 }
+
+// commit runs cb in its own transaction, so each feed's row, refresh time, and events are committed together,
+// and releases the lease on the row in the same transaction.
+func (r *Refresher) commit(ctx context.Context, rtp RowToProcess, cb func(d *db.DB) error) error {
+	return pgxt.WithTransaction(ctx, r.ag.DB, func(tx pgx.Tx) error {
+		d := db.New(tx)
+		if err := cb(d); err != nil {
+			return err
+		}
+		return d.ReleaseLease(ctx, rtp.Id, rtp.LeasedUntil)
+	})
+}
+
+// retryAfterFor returns when the url's host asked to be fetched again,
+// or zero if it did not, or that time has passed.
+func (r *Refresher) retryAfterFor(uri *url.URL) time.Time {
+	r.hostRetryAfterMux.Lock()
+	defer r.hostRetryAfterMux.Unlock()
+	host := types.NormalizeURLHostname(uri)
+	t, ok := r.hostRetryAfter[host]
+	if !ok {
+		return time.Time{}
+	}
+	if !t.After(time.Now()) {
+		delete(r.hostRetryAfter, host)
+		return time.Time{}
+	}
+	return t
+}
+
+func (r *Refresher) setRetryAfter(uri *url.URL, t time.Time) {
+	r.hostRetryAfterMux.Lock()
+	defer r.hostRetryAfterMux.Unlock()
+	host := types.NormalizeURLHostname(uri)
+	if t.After(r.hostRetryAfter[host]) {
+		r.hostRetryAfter[host] = t
+	}
+}
+
+// webhookDiff returns the events changed between the stored body and the newly fetched one,
+// merged with the changes from any webhook that has not been sent yet.
+// Returns nil if the changes cannot be determined, like if either body is not a valid calendar.
+func (r *Refresher) webhookDiff(ctx context.Context, rtp RowToProcess, fd *feed.Feed) *ical.Diff {
+	if rtp.WebhookPending && rtp.WebhookDiff == nil {
+		// The pending changes are already unknown, so there's nothing to merge with.
+		return nil
+	}
+	oldBody, err := r.ag.FeedStorage.Fetch(ctx, rtp.Id)
+	if err != nil {
+		logctx.Logger(ctx).With("error", err).WarnContext(ctx, "refresh_diff_fetch_error")
+		return nil
+	}
+	oldCal, err := ical.Parse(oldBody)
+	if err != nil {
+		return nil
+	}
+	newCal, err := ical.Parse(fd.Body)
+	if err != nil {
+		return nil
+	}
+	diff := ical.DiffCalendars(oldCal, newCal, feed.VolatilePropertiesFor(fd.Url, r.ag.Config.IcalVolatileMap)...)
+	if rtp.WebhookPending {
+		diff = rtp.WebhookDiff.Merge(diff)
+	}
+	return diff
+}
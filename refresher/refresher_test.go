@@ -12,6 +12,7 @@ import (
 	"github.com/webhookdb/icalproxy/db"
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/fp"
+	"github.com/webhookdb/icalproxy/ical"
 	. "github.com/webhookdb/icalproxy/icalproxytest"
 	"github.com/webhookdb/icalproxy/pgxt"
 	"github.com/webhookdb/icalproxy/refresher"
@@ -20,6 +21,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -39,6 +42,8 @@ var _ = Describe("refresher", func() {
 	BeforeEach(func() {
 		ctx, hook = logctx.WithNullLogger(context.Background())
 		ag = fp.Must(appglobals.New(ctx, fp.Must(config.LoadConfig())))
+		// Origins in tests are ghttp servers listening on loopback, which is blocked by default.
+		ag.Config.OriginAllowlist = fp.Must(types.ParseOriginAllowlist([]string{"127.0.0.1"}))
 		Expect(TruncateLocal(ctx, ag.DB)).To(Succeed())
 		origin = ghttp.NewServer()
 		d = db.New(ag.DB)
@@ -70,7 +75,7 @@ var _ = Describe("refresher", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/expired-ttl.ics", ""),
-					ghttp.RespondWith(200, "FETCHED"),
+					ghttp.RespondWith(200, Calendar("FETCHED")),
 				),
 			)
 			Expect(d.CommitFeed(ctx,
@@ -99,7 +104,7 @@ var _ = Describe("refresher", func() {
 				pgx.RowToStructByName[FeedRow],
 			))
 			Expect(row).To(And(
-				HaveField("ContentsMD5", MustMD5("FETCHED")),
+				HaveField("ContentsMD5", MustMD5(Calendar("FETCHED"))),
 				HaveField("WebhookPending", false),
 			))
 		})
@@ -115,7 +120,7 @@ var _ = Describe("refresher", func() {
 					time.Now().Add(-5*time.Hour),
 				), nil)).To(Succeed())
 			origin.RouteToHandler("GET", "/changed.ics",
-				ghttp.RespondWith(200, "CHANGED-DIFF"),
+				ghttp.RespondWith(200, Calendar("CHANGED-DIFF")),
 			)
 			Expect(d.CommitFeed(ctx,
 				ag.FeedStorage,
@@ -123,11 +128,11 @@ var _ = Describe("refresher", func() {
 					fp.Must(url.Parse(origin.URL()+"/unchanged.ics")),
 					make(map[string]string),
 					200,
-					[]byte("UNCHANGED"),
+					[]byte(Calendar("UNCHANGED")),
 					time.Now().Add(-5*time.Hour),
 				), nil)).To(Succeed())
 			origin.RouteToHandler("GET", "/unchanged.ics",
-				ghttp.RespondWith(200, "UNCHANGED"),
+				ghttp.RespondWith(200, Calendar("UNCHANGED")),
 			)
 			Expect(d.CommitFeed(ctx,
 				ag.FeedStorage,
@@ -163,20 +168,188 @@ var _ = Describe("refresher", func() {
 				)),
 			))
 		})
+		It("stores but does not notify about changes to volatile properties", func() {
+			ag.Config.WebhookUrl = "https://fake"
+			ag.Config.IcalVolatileMap = map[types.NormalizedHostname][]string{"127001": {"X-GENERATED"}}
+			body := func(stamp, generated, summary string) string {
+				return "BEGIN:VCALENDAR\r\nX-GENERATED:" + generated + "\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTAMP:" + stamp +
+					"\r\nSUMMARY:" + summary + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+			}
+			for _, name := range []string{"cosmetic", "semantic"} {
+				fd := feed.New(
+					fp.Must(url.Parse(origin.URL()+"/"+name+".ics")),
+					make(map[string]string),
+					200,
+					[]byte(body("20240101T000000Z", "a", "x")),
+					time.Now().Add(-5*time.Hour),
+				)
+				fd.SetFingerprint(ag.Config.IcalVolatileMap)
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, fd, nil)).To(Succeed())
+			}
+			origin.RouteToHandler("GET", "/cosmetic.ics", ghttp.RespondWith(200, body("20250101T000000Z", "b", "x")))
+			origin.RouteToHandler("GET", "/semantic.ics", ghttp.RespondWith(200, body("20250101T000000Z", "b", "y")))
+
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+
+			rows := fp.Must(pgx.CollectRows[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE starts_with(url, $1)`, origin.URL())),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(rows).To(And(
+				ContainElement(And(
+					HaveField("Url", HaveSuffix("cosmetic.ics")),
+					HaveField("ContentsMD5", MustMD5(body("20250101T000000Z", "b", "x"))),
+					HaveField("WebhookPending", false),
+				)),
+				ContainElement(And(
+					HaveField("Url", HaveSuffix("semantic.ics")),
+					HaveField("WebhookPending", true),
+				)),
+			))
+		})
+		It("keeps the stored body if the fetched body is invalid and rejecting invalid bodies is configured", func() {
+			ag.Config.RefreshRejectInvalid = true
+			valid := "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"
+			for _, name := range []string{"valid", "invalid"} {
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/"+name+".ics"), nil)).To(Succeed())
+			}
+			origin.RouteToHandler("GET", "/valid.ics", ghttp.RespondWith(200, valid))
+			origin.RouteToHandler("GET", "/invalid.ics", ghttp.RespondWith(200, "BEGIN:VCALENDAR\r\n"))
+
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+
+			rows := fp.Must(pgx.CollectRows[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE starts_with(url, $1)`, origin.URL())),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(rows).To(And(
+				ContainElement(And(
+					HaveField("Url", HaveSuffix("/valid.ics")),
+					HaveField("ContentsMD5", MustMD5(valid)),
+					HaveField("ValidationStatus", "warnings"),
+				)),
+				ContainElement(And(
+					HaveField("Url", HaveSuffix("/invalid.ics")),
+					HaveField("ContentsMD5", MustMD5("EXPIRED")),
+					HaveField("CheckedAt", BeTemporally("~", time.Now(), time.Minute)),
+				)),
+			))
+			messages := fp.Map(hook.Records(), func(r logctx.HookRecord) string { return r.Record.Message })
+			Expect(messages).To(ContainElement("feed_invalid_rejected"))
+		})
+		It("stores the changed events for the webhook, merged with any pending changes", func() {
+			ag.Config.WebhookUrl = "https://fake"
+			event := func(uid, summary string) string {
+				return "BEGIN:VEVENT\r\nUID:" + uid + "\r\nSUMMARY:" + summary + "\r\nEND:VEVENT\r\n"
+			}
+			cal := func(events ...string) string {
+				return "BEGIN:VCALENDAR\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n"
+			}
+			commit := func(name, body string, opts *db.CommitFeedOptions) {
+				fd := feed.New(
+					fp.Must(url.Parse(origin.URL()+"/"+name+".ics")),
+					make(map[string]string),
+					200,
+					[]byte(body),
+					time.Now().Add(-5*time.Hour),
+				)
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, fd, opts)).To(Succeed())
+			}
+			commit("fresh", cal(event("1", "a"), event("2", "a")), nil)
+			commit("pending", cal(event("1", "a"), event("2", "a")), &db.CommitFeedOptions{
+				WebhookPendingOnInsert: true,
+				WebhookDiff:            &ical.Diff{Added: []ical.EventKey{{UID: "2"}}},
+			})
+			commit("unknown", cal(event("1", "a")), &db.CommitFeedOptions{WebhookPendingOnInsert: true})
+			commit("invalid", "not a calendar", nil)
+			newBody := cal(event("1", "b"), event("3", "a"))
+			for _, name := range []string{"fresh", "pending", "unknown", "invalid"} {
+				origin.RouteToHandler("GET", "/"+name+".ics", ghttp.RespondWith(200, newBody))
+			}
+
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+
+			rows := fp.Must(pgx.CollectRows[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE starts_with(url, $1)`, origin.URL())),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(rows).To(HaveLen(4))
+			diffs := make(map[string]string)
+			for _, row := range rows {
+				Expect(row).To(HaveField("WebhookPending", true))
+				diffs[row.Url] = string(row.WebhookDiff)
+			}
+			Expect(diffs[origin.URL()+"/fresh.ics"]).To(MatchJSON(`{"added": [{"uid": "3"}], "removed": [{"uid": "2"}], "modified": [{"uid": "1"}]}`))
+			Expect(diffs[origin.URL()+"/pending.ics"]).To(MatchJSON(`{"added": [{"uid": "3"}], "removed": [], "modified": [{"uid": "1"}]}`))
+			Expect(diffs).To(HaveKeyWithValue(origin.URL()+"/unknown.ics", ""))
+			Expect(diffs).To(HaveKeyWithValue(origin.URL()+"/invalid.ics", ""))
+		})
 		It("can work for large sets, without races or page issues", func() {
 			rowCnt := 1003 + rand.Intn(500)
 			for i := 0; i < rowCnt; i++ {
 				istr := strconv.Itoa(i)
 				Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed-"+istr), nil)).To(Succeed())
-				origin.RouteToHandler("GET", "/feed-"+istr, ghttp.RespondWith(200, "FETCHED-"+istr))
+				origin.RouteToHandler("GET", "/feed-"+istr, ghttp.RespondWith(200, Calendar("FETCHED-"+istr)))
 			}
 			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
 
 			row2 := fp.Must(d.FetchContentsAsFeed(ctx, ag.FeedStorage, fp.Must(url.Parse(origin.URL()+"/feed-2"))))
-			Expect(string(row2.Body)).To(BeEquivalentTo("FETCHED-2"))
+			Expect(string(row2.Body)).To(Equal(Calendar("FETCHED-2")))
 
 			row1002 := fp.Must(d.FetchContentsAsFeed(ctx, ag.FeedStorage, fp.Must(url.Parse(origin.URL()+"/feed-1002"))))
-			Expect(string(row1002.Body)).To(BeEquivalentTo("FETCHED-1002"))
+			Expect(string(row1002.Body)).To(Equal(Calendar("FETCHED-1002")))
+		})
+		It("limits the requests made to each host at the same time", func() {
+			ag.HostLimiter = feed.NewHostLimiter(config.Config{HostConcurrency: 2})
+			var inFlight, maxInFlight atomic.Int32
+			for i := 0; i < 10; i++ {
+				istr := strconv.Itoa(i)
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed-"+istr), nil)).To(Succeed())
+				origin.RouteToHandler("GET", "/feed-"+istr, func(w http.ResponseWriter, r *http.Request) {
+					n := inFlight.Add(1)
+					defer inFlight.Add(-1)
+					for {
+						if m := maxInFlight.Load(); n <= m || maxInFlight.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					_, _ = w.Write([]byte(Calendar("FETCHED-" + istr)))
+				})
+			}
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(HaveLen(10))
+			Expect(maxInFlight.Load()).To(BeEquivalentTo(2))
+		})
+		It("does not fetch feeds from a host that asked to retry later", func() {
+			ag.HostLimiter = feed.NewHostLimiter(config.Config{HostConcurrency: 1})
+			for _, p := range []string{"/feed-1", "/feed-2"} {
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed(p), nil)).To(Succeed())
+				origin.RouteToHandler("GET", p, ghttp.RespondWith(429, "slow down", http.Header{"Retry-After": {"3600"}}))
+			}
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(HaveLen(1))
+			rows := fp.Must(pgx.CollectRows(
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE starts_with(url, $1)`, origin.URL())),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(rows).To(ConsistOf(
+				// The rate limited feed backs off, which is later than its Retry-After
+				And(
+					HaveField("RetryAfter", HaveValue(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))),
+					HaveField("RefreshAt", BeTemporally("~", time.Now().Add(2*time.Duration(feed.DefaultTTL)), 5*time.Second)),
+				),
+				// The other feed was not fetched, and waits for the host
+				And(
+					HaveField("RetryAfter", BeNil()),
+					HaveField("RefreshAt", BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second)),
+				),
+			))
+
+			// The host is skipped even if the feeds are due, like when another process commits them.
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET refresh_at = 'epoch' WHERE starts_with(url, $1)`, origin.URL())).Error().ToNot(HaveOccurred())
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(HaveLen(1))
 		})
 		It("commits rows that fail to fetch", func() {
 			origin.AppendHandlers(
@@ -199,6 +372,27 @@ var _ = Describe("refresher", func() {
 				HaveField("WebhookPending", false),
 			))
 		})
+		It("commits successful responses that are not calendars as errors, keeping the stored body", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/expired-ttl.ics", ""),
+					ghttp.RespondWith(200, `{"error":"expired token"}`),
+				),
+			)
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/expired-ttl.ics"), nil)).To(Succeed())
+
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = $1`, origin.URL()+"/expired-ttl.ics")),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(And(
+				HaveField("FetchStatus", feed.StatusNotCalendar),
+				HaveField("FetchErrorBody", BeEquivalentTo(`{"error":"expired token"}`)),
+				HaveField("ContentsMD5", MustMD5("EXPIRED")),
+			))
+		})
 		It("marks repeated fetch failures as unchanged (compares bodies)", func() {
 			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed.ics"), nil)).To(Succeed())
 			origin.AppendHandlers(
@@ -215,7 +409,7 @@ var _ = Describe("refresher", func() {
 			)
 			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
 			// Set this to need to be checked again
-			_, err := ag.DB.Exec(ctx, "UPDATE icalproxy_feeds_v2 SET checked_at=$1 WHERE url=$2", time.Now().Add(-5*time.Hour), origin.URL()+"/feed.ics")
+			_, err := ag.DB.Exec(ctx, "UPDATE icalproxy_feeds_v2 SET checked_at=$1, refresh_at=$1 WHERE url=$2", time.Now().Add(-5*time.Hour), origin.URL()+"/feed.ics")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
 			messages := fp.Map(hook.Records(), func(r logctx.HookRecord) string { return r.Record.Message })
@@ -250,7 +444,7 @@ var _ = Describe("refresher", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/expired-ttl.ics", ""),
-					ghttp.RespondWith(200, "SAMEBODY"),
+					ghttp.RespondWith(200, Calendar("SAMEBODY")),
 				),
 			)
 			Expect(d.CommitFeed(ctx,
@@ -259,7 +453,7 @@ var _ = Describe("refresher", func() {
 					fp.Must(url.Parse(origin.URL()+"/expired-ttl.ics")),
 					make(map[string]string),
 					200,
-					[]byte("SAMEBODY"),
+					[]byte(Calendar("SAMEBODY")),
 					time.Now().Add(-5*time.Hour),
 				), &db.CommitFeedOptions{WebhookPending: false})).To(Succeed())
 
@@ -269,7 +463,7 @@ var _ = Describe("refresher", func() {
 				pgx.RowToStructByName[FeedRow],
 			))
 			Expect(row).To(And(
-				HaveField("ContentsMD5", MustMD5("SAMEBODY")),
+				HaveField("ContentsMD5", MustMD5(Calendar("SAMEBODY"))),
 				HaveField("CheckedAt", BeTemporally("~", time.Now(), time.Minute)),
 				// Make sure this doesn't get set back to true when there is no change
 				HaveField("WebhookPending", false),
@@ -288,7 +482,7 @@ var _ = Describe("refresher", func() {
 					fp.Must(url.Parse(origin.URL()+"/expired-ttl.ics")),
 					make(map[string]string),
 					200,
-					[]byte("SAMEBODY"),
+					[]byte(Calendar("SAMEBODY")),
 					time.Now().Add(-5*time.Hour),
 				), &db.CommitFeedOptions{WebhookPending: false})).To(Succeed())
 
@@ -298,14 +492,29 @@ var _ = Describe("refresher", func() {
 				pgx.RowToStructByName[FeedRow],
 			))
 			Expect(row).To(And(
-				HaveField("ContentsMD5", MustMD5("SAMEBODY")),
+				HaveField("ContentsMD5", MustMD5(Calendar("SAMEBODY"))),
 				HaveField("CheckedAt", BeTemporally("~", time.Now(), time.Minute)),
 				// Make sure this doesn't get set back to true when there is no change
 				HaveField("WebhookPending", false),
 			))
 		})
+		It("commits rows whose origin address is not allowed as errors", func() {
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/blocked.ics"), nil)).To(Succeed())
+			ag.Config.OriginAllowlist = types.OriginAllowlist{}
+
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+			row := fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+				fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = $1`, origin.URL()+"/blocked.ics")),
+				pgx.RowToStructByName[FeedRow],
+			))
+			Expect(row).To(And(
+				HaveField("FetchStatus", feed.StatusOriginForbidden),
+				HaveField("CheckedAt", BeTemporally("~", time.Now(), time.Minute)),
+			))
+		})
 	})
-	Describe("SelectRowsToProcess", func() {
+	Describe("ClaimRowsToProcess", func() {
 		It("selects rows that have not been checked since the TTL for their host", func() {
 			// Set up 2 custom domains, with 30 and 60 minute TTLs.
 			// Then create two feeds for each domain, with recent and expired TTLs.
@@ -315,51 +524,143 @@ var _ = Describe("refresher", func() {
 			ag.Config.IcalTTLMap["30MINLOCALHOST"] = types.TTL(30 * time.Minute)
 			ag.Config.IcalTTLMap["60MINLOCALHOST"] = types.TTL(60 * time.Minute)
 			hd := make(map[string]string)
+			commit := func(u string, age time.Duration) {
+				fd := feed.New(fp.Must(url.Parse(u)), hd, 200, []byte("ORIGINAL"), time.Now().Add(-age))
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, fd, &db.CommitFeedOptions{Refresh: feed.RefreshBoundsFor(fd.Url, ag.Config)})).To(Succeed())
+			}
 
-			Expect(d.CommitFeed(ctx, ag.FeedStorage,
-				feed.New(fp.Must(url.Parse("https://30min.localhost/15old")), hd, 200, []byte("ORIGINAL"), time.Now().Add(-15*time.Minute)), nil,
-			)).To(Succeed())
-			Expect(d.CommitFeed(ctx, ag.FeedStorage,
-				feed.New(fp.Must(url.Parse("https://30min.localhost/45old")), hd, 200, []byte("ORIGINAL"), time.Now().Add(-45*time.Minute)), nil,
-			)).To(Succeed())
+			commit("https://30min.localhost/15old", 15*time.Minute)
+			commit("https://30min.localhost/45old", 45*time.Minute)
 
+			commit("https://60min.localhost/45old", 45*time.Minute)
+			commit("https://60min.localhost/75old", 75*time.Minute)
+
+			rows, err := refresher.New(ag).ClaimRowsToProcess(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(ConsistOf(
+				HaveField("Url", "https://30min.localhost/45old"),
+				HaveField("Url", "https://60min.localhost/75old"),
+			))
+		})
+		It("selects rows whose refresh time has passed, regardless of their host", func() {
+			ag.Config.IcalTTLMap["30MINLOCALHOST"] = types.TTL(30 * time.Minute)
+			hd := make(map[string]string)
+			// Would be due based on the TTL alone, but has backed off after failing
+			failing := feed.New(fp.Must(url.Parse("https://30min.localhost/failing")), hd, 500, []byte("ERROR"), time.Now().Add(-45*time.Minute))
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, failing, &db.CommitFeedOptions{Refresh: feed.RefreshBoundsFor(failing.Url, ag.Config)})).To(Succeed())
 			Expect(d.CommitFeed(ctx, ag.FeedStorage,
-				feed.New(fp.Must(url.Parse("https://60min.localhost/45old")), hd, 200, []byte("ORIGINAL"), time.Now().Add(-45*time.Minute)), nil,
-			)).To(Succeed())
-			Expect(d.CommitFeed(ctx, ag.FeedStorage,
-				feed.New(fp.Must(url.Parse("https://60min.localhost/75old")), hd, 200, []byte("ORIGINAL"), time.Now().Add(-75*time.Minute)), nil,
+				feed.New(fp.Must(url.Parse("https://30min.localhost/due")), hd, 200, []byte("ORIGINAL"), time.Now()), nil,
 			)).To(Succeed())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET refresh_at = now() - '1s'::interval WHERE url = 'https://30min.localhost/due'`)).Error().ToNot(HaveOccurred())
 
-			Expect(pgxt.WithTransaction(ctx, d.Conn(), func(tx pgx.Tx) error {
-				rows, err := refresher.New(ag).SelectRowsToProcess(ctx, tx)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(rows).To(ConsistOf(
-					HaveField("Url", "https://30min.localhost/45old"),
-					HaveField("Url", "https://60min.localhost/75old"),
-				))
-				return nil
+			rows, err := refresher.New(ag).ClaimRowsToProcess(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(ConsistOf(
+				HaveField("Url", "https://30min.localhost/due"),
+			))
+		})
+		It("selects the most recently requested rows first", func() {
+			ag.Config.RefreshPageSize = 1
+			for _, tail := range []string{"/old", "/recent"} {
+				Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed(tail), nil)).To(Succeed())
+			}
+			Expect(d.RecordAccesses(ctx, []db.FeedAccess{
+				{Url: origin.URL() + "/old", Count: 1, AccessedAt: time.Now().Add(-time.Hour)},
+				{Url: origin.URL() + "/recent", Count: 1, AccessedAt: time.Now().Add(time.Hour)},
 			})).To(Succeed())
+
+			rows, err := refresher.New(ag).ClaimRowsToProcess(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(ConsistOf(
+				HaveField("Url", origin.URL()+"/recent"),
+			))
+		})
+		It("does not select rows that have not been requested within the access window", func() {
+			ag.Config.RefreshAccessWindow = 24 * time.Hour
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/requested"), nil)).To(Succeed())
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/abandoned"), nil)).To(Succeed())
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET last_accessed_at = now() - '25 hours'::interval WHERE url = $1`, origin.URL()+"/abandoned")).Error().ToNot(HaveOccurred())
+
+			rows, err := refresher.New(ag).ClaimRowsToProcess(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(ConsistOf(
+				HaveField("Url", origin.URL()+"/requested"),
+			))
+		})
+		It("leases the rows it claims until they are committed or the lease expires", func() {
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed"), nil)).To(Succeed())
+			feedRow := func() FeedRow {
+				return fp.Must(pgx.CollectExactlyOneRow[FeedRow](
+					fp.Must(ag.DB.Query(ctx, `SELECT * FROM icalproxy_feeds_v2 WHERE url = $1`, origin.URL()+"/feed")),
+					pgx.RowToStructByName[FeedRow],
+				))
+			}
+
+			Expect(refresher.New(ag).ClaimRowsToProcess(ctx)).To(HaveLen(1))
+			Expect(feedRow().LeasedUntil).To(HaveValue(BeTemporally("~", time.Now().Add(ag.Config.RefreshLeaseDuration), time.Minute)))
+			// Leased rows are not claimed or refreshed again
+			Expect(refresher.New(ag).ClaimRowsToProcess(ctx)).To(BeEmpty())
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+
+			// Expired leases are claimed again
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET leased_until = now() - '1s'::interval WHERE url = $1`, origin.URL()+"/feed")).Error().ToNot(HaveOccurred())
+			origin.AppendHandlers(ghttp.RespondWith(200, Calendar("FETCHED")))
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(origin.ReceivedRequests()).To(HaveLen(1))
+			// Committing releases the lease
+			Expect(feedRow()).To(And(
+				HaveField("ContentsMD5", MustMD5(Calendar("FETCHED"))),
+				HaveField("LeasedUntil", BeNil()),
+			))
+		})
+		It("only releases the lease it took, so other commits do not clear it", func() {
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed"), nil)).To(Succeed())
+			leasedUntil := func() *time.Time {
+				return fp.Must(pgxt.GetScalar[*time.Time](ctx, ag.DB, `SELECT leased_until FROM icalproxy_feeds_v2 WHERE url = $1`, origin.URL()+"/feed"))
+			}
+			rows := fp.Must(refresher.New(ag).ClaimRowsToProcess(ctx))
+			Expect(rows).To(HaveLen(1))
+
+			// Like the server committing the feed while the refresher is fetching it
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed"), nil)).To(Succeed())
+			Expect(leasedUntil()).ToNot(BeNil())
+			Expect(d.ReleaseLease(ctx, rows[0].Id, rows[0].LeasedUntil.Add(-time.Second))).To(Succeed())
+			Expect(leasedUntil()).ToNot(BeNil())
+			Expect(d.ReleaseLease(ctx, rows[0].Id, rows[0].LeasedUntil)).To(Succeed())
+			Expect(leasedUntil()).To(BeNil())
+		})
+		It("stops waiting for the host before the lease expires", func() {
+			ag.Config.HostConcurrency = 1
+			ag.Config.RefreshTimeout = 1
+			ag.Config.RefreshLeaseDuration = 1500 * time.Millisecond
+			ag.HostLimiter = feed.NewHostLimiter(ag.Config)
+			Expect(d.CommitFeed(ctx, ag.FeedStorage, expiredFeed("/feed"), nil)).To(Succeed())
+			// Hold the only slot for the host, so the refresher cannot fetch the feed.
+			release := fp.Must(ag.HostLimiter.Acquire(ctx, fp.Must(url.Parse(origin.URL()+"/other"))))
+			defer release()
+
+			start := time.Now()
+			Expect(refresher.New(ag).Run(ctx)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", ag.Config.RefreshLeaseDuration))
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+			// It is left leased, so it is tried again when the lease expires.
+			Expect(pgxt.GetScalar[*time.Time](ctx, ag.DB, `SELECT leased_until FROM icalproxy_feeds_v2 WHERE url = $1`, origin.URL()+"/feed")).ToNot(BeNil())
 		})
 		It("uses indices for its query", func() {
 			// Test the actual query, we want to make sure we don't accidentally regress on performance
 			// since this is a really important query to keep fast.
-			ag.Config.IcalTTLMap["EXAMPLEORG"] = types.TTL(time.Minute)
 			expl, err := refresher.New(ag).ExplainSelectQuery(ctx)
 			Expect(err).NotTo(HaveOccurred())
-			// Limit  (cost=12.54..16.57 rows=1 width=63) (actual time=0.025..0.025 rows=0 loops=1)
-			//  ->  LockRows  (cost=12.54..16.57 rows=1 width=63) (actual time=0.024..0.024 rows=0 loops=1)
-			//        ->  Bitmap Heap Scan on icalproxy_feeds_v2  (cost=12.54..16.56 rows=1 width=63) (actual time=0.023..0.024 rows=0 loops=1)
-			//              Recheck Cond: (starts_with(url_host_rev, 'GROELPMAXE'::text) OR (checked_at < ('2025-01-19 00:26:55+00'::timestamp with time zone - '02:00:00'::interval)))
-			//              Filter: ((starts_with(url_host_rev, 'GROELPMAXE'::text) AND (checked_at < ('2025-01-19 00:26:55+00'::timestamp with time zone - '00:01:00'::interval))) OR (checked_at < ('2025-01-19 00:26:55+00'::timestamp with time zone - '02:00:00'::interval)))
-			//              ->  BitmapOr  (cost=12.54..12.54 rows=1 width=0) (actual time=0.021..0.021 rows=0 loops=1)
-			//                    ->  Bitmap Index Scan on icalproxy_feeds_v2_url_host_rev_idx  (cost=0.00..8.27 rows=1 width=0) (actual time=0.018..0.018 rows=0 loops=1)
-			//                          Index Cond: ((url_host_rev >= 'GROELPMAXE'::text) AND (url_host_rev < 'GROELPMAXF'::text))
-			//                    ->  Bitmap Index Scan on icalproxy_feeds_v2_checked_at_idx  (cost=0.00..4.27 rows=1 width=0) (actual time=0.002..0.002 rows=0 loops=1)
-			//                          Index Cond: (checked_at < ('2025-01-19 00:26:55+00'::timestamp with time zone - '02:00:00'::interval))
+			// Limit  (cost=8.18..8.20 rows=1 width=71) (actual time=0.012..0.012 rows=0 loops=1)
+			//  ->  LockRows  (cost=8.18..8.20 rows=1 width=71) (actual time=0.011..0.011 rows=0 loops=1)
+			//    ->  Sort  (cost=8.18..8.19 rows=1 width=71) (actual time=0.011..0.011 rows=0 loops=1)
+			//        Sort Key: last_accessed_at DESC
+			//        ->  Index Scan using icalproxy_feeds_v2_refresh_at_idx on icalproxy_feeds_v2  (cost=0.15..8.17 rows=1 width=63) (actual time=0.010..0.010 rows=0 loops=1)
+			//              Index Cond: (refresh_at < '2025-01-19 00:26:55+00'::timestamp with time zone)
 			// Planning Time: 0.868 ms
 			// Execution Time: 0.551 ms
-			Expect(expl).To(ContainSubstring("Index Cond: ((url_host_rev >= 'GROELPMAXE'::text) AND (url_host_rev < 'GROELPMAXF'::text))"))
-			Expect(expl).To(ContainSubstring("Index Cond: (checked_at < "))
+			Expect(expl).To(ContainSubstring("Index Cond: (refresh_at < "))
 			Expect(expl).To(ContainSubstring("LockRows"))
 		})
 	})
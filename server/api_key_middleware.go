@@ -3,35 +3,49 @@ package server
 import (
 	"crypto/subtle"
 	"errors"
-	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"strings"
 )
 
-func ApiKeyMiddlewares(key string) ([]echo.MiddlewareFunc, error) {
-	if key == "" {
+// ApiKeyMiddlewares require the key, or any of busyKeys, in the Authorization header.
+// Callers using one of busyKeys are only served the "busy only" version of feeds,
+// and only by routes that allow it (see allowBusyOnly).
+// Requests with a valid 'busy_sig' (see BusySignatureMiddleware) do not need a key.
+func ApiKeyMiddlewares(key string, busyKeys ...string) ([]echo.MiddlewareFunc, error) {
+	if key == "" && len(busyKeys) == 0 {
 		return nil, errors.New("ApiKey must be configured")
 	}
+	matches := func(c echo.Context, provided string) bool {
+		if key != "" && strconstcmp(key, provided) {
+			return true
+		}
+		for _, bk := range busyKeys {
+			if bk != "" && strconstcmp(bk, provided) {
+				c.Set(busyOnlyKey, true)
+				return true
+			}
+		}
+		return false
+	}
 	basicAuthMW := middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
 		Skipper: func(c echo.Context) bool {
 			// If the caller provided Authorization: Apikey, we'll use that;
 			// otherwise, we use basic auth.
-			return isApiKeyAuth(c)
+			return isApiKeyAuth(c) || isBusySigned(c)
 		},
 		Validator: func(reqUsername string, reqPassword string, c echo.Context) (bool, error) {
-			passOk := strconstcmp(key, reqPassword)
-			return passOk, nil
+			return matches(c, reqPassword), nil
 		},
 	})
 	apiKeyMW := func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			if !isApiKeyAuth(c) {
+			if !isApiKeyAuth(c) || isBusySigned(c) {
 				return next(c)
 			}
 			authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
-			expected := fmt.Sprintf("Apikey %s", key)
-			if !strconstcmp(authHeader, expected) {
+			provided, ok := strings.CutPrefix(authHeader, "Apikey ")
+			if !ok || !matches(c, provided) {
 				return echo.NewHTTPError(401, "Header required or incorrect: 'Authorization: Apikey [value]'")
 			}
 			return next(c)
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+// Keys set on the echo.Context by the auth middlewares.
+const (
+	// busyOnlyKey is set when the caller authenticated with one of the busy-only API keys.
+	busyOnlyKey = "icalproxy.busy_only"
+	// busySignedKey is set when the caller passed a valid 'busy_sig' param, so does not need an API key.
+	busySignedKey = "icalproxy.busy_signed"
+	// busyAllowedKey is set by allowBusyOnly, for routes that serve "busy only" callers.
+	busyAllowedKey = "icalproxy.busy_allowed"
+)
+
+// BusySignature returns the 'busy_sig' query param for the given feed urls (in the order they are passed),
+// which allows callers to fetch the "busy only" version of the feeds without an API key.
+// It is the hex HMAC-SHA256 of the urls joined with newlines.
+func BusySignature(key string, urls ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join(urls, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BusySignatureMiddleware validates the 'busy_sig' query param, if present.
+// Requests with a valid signature skip the API key middlewares,
+// and are always served the "busy only" version of feeds (see extractServeOptions).
+func BusySignatureMiddleware(key string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			sig := c.QueryParam("busy_sig")
+			if sig == "" {
+				return next(c)
+			}
+			if !hmac.Equal([]byte(sig), []byte(BusySignature(key, c.QueryParams()["url"]...))) {
+				return echo.NewHTTPError(401, "'busy_sig' is incorrect")
+			}
+			c.Set(busySignedKey, true)
+			return next(c)
+		}
+	}
+}
+
+func isBusySigned(c echo.Context) bool {
+	v, _ := c.Get(busySignedKey).(bool)
+	return v
+}
+
+// isBusyOnly returns true if the caller may only see the "busy only" version of feeds.
+// Any 'busy_sig' param forces it, even if signatures are not configured, since a signed link
+// is never meant to show details.
+func isBusyOnly(c echo.Context) bool {
+	v, _ := c.Get(busyOnlyKey).(bool)
+	return v || c.QueryParam("busy_sig") != ""
+}
+
+// allowBusyOnly lets callers that may only see "busy only" feeds (see isBusyOnly) use the route.
+// It must come before denyBusyOnly, and only be used on routes that serve the busy only version of feeds.
+func allowBusyOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Set(busyAllowedKey, true)
+		return next(c)
+	}
+}
+
+// denyBusyOnly rejects callers that may only see "busy only" feeds, unless the route allows them
+// (see allowBusyOnly). It is the last auth middleware, so routes deny busy only callers by default.
+func denyBusyOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		allowed, _ := c.Get(busyAllowedKey).(bool)
+		if isBusyOnly(c) && !allowed {
+			return echo.NewHTTPError(http.StatusForbidden, "not available for busy only access")
+		}
+		return next(c)
+	}
+}
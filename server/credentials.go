@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/lithictech/go-aperitif/v2/api"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/credentials"
+	"net/http"
+)
+
+type putCredentialsRequest struct {
+	UrlPrefix string            `json:"url_prefix"`
+	Headers   map[string]string `json:"headers"`
+	BasicAuth *struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"basic_auth"`
+}
+
+// registerCredentials adds the endpoints to manage origin credentials.
+// Responses only ever include the names of headers, never their values.
+func registerCredentials(e *echo.Echo, ag *appglobals.AppGlobals, mw ...echo.MiddlewareFunc) {
+	e.GET("/credentials", func(c echo.Context) error {
+		summaries, err := ag.Credentials.List(api.StdContext(c))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]any{"credentials": summaries})
+	}, mw...)
+	e.PUT("/credentials", func(c echo.Context) error {
+		var req putCredentialsRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		prefix, err := credentials.CanonicalPrefix(req.UrlPrefix, ag.Config)
+		if err != nil {
+			return echo.NewHTTPError(400, fmt.Sprintf("'url_prefix' is invalid: %s", err.Error()))
+		}
+		cr := credentials.Credentials{UrlPrefix: prefix, Headers: make(map[string]string)}
+		for k, v := range req.Headers {
+			cr.Headers[http.CanonicalHeaderKey(k)] = v
+		}
+		if req.BasicAuth != nil {
+			auth := req.BasicAuth.Username + ":" + req.BasicAuth.Password
+			cr.Headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+		}
+		if err := cr.Validate(); err != nil {
+			return echo.NewHTTPError(400, err.Error())
+		}
+		if err := ag.Credentials.Put(api.StdContext(c), cr); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]any{"url_prefix": prefix})
+	}, mw...)
+	e.DELETE("/credentials", func(c echo.Context) error {
+		prefix, err := credentials.CanonicalPrefix(c.QueryParam("url_prefix"), ag.Config)
+		if err != nil {
+			return echo.NewHTTPError(400, fmt.Sprintf("'url_prefix' is invalid: %s", err.Error()))
+		}
+		deleted, err := ag.Credentials.Delete(api.StdContext(c), prefix)
+		if err != nil {
+			return err
+		} else if !deleted {
+			return echo.NewHTTPError(404, "no credentials for 'url_prefix'")
+		}
+		return c.NoContent(http.StatusNoContent)
+	}, mw...)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/ical"
+	"time"
+)
+
+// FreeBusyProdId is the PRODID of calendars served from /freebusy.
+const FreeBusyProdId = "-//icalproxy//freebusy//EN"
+
+// eventWindow is the time range to expand events into, for the /events and /freebusy endpoints.
+type eventWindow struct {
+	start time.Time
+	end   time.Time
+	// floating is the location used for floating times and all-day events.
+	floating *time.Location
+}
+
+func (w *eventWindow) etagSuffix() string {
+	return fmt.Sprintf("-%d-%d-%s", w.start.Unix(), w.end.Unix(), w.floating.String())
+}
+
+func (h *endpointHandler) extractEventWindow() (*eventWindow, error) {
+	w := &eventWindow{floating: time.UTC}
+	if tz := h.c.QueryParam("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil || tz == "Local" {
+			return nil, echo.NewHTTPError(400, fmt.Sprintf("'tz' is not a valid time zone: %q", tz))
+		}
+		w.floating = loc
+	}
+	var err error
+	if w.start, err = h.timeParam("start", w.floating, true); err != nil {
+		return nil, err
+	}
+	if w.end, err = h.timeParam("end", w.floating, true); err != nil {
+		return nil, err
+	}
+	if !w.start.Before(w.end) {
+		return nil, echo.NewHTTPError(400, "'start' must be before 'end'")
+	}
+	return w, nil
+}
+
+// timeParam parses a query param that is an RFC 3339 timestamp, or a date in loc.
+// If the param is not required and is missing, return a zero time.
+func (h *endpointHandler) timeParam(name string, loc *time.Location, required bool) (time.Time, error) {
+	v := h.c.QueryParam(name)
+	if v == "" {
+		if required {
+			return time.Time{}, echo.NewHTTPError(400, fmt.Sprintf("'%s' query param is required", name))
+		}
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.ParseInLocation(time.DateOnly, v, loc)
+	}
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(400, fmt.Sprintf("'%s' must be an RFC 3339 timestamp or a date: %q", name, v))
+	}
+	return t, nil
+}
+
+// trimWindow limits the events in a served feed, see ical.Calendar.Trim.
+// Either side of the window may be zero (unbounded), but not both.
+type trimWindow struct {
+	since time.Time
+	until time.Time
+}
+
+func (w *trimWindow) etagSuffix() string {
+	s := ""
+	if !w.since.IsZero() {
+		s += fmt.Sprintf("-since-%d", w.since.Unix())
+	}
+	if !w.until.IsZero() {
+		s += fmt.Sprintf("-until-%d", w.until.Unix())
+	}
+	return s
+}
+
+func (h *endpointHandler) extractTrimWindow() (*trimWindow, error) {
+	w := &trimWindow{}
+	var err error
+	if w.since, err = h.timeParam("since", time.UTC, false); err != nil {
+		return nil, err
+	}
+	if w.until, err = h.timeParam("until", time.UTC, false); err != nil {
+		return nil, err
+	}
+	if w.since.IsZero() && w.until.IsZero() {
+		return nil, nil
+	}
+	if !w.since.IsZero() && !w.until.IsZero() && !w.since.Before(w.until) {
+		return nil, echo.NewHTTPError(400, "'since' must be before 'until'")
+	}
+	return w, nil
+}
+
+type eventOccurrence struct {
+	UID          string `json:"uid"`
+	RecurrenceID string `json:"recurrence_id,omitempty"`
+	Start        string `json:"start"`
+	End          string `json:"end"`
+	AllDay       bool   `json:"all_day"`
+	Summary      string `json:"summary"`
+	Location     string `json:"location"`
+	Status       string `json:"status"`
+	Transp       string `json:"transp"`
+}
+
+// eventsBody returns the JSON body for the occurrences of events in the window.
+func eventsBody(cal *ical.Calendar, w *eventWindow) ([]byte, error) {
+	occurrences := cal.Expand(w.start, w.end, w.floating)
+	events := make([]eventOccurrence, 0, len(occurrences))
+	for _, o := range occurrences {
+		format := time.RFC3339
+		if o.AllDay {
+			format = time.DateOnly
+		}
+		eo := eventOccurrence{
+			UID:      o.Event.PropValue("UID"),
+			Start:    o.Start.Format(format),
+			End:      o.End.Format(format),
+			AllDay:   o.AllDay,
+			Summary:  ical.UnescapeText(o.Event.PropValue("SUMMARY")),
+			Location: ical.UnescapeText(o.Event.PropValue("LOCATION")),
+			Status:   o.Event.PropValue("STATUS"),
+			Transp:   o.Event.PropValue("TRANSP"),
+		}
+		if !o.RecurrenceID.IsZero() {
+			eo.RecurrenceID = o.RecurrenceID.Format(format)
+		}
+		events = append(events, eo)
+	}
+	return json.Marshal(map[string]any{"events": events})
+}
+
+// freeBusyBody returns a calendar with a VFREEBUSY for the busy times of the feed in the window.
+// The feed's url and fetch time are used as the UID and DTSTAMP, so the body only changes with the feed.
+func freeBusyBody(cal *ical.Calendar, fd *feed.Feed, w *eventWindow) *ical.Calendar {
+	fbcal := ical.NewCalendar(FreeBusyProdId)
+	fb := cal.FreeBusy(fd.Url.String(), fd.FetchedAt, w.start, w.end, w.floating)
+	fb.AddProp("URL", fd.Url.String())
+	fbcal.Components = append(fbcal.Components, fb)
+	return fbcal
+}
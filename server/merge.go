@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/lithictech/go-aperitif/v2/api"
+	"github.com/lithictech/go-aperitif/v2/logctx"
+	"github.com/lithictech/go-aperitif/v2/parallel"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/feed"
+	"github.com/webhookdb/icalproxy/ical"
+	"github.com/webhookdb/icalproxy/internal"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MaxMergeUrls is the most feeds that can be merged in a single request.
+const MaxMergeUrls = 50
+
+// MergeProdId is the PRODID of merged calendars.
+const MergeProdId = "-//icalproxy//merge//EN"
+
+// handleMerge serves a single calendar made from the feeds of all the 'url' query params.
+// Each feed is loaded the same way as the / endpoint (from the database if its TTL has not expired,
+// otherwise refetched and committed), and falls back to fetching from origin if the database is down.
+func handleMerge(ag *appglobals.AppGlobals) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := api.StdContext(c)
+		eh := &endpointHandler{
+			ag: ag,
+			c:  c,
+		}
+		if err := eh.extractServeOptions(); err != nil {
+			return err
+		}
+		members, labels, err := eh.extractMergeMembers()
+		if err != nil {
+			return err
+		}
+		feeds := make([]*feed.Feed, len(members))
+		fellBack := make([]bool, len(members))
+		err = parallel.ForEach(len(members), len(members), func(idx int) error {
+			m := members[idx]
+			mctx := logctx.AddTo(ctx, "feed_url", m.url.String())
+			ag.AccessTracker.Record(m.url)
+			fd, err := m.loadFeed(mctx)
+			if errors.Is(err, ErrFallback) {
+				fellBack[idx] = true
+				fd, err = m.fetchAsProxy(mctx)
+			}
+			feeds[idx] = fd
+			return err
+		})
+		// Members do not write response headers while loading concurrently, so set them for all members here.
+		// The merged feed is stale if any member is, and can be retried once every member can.
+		for _, m := range members {
+			eh.stale = eh.stale || m.stale
+			if m.retryAfterAt.After(eh.retryAfterAt) {
+				eh.retryAfterAt = m.retryAfterAt
+			}
+		}
+		eh.setLoadHeaders()
+		if err != nil {
+			return err
+		}
+		for _, fb := range fellBack {
+			if fb {
+				c.Response().Header().Set("Ical-Proxy-Fallback", "true")
+				break
+			}
+		}
+		// If any feed failed, the merged calendar would be silently missing events, so serve the error instead.
+		for i, fd := range feeds {
+			if fd.HttpStatus >= 400 {
+				c.Response().Header().Set("Ical-Proxy-Origin-Url", members[i].url.String())
+				return eh.serveResponse(ctx, fd)
+			}
+		}
+
+		sources := make([]ical.MergeSource, len(feeds))
+		// The merged contents change whenever any member (or its label) changes,
+		// so derive the hash from the member hashes rather than hashing the merged body.
+		hashInput := strings.Builder{}
+		var lastModified time.Time
+		for i, fd := range feeds {
+			cal, err := ical.Parse(fd.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("feed %s is not a valid calendar: %s", members[i].url, err.Error()))
+			}
+			sources[i] = ical.MergeSource{Calendar: cal, Label: labels[i]}
+			hashInput.WriteString(fmt.Sprintf("%s\n%s\n%s\n", members[i].url, labels[i], fd.MD5))
+			if fd.FetchedAt.After(lastModified) {
+				lastModified = fd.FetchedAt
+			}
+		}
+		merged := &feed.Feed{
+			HttpStatus: 200,
+			Body:       ical.Merge(MergeProdId, sources...).Bytes(),
+			MD5:        internal.MD5HashHex([]byte(hashInput.String())),
+			// Http times have a resolution of seconds, so make sure If-Modified-Since compares correctly.
+			FetchedAt: lastModified.Truncate(time.Second),
+		}
+		if etag := c.Request().Header.Get("If-None-Match"); etag != "" && etag == eh.etag(merged.MD5) {
+			return echo.NewHTTPError(http.StatusNotModified)
+		}
+		if lastmod := c.Request().Header.Get("If-Modified-Since"); lastmod != "" {
+			if lastmodtz, err := http.ParseTime(lastmod); err == nil && !merged.FetchedAt.After(lastmodtz) {
+				return echo.NewHTTPError(http.StatusNotModified)
+			}
+		}
+		return eh.serveResponse(ctx, merged)
+	}
+}
+
+// extractMergeMembers returns a handler for each 'url' query param,
+// and the 'label' for each one (empty if labels are not given).
+func (h *endpointHandler) extractMergeMembers() ([]*endpointHandler, []string, error) {
+	q := h.c.QueryParams()
+	urls := q["url"]
+	if len(urls) == 0 {
+		return nil, nil, echo.NewHTTPError(400, "'url' query param is required")
+	}
+	if len(urls) > MaxMergeUrls {
+		return nil, nil, echo.NewHTTPError(400, fmt.Sprintf("at most %d 'url' query params can be merged", MaxMergeUrls))
+	}
+	labels := q["label"]
+	if len(labels) == 0 {
+		labels = make([]string, len(urls))
+	} else if len(labels) != len(urls) {
+		return nil, nil, echo.NewHTTPError(400, "if 'label' query params are given, there must be one for each 'url'")
+	}
+	members := make([]*endpointHandler, len(urls))
+	for i, u := range urls {
+		if u == "" {
+			return nil, nil, echo.NewHTTPError(400, "'url' query params cannot be empty")
+		}
+		uri, err := url.Parse(u)
+		if err != nil {
+			return nil, nil, echo.NewHTTPError(400, fmt.Sprintf("'url' %q is invalid: %s", u, err.Error()))
+		}
+		members[i] = &endpointHandler{ag: h.ag, c: h.c, url: feed.CanonicalURL(uri, h.ag.Config.IcalSortQueryMap)}
+	}
+	return members, labels, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/lithictech/go-aperitif/v2/api"
+	"github.com/webhookdb/icalproxy/appglobals"
+	"github.com/webhookdb/icalproxy/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MaxSearchLimit is the most events that can be returned from /events/search.
+const MaxSearchLimit = 1000
+
+// handleSearchEvents serves the stored events (see db.SearchEvents) matching the query params, as JSON.
+// Since events are only stored in the database, this endpoint has no fallback.
+func handleSearchEvents(ag *appglobals.AppGlobals) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := api.StdContext(c)
+		eh := &endpointHandler{
+			ag: ag,
+			c:  c,
+		}
+		search := db.EventSearch{
+			Query: c.QueryParam("q"),
+			Host:  c.QueryParam("host"),
+			Limit: 100,
+		}
+		var err error
+		if search.Start, err = eh.timeParam("start", time.UTC, false); err != nil {
+			return err
+		}
+		if search.End, err = eh.timeParam("end", time.UTC, false); err != nil {
+			return err
+		}
+		if !search.Start.IsZero() && !search.End.IsZero() && !search.Start.Before(search.End) {
+			return echo.NewHTTPError(400, "'start' must be before 'end'")
+		}
+		if v := c.QueryParam("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > MaxSearchLimit {
+				return echo.NewHTTPError(400, fmt.Sprintf("'limit' must be between 1 and %d, got %q", MaxSearchLimit, v))
+			}
+			search.Limit = n
+		}
+		events, err := db.New(ag.DB).SearchEvents(ctx, search)
+		if err != nil {
+			return err
+		}
+		if events == nil {
+			events = []db.EventSearchResult{}
+		}
+		return c.JSON(http.StatusOK, map[string]any{"events": events})
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
@@ -12,13 +13,16 @@ import (
 	"github.com/webhookdb/icalproxy/db"
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/feedstorage"
+	"github.com/webhookdb/icalproxy/ical"
 	"github.com/webhookdb/icalproxy/internal"
 	"github.com/webhookdb/icalproxy/pgxt"
 	"github.com/webhookdb/icalproxy/refresher"
 	"github.com/webhookdb/icalproxy/types"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,16 +36,35 @@ const EtagBusterPrefix = "v1"
 func Register(_ context.Context, e *echo.Echo, ag *appglobals.AppGlobals) error {
 	e.GET("/favicon.ico", func(c echo.Context) error { return c.Blob(200, "image/x-icon", favicon) })
 
-	mw := []echo.MiddlewareFunc{FallbackMiddleware(ag)}
-	if ag.Config.ApiKey != "" {
-		apiKeyMws, err := ApiKeyMiddlewares(ag.Config.ApiKey)
+	var authMw []echo.MiddlewareFunc
+	if ag.Config.BusySigningKey != "" {
+		authMw = append(authMw, BusySignatureMiddleware(ag.Config.BusySigningKey))
+	}
+	if ag.Config.ApiKey != "" || len(ag.Config.BusyApiKeys) > 0 {
+		apiKeyMws, err := ApiKeyMiddlewares(ag.Config.ApiKey, ag.Config.BusyApiKeys...)
 		if err != nil {
 			return err
 		}
-		mw = append(mw, apiKeyMws...)
+		authMw = append(authMw, apiKeyMws...)
+	}
+	authMw = append(authMw, denyBusyOnly)
+	mw := append([]echo.MiddlewareFunc{FallbackMiddleware(ag)}, authMw...)
+	// Only routes that serve the busy only version of feeds are available to busy only callers.
+	busyMw := append([]echo.MiddlewareFunc{FallbackMiddleware(ag), allowBusyOnly}, authMw...)
+	e.HEAD("/", handle(ag), busyMw...)
+	e.GET("/", handle(ag), busyMw...)
+	e.GET("/events", handle(ag), busyMw...)
+	e.GET("/freebusy", handle(ag), busyMw...)
+	e.GET("/validation", handle(ag), mw...)
+	// Merged feeds fall back for each url individually (see handleMerge), rather than proxying the request.
+	e.GET("/merge", handleMerge(ag), authMw...)
+	e.GET("/events/search", handleSearchEvents(ag), authMw...)
+	if ag.Credentials != nil {
+		if ag.Config.ApiKey == "" {
+			return errors.New("API_KEY must be configured to use CREDENTIALS_KEY, so credentials cannot be managed by anyone")
+		}
+		registerCredentials(e, ag, authMw...)
 	}
-	e.HEAD("/", handle(ag), mw...)
-	e.GET("/", handle(ag), mw...)
 	e.GET("/stats", handleStats(ag), mw...)
 	return nil
 }
@@ -50,10 +73,65 @@ func Register(_ context.Context, e *echo.Echo, ag *appglobals.AppGlobals) error
 var favicon []byte
 
 type endpointHandler struct {
-	ag  *appglobals.AppGlobals
-	c   echo.Context
-	url *url.URL
-	row *db.FeedRow
+	ag   *appglobals.AppGlobals
+	c    echo.Context
+	url  *url.URL
+	row  *db.FeedRow
+	opts serveOptions
+	// stale is set when the stored feed was loaded even though its TTL expired (see staleFeed).
+	// Loading does not write response headers, since /merge loads its feeds concurrently
+	// with the same echo.Context; see setLoadHeaders.
+	stale bool
+	// retryAfterAt is set when the feed could not be loaded because the origin asked us to retry later.
+	retryAfterAt time.Time
+}
+
+// serveOptions control how the feed is transformed before it is served.
+// Every option that changes the response body must also change the Etag (see etagSuffix),
+// so caches do not confuse different representations of the same feed.
+type serveOptions struct {
+	// jcal is true to serve the feed as jCal (RFC 7265) rather than iCalendar.
+	jcal bool
+	// events is set for the /events endpoint, to serve the occurrences of events in the window as JSON.
+	events *eventWindow
+	// freeBusy is set for the /freebusy endpoint, to serve a VFREEBUSY for the busy times in the window.
+	freeBusy *eventWindow
+	// trim is set to remove events outside of the window from the served feed.
+	trim *trimWindow
+	// validation is true for the /validation endpoint, to serve the feed's validation report as JSON.
+	validation bool
+	// timezonesAt is set to add VTIMEZONEs for TZIDs that the feed uses but does not define.
+	// The VTIMEZONEs depend on the time they are generated at (see ical.Calendar.AddMissingTimezones),
+	// so its year is part of the Etag.
+	timezonesAt time.Time
+	// busy is true to serve the feed without any event details, only when events are (see ical.Calendar.BusyOnly).
+	busy bool
+}
+
+func (o serveOptions) etagSuffix() string {
+	s := ""
+	if o.jcal {
+		s += "-jcal"
+	}
+	if o.events != nil {
+		s += "-events" + o.events.etagSuffix()
+	}
+	if o.freeBusy != nil {
+		s += "-freebusy" + o.freeBusy.etagSuffix()
+	}
+	if o.trim != nil {
+		s += o.trim.etagSuffix()
+	}
+	if o.validation {
+		s += "-validation"
+	}
+	if !o.timezonesAt.IsZero() {
+		s += "-tz" + strconv.Itoa(o.timezonesAt.Year())
+	}
+	if o.busy {
+		s += "-busy"
+	}
+	return s
 }
 
 func handle(ag *appglobals.AppGlobals) echo.HandlerFunc {
@@ -67,7 +145,11 @@ func handle(ag *appglobals.AppGlobals) echo.HandlerFunc {
 		if err := eh.extractUrl(); err != nil {
 			return err
 		}
+		if err := eh.extractServeOptions(); err != nil {
+			return err
+		}
 		ctx = logctx.AddTo(ctx, "feed_url", eh.url.String())
+		ag.AccessTracker.Record(eh.url)
 		// Load the row from the database, if there is one.
 		// If there isn't, 'row' will be nil.
 		if err := eh.loadRow(ctx); err != nil {
@@ -86,6 +168,7 @@ func handle(ag *appglobals.AppGlobals) echo.HandlerFunc {
 		}
 		// We discover we need to fetch the feed, store it in the database.
 		fd, err := eh.refetchAndCommit(ctx)
+		eh.setLoadHeaders()
 		if err != nil {
 			return err
 		}
@@ -103,10 +186,134 @@ func (h *endpointHandler) extractUrl() error {
 	if err != nil {
 		return echo.NewHTTPError(400, fmt.Sprintf("'url' is invalid: %s", err.Error()))
 	}
-	h.url = uri
+	// Different spellings of the same feed should share a row, so look up and store the canonical url.
+	h.url = feed.CanonicalURL(uri, h.ag.Config.IcalSortQueryMap)
+	return nil
+}
+
+func (h *endpointHandler) extractServeOptions() error {
+	busy, err := h.boolParam("busy")
+	if err != nil {
+		return err
+	}
+	h.opts.busy = busy || isBusyOnly(h.c)
+	if h.c.Path() == "/events" {
+		w, err := h.extractEventWindow()
+		if err != nil {
+			return err
+		}
+		h.opts.events = w
+		return nil
+	}
+	if h.c.Path() == "/validation" {
+		h.opts.validation = true
+		return nil
+	}
+	if h.opts.jcal, err = h.extractJCal(); err != nil {
+		return err
+	}
+	if h.c.Path() == "/freebusy" {
+		w, err := h.extractEventWindow()
+		if err != nil {
+			return err
+		}
+		h.opts.freeBusy = w
+		return nil
+	}
+	w, err := h.extractTrimWindow()
+	if err != nil {
+		return err
+	}
+	h.opts.trim = w
+	addTimezones, err := h.boolParam("add_timezones")
+	if err != nil {
+		return err
+	}
+	if addTimezones {
+		h.opts.timezonesAt = time.Now()
+	}
 	return nil
 }
 
+// extractJCal returns true if the feed should be served as jCal,
+// based on the 'format' param or the Accept header.
+func (h *endpointHandler) extractJCal() (bool, error) {
+	switch format := h.c.QueryParam("format"); format {
+	case "":
+		return acceptsJCal(h.c.Request().Header.Get("Accept")), nil
+	case "jcal":
+		return true, nil
+	case "ical":
+		return false, nil
+	default:
+		return false, echo.NewHTTPError(400, fmt.Sprintf("'format' must be 'ical' or 'jcal', got %q", format))
+	}
+}
+
+// acceptsJCal returns true if the Accept header prefers jCal to iCalendar,
+// by comparing their q-values (RFC 9110 section 12.5.1). iCalendar wins ties.
+func acceptsJCal(accept string) bool {
+	if accept == "" {
+		return false
+	}
+	jcal := acceptQuality(accept, "application", "calendar+json")
+	return jcal > 0 && jcal > acceptQuality(accept, "text", "calendar")
+}
+
+// acceptQuality returns the q-value the Accept header gives to the media type,
+// from the most specific media range that matches it, or 0 if none do.
+func acceptQuality(accept, typ, subtype string) float64 {
+	q := 0.0
+	specificity := -1
+	for _, rng := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(rng, ";")
+		rangeType, rangeSubtype, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mediaRange)), "/")
+		var s int
+		switch {
+		case rangeType == typ && rangeSubtype == subtype:
+			s = 2
+		case rangeType == typ && rangeSubtype == "*":
+			s = 1
+		case rangeType == "*" && rangeSubtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity = s
+		q = 1
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
+}
+
+// boolParam parses an optional boolean query param, which is false if missing.
+func (h *endpointHandler) boolParam(name string) (bool, error) {
+	v := h.c.QueryParam(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, echo.NewHTTPError(400, fmt.Sprintf("'%s' must be a boolean, got %q", name, v))
+	}
+	return b, nil
+}
+
+// etag returns the Etag for the given contents hash and the options being served.
+func (h *endpointHandler) etag(md5 types.MD5Hash) string {
+	return EtagBusterPrefix + string(md5) + h.opts.etagSuffix()
+}
+
 func (h *endpointHandler) loadRow(ctx context.Context) error {
 	r, err := db.New(h.ag.DB).FetchFeedRow(ctx, h.url)
 	if err != nil {
@@ -121,7 +328,11 @@ func (h *endpointHandler) conditionalGetCheck(_ context.Context) error {
 		return nil
 	}
 	if etag := h.c.Request().Header.Get("If-None-Match"); etag != "" {
-		if string(h.row.ContentsMD5) == etag {
+		if h.etag(h.row.ContentsMD5) == etag {
+			return echo.NewHTTPError(http.StatusNotModified)
+		}
+		// Callers have always been able to pass the bare contents hash for the plain iCalendar representation.
+		if h.opts == (serveOptions{}) && string(h.row.ContentsMD5) == etag {
 			return echo.NewHTTPError(http.StatusNotModified)
 		}
 	}
@@ -137,22 +348,45 @@ func (h *endpointHandler) conditionalGetCheck(_ context.Context) error {
 }
 
 func (h *endpointHandler) serveIfTtl(ctx context.Context) (bool, error) {
+	fd, err := h.cachedFeed(ctx)
+	if fd == nil || err != nil {
+		return false, err
+	}
+	h.c.Response().Header().Set("Ical-Proxy-Cached", "true")
+	return true, h.serveResponse(ctx, fd)
+}
+
+// cachedFeed returns the stored feed if its TTL has not expired,
+// or nil if there is no stored feed or it needs to be refetched.
+func (h *endpointHandler) cachedFeed(ctx context.Context) (*feed.Feed, error) {
 	if h.row == nil {
-		return false, nil
+		return nil, nil
 	}
 	timeSinceFetch := time.Now().Sub(h.row.ContentsLastModified)
 	maxTtl := time.Duration(feed.TTLFor(h.url, h.ag.Config.IcalTTLMap))
-	if timeSinceFetch <= maxTtl {
-		fd, err := db.New(h.ag.DB).FetchContentsAsFeed(ctx, h.ag.FeedStorage, h.url)
-		if errors.Is(err, feedstorage.ErrNotFound) {
-			return false, nil
-		} else if err != nil {
-			return false, ErrFallback
-		}
-		h.c.Response().Header().Set("Ical-Proxy-Cached", "true")
-		return true, h.serveResponse(ctx, fd)
+	if timeSinceFetch > maxTtl {
+		return nil, nil
+	}
+	fd, err := db.New(h.ag.DB).FetchContentsAsFeed(ctx, h.ag.FeedStorage, h.url)
+	if errors.Is(err, feedstorage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, ErrFallback
+	}
+	return fd, nil
+}
+
+// loadFeed returns the feed for the url, from the database if its TTL has not expired,
+// or otherwise by fetching it from origin and committing it.
+// Like handle, but without any conditional GET checks or serving.
+func (h *endpointHandler) loadFeed(ctx context.Context) (*feed.Feed, error) {
+	if err := h.loadRow(ctx); err != nil {
+		return nil, err
 	}
-	return false, nil
+	if fd, err := h.cachedFeed(ctx); fd != nil || err != nil {
+		return fd, err
+	}
+	return h.refetchAndCommit(ctx)
 }
 
 func (h *endpointHandler) refetchAndCommit(ctx context.Context) (*feed.Feed, error) {
@@ -165,14 +399,32 @@ func (h *endpointHandler) refetchAndCommit(ctx context.Context) (*feed.Feed, err
 	if h.row != nil {
 		previousHeaders = h.row.FetchHeaders
 	}
-	fd, err := feed.Fetch(timeoutctx, h.url, previousHeaders)
-	if err != nil && !errors.Is(err, feed.ErrNotModified) {
+	if retryAfter := h.retryAfter(ctx); !retryAfter.IsZero() {
+		logctx.Logger(ctx).InfoContext(ctx, "origin_retry_after", "retry_after", retryAfter)
+		fd, err := h.staleFeed(ctx, errOriginRetryAfter)
+		if err != nil {
+			h.retryAfterAt = retryAfter
+		}
+		return fd, err
+	}
+	release, err := h.ag.HostLimiter.Acquire(timeoutctx, h.url)
+	if err != nil {
+		logctx.Logger(ctx).WarnContext(ctx, "host_limit_wait_timeout")
+		return h.staleFeed(ctx, errHostBusy)
+	}
+	fd, err := feed.Fetch(timeoutctx, h.url, previousHeaders, h.ag.FetchOptions(timeoutctx, h.url))
+	// Release right away, since committing can refetch (and acquire again).
+	release()
+	if errors.Is(err, feed.ErrOriginForbidden) {
+		// Do not commit the feed, since the url should never be fetched.
+		return nil, originForbidden(err)
+	} else if err != nil && !errors.Is(err, feed.ErrNotModified) {
 		return nil, err
 	} else if errors.Is(err, feed.ErrNotModified) {
 		// If origin told us there are no changes, we need to commit the feed to reset its TTL,
 		// and then serve whatever is in cache.
 		dbo := db.New(h.ag.DB)
-		if err := dbo.CommitUnchanged(ctx, fd); err != nil {
+		if err := dbo.CommitUnchanged(ctx, fd, feed.RefreshBoundsFor(h.url, h.ag.Config)); err != nil {
 			logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "commit_unchanged_feed_error")
 		}
 		fd, err := dbo.FetchContentsAsFeed(ctx, h.ag.FeedStorage, h.url)
@@ -188,16 +440,64 @@ func (h *endpointHandler) refetchAndCommit(ctx context.Context) (*feed.Feed, err
 		return fd, nil
 	}
 
+	fd.SetFingerprint(h.ag.Config.IcalVolatileMap)
 	// If the commit is coming through the server, we don't need to send a webhook.
 	// Note that we don't compare the feed to the database version like refresher does and CommitUnchanged;
 	// this code path should be relatively rare, since refresher should take care of keeping feeds up to date.
-	if err := db.New(h.ag.DB).CommitFeed(ctx, h.ag.FeedStorage, fd, nil); err != nil {
+	opts := &db.CommitFeedOptions{Refresh: feed.RefreshBoundsFor(h.url, h.ag.Config)}
+	if err := db.New(h.ag.DB).CommitFeed(ctx, h.ag.FeedStorage, fd, opts); err != nil {
 		logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "commit_feed_error")
 	}
 	return fd, nil
 }
 
+// staleFeed returns the stored feed even though its TTL has expired,
+// for when the origin cannot be fetched right now, like when too many requests to its host
+// are already in progress (see feed.HostLimiter). If there is no stored feed, return errIfNone.
+func (h *endpointHandler) staleFeed(ctx context.Context, errIfNone error) (*feed.Feed, error) {
+	if h.row != nil {
+		fd, err := db.New(h.ag.DB).FetchContentsAsFeed(ctx, h.ag.FeedStorage, h.url)
+		if err == nil && fd.Body != nil {
+			h.stale = true
+			return fd, nil
+		}
+	}
+	return nil, errIfNone
+}
+
+// setLoadHeaders sets the response headers for what happened while loading the feed.
+func (h *endpointHandler) setLoadHeaders() {
+	if h.stale {
+		h.c.Response().Header().Set("Ical-Proxy-Stale", "true")
+	}
+	if !h.retryAfterAt.IsZero() {
+		h.c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(h.retryAfterAt).Seconds()))))
+	}
+}
+
+// These are 503s, since the origin is not at fault.
+var errHostBusy = echo.NewHTTPError(http.StatusServiceUnavailable, "too many requests to the origin host are in progress, try again later")
+var errOriginRetryAfter = echo.NewHTTPError(http.StatusServiceUnavailable, "the origin host is rate limiting requests, try again later")
+
+// retryAfter returns when the origin asked for the feed, or any feed with its host, to be fetched again
+// (see feed.ParseRetryAfter), or zero if that has passed.
+func (h *endpointHandler) retryAfter(ctx context.Context) time.Time {
+	if h.row != nil && h.row.RetryAfter.After(time.Now()) {
+		return h.row.RetryAfter
+	}
+	t, err := db.New(h.ag.DB).HostRetryAfter(ctx, h.url)
+	if err != nil {
+		logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "host_retry_after_error")
+	}
+	return t
+}
+
 func (h *endpointHandler) serveResponse(_ context.Context, fd *feed.Feed) error {
+	if fd.FailureCount > 0 {
+		// The origin is failing, so the refresher is backing off from it.
+		h.c.Response().Header().Set("Ical-Proxy-Failure-Count", strconv.Itoa(fd.FailureCount))
+		h.c.Response().Header().Set("Ical-Proxy-Failing-Since", types.FormatHttpTime(fd.FailingSince))
+	}
 	if fd.HttpStatus >= 400 {
 		// Origin errors should be 'proxied' as a 421 error.
 		// If we use any error code, it makes it very confusing both operationally,
@@ -211,24 +511,85 @@ func (h *endpointHandler) serveResponse(_ context.Context, fd *feed.Feed) error
 		}
 		return h.c.Blob(http.StatusMisdirectedRequest, contentType, fd.Body)
 	}
-	h.c.Response().Header().Set("Content-Type", feed.CalendarContentType)
-	h.c.Response().Header().Set("Content-Length", strconv.Itoa(len(fd.Body)))
-	h.c.Response().Header().Set("Etag", EtagBusterPrefix+string(fd.MD5))
+	if fd.Validation != nil {
+		h.c.Response().Header().Set("Ical-Proxy-Validation", string(fd.Validation.Status))
+	}
+	contentType, body, err := h.transformBody(fd)
+	if err != nil {
+		return err
+	}
+	// The representation depends on the Accept header, so shared caches must key on it.
+	h.c.Response().Header().Set("Vary", "Accept")
+	h.c.Response().Header().Set("Content-Type", contentType)
+	h.c.Response().Header().Set("Content-Length", strconv.Itoa(len(body)))
+	h.c.Response().Header().Set("Etag", h.etag(fd.MD5))
 	h.c.Response().Header().Set("Last-Modified", types.FormatHttpTime(fd.FetchedAt))
 	if h.c.Request().Method == http.MethodHead {
 		h.c.Response().WriteHeader(200)
 		return nil
 	}
-	return h.c.Blob(200, feed.CalendarContentType, fd.Body)
+	return h.c.Blob(200, contentType, body)
+}
+
+// transformBody applies the serve options to a successfully fetched feed,
+// returning the content type and body to serve.
+func (h *endpointHandler) transformBody(fd *feed.Feed) (string, []byte, error) {
+	if h.opts == (serveOptions{}) {
+		return feed.CalendarContentType, fd.Body, nil
+	}
+	if h.opts.validation {
+		v := fd.Validation
+		if v == nil {
+			// Feeds stored before validation was added do not have a report.
+			v = ical.Validate(fd.Body)
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", nil, internal.ErrWrap(err, "marshaling validation")
+		}
+		return echo.MIMEApplicationJSON, b, nil
+	}
+	cal, err := ical.Parse(fd.Body)
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("feed is not a valid calendar: %s", err.Error()))
+	}
+	if h.opts.busy {
+		cal = cal.BusyOnly()
+	}
+	if h.opts.events != nil {
+		b, err := eventsBody(cal, h.opts.events)
+		if err != nil {
+			return "", nil, internal.ErrWrap(err, "marshaling events")
+		}
+		return echo.MIMEApplicationJSON, b, nil
+	}
+	if h.opts.freeBusy != nil {
+		cal = freeBusyBody(cal, fd, h.opts.freeBusy)
+	}
+	if h.opts.trim != nil {
+		cal = cal.Trim(h.opts.trim.since, h.opts.trim.until, time.UTC)
+	}
+	if !h.opts.timezonesAt.IsZero() {
+		cal.AddMissingTimezones(h.opts.timezonesAt)
+	}
+	if !h.opts.jcal {
+		return feed.CalendarContentType, cal.Bytes(), nil
+	}
+	b, err := cal.MarshalJCal()
+	if err != nil {
+		return "", nil, internal.ErrWrap(err, "marshaling jcal")
+	}
+	return ical.JCalContentType, b, nil
 }
 
 func (h *endpointHandler) runAsProxy(ctx context.Context) error {
 	if err := h.extractUrl(); err != nil {
 		return err
 	}
-	timeoutCtx, cancel := context.WithTimeout(ctx, time.Duration(h.ag.Config.RequestMaxTimeout)*time.Second)
-	defer cancel()
-	resp, err := feed.Fetch(timeoutCtx, h.url, nil)
+	if err := h.extractServeOptions(); err != nil {
+		return err
+	}
+	resp, err := h.fetchAsProxy(ctx)
 	if err != nil {
 		return err
 	}
@@ -236,6 +597,29 @@ func (h *endpointHandler) runAsProxy(ctx context.Context) error {
 	return h.serveResponse(ctx, resp)
 }
 
+// fetchAsProxy fetches the feed from origin without using the database,
+// with the maximum request timeout since there is no refresher to fall back on.
+func (h *endpointHandler) fetchAsProxy(ctx context.Context) (*feed.Feed, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Duration(h.ag.Config.RequestMaxTimeout)*time.Second)
+	defer cancel()
+	release, err := h.ag.HostLimiter.Acquire(timeoutCtx, h.url)
+	if err != nil {
+		return nil, errHostBusy
+	}
+	defer release()
+	fd, err := feed.Fetch(timeoutCtx, h.url, nil, h.ag.FetchOptions(timeoutCtx, h.url))
+	if errors.Is(err, feed.ErrOriginForbidden) {
+		return nil, originForbidden(err)
+	}
+	return fd, err
+}
+
+// originForbidden returns a 403 for feed.ErrOriginForbidden,
+// since the url itself (rather than the origin's response) is the problem.
+func originForbidden(err error) error {
+	return echo.NewHTTPError(http.StatusForbidden, err.Error())
+}
+
 func handleStats(ag *appglobals.AppGlobals) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		ctx := api.StdContext(c)
@@ -251,10 +635,16 @@ func handleStats(ag *appglobals.AppGlobals) echo.HandlerFunc {
 			logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "counting_rows_pending_webhook")
 			whRowCnt = -1
 		}
+		failingRowCnt, err := pgxt.GetScalar[int64](ctx, ag.DB, "SELECT count(1) FROM icalproxy_feeds_v2 WHERE failure_count > 0")
+		if err != nil {
+			logctx.Logger(ctx).With("error", err).ErrorContext(ctx, "counting_rows_failing")
+			failingRowCnt = -1
+		}
 		resp := map[string]any{
 			"pending_refresh_count": refreshRowCnt,
 			"db_count_latency":      countLatency.Seconds(),
 			"pending_webhooks":      whRowCnt,
+			"failing_count":         failingRowCnt,
 		}
 		return c.JSON(http.StatusOK, resp)
 	}
@@ -2,6 +2,7 @@ package server_test
 
 import (
 	"context"
+	"encoding/base64"
 	"github.com/labstack/echo/v4"
 	"github.com/lithictech/go-aperitif/v2/api"
 	. "github.com/lithictech/go-aperitif/v2/api/echoapitest"
@@ -13,15 +14,19 @@ import (
 	. "github.com/rgalanakis/golangal"
 	"github.com/webhookdb/icalproxy/appglobals"
 	"github.com/webhookdb/icalproxy/config"
+	"github.com/webhookdb/icalproxy/credentials"
 	"github.com/webhookdb/icalproxy/db"
 	"github.com/webhookdb/icalproxy/feed"
 	"github.com/webhookdb/icalproxy/feedstorage/fakefeedstorage"
 	"github.com/webhookdb/icalproxy/fp"
 	"github.com/webhookdb/icalproxy/icalproxytest"
+	"github.com/webhookdb/icalproxy/pgxt"
 	"github.com/webhookdb/icalproxy/server"
 	"github.com/webhookdb/icalproxy/types"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -42,6 +47,8 @@ var _ = Describe("server", func() {
 
 	BeforeEach(func() {
 		ag = fp.Must(appglobals.New(ctx, fp.Must(config.LoadConfig())))
+		// Origins in tests are ghttp servers listening on loopback, which is blocked by default.
+		ag.Config.OriginAllowlist = fp.Must(types.ParseOriginAllowlist([]string{"127.0.0.1"}))
 		Expect(icalproxytest.TruncateLocal(ctx, ag.DB)).To(Succeed())
 		e = api.New(api.Config{Logger: logctx.Logger(ctx)})
 
@@ -65,27 +72,27 @@ var _ = Describe("server", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/feed.ics", ""),
-					ghttp.RespondWith(200, "VEVENT"),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
 				),
 			)
 			req := NewRequest("GET", serverRequestUrl, nil)
 			req.Header.Add("Authorization", "Apikey sekret")
 			rr := Serve(e, req)
 			Expect(rr).To(HaveResponseCode(200))
-			Expect(rr.Body.String()).To(Equal("VEVENT"))
+			Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("VEVENT")))
 		})
 		It("succeeds with basic auth with the api key as the password", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/feed.ics", ""),
-					ghttp.RespondWith(200, "VEVENT"),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
 				),
 			)
 			req := NewRequest("GET", serverRequestUrl, nil)
 			req.SetBasicAuth("", "sekret")
 			rr := Serve(e, req)
 			Expect(rr).To(HaveResponseCode(200))
-			Expect(rr.Body.String()).To(Equal("VEVENT"))
+			Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("VEVENT")))
 		})
 		It("errors with a missing auth header", func() {
 			req := NewRequest("GET", serverRequestUrl, nil)
@@ -100,6 +107,90 @@ var _ = Describe("server", func() {
 		})
 	})
 
+	Describe("busy only feeds", func() {
+		calBody := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Secret\r\nLOCATION:Office\r\n" +
+			"DTSTART:20240101T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		busyBody := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Busy\r\n" +
+			"DTSTART:20240101T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		calMD5 := string(icalproxytest.MustMD5(calBody))
+
+		BeforeEach(func() {
+			ag.Config.ApiKey = "sekret"
+			ag.Config.BusyApiKeys = []string{"busykey"}
+			ag.Config.BusySigningKey = "signer"
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte(calBody),
+				time.Now(),
+			), nil)).To(Succeed())
+		})
+
+		It("serves the busy only version if requested, with its own Etag", func() {
+			req := NewRequest("GET", serverRequestUrl+"&busy=true", nil)
+			req.Header.Add("Authorization", "Apikey sekret")
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(Equal(busyBody))
+			Expect(rr.Header().Get("Etag")).To(Equal("v1" + calMD5 + "-busy"))
+
+			req = NewRequest("GET", serverRequestUrl, nil)
+			req.Header.Add("Authorization", "Apikey sekret")
+			rr = Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(Equal(calBody))
+		})
+		It("always serves the busy only version to busy only api keys", func() {
+			req := NewRequest("GET", serverRequestUrl+"&busy=false", nil)
+			req.Header.Add("Authorization", "Apikey busykey")
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(Equal(busyBody))
+
+			req = NewRequest("GET", "/events?start=2024-01-01&end=2024-01-02&url="+url.QueryEscape(originFeedUrl), nil)
+			req.SetBasicAuth("", "busykey")
+			rr = Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(ContainSubstring(`"summary":"Busy"`))
+			Expect(rr.Body.String()).ToNot(ContainSubstring("Office"))
+		})
+		It("serves the busy only version without an api key if the url is signed", func() {
+			sig := server.BusySignature("signer", originFeedUrl)
+			rr := Serve(e, NewRequest("GET", serverRequestUrl+"&busy_sig="+sig, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(Equal(busyBody))
+
+			rr = Serve(e, NewRequest("GET", serverRequestUrl+"&busy_sig="+server.BusySignature("other", originFeedUrl), nil))
+			Expect(rr).To(HaveResponseCode(401))
+			rr = Serve(e, NewRequest("GET", "/?url="+url.QueryEscape(originFeedUrl+"?x")+"&busy_sig="+sig, nil))
+			Expect(rr).To(HaveResponseCode(401))
+		})
+		It("denies busy only callers on routes that do not serve the busy only version", func() {
+			sig := server.BusySignature("signer", originFeedUrl)
+			for _, target := range []string{
+				"/validation?url=" + url.QueryEscape(originFeedUrl),
+				"/merge?url=" + url.QueryEscape(originFeedUrl),
+				"/stats?url=" + url.QueryEscape(originFeedUrl),
+			} {
+				req := NewRequest("GET", target, nil)
+				req.Header.Add("Authorization", "Apikey busykey")
+				Expect(Serve(e, req)).To(HaveResponseCode(403), target)
+				Expect(Serve(e, NewRequest("GET", target+"&busy_sig="+sig, nil))).To(HaveResponseCode(403), target)
+
+				req = NewRequest("GET", target, nil)
+				req.Header.Add("Authorization", "Apikey sekret")
+				Expect(Serve(e, req)).To(HaveResponseCode(200), target)
+			}
+		})
+		It("returns 400 for an invalid value", func() {
+			req := NewRequest("GET", serverRequestUrl+"&busy=maybe", nil)
+			req.Header.Add("Authorization", "Apikey sekret")
+			Expect(Serve(e, req)).To(HaveResponseCode(400))
+		})
+	})
+
 	Describe("GET /", func() {
 		BeforeEach(func() {
 			Expect(server.Register(ctx, e, ag)).To(Succeed())
@@ -119,22 +210,31 @@ var _ = Describe("server", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/feed.ics", ""),
-					ghttp.RespondWith(200, "VEVENT"),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
 				),
 			)
 			req := NewRequest("GET", serverRequestUrl, nil)
 			rr := Serve(e, req)
 			Expect(rr).To(HaveResponseCode(200))
-			Expect(rr.Body.String()).To(Equal("VEVENT"))
+			Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("VEVENT")))
 			Expect(feed.HeadersToMap(rr.Header())).To(And(
 				HaveKeyWithValue("Content-Type", "text/calendar; charset=utf-8"),
-				HaveKeyWithValue("Content-Length", "6"),
+				HaveKeyWithValue("Content-Length", "49"),
 				HaveKey("Last-Modified"),
-				HaveKeyWithValue("Etag", "v1a2ec0c77b7bea23455185bcc75535bf7"),
+				HaveKeyWithValue("Etag", "v1"+string(icalproxytest.MustMD5(icalproxytest.Calendar("VEVENT")))),
 			))
 
 			row := fp.Must(db.New(ag.DB).FetchFeedRow(ctx, originFeedUri))
-			Expect(row.ContentsMD5).To(BeEquivalentTo("a2ec0c77b7bea23455185bcc75535bf7"))
+			Expect(row.ContentsMD5).To(Equal(icalproxytest.MustMD5(icalproxytest.Calendar("VEVENT"))))
+		})
+		It("returns a 403 and does not store the feed if the origin address is not allowed", func() {
+			ag.Config.OriginAllowlist = types.OriginAllowlist{}
+			rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(403))
+			Expect(rr.Body.String()).To(ContainSubstring("127.0.0.1 is loopback"))
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+			_, err := db.New(ag.DB).FetchFeedRow(ctx, originFeedUri)
+			Expect(err).To(HaveOccurred())
 		})
 		It("returns a 421 with the origin error if the fetch errors", func() {
 			origin.AppendHandlers(
@@ -150,8 +250,41 @@ var _ = Describe("server", func() {
 			Expect(feed.HeadersToMap(rr.Header())).To(And(
 				HaveKeyWithValue("Content-Type", "application/custom"),
 				HaveKeyWithValue("Ical-Proxy-Origin-Error", "403"),
+				HaveKeyWithValue("Ical-Proxy-Failure-Count", "1"),
+				HaveKey("Ical-Proxy-Failing-Since"),
 			))
 		})
+		It("looks up and stores the canonical url", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
+				),
+			)
+			webcalUrl := "webcal://" + originFeedUri.Host + "/feed.ics#x"
+			rr := Serve(e, NewRequest("GET", "/?url="+url.QueryEscape(webcalUrl), nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(fp.Must(db.New(ag.DB).FetchFeedRow(ctx, originFeedUri))).ToNot(BeNil())
+
+			// Served from the database, so origin is not called again.
+			rr = Serve(e, NewRequest("GET", serverRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(origin.ReceivedRequests()).To(HaveLen(1))
+		})
+		It("returns a 421 if the origin body is too large", func() {
+			ag.Config.MaxFeedBytes = 10
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
+				),
+			)
+			req := NewRequest("GET", serverRequestUrl, nil)
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(421))
+			Expect(rr.Body.String()).To(Equal("response body is larger than the limit of 10 bytes"))
+			Expect(rr.Header().Get("Ical-Proxy-Origin-Error")).To(Equal("597"))
+		})
 		Describe("with a feed in the database but not in storage", func() {
 			It("fetches from origin and serves there was no stored body", func() {
 				fs := fakefeedstorage.New()
@@ -167,13 +300,13 @@ var _ = Describe("server", func() {
 				origin.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
-						ghttp.RespondWith(200, "FETCHED"),
+						ghttp.RespondWith(200, icalproxytest.Calendar("FETCHED")),
 					),
 				)
 				req := NewRequest("GET", serverRequestUrl, nil)
 				rr := Serve(e, req)
 				Expect(rr).To(HaveResponseCode(200))
-				Expect(rr.Body.String()).To(Equal("FETCHED"))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("FETCHED")))
 			})
 
 		})
@@ -216,6 +349,16 @@ var _ = Describe("server", func() {
 				rr := Serve(e, req)
 				Expect(rr).To(HaveResponseCode(200))
 			})
+			It("records requests for the feed, including 304s", func() {
+				Expect(Serve(e, NewRequest("GET", serverRequestUrl, nil))).To(HaveResponseCode(200))
+				req := NewRequest("GET", serverRequestUrl, nil)
+				req.Header.Add("If-Modified-Since", types.FormatHttpTime(time.Now()))
+				Expect(Serve(e, req)).To(HaveResponseCode(304))
+				Expect(ag.AccessTracker.Run(ctx)).To(Succeed())
+				count, err := pgxt.GetScalar[int64](ctx, ag.DB, `SELECT access_count FROM icalproxy_feeds_v2 WHERE url = $1`, originFeedUrl)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(2))
+			})
 			It("fetches from origin and serves from cache if the TTL has expired", func() {
 				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
 					originFeedUri,
@@ -227,29 +370,29 @@ var _ = Describe("server", func() {
 				origin.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
-						ghttp.RespondWith(200, "VERSION2"),
+						ghttp.RespondWith(200, icalproxytest.Calendar("VERSION2")),
 					),
 				)
 				req := NewRequest("GET", serverRequestUrl, nil)
 				rr := Serve(e, req)
 				Expect(rr).To(HaveResponseCode(200))
-				Expect(rr.Body.String()).To(Equal("VERSION2"))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("VERSION2")))
 
 				row := fp.Must(db.New(ag.DB).FetchFeedRow(ctx, originFeedUri))
-				Expect(row.ContentsMD5).To(BeEquivalentTo("e09e7582b0849d4b27f9af87ae6703ea"))
+				Expect(row.ContentsMD5).To(Equal(icalproxytest.MustMD5(icalproxytest.Calendar("VERSION2"))))
 			})
 			It("fetches from origin and serves if there are critical issues like DB problems", func() {
 				origin.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
-						ghttp.RespondWith(200, "FETCHED"),
+						ghttp.RespondWith(200, icalproxytest.Calendar("FETCHED")),
 					),
 				)
 				ag.DB.Close() // Cause a DB error
 				req := NewRequest("GET", serverRequestUrl, nil)
 				rr := Serve(e, req)
 				Expect(rr).To(HaveResponseCode(200))
-				Expect(rr.Body.String()).To(Equal("FETCHED"))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("FETCHED")))
 			})
 			It("returns the origin error if the cached feed was an error", func() {
 				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
@@ -268,6 +411,31 @@ var _ = Describe("server", func() {
 					HaveKeyWithValue("Ical-Proxy-Origin-Error", "403"),
 				))
 			})
+			It("returns an origin error, and keeps the stored body, if origin returns something other than a calendar", func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(icalproxytest.Calendar("VERSION1")),
+					time.Now().Add(-5*time.Hour),
+				), nil)).To(Succeed())
+				origin.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/feed.ics", ""),
+						ghttp.RespondWith(200, "<html>Log in</html>", http.Header{"Content-Type": {"text/html"}}),
+					),
+				)
+				rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(421))
+				Expect(rr.Body.String()).To(Equal("<html>Log in</html>"))
+				Expect(feed.HeadersToMap(rr.Header())).To(And(
+					HaveKeyWithValue("Content-Type", "text/html"),
+					HaveKeyWithValue("Ical-Proxy-Origin-Error", "598"),
+				))
+
+				row := fp.Must(db.New(ag.DB).FetchFeedRow(ctx, originFeedUri))
+				Expect(row.ContentsMD5).To(Equal(icalproxytest.MustMD5(icalproxytest.Calendar("VERSION1"))))
+			})
 			It("returns the cached feed if there was an expired TTL but the origin returned NotModified on fetch", func() {
 				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
 					originFeedUri,
@@ -306,13 +474,188 @@ var _ = Describe("server", func() {
 				origin.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("GET", "/feed.ics", ""),
-						ghttp.RespondWith(200, "REFETCHED"),
+						ghttp.RespondWith(200, icalproxytest.Calendar("REFETCHED")),
 					),
 				)
 				req := NewRequest("GET", serverRequestUrl, nil)
 				rr := Serve(e, req)
 				Expect(rr).To(HaveResponseCode(200))
-				Expect(rr.Body.String()).To(Equal("REFETCHED"))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("REFETCHED")))
+			})
+		})
+		Describe("with jCal requested", func() {
+			calBody := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:1\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+			calMD5 := string(icalproxytest.MustMD5(calBody))
+
+			BeforeEach(func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(calBody),
+					time.Now(),
+				), nil)).To(Succeed())
+			})
+
+			It("serves jCal if the Accept header asks for it", func() {
+				req := NewRequest("GET", serverRequestUrl, nil)
+				req.Header.Add("Accept", "application/calendar+json")
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(MatchJSON(`["vcalendar",[["version",{},"text","2.0"]],[["vevent",[["uid",{},"text","1"]],[]]]]`))
+				Expect(feed.HeadersToMap(rr.Header())).To(And(
+					HaveKeyWithValue("Content-Type", "application/calendar+json"),
+					HaveKeyWithValue("Etag", "v1"+calMD5+"-jcal"),
+					HaveKeyWithValue("Vary", "Accept"),
+					HaveKey("Last-Modified"),
+				))
+			})
+			It("serves whichever format the Accept header prefers, and iCalendar for ties", func() {
+				for accept, jcal := range map[string]bool{
+					"text/calendar, application/calendar+json;q=0":   false,
+					"text/calendar;q=0.5, application/calendar+json": true,
+					"application/calendar+json, text/calendar":       false,
+					"application/calendar+json;q=0.9, */*;q=0.1":     true,
+					"application/*, text/calendar;q=0.8":             true,
+					"application/calendar+json;q=0.2, text/*;q=0.5":  false,
+					"*/*": false,
+					"application/calendar+json; charset=utf-8; q=0.7": true,
+				} {
+					req := NewRequest("GET", serverRequestUrl, nil)
+					req.Header.Add("Accept", accept)
+					rr := Serve(e, req)
+					Expect(rr).To(HaveResponseCode(200))
+					if jcal {
+						Expect(rr.Header().Get("Content-Type")).To(Equal("application/calendar+json"), accept)
+					} else {
+						Expect(rr.Body.String()).To(Equal(calBody), accept)
+					}
+				}
+			})
+			It("serves jCal if the format param asks for it", func() {
+				req := NewRequest("GET", serverRequestUrl+"&format=jcal", nil)
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Header().Get("Content-Type")).To(Equal("application/calendar+json"))
+			})
+			It("prefers the format param over the Accept header", func() {
+				req := NewRequest("GET", serverRequestUrl+"&format=ical", nil)
+				req.Header.Add("Accept", "application/calendar+json")
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(Equal(calBody))
+				Expect(rr.Header().Get("Etag")).To(Equal("v1" + calMD5))
+			})
+			It("returns 304 only for the jCal Etag", func() {
+				req := NewRequest("GET", serverRequestUrl+"&format=jcal", nil)
+				req.Header.Add("If-None-Match", "v1"+calMD5+"-jcal")
+				Expect(Serve(e, req)).To(HaveResponseCode(304))
+
+				req = NewRequest("GET", serverRequestUrl+"&format=jcal", nil)
+				req.Header.Add("If-None-Match", calMD5)
+				Expect(Serve(e, req)).To(HaveResponseCode(200))
+			})
+			It("returns 422 if the feed is not a valid calendar", func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte("VEVENT"),
+					time.Now(),
+				), nil)).To(Succeed())
+				req := NewRequest("GET", serverRequestUrl+"&format=jcal", nil)
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(422))
+			})
+			It("returns 400 for an invalid format", func() {
+				req := NewRequest("GET", serverRequestUrl+"&format=xml", nil)
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(400))
+			})
+		})
+		Describe("with a time window requested", func() {
+			calBody := "BEGIN:VCALENDAR\r\n" +
+				"BEGIN:VEVENT\r\nUID:old\r\nDTSTART:20100101T000000Z\r\nEND:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\nUID:weekly\r\nDTSTART:20100101T000000Z\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\nUID:new\r\nDTSTART:20240101T000000Z\r\nEND:VEVENT\r\n" +
+				"END:VCALENDAR\r\n"
+			calMD5 := string(icalproxytest.MustMD5(calBody))
+
+			BeforeEach(func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(calBody),
+					time.Now(),
+				), nil)).To(Succeed())
+			})
+
+			It("serves only events that occur in the window", func() {
+				req := NewRequest("GET", serverRequestUrl+"&since=2023-01-01", nil)
+				rr := Serve(e, req)
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(Equal("BEGIN:VCALENDAR\r\n" +
+					"BEGIN:VEVENT\r\nUID:weekly\r\nDTSTART:20100101T000000Z\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\n" +
+					"BEGIN:VEVENT\r\nUID:new\r\nDTSTART:20240101T000000Z\r\nEND:VEVENT\r\n" +
+					"END:VCALENDAR\r\n"))
+				Expect(feed.HeadersToMap(rr.Header())).To(And(
+					HaveKeyWithValue("Content-Type", "text/calendar; charset=utf-8"),
+					HaveKeyWithValue("Etag", "v1"+calMD5+"-since-1672531200"),
+				))
+
+				req = NewRequest("GET", serverRequestUrl+"&until=2011-01-01T00:00:00Z&format=jcal", nil)
+				rr = Serve(e, req)
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(MatchJSON(`["vcalendar",[],[
+["vevent",[["uid",{},"text","old"],["dtstart",{},"date-time","2010-01-01T00:00:00Z"]],[]],
+["vevent",[["uid",{},"text","weekly"],["dtstart",{},"date-time","2010-01-01T00:00:00Z"],["rrule",{},"recur",{"freq":"WEEKLY"}]],[]]
+]]`))
+				Expect(rr.Header().Get("Etag")).To(Equal("v1" + calMD5 + "-jcal-until-1293840000"))
+			})
+			It("returns 304 only for the Etag of the same window", func() {
+				req := NewRequest("GET", serverRequestUrl+"&since=2023-01-01", nil)
+				req.Header.Add("If-None-Match", "v1"+calMD5+"-since-1672531200")
+				Expect(Serve(e, req)).To(HaveResponseCode(304))
+
+				req = NewRequest("GET", serverRequestUrl+"&since=2023-01-02", nil)
+				req.Header.Add("If-None-Match", "v1"+calMD5+"-since-1672531200")
+				Expect(Serve(e, req)).To(HaveResponseCode(200))
+
+				req = NewRequest("GET", serverRequestUrl+"&since=2023-01-01", nil)
+				req.Header.Add("If-None-Match", calMD5)
+				Expect(Serve(e, req)).To(HaveResponseCode(200))
+			})
+			It("returns 400 for an invalid window", func() {
+				Expect(Serve(e, NewRequest("GET", serverRequestUrl+"&since=yesterday", nil))).To(HaveResponseCode(400))
+				Expect(Serve(e, NewRequest("GET", serverRequestUrl+"&since=2024-01-02&until=2024-01-01", nil))).To(HaveResponseCode(400))
+			})
+		})
+		Describe("with timezones requested", func() {
+			calBody := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTART;TZID=Tokyo Standard Time:20240101T100000\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+			BeforeEach(func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(calBody),
+					time.Now(),
+				), nil)).To(Succeed())
+			})
+
+			It("adds VTIMEZONEs for TZIDs that are not defined", func() {
+				rr := Serve(e, NewRequest("GET", serverRequestUrl+"&add_timezones=true", nil))
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(Equal("BEGIN:VCALENDAR\r\n" +
+					"BEGIN:VTIMEZONE\r\nTZID:Tokyo Standard Time\r\nX-LIC-LOCATION:Asia/Tokyo\r\n" +
+					"BEGIN:STANDARD\r\nDTSTART:20240101T000000\r\nTZOFFSETFROM:+0900\r\nTZOFFSETTO:+0900\r\nTZNAME:JST\r\nEND:STANDARD\r\n" +
+					"END:VTIMEZONE\r\n" +
+					"BEGIN:VEVENT\r\nUID:1\r\nDTSTART;TZID=Tokyo Standard Time:20240101T100000\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"))
+				Expect(rr.Header().Get("Etag")).To(Equal("v1" + string(icalproxytest.MustMD5(calBody)) + "-tz" + strconv.Itoa(time.Now().Year())))
+			})
+			It("returns 400 for an invalid value", func() {
+				Expect(Serve(e, NewRequest("GET", serverRequestUrl+"&add_timezones=please", nil))).To(HaveResponseCode(400))
 			})
 		})
 		Describe("when the database is down", func() {
@@ -378,6 +721,72 @@ var _ = Describe("server", func() {
 				))
 			})
 		})
+		Describe("when too many requests to the origin host are in progress", func() {
+			BeforeEach(func() {
+				ag.Config.RequestTimeout = 0
+				ag.HostLimiter = feed.NewHostLimiter(config.Config{HostConcurrency: 1})
+				release := fp.Must(ag.HostLimiter.Acquire(ctx, originFeedUri))
+				DeferCleanup(release)
+			})
+
+			It("serves the stored feed even though its TTL expired", func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(icalproxytest.Calendar("STALE")),
+					time.Now().Add(-5*time.Hour),
+				), nil)).To(Succeed())
+				rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("STALE")))
+				Expect(rr.Header().Get("Ical-Proxy-Stale")).To(Equal("true"))
+				Expect(origin.ReceivedRequests()).To(BeEmpty())
+			})
+			It("returns a 503 if there is no stored feed", func() {
+				Expect(Serve(e, NewRequest("GET", serverRequestUrl, nil))).To(HaveResponseCode(503))
+				Expect(origin.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+		Describe("when the origin asked to retry later", func() {
+			It("stores the Retry-After and does not refetch until then", func() {
+				origin.AppendHandlers(ghttp.RespondWith(429, "slow down", http.Header{"Retry-After": {"60"}}))
+				rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(421))
+				Expect(rr.Header().Get("Ical-Proxy-Origin-Error")).To(Equal("429"))
+				Expect(fp.Must(db.New(ag.DB).FetchFeedRow(ctx, originFeedUri)).RetryAfter).To(
+					BeTemporally("~", time.Now().Add(time.Minute), 2*time.Second))
+
+				// The error is not cached (its TTL has expired), but the origin is not requested again.
+				Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET contents_last_modified = 'epoch' WHERE url = $1`, originFeedUri.String())).Error().ToNot(HaveOccurred())
+				rr = Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(421))
+				Expect(rr.Header().Get("Ical-Proxy-Stale")).To(Equal("true"))
+				Expect(origin.ReceivedRequests()).To(HaveLen(1))
+			})
+			It("serves the stored feed even though its TTL expired", func() {
+				Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+					originFeedUri,
+					make(map[string]string),
+					200,
+					[]byte(icalproxytest.Calendar("STALE")),
+					time.Now().Add(-5*time.Hour),
+				), nil)).To(Succeed())
+				Expect(db.New(ag.DB).SetHostRetryAfter(ctx, originFeedUri, time.Now().Add(time.Hour))).To(Succeed())
+				rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(200))
+				Expect(rr.Body.String()).To(Equal(icalproxytest.Calendar("STALE")))
+				Expect(rr.Header().Get("Ical-Proxy-Stale")).To(Equal("true"))
+				Expect(origin.ReceivedRequests()).To(BeEmpty())
+			})
+			It("returns a 503 with Retry-After if there is no stored feed", func() {
+				Expect(db.New(ag.DB).SetHostRetryAfter(ctx, originFeedUri, time.Now().Add(time.Hour))).To(Succeed())
+				rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+				Expect(rr).To(HaveResponseCode(503))
+				Expect(strconv.Atoi(rr.Header().Get("Retry-After"))).To(BeNumerically("~", 3600, 5))
+				Expect(origin.ReceivedRequests()).To(BeEmpty())
+			})
+		})
 	})
 	Describe("HEAD /", func() {
 		BeforeEach(func() {
@@ -388,7 +797,7 @@ var _ = Describe("server", func() {
 			origin.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/feed.ics", ""),
-					ghttp.RespondWith(200, "FETCHED"),
+					ghttp.RespondWith(200, icalproxytest.Calendar("FETCHED")),
 				),
 			)
 			req := NewRequest("HEAD", serverRequestUrl, nil)
@@ -397,6 +806,391 @@ var _ = Describe("server", func() {
 			Expect(rr.Body.Len()).To(Equal(0))
 		})
 	})
+	Describe("GET /events", func() {
+		calBody := "BEGIN:VCALENDAR\r\n" +
+			"BEGIN:VEVENT\r\nUID:weekly\r\nSUMMARY:Standup\\, daily\r\nDTSTART;TZID=America/New_York:20240101T090000\r\n" +
+			"DTEND;TZID=America/New_York:20240101T093000\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\n" +
+			"BEGIN:VEVENT\r\nUID:allday\r\nDTSTART;VALUE=DATE:20240102\r\nTRANSP:TRANSPARENT\r\nEND:VEVENT\r\n" +
+			"END:VCALENDAR\r\n"
+		var eventsRequestUrl string
+
+		BeforeEach(func() {
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			eventsRequestUrl = "/events?url=" + url.QueryEscape(originFeedUrl)
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte(calBody),
+				time.Now(),
+			), nil)).To(Succeed())
+		})
+
+		It("returns the occurrences of events in the window", func() {
+			req := NewRequest("GET", eventsRequestUrl+"&start=2024-01-01&end=2024-01-09T00:00:00Z", nil)
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"events": [
+{"uid": "weekly", "recurrence_id": "2024-01-01T09:00:00-05:00", "start": "2024-01-01T09:00:00-05:00", "end": "2024-01-01T09:30:00-05:00",
+ "all_day": false, "summary": "Standup, daily", "location": "", "status": "", "transp": ""},
+{"uid": "allday", "start": "2024-01-02", "end": "2024-01-03", "all_day": true, "summary": "", "location": "", "status": "", "transp": "TRANSPARENT"},
+{"uid": "weekly", "recurrence_id": "2024-01-08T09:00:00-05:00", "start": "2024-01-08T09:00:00-05:00", "end": "2024-01-08T09:30:00-05:00",
+ "all_day": false, "summary": "Standup, daily", "location": "", "status": "", "transp": ""}
+]}`))
+			Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(rr.Header().Get("Etag")).To(Equal("v1" + string(icalproxytest.MustMD5(calBody)) + "-events-1704067200-1704758400-UTC"))
+		})
+		It("interprets dates and all-day events in the given time zone", func() {
+			req := NewRequest("GET", eventsRequestUrl+"&start=2024-01-02&end=2024-01-03&tz=Asia/Tokyo", nil)
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"events": [
+{"uid": "allday", "start": "2024-01-02", "end": "2024-01-03", "all_day": true, "summary": "", "location": "", "status": "", "transp": "TRANSPARENT"}
+]}`))
+		})
+		It("returns 400 for a missing or invalid window", func() {
+			Expect(Serve(e, NewRequest("GET", eventsRequestUrl+"&start=2024-01-01", nil))).To(HaveResponseCode(400))
+			Expect(Serve(e, NewRequest("GET", eventsRequestUrl+"&start=2024-01-01&end=tomorrow", nil))).To(HaveResponseCode(400))
+			Expect(Serve(e, NewRequest("GET", eventsRequestUrl+"&start=2024-01-02&end=2024-01-01", nil))).To(HaveResponseCode(400))
+			Expect(Serve(e, NewRequest("GET", eventsRequestUrl+"&start=2024-01-01&end=2024-01-02&tz=Mars/Base", nil))).To(HaveResponseCode(400))
+		})
+		It("returns 422 if the feed is not a valid calendar", func() {
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte("VEVENT"),
+				time.Now(),
+			), nil)).To(Succeed())
+			req := NewRequest("GET", eventsRequestUrl+"&start=2024-01-01&end=2024-01-02", nil)
+			Expect(Serve(e, req)).To(HaveResponseCode(422))
+		})
+	})
+	Describe("GET /freebusy", func() {
+		calBody := "BEGIN:VCALENDAR\r\n" +
+			"BEGIN:VEVENT\r\nUID:weekly\r\nDTSTART;TZID=America/New_York:20240101T090000\r\n" +
+			"DTEND;TZID=America/New_York:20240101T093000\r\nRRULE:FREQ=WEEKLY\r\nEND:VEVENT\r\n" +
+			"BEGIN:VEVENT\r\nUID:allday\r\nDTSTART;VALUE=DATE:20240102\r\nTRANSP:TRANSPARENT\r\nEND:VEVENT\r\n" +
+			"BEGIN:VEVENT\r\nUID:cancelled\r\nSTATUS:CANCELLED\r\nDTSTART:20240103T100000Z\r\nDURATION:PT1H\r\nEND:VEVENT\r\n" +
+			"END:VCALENDAR\r\n"
+		var freeBusyRequestUrl string
+
+		BeforeEach(func() {
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			freeBusyRequestUrl = "/freebusy?url=" + url.QueryEscape(originFeedUrl)
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte(calBody),
+				time.Now(),
+			), nil)).To(Succeed())
+		})
+
+		It("returns a VFREEBUSY with the busy times in the window", func() {
+			req := NewRequest("GET", freeBusyRequestUrl+"&start=2024-01-01&end=2024-01-09T00:00:00Z", nil)
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Header().Get("Content-Type")).To(Equal("text/calendar; charset=utf-8"))
+			Expect(rr.Header().Get("Etag")).To(Equal("v1" + string(icalproxytest.MustMD5(calBody)) + "-freebusy-1704067200-1704758400-UTC"))
+			Expect(rr.Body.String()).To(HavePrefix("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//icalproxy//freebusy//EN\r\n" +
+				"BEGIN:VFREEBUSY\r\nUID:" + originFeedUrl + "\r\nDTSTAMP:"))
+			Expect(rr.Body.String()).To(HaveSuffix("DTSTART:20240101T000000Z\r\nDTEND:20240109T000000Z\r\n" +
+				"FREEBUSY:20240101T140000Z/20240101T143000Z\r\n" +
+				"FREEBUSY:20240108T140000Z/20240108T143000Z\r\n" +
+				"URL:" + originFeedUrl + "\r\n" +
+				"END:VFREEBUSY\r\nEND:VCALENDAR\r\n"))
+		})
+		It("can be served as jCal", func() {
+			req := NewRequest("GET", freeBusyRequestUrl+"&start=2024-01-01&end=2024-01-02&format=jcal", nil)
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Header().Get("Content-Type")).To(Equal("application/calendar+json"))
+			Expect(rr.Body.String()).To(ContainSubstring(`["freebusy",{},"period","2024-01-01T14:00:00Z/2024-01-01T14:30:00Z"]`))
+		})
+		It("returns 400 for a missing or invalid window", func() {
+			Expect(Serve(e, NewRequest("GET", freeBusyRequestUrl+"&start=2024-01-01", nil))).To(HaveResponseCode(400))
+			Expect(Serve(e, NewRequest("GET", freeBusyRequestUrl+"&start=2024-01-02&end=2024-01-01", nil))).To(HaveResponseCode(400))
+		})
+	})
+	Describe("GET /events/search", func() {
+		BeforeEach(func() {
+			ag.Config.ApiKey = "sekret"
+			ag.Config.BusyApiKeys = []string{"busykey"}
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:booking-123\r\nSUMMARY:Haircut\r\n"+
+					"DTSTART:20240201T100000Z\r\nDTEND:20240201T110000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"),
+				time.Now(),
+			), nil)).To(Succeed())
+		})
+
+		It("returns matching events and their feeds", func() {
+			req := NewRequest("GET", "/events/search?q=HAIRCUT&host=127.0.0.1&start=2024-02-01&end=2024-02-02", nil)
+			req.Header.Add("Authorization", "Apikey sekret")
+			rr := Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"events": [{
+"feed_url": "` + originFeedUrl + `", "uid": "booking-123", "recurrence_id": null,
+"starts_at": "2024-02-01T10:00:00Z", "ends_at": "2024-02-01T11:00:00Z",
+"summary": "Haircut", "location": "", "status": ""
+}]}`))
+
+			req = NewRequest("GET", "/events/search?q=nothing", nil)
+			req.Header.Add("Authorization", "Apikey sekret")
+			rr = Serve(e, req)
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"events": []}`))
+		})
+		It("returns 400 for invalid params", func() {
+			for _, q := range []string{"start=tomorrow", "start=2024-01-02&end=2024-01-01", "limit=0", "limit=x"} {
+				req := NewRequest("GET", "/events/search?"+q, nil)
+				req.Header.Add("Authorization", "Apikey sekret")
+				Expect(Serve(e, req)).To(HaveResponseCode(400))
+			}
+		})
+		It("returns 403 for busy only callers", func() {
+			req := NewRequest("GET", "/events/search?q=haircut", nil)
+			req.Header.Add("Authorization", "Apikey busykey")
+			Expect(Serve(e, req)).To(HaveResponseCode(403))
+		})
+	})
+	Describe("/credentials", func() {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+		authed := func(method, target, body string) *http.Request {
+			return NewRequest(method, target, []byte(body), JsonReq(), SetReqHeader("Authorization", "Apikey sekret"))
+		}
+
+		BeforeEach(func() {
+			ag.Config.ApiKey = "sekret"
+			ag.Config.BusyApiKeys = []string{"busykey"}
+			ag.Credentials = fp.Must(credentials.NewStore(ag.DB, key))
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+		})
+
+		It("stores credentials that are sent to the origin, without returning their values", func() {
+			rr := Serve(e, authed("PUT", "/credentials",
+				`{"url_prefix": "`+origin.URL()+`", "headers": {"x-calendar-token": "xyz"}, "basic_auth": {"username": "u", "password": "p"}}`))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"url_prefix": "` + origin.URL() + `/"}`))
+
+			rr = Serve(e, authed("GET", "/credentials", ""))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(ContainSubstring(`"header_names":["Authorization","X-Calendar-Token"]`))
+			Expect(rr.Body.String()).ToNot(ContainSubstring("xyz"))
+
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.VerifyBasicAuth("u", "p"),
+					ghttp.VerifyHeaderKV("X-Calendar-Token", "xyz"),
+					ghttp.RespondWith(200, icalproxytest.Calendar("VEVENT")),
+				),
+			)
+			Expect(Serve(e, authed("GET", serverRequestUrl, ""))).To(HaveResponseCode(200))
+
+			deleteUrl := "/credentials?url_prefix=" + url.QueryEscape(origin.URL())
+			Expect(Serve(e, authed("DELETE", deleteUrl, ""))).To(HaveResponseCode(204))
+			Expect(Serve(e, authed("DELETE", deleteUrl, ""))).To(HaveResponseCode(404))
+		})
+		It("returns 400 for invalid credentials", func() {
+			Expect(Serve(e, authed("PUT", "/credentials", `{"url_prefix": "/feeds", "headers": {"X-A": "b"}}`))).To(HaveResponseCode(400))
+			Expect(Serve(e, authed("PUT", "/credentials", `{"url_prefix": "`+origin.URL()+`"}`))).To(HaveResponseCode(400))
+			Expect(Serve(e, authed("PUT", "/credentials", `{"url_prefix": "`+origin.URL()+`", "headers": {"X A": "b"}}`))).To(HaveResponseCode(400))
+		})
+		It("requires a full access api key", func() {
+			Expect(Serve(e, NewRequest("GET", "/credentials", nil))).To(HaveResponseCode(401))
+			req := NewRequest("GET", "/credentials", nil)
+			req.Header.Add("Authorization", "Apikey busykey")
+			Expect(Serve(e, req)).To(HaveResponseCode(403))
+		})
+		It("cannot be registered without an api key", func() {
+			ag.Config.ApiKey = ""
+			Expect(server.Register(ctx, echo.New(), ag)).To(MatchError(ContainSubstring("API_KEY must be configured")))
+		})
+	})
+	Describe("GET /validation", func() {
+		calBody := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:x\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTAMP:20240101T000000Z\r\n" +
+			"DTSTART;TZID=Nowhere/Special:20240101T000000\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		var validationRequestUrl string
+
+		BeforeEach(func() {
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			validationRequestUrl = "/validation?url=" + url.QueryEscape(originFeedUrl)
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte(calBody),
+				time.Now(),
+			), nil)).To(Succeed())
+		})
+
+		It("returns the validation report of the feed", func() {
+			rr := Serve(e, NewRequest("GET", validationRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(MatchJSON(`{"status": "warnings", "errors": 0, "warnings": 1, "issues": [
+{"severity": "warning", "component": "VEVENT", "uid": "1", "property": "DTSTART", "message": "unknown TZID \"Nowhere/Special\""}
+]}`))
+			Expect(feed.HeadersToMap(rr.Header())).To(And(
+				HaveKeyWithValue("Content-Type", "application/json"),
+				HaveKeyWithValue("Etag", "v1"+string(icalproxytest.MustMD5(calBody))+"-validation"),
+				HaveKeyWithValue("Ical-Proxy-Validation", "warnings"),
+			))
+		})
+		It("sets the validation header when serving the feed", func() {
+			rr := Serve(e, NewRequest("GET", serverRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Header().Get("Ical-Proxy-Validation")).To(Equal("warnings"))
+		})
+		It("validates feeds stored without a report", func() {
+			_, err := ag.DB.Exec(ctx, "UPDATE icalproxy_feeds_v2 SET validation_status='', validation_report=NULL WHERE url=$1", originFeedUrl)
+			Expect(err).ToNot(HaveOccurred())
+			rr := Serve(e, NewRequest("GET", validationRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(ContainSubstring(`"status":"warnings"`))
+		})
+	})
+	Describe("GET /merge", func() {
+		bodyA := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:a\r\nSUMMARY:Lunch\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		bodyB := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:b\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+		var otherFeedUrl string
+		var mergeRequestUrl string
+
+		BeforeEach(func() {
+			Expect(server.Register(ctx, e, ag)).To(Succeed())
+			otherFeedUrl = origin.URL() + "/other.ics"
+			mergeRequestUrl = "/merge?url=" + url.QueryEscape(originFeedUrl) + "&url=" + url.QueryEscape(otherFeedUrl)
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				originFeedUri,
+				make(map[string]string),
+				200,
+				[]byte(bodyA),
+				time.Now().Add(-time.Minute),
+			), nil)).To(Succeed())
+		})
+
+		It("returns 400 for missing urls or mismatched labels", func() {
+			Expect(Serve(e, NewRequest("GET", "/merge", nil))).To(HaveResponseCode(400))
+			Expect(Serve(e, NewRequest("GET", mergeRequestUrl+"&label=x", nil))).To(HaveResponseCode(400))
+		})
+		It("serves the cached and fetched feeds as one calendar", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/other.ics", ""),
+					ghttp.RespondWith(200, bodyB),
+				),
+			)
+			rr := Serve(e, NewRequest("GET", mergeRequestUrl+"&label=Work&label=", nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(Equal("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:" + server.MergeProdId + "\r\n" +
+				"BEGIN:VEVENT\r\nUID:a\r\nSUMMARY:Work: Lunch\r\nEND:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\nUID:b\r\nEND:VEVENT\r\n" +
+				"END:VCALENDAR\r\n"))
+			etag := "v1" + string(icalproxytest.MustMD5(
+				originFeedUrl+"\nWork\n"+string(icalproxytest.MustMD5(bodyA))+"\n"+
+					otherFeedUrl+"\n\n"+string(icalproxytest.MustMD5(bodyB))+"\n",
+			))
+			Expect(feed.HeadersToMap(rr.Header())).To(And(
+				HaveKeyWithValue("Content-Type", "text/calendar; charset=utf-8"),
+				HaveKeyWithValue("Etag", etag),
+				HaveKey("Last-Modified"),
+			))
+
+			row := fp.Must(db.New(ag.DB).FetchFeedRow(ctx, fp.Must(url.Parse(otherFeedUrl))))
+			Expect(row.ContentsMD5).To(Equal(icalproxytest.MustMD5(bodyB)))
+
+			// Both feeds are now cached, so the merged feed has not changed.
+			req := NewRequest("GET", mergeRequestUrl+"&label=Work&label=", nil)
+			req.Header.Add("If-None-Match", etag)
+			Expect(Serve(e, req)).To(HaveResponseCode(304))
+
+			req = NewRequest("GET", mergeRequestUrl, nil)
+			req.Header.Add("If-None-Match", etag)
+			Expect(Serve(e, req)).To(HaveResponseCode(200))
+
+			req = NewRequest("GET", mergeRequestUrl, nil)
+			req.Header.Add("If-Modified-Since", types.FormatHttpTime(time.Now()))
+			Expect(Serve(e, req)).To(HaveResponseCode(304))
+		})
+		It("records requests for each merged feed", func() {
+			origin.AppendHandlers(ghttp.RespondWith(200, bodyB))
+			Expect(Serve(e, NewRequest("GET", mergeRequestUrl, nil))).To(HaveResponseCode(200))
+			Expect(ag.AccessTracker.Run(ctx)).To(Succeed())
+			counts := fp.Must(pgxt.GetScalars[int64](ctx, ag.DB,
+				`SELECT access_count FROM icalproxy_feeds_v2 WHERE url = ANY($1) ORDER BY url`, []string{originFeedUrl, otherFeedUrl}))
+			Expect(counts).To(Equal([]int64{1, 1}))
+		})
+		It("serves stale feeds when too many requests to the origin host are in progress", func() {
+			// Both feeds load at the same time and are stale, which must not race on the response headers.
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET contents_last_modified = now() - '5 hours'::interval`)).Error().ToNot(HaveOccurred())
+			Expect(db.New(ag.DB).CommitFeed(ctx, ag.FeedStorage, feed.New(
+				fp.Must(url.Parse(otherFeedUrl)),
+				make(map[string]string),
+				200,
+				[]byte(bodyB),
+				time.Now().Add(-5*time.Hour),
+			), nil)).To(Succeed())
+			ag.Config.RequestTimeout = 0
+			ag.HostLimiter = feed.NewHostLimiter(config.Config{HostConcurrency: 1})
+			release := fp.Must(ag.HostLimiter.Acquire(ctx, originFeedUri))
+			defer release()
+
+			rr := Serve(e, NewRequest("GET", mergeRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(And(ContainSubstring("UID:a\r\n"), ContainSubstring("UID:b\r\n")))
+			Expect(rr.Header().Values("Ical-Proxy-Stale")).To(Equal([]string{"true"}))
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+		})
+		It("returns a 503 with Retry-After if the origin asked to retry later and a feed is not stored", func() {
+			Expect(ag.DB.Exec(ctx, `UPDATE icalproxy_feeds_v2 SET contents_last_modified = now() - '5 hours'::interval`)).Error().ToNot(HaveOccurred())
+			Expect(db.New(ag.DB).SetHostRetryAfter(ctx, originFeedUri, time.Now().Add(time.Hour))).To(Succeed())
+			rr := Serve(e, NewRequest("GET", mergeRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(503))
+			Expect(strconv.Atoi(rr.Header().Get("Retry-After"))).To(BeNumerically("~", 3600, 5))
+			Expect(origin.ReceivedRequests()).To(BeEmpty())
+		})
+		It("returns a 421 with the origin error if any feed errors", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/other.ics", ""),
+					ghttp.RespondWith(403, "nope"),
+				),
+			)
+			rr := Serve(e, NewRequest("GET", mergeRequestUrl, nil))
+			Expect(rr).To(HaveResponseCode(421))
+			Expect(rr.Body.String()).To(Equal("nope"))
+			Expect(feed.HeadersToMap(rr.Header())).To(And(
+				HaveKeyWithValue("Ical-Proxy-Origin-Error", "403"),
+				HaveKeyWithValue("Ical-Proxy-Origin-Url", otherFeedUrl),
+			))
+		})
+		It("returns 422 if any feed is not a valid calendar", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/other.ics", ""),
+					ghttp.RespondWith(200, "BEGIN:VCALENDAR\r\n"),
+				),
+			)
+			Expect(Serve(e, NewRequest("GET", mergeRequestUrl, nil))).To(HaveResponseCode(422))
+		})
+		It("fetches each feed from origin when the database is down", func() {
+			origin.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/feed.ics", ""),
+					ghttp.RespondWith(200, bodyA),
+				),
+			)
+			ag.DB.Close()
+			rr := Serve(e, NewRequest("GET", "/merge?url="+url.QueryEscape(originFeedUrl), nil))
+			Expect(rr).To(HaveResponseCode(200))
+			Expect(rr.Body.String()).To(ContainSubstring("UID:a\r\n"))
+			Expect(rr.Header().Get("Ical-Proxy-Fallback")).To(Equal("true"))
+		})
+	})
 	Describe("GET /stats", func() {
 		BeforeEach(func() {
 			Expect(server.Register(ctx, e, ag)).To(Succeed())
@@ -410,6 +1204,7 @@ var _ = Describe("server", func() {
 				HaveKey("db_count_latency"),
 				HaveKey("pending_refresh_count"),
 				HaveKey("pending_webhooks"),
+				HaveKey("failing_count"),
 			))
 		})
 	})
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// OriginAllowlist is the hosts and networks that origin requests may connect to,
+// even though they resolve to addresses that are otherwise blocked (like loopback or private networks).
+// The zero value allows nothing.
+type OriginAllowlist struct {
+	Prefixes []netip.Prefix
+	// Hosts are lowercase hostnames, which also match their subdomains.
+	Hosts []string
+}
+
+// ParseOriginAllowlist parses entries that are IP addresses (like "10.1.2.3"),
+// networks (like "10.0.0.0/8"), or hostnames (like "calendar.internal").
+func ParseOriginAllowlist(entries []string) (OriginAllowlist, error) {
+	a := OriginAllowlist{}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return a, fmt.Errorf("%q is not a valid network: %w", e, err)
+			}
+			a.Prefixes = append(a.Prefixes, p.Masked())
+		} else if addr, err := netip.ParseAddr(strings.Trim(e, "[]")); err == nil {
+			a.Prefixes = append(a.Prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			a.Hosts = append(a.Hosts, strings.TrimSuffix(strings.ToLower(e), "."))
+		}
+	}
+	return a, nil
+}
+
+// AllowsHost returns true if the hostname is, or is a subdomain of, an allowed host.
+func (a OriginAllowlist) AllowsHost(hostname string) bool {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	for _, h := range a.Hosts {
+		if hostname == h || strings.HasSuffix(hostname, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAddr returns true if the address is in an allowed network.
+func (a OriginAllowlist) AllowsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range a.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
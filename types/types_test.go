@@ -4,6 +4,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/webhookdb/icalproxy/types"
+	"net/netip"
 	"testing"
 )
 
@@ -20,4 +21,25 @@ var _ = Describe("types", func() {
 			})
 		})
 	})
+	Describe("OriginAllowlist", func() {
+		It("parses and matches addresses, networks, and hosts", func() {
+			a, err := types.ParseOriginAllowlist([]string{"10.0.0.0/8", " 127.0.0.1", "[::1]", "Cal.Internal.", ""})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.AllowsAddr(netip.MustParseAddr("10.1.2.3"))).To(BeTrue())
+			Expect(a.AllowsAddr(netip.MustParseAddr("::ffff:127.0.0.1"))).To(BeTrue())
+			Expect(a.AllowsAddr(netip.MustParseAddr("::1"))).To(BeTrue())
+			Expect(a.AllowsAddr(netip.MustParseAddr("127.0.0.2"))).To(BeFalse())
+			Expect(a.AllowsHost("cal.internal")).To(BeTrue())
+			Expect(a.AllowsHost("x.CAL.internal")).To(BeTrue())
+			Expect(a.AllowsHost("evilcal.internal")).To(BeFalse())
+		})
+		It("errors for invalid networks", func() {
+			_, err := types.ParseOriginAllowlist([]string{"10.0.0.0/99"})
+			Expect(err).To(MatchError(ContainSubstring("not a valid network")))
+		})
+		It("allows nothing when empty", func() {
+			Expect(types.OriginAllowlist{}.AllowsAddr(netip.MustParseAddr("127.0.0.1"))).To(BeFalse())
+			Expect(types.OriginAllowlist{}.AllowsHost("localhost")).To(BeFalse())
+		})
+	})
 })